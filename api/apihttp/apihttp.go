@@ -18,6 +18,9 @@
 package apihttp
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,18 +28,22 @@ import (
 	"time"
 
 	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/balloon/hyper"
 	"github.com/bbva/qed/consensus"
 	"github.com/bbva/qed/crypto/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
 	"github.com/hashicorp/raft"
 )
 
 type ClientApi interface {
-	Add(event []byte) (*balloon.Snapshot, error)
-	AddBulk(bulk [][]byte) ([]*balloon.Snapshot, error)
+	AddWithContext(ctx context.Context, event []byte) (*balloon.Snapshot, error)
+	AddBulkWithContext(ctx context.Context, bulk [][]byte) ([]*balloon.Snapshot, error)
 	QueryDigestMembershipConsistency(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error)
 	QueryMembershipConsistency(event []byte, version uint64) (*balloon.MembershipProof, error)
+	QueryDigestMembershipAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error)
+	QueryMembershipAt(event []byte, version uint64) (*balloon.MembershipProof, error)
 	QueryDigestMembership(keyDigest hashing.Digest) (*balloon.MembershipProof, error)
 	QueryMembership(event []byte) (*balloon.MembershipProof, error)
 	QueryConsistency(start, end uint64) (*balloon.IncrementalProof, error)
@@ -132,7 +139,7 @@ func Add(api ClientApi) http.HandlerFunc {
 		}
 
 		// Wait for the response
-		response, err := api.Add(event.Event)
+		response, err := api.AddWithContext(r.Context(), event.Event)
 		switch err {
 		case nil:
 			break
@@ -161,12 +168,15 @@ func Add(api ClientApi) http.HandlerFunc {
 			http.Redirect(w, r, shards.Shards[shards.LeaderId].HTTPAddr, http.StatusMovedPermanently)
 			return
 		default:
+			if unavailable(err) {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusPreconditionFailed)
 			return
 		}
 
-		snapshot := protocol.Snapshot(*response)
-		out, err := json.Marshal(&snapshot)
+		out, err := json.Marshal(protocol.ToSnapshot(response))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -179,6 +189,17 @@ func Add(api ClientApi) http.HandlerFunc {
 	}
 }
 
+// unavailable tells whether the events could not be added because Raft
+// is shutting down, overloaded or transferring its leadership, so the
+// same request may succeed later.
+func unavailable(err error) bool {
+	switch err {
+	case raft.ErrRaftShutdown, raft.ErrEnqueueTimeout, raft.ErrLeadershipTransferInProgress:
+		return true
+	}
+	return false
+}
+
 // AddBulk posts a bulk of events into the system:
 // The http post url is:
 //   POST /events/bulk
@@ -219,7 +240,7 @@ func AddBulk(api ClientApi) http.HandlerFunc {
 		}
 
 		// Wait for the response
-		snapshotBulk, err := api.AddBulk(eventBulk.Events)
+		snapshotBulk, err := api.AddBulkWithContext(r.Context(), eventBulk.Events)
 		switch err {
 		case nil:
 			break
@@ -248,6 +269,10 @@ func AddBulk(api ClientApi) http.HandlerFunc {
 			http.Redirect(w, r, shards.Shards[shards.LeaderId].HTTPAddr, http.StatusMovedPermanently)
 			return
 		default:
+			if unavailable(err) {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusPreconditionFailed)
 			return
 		}
@@ -280,6 +305,11 @@ func AddBulk(api ClientApi) http.HandlerFunc {
 //  "ActualVersion":	0,
 // 	"KeyDigest":		"5beeaf427ee0bfcd1a7b6f63010f2745110cf23ae088b859275cd0aad369561b"
 // }
+//
+// If the query sets Historical along with a Version, the hyper proof is built
+// against the hyper tree at that version, so the whole proof can be verified
+// with the snapshot of that version. Servers not keeping the hyper tree
+// history of that version answer with a 422 status.
 func Membership(api ClientApi) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		MembershipRequest.Inc()
@@ -307,6 +337,14 @@ func Membership(api ClientApi) http.HandlerFunc {
 				http.Error(w, err.Error(), http.StatusPreconditionFailed)
 				return
 			}
+		} else if query.Historical {
+
+			// Wait for the response
+			proof, err = api.QueryMembershipAt(query.Key, *query.Version)
+			if err != nil {
+				historicalError(w, err)
+				return
+			}
 		} else {
 
 			// Wait for the response
@@ -347,6 +385,19 @@ func Membership(api ClientApi) http.HandlerFunc {
 //  "ActualVersion":	0,
 //  "KeyDigest":		"5beeaf427ee0bfcd1a7b6f63010f2745110cf23ae088b859275cd0aad369561b"
 // }
+//
+// historicalError answers a failed historical membership query. Queries
+// of versions whose hyper tree history is not kept are answered with a
+// 422 status, so clients can tell them apart from the failed ones.
+func historicalError(w http.ResponseWriter, err error) {
+	if err == hyper.ErrHistoryNotKept {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusPreconditionFailed)
+}
+
+// As in Membership, the query can set Historical along with a Version.
 func DigestMembership(api ClientApi) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		DigestMembershipRequest.Inc()
@@ -375,6 +426,14 @@ func DigestMembership(api ClientApi) http.HandlerFunc {
 				http.Error(w, err.Error(), http.StatusPreconditionFailed)
 				return
 			}
+		} else if query.Historical {
+
+			// Wait for the response
+			proof, err = api.QueryDigestMembershipAt(query.KeyDigest, *query.Version)
+			if err != nil {
+				historicalError(w, err)
+				return
+			}
 		} else {
 
 			// Wait for the response
@@ -614,10 +673,19 @@ func GetReqSanitizer(w http.ResponseWriter, r *http.Request) (http.ResponseWrite
 func LogHandler(handle http.Handler, logger log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
 		start := time.Now()
+
+		requestID := request.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		ctx := log.ContextWithRequestID(request.Context(), requestID)
+
 		writer := statusWriter{w, 0, 0}
-		handle.ServeHTTP(&writer, request)
+		handle.ServeHTTP(&writer, request.WithContext(ctx))
 		latency := time.Now().Sub(start)
 
+		logger := log.FromContext(ctx, logger)
 		logger.Debugf("Request: lat %d %+v", latency, request)
 		if writer.status >= 400 && writer.status < 500 {
 			logger.Infof("Bad Request: %d %+v", latency, request)
@@ -628,6 +696,60 @@ func LogHandler(handle http.Handler, logger log.Logger) http.HandlerFunc {
 	}
 }
 
+// RequestIDHeader is the header identifying each request in the logs.
+// Clients may set it to correlate their own logs with the server ones,
+// otherwise LogHandler generates a new identifier.
+const RequestIDHeader = "X-Request-Id"
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// validRequestID accepts short identifiers made of letters, digits and
+// a few separators, so they are safe to write in the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// TracingHandler starts a span for each request, continuing the trace
+// of the caller when the request carries a traceparent header. Handlers
+// find the span in the context of the request.
+func TracingHandler(handle http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		ctx := tracing.Extract(request.Context(), request.Header)
+		ctx, span := tracing.StartSpan(ctx, "http "+request.Method+" "+request.URL.Path)
+		if span == nil {
+			handle.ServeHTTP(w, request)
+			return
+		}
+		defer span.End()
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.path", request.URL.Path)
+
+		writer := statusWriter{w, 0, 0}
+		handle.ServeHTTP(&writer, request.WithContext(ctx))
+		span.SetAttribute("http.status_code", writer.status)
+		if writer.status >= 500 {
+			span.SetError(fmt.Errorf("Server error: %d", writer.status))
+		}
+	}
+}
+
 type statusWriter struct {
 	http.ResponseWriter
 	status int
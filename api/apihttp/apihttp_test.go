@@ -18,20 +18,29 @@ package apihttp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/bbva/qed/testutils/spec"
+	"github.com/stretchr/testify/require"
 
 	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/balloon/history"
 	"github.com/bbva/qed/balloon/hyper"
 	"github.com/bbva/qed/consensus"
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/tracing"
+	"github.com/hashicorp/raft"
 )
 
 type fakeRaftBalloon struct {
@@ -41,7 +50,7 @@ type fakeRaftBalloon struct {
 	raftID       string
 }
 
-func (b fakeRaftBalloon) Add(event []byte) (*balloon.Snapshot, error) {
+func (b fakeRaftBalloon) AddWithContext(ctx context.Context, event []byte) (*balloon.Snapshot, error) {
 	return &balloon.Snapshot{
 		EventDigest:   hashing.Digest{0x02},
 		HistoryDigest: hashing.Digest{0x00},
@@ -49,7 +58,7 @@ func (b fakeRaftBalloon) Add(event []byte) (*balloon.Snapshot, error) {
 		Version:       0}, nil
 }
 
-func (b fakeRaftBalloon) AddBulk(bulk [][]byte) ([]*balloon.Snapshot, error) {
+func (b fakeRaftBalloon) AddBulkWithContext(ctx context.Context, bulk [][]byte) ([]*balloon.Snapshot, error) {
 	return []*balloon.Snapshot{
 		{
 			EventDigest:   hashing.Digest{0x02},
@@ -120,6 +129,30 @@ func (b fakeRaftBalloon) QueryMembership(event []byte) (*balloon.MembershipProof
 	}, nil
 }
 
+func (b fakeRaftBalloon) QueryDigestMembershipAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	switch version {
+	case 10:
+		return nil, hyper.ErrHistoryNotKept
+	case 11:
+		return nil, errors.New("unable to get proof from hyper tree")
+	}
+	return &balloon.MembershipProof{
+		Exists:         true,
+		HyperProof:     hyper.NewQueryProof([]byte{0x0}, []byte{0x0}, hyper.AuditPath{}, nil),
+		HistoryProof:   history.NewMembershipProof(0, 0, history.AuditPath{}, nil),
+		CurrentVersion: 3,
+		QueryVersion:   version,
+		ActualVersion:  0,
+		KeyDigest:      keyDigest,
+		Hasher:         hashing.NewFakeXorHasher(),
+	}, nil
+}
+
+func (b fakeRaftBalloon) QueryMembershipAt(event []byte, version uint64) (*balloon.MembershipProof, error) {
+	hasher := hashing.NewFakeXorHasher()
+	return b.QueryDigestMembershipAt(hasher.Do(event), version)
+}
+
 func (b fakeRaftBalloon) QueryConsistency(start, end uint64) (*balloon.IncrementalProof, error) {
 	var pathKey [10]byte
 	ip := balloon.IncrementalProof{
@@ -289,6 +322,39 @@ func TestAddBulk(t *testing.T) {
 	}
 }
 
+type failingRaftBalloon struct {
+	fakeRaftBalloon
+	err error
+}
+
+func (b failingRaftBalloon) AddBulkWithContext(ctx context.Context, bulk [][]byte) ([]*balloon.Snapshot, error) {
+	return nil, b.err
+}
+
+func TestAddBulkErrors(t *testing.T) {
+	testCases := []struct {
+		err            error
+		expectedStatus int
+	}{
+		{raft.ErrRaftShutdown, http.StatusServiceUnavailable},
+		{raft.ErrEnqueueTimeout, http.StatusServiceUnavailable},
+		{raft.ErrLeadershipTransferInProgress, http.StatusServiceUnavailable},
+		{errors.New("invalid bulk"), http.StatusPreconditionFailed},
+	}
+
+	for i, c := range testCases {
+		data, _ := json.Marshal(protocol.EventsBulk{Events: [][]byte{[]byte("this is event 1")}})
+		req, err := http.NewRequest("POST", "/events/bulk", bytes.NewBuffer(data))
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		AddBulk(failingRaftBalloon{err: c.err}).ServeHTTP(rr, req)
+		if status := rr.Code; status != c.expectedStatus {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v", i, status, c.expectedStatus)
+		}
+	}
+}
+
 func TestMembership(t *testing.T) {
 
 	key := []byte("this is a sample event")
@@ -380,6 +446,80 @@ func TestMembershipConsistency(t *testing.T) {
 
 }
 
+func TestMembershipAt(t *testing.T) {
+	var version uint64 = 1
+	key := []byte("this is a sample event")
+
+	query, _ := json.Marshal(protocol.MembershipQuery{
+		Key:        key,
+		Version:    &version,
+		Historical: true,
+	})
+
+	req, err := http.NewRequest("POST", "/proofs/membership", bytes.NewBuffer(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Membership(fakeRaftBalloon{})
+	expectedResult := &protocol.MembershipResult{
+		Exists:         true,
+		Hyper:          map[string]hashing.Digest{},
+		History:        map[string]hashing.Digest{},
+		CurrentVersion: 0x3,
+		QueryVersion:   0x1,
+		ActualVersion:  0x0,
+		KeyDigest:      []uint8{0x17},
+		Key:            key,
+	}
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	actualResult := new(protocol.MembershipResult)
+	json.Unmarshal([]byte(rr.Body.String()), actualResult)
+
+	spec.Equal(t, expectedResult, actualResult, "Incorrect proof")
+
+}
+
+func TestDigestMembershipAtErrors(t *testing.T) {
+	testCases := []struct {
+		version  uint64
+		expected int
+	}{
+		{1, http.StatusOK},
+		{10, http.StatusUnprocessableEntity},
+		{11, http.StatusPreconditionFailed},
+	}
+
+	for i, c := range testCases {
+		version := c.version
+		query, _ := json.Marshal(protocol.MembershipDigest{
+			KeyDigest:  hashing.Digest{0x1},
+			Version:    &version,
+			Historical: true,
+		})
+		req, err := http.NewRequest("POST", "/proofs/digest-membership", bytes.NewBuffer(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		DigestMembership(fakeRaftBalloon{}).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v",
+				i, status, c.expected)
+		}
+	}
+}
+
 func TestDigestMembership(t *testing.T) {
 
 	hasher := hashing.NewSha256Hasher()
@@ -433,8 +573,8 @@ func TestDigestMembershipConsistency(t *testing.T) {
 	eventDigest := hasher.Do([]byte("this is a sample event"))
 
 	query, _ := json.Marshal(protocol.MembershipDigest{
-		eventDigest,
-		&version,
+		KeyDigest: eventDigest,
+		Version:   &version,
 	})
 
 	req, err := http.NewRequest("POST", "/proofs/digest-membership", bytes.NewBuffer(query))
@@ -531,6 +671,65 @@ func TestAuthHandlerMiddleware(t *testing.T) {
 	}
 }
 
+func TestTracingHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apihttp-tracing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	exporter, err := tracing.NewFileExporter(path)
+	require.NoError(t, err)
+	tracer := tracing.NewTracer(exporter, nil)
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, err := http.NewRequest("POST", "/events", bytes.NewBuffer([]byte(`{"Event": "dGhpcyBpcyBhIHNhbXBsZSBldmVudA=="}`)))
+	require.NoError(t, err)
+	req.Header.Set(tracing.TraceParentHeader, traceparent)
+
+	rr := httptest.NewRecorder()
+	TracingHandler(Add(fakeRaftBalloon{})).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	require.NoError(t, tracer.Close())
+
+	spans, err := tracing.ReadSpans(path)
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	require.Equal(t, "http POST /events", spans[0].Name)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].TraceID)
+	require.Equal(t, "00f067aa0ba902b7", spans[0].ParentSpanID)
+	require.Equal(t, float64(http.StatusCreated), spans[0].Attributes["http.status_code"])
+}
+
+func TestLogHandlerRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&log.LoggerOptions{Output: &buf, Level: log.Info})
+
+	var seen string
+	handler := LogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = log.RequestID(r.Context())
+		w.WriteHeader(http.StatusBadRequest)
+	}), logger)
+
+	req, err := http.NewRequest("POST", "/events", nil)
+	require.NoError(t, err)
+	req.Header.Set(RequestIDHeader, "client-id-1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, "client-id-1", seen)
+	require.Equal(t, "client-id-1", rr.Header().Get(RequestIDHeader))
+	require.Contains(t, buf.String(), "request_id=client-id-1")
+
+	req, err = http.NewRequest("POST", "/events", nil)
+	require.NoError(t, err)
+	req.Header.Set(RequestIDHeader, "not a valid id")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Len(t, seen, 32)
+	require.Equal(t, seen, rr.Header().Get(RequestIDHeader))
+}
+
 func TestInfo(t *testing.T) {
 	req, err := http.NewRequest("GET", "/info", nil)
 	if err != nil {
@@ -0,0 +1,343 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mgmthttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+)
+
+// defaultAuditLimit is the number of audit entries listed when the
+// request does not ask for a different one.
+const defaultAuditLimit = 100
+
+// AuditRecorder records the entries describing the operations served
+// by the management API.
+type AuditRecorder interface {
+	// Reserve waits until there is room to record one more entry, and
+	// fails if the context is done first or the recorder is stopped.
+	Reserve(ctx context.Context) error
+	// Record records an entry in the room reserved for it. It must not
+	// block the caller while the entry is added to the audit log.
+	Record(ctx context.Context, entry *protocol.AuditEntry)
+}
+
+// AuditHandler records an audit entry for every request changing the
+// state of the server, i.e. any request but GET and HEAD ones, once it
+// has been served. Requests are refused with a 503 status if their entry
+// cannot be recorded. Entries forwarded to /audit are recorded by the
+// request itself, stamped with the forwarder.
+func AuditHandler(handle http.Handler, recorder AuditRecorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.URL.Path == "/audit" {
+			handle.ServeHTTP(w, r)
+			return
+		}
+
+		if err := recorder.Reserve(r.Context()); err != nil {
+			http.Error(w, "Unable to record the operation in the audit log: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		writer := statusWriter{ResponseWriter: w}
+		handle.ServeHTTP(&writer, r)
+
+		recorder.Record(r.Context(), &protocol.AuditEntry{
+			Timestamp:  time.Now().UnixNano(),
+			Actor:      AuditActor(r),
+			RemoteAddr: r.RemoteAddr,
+			RequestID:  log.RequestID(r.Context()),
+			Operation:  r.Method + " " + r.URL.Path,
+			Target:     r.URL.RawQuery,
+			Status:     writer.status,
+		})
+	}
+}
+
+// AuditActor identifies who sends the request: requests with an API key
+// are identified by a fingerprint of the key, so it is not disclosed in
+// the audit log.
+func AuditActor(r *http.Request) string {
+	key := r.Header.Get("Api-Key")
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "api-key:" + hex.EncodeToString(sum[:8])
+}
+
+func ManageAudit(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ListAuditEntries(api, w, r)
+		case "POST":
+			AddAuditEntry(api, w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// ListAuditEntries returns the audit entries recorded at the given version
+// or after it, along with the event and version needed to ask for their
+// membership proofs:
+// The http get url is:
+//   GET /audit[?from=<version>][&limit=<entries>]
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// [
+//  {
+//    "version": 12,
+//    "event": "cWVkLmF1ZGl0OnsidGltZXN0YW1w...",
+//    "entry": {
+//      "timestamp": 1571234567000000000,
+//      "node": "server0",
+//      "actor": "api-key:0123456789abcdef",
+//      "remote_addr": "127.0.0.1:52346",
+//      "request_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+//      "operation": "DELETE /cluster/members",
+//      "target": "id=server1",
+//      "status": 204
+//    }
+//  },
+//	...
+// ]
+// If the parameters are not valid numbers, the HTTP status is 400.
+func ListAuditEntries(api MgmtApi, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var from uint64
+	if f := query.Get("from"); f != "" {
+		var err error
+		from, err = strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultAuditLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := api.ListAuditEntries(from, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(records)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
+}
+
+// AddAuditEntry adds an audit entry recorded by another node of the
+// cluster, which forwards them to the leader. The entry is stamped with
+// the actor and the address forwarding it, so this request is recorded
+// along with the entry:
+// The http post url is:
+//   POST /audit
+//
+// The body of the request is the JSON encoded entry, as listed by
+// GET /audit.
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 201 and the body contains
+// the record of the entry, as listed by GET /audit.
+// If the node is not the leader of the cluster, the HTTP status is 409.
+func AddAuditEntry(api MgmtApi, w http.ResponseWriter, r *http.Request) {
+	var entry protocol.AuditEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, "Invalid audit entry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.ForwardedBy = AuditActor(r)
+	entry.ForwardedFrom = r.RemoteAddr
+
+	record, err := api.AddAuditEntry(r.Context(), &entry)
+	if err != nil {
+		if err == consensus.ErrNotLeader {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(record)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(out)
+}
+
+// ProveAuditEntry returns the proof that an audit entry is part of the
+// audit log at its last version:
+// The http get url is:
+//   GET /audit/proof?version=<version>
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// {
+//   "version": 12,
+//   "current_version": 20,
+//   "event": "cWVkLmF1ZGl0OnsidGltZXN0YW1w...",
+//   "history_digest": "yD8Y2QGBXdEYVVr5SfeX1mRv3x...",
+//   "audit_path": {"12|0": "...", ...}
+// }
+// If the version is not a valid number, the HTTP status is 400.
+// If there is no audit entry of that version, the HTTP status is 404.
+func ProveAuditEntry(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		version, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid version parameter", http.StatusBadRequest)
+			return
+		}
+
+		proof, err := api.ProveAuditEntry(version)
+		if err == storage.ErrKeyNotFound {
+			http.Error(w, "Audit entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(proof)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(out)
+	}
+}
+
+// ProveAuditConsistency returns the proof that the audit log at the end
+// version is an extension of the one at the start version, to be
+// verified against the signed audit roots of both versions:
+// The http get url is:
+//   GET /audit/incremental?start=<version>&end=<version>
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// {
+//   "start": 12,
+//   "end": 20,
+//   "audit_path": {"12|0": "...", ...}
+// }
+// If the versions are not valid numbers or the start version is after
+// the end version, the HTTP status is 400.
+// If the audit log has no entry of the end version, the HTTP status is 404.
+func ProveAuditConsistency(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		start, err := strconv.ParseUint(query.Get("start"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid start parameter", http.StatusBadRequest)
+			return
+		}
+		end, err := strconv.ParseUint(query.Get("end"), 10, 64)
+		if err != nil || end < start {
+			http.Error(w, "Invalid end parameter", http.StatusBadRequest)
+			return
+		}
+
+		proof, err := api.ProveAuditConsistency(start, end)
+		if err == storage.ErrKeyNotFound {
+			http.Error(w, "Audit entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.Marshal(proof)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(out)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
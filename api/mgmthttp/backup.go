@@ -0,0 +1,169 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mgmthttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bbva/qed/api/apihttp"
+	"github.com/bbva/qed/protocol"
+)
+
+// VerifyBackup checks that a certain backup (given its ID) is not corrupted:
+// The http post url is:
+//   POST /backup/verify?backupID=<id>
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 204 with an empty body.
+// If the backup ID is missing or invalid, the HTTP status is 400.
+// If the backup is not found or not valid, the HTTP status is 500 and the
+// body contains the reason.
+func VerifyBackup(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		backupID, err := strconv.ParseUint(r.URL.Query().Get("backupID"), 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid backupID", http.StatusBadRequest)
+			return
+		}
+
+		if err := api.VerifyBackup(uint32(backupID)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// UploadBackup uploads a certain backup (given its ID) to a backup target
+// configured in the server, along with its manifest:
+// The http post url is:
+//   POST /backup/upload?backupID=<id>&target=<name>
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// {
+//   "name": "20200423T091414Z-server1-12",
+//   "node_id": "server1",
+//   "engine": "rocksdb",
+//   "backup_id": 12,
+//   "timestamp": 1587633254,
+//   "version": 1023,
+//   "hasher": "sha256",
+//   "snapshot": {
+//     "Snapshot": {...},
+//     "Signature": "..."
+//   },
+//   "files": [
+//     {
+//       "path": "000012.sst",
+//       "size": 1048576,
+//       "sha256": "...",
+//       "parts": 1,
+//       "part_size": 33554432
+//     },
+//     ...
+//   ]
+// }
+// If the backup ID is invalid or the target is unknown, the HTTP status
+// is 400.
+func UploadBackup(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		backupID, err := strconv.ParseUint(r.URL.Query().Get("backupID"), 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid backupID", http.StatusBadRequest)
+			return
+		}
+		uploadBackup(api, w, uint32(backupID), r.URL.Query().Get("target"))
+	}
+}
+
+func uploadBackup(api MgmtApi, w http.ResponseWriter, backupID uint32, target string) {
+	manifest, err := api.UploadBackup(backupID, target)
+	if err == protocol.ErrUnknownBackupTarget {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(manifest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
+}
+
+// BackupStatus returns the state of the scheduled backups of the node:
+// The http get url is:
+//   GET /backups/status
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// {
+//   "enabled": true,
+//   "interval": "1h0m0s",
+//   "scheduled": true,
+//   "last_run": 1587633254,
+//   "last_success": 1587633254,
+//   "last_backup_id": 12,
+//   "last_verified": true,
+//   "last_deleted": 1,
+//   "backups": 7
+// }
+// The last_error field contains the reason of the last failure, if the
+// last run failed.
+func BackupStatus(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		// Make sure we can only be called with an HTTP GET request.
+		w, _, err = apihttp.GetReqSanitizer(w, r)
+		if err != nil {
+			return
+		}
+
+		out, err := json.Marshal(api.BackupStatus())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(out)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mgmthttp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bbva/qed/log"
+)
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func ManageLogLevel(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			GetLogLevel(logger, w, r)
+		case "PUT":
+			SetLogLevel(logger, w, r)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// GetLogLevel returns the current level of the server logs:
+// The http get url is:
+//   GET /log/level
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// {
+//   "level": "info"
+// }
+func GetLogLevel(logger log.Logger, w http.ResponseWriter, r *http.Request) {
+	writeLogLevel(logger, w)
+}
+
+// SetLogLevel changes the level of the server logs without restarting it.
+// Every subsystem logging through the server logger is affected:
+// The http put url is:
+//   PUT /log/level?level=<off|fatal|error|warn|info|debug|trace>
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains
+// the new level, as in GET /log/level.
+// If the level is missing or unknown, the HTTP status is 400.
+func SetLogLevel(logger log.Logger, w http.ResponseWriter, r *http.Request) {
+	level := log.LevelFromString(r.URL.Query().Get("level"))
+	if level == log.NotSet {
+		http.Error(w, "Unknown log level: "+r.URL.Query().Get("level"), http.StatusBadRequest)
+		return
+	}
+
+	previous := logger.Level()
+	logger.SetLevel(level)
+	if previous != level {
+		logger.Infof("Log level changed from %s to %s", previous, level)
+	}
+
+	writeLogLevel(logger, w)
+}
+
+func writeLogLevel(logger log.Logger, w http.ResponseWriter) {
+	out, err := json.Marshal(logLevel{Level: logger.Level().String()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
+}
@@ -0,0 +1,240 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mgmthttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/bbva/qed/consensus"
+)
+
+func ManageMembers(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ListMembers(api, w, r)
+		case "DELETE":
+			RemoveMember(api, w, r)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// ListMembers returns the members of the Raft cluster:
+// The http get url is:
+//   GET /cluster/members
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 200 and the body contains:
+// [
+//  {
+//    "node_id": "server0",
+//    "raft_addr": "127.0.0.1:8500",
+//    "suffrage": "Voter",
+//    "leader": true,
+//    "reachable": true
+//  },
+//	...
+// ]
+func ListMembers(api MgmtApi, w http.ResponseWriter, r *http.Request) {
+	members, err := api.ListMembers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := json.Marshal(members)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
+}
+
+// RemoveMember removes a node from the Raft cluster. Unless forced, voters
+// are not removed if the cluster would lose its quorum:
+// The http delete url is:
+//   DELETE /cluster/members?id=<node id>[&force=true]
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 204 with an empty body.
+func RemoveMember(api MgmtApi, w http.ResponseWriter, r *http.Request) {
+	id, force, ok := memberParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := api.RemoveMember(id, force); err != nil {
+		membershipError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddNonvoter adds a node to the Raft cluster as a nonvoter:
+// The http post url is:
+//   POST /cluster/nonvoters?id=<node id>&addr=<raft address>
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 204 with an empty body.
+func AddNonvoter(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, addr := r.URL.Query().Get("id"), r.URL.Query().Get("addr")
+		if id == "" || addr == "" {
+			http.Error(w, "Node id and address are required", http.StatusBadRequest)
+			return
+		}
+
+		if err := api.AddNonvoterMember(id, addr); err != nil {
+			membershipError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PromoteMember turns a nonvoter into a voter. Unless forced, the node
+// is not promoted if the cluster would lose its quorum:
+// The http post url is:
+//   POST /cluster/promote?id=<node id>[&force=true]
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 204 with an empty body.
+func PromoteMember(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, force, ok := memberParams(w, r)
+		if !ok {
+			return
+		}
+
+		if err := api.PromoteMember(id, force); err != nil {
+			membershipError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DemoteMember turns a voter into a nonvoter. Unless forced, the node
+// is not demoted if the cluster would lose its quorum:
+// The http post url is:
+//   POST /cluster/demote?id=<node id>[&force=true]
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 204 with an empty body.
+func DemoteMember(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, force, ok := memberParams(w, r)
+		if !ok {
+			return
+		}
+
+		if err := api.DemoteMember(id, force); err != nil {
+			membershipError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TransferLeadership transfers the leadership to the given voter, or to
+// the most up to date one if no node is given:
+// The http post url is:
+//   POST /cluster/leadership[?id=<node id>]
+//
+// The following statuses are expected:
+// If everything is alright, the HTTP status is 204 with an empty body.
+func TransferLeadership(api MgmtApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := api.TransferLeadership(r.URL.Query().Get("id")); err != nil {
+			membershipError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func memberParams(w http.ResponseWriter, r *http.Request) (string, bool, bool) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	if id == "" {
+		http.Error(w, "Node id is required", http.StatusBadRequest)
+		return "", false, false
+	}
+
+	var force bool
+	if f := query.Get("force"); f != "" {
+		var err error
+		force, err = strconv.ParseBool(f)
+		if err != nil {
+			http.Error(w, "Invalid force parameter", http.StatusBadRequest)
+			return "", false, false
+		}
+	}
+
+	return id, force, true
+}
+
+func membershipError(w http.ResponseWriter, err error) {
+	switch err {
+	case consensus.ErrNotLeader, consensus.ErrMemberExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case consensus.ErrUnknownMember:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case consensus.ErrQuorumLoss, consensus.ErrLeaderMember:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -18,11 +18,14 @@
 package mgmthttp
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strconv"
 
 	"github.com/bbva/qed/api/apihttp"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/storage"
 )
 
@@ -30,16 +33,59 @@ type MgmtApi interface {
 	CreateBackup() error
 	ListBackups() []*storage.BackupInfo
 	DeleteBackup(backupID uint32) error
+	VerifyBackup(backupID uint32) error
+	UploadBackup(backupID uint32, target string) (*protocol.BackupManifest, error)
+	BackupStatus() *protocol.BackupStatus
+	ListMembers() ([]*protocol.MemberInfo, error)
+	RemoveMember(id string, force bool) error
+	AddNonvoterMember(id, addr string) error
+	PromoteMember(id string, force bool) error
+	DemoteMember(id string, force bool) error
+	TransferLeadership(id string) error
+	AddAuditEntry(ctx context.Context, entry *protocol.AuditEntry) (*protocol.AuditRecord, error)
+	ListAuditEntries(from uint64, limit int) ([]*protocol.AuditRecord, error)
+	ProveAuditEntry(version uint64) (*protocol.AuditProof, error)
+	ProveAuditConsistency(start, end uint64) (*protocol.AuditIncrementalProof, error)
 }
 
 // NewMgmtHttp will return a mux server with endpoints to manage different
 // QED log service features: DDBB backups, Raft membership,...
 //	/backup -> Create or Delete a backup
+//	/backup/verify -> Verify a backup
+//	/backup/upload -> Upload a backup to a backup target
 //	/backups -> List backups
+//	/backups/status -> State of the scheduled backups
+//	/cluster/members -> List or remove cluster members
+//	/cluster/nonvoters -> Add a nonvoter member
+//	/cluster/promote -> Promote a nonvoter to voter
+//	/cluster/demote -> Demote a voter to nonvoter
+//	/cluster/leadership -> Transfer the cluster leadership
+//	/log/level -> Get or change the level of the default logger
+//	/audit -> List or add audit entries
+//	/audit/proof -> Prove an audit entry is part of the audit log
+//	/audit/incremental -> Prove the audit log is consistent between two versions
 func NewMgmtHttp(api MgmtApi) *http.ServeMux {
+	return NewMgmtHttpWithLogger(api, log.L())
+}
+
+// NewMgmtHttpWithLogger will return the same mux server as NewMgmtHttp,
+// but changing the level of the given logger.
+func NewMgmtHttpWithLogger(api MgmtApi, logger log.Logger) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/backup", ManageBackup(api))
+	mux.HandleFunc("/backup/verify", VerifyBackup(api))
+	mux.HandleFunc("/backup/upload", UploadBackup(api))
 	mux.HandleFunc("/backups", ListBackups(api))
+	mux.HandleFunc("/backups/status", BackupStatus(api))
+	mux.HandleFunc("/cluster/members", ManageMembers(api))
+	mux.HandleFunc("/cluster/nonvoters", AddNonvoter(api))
+	mux.HandleFunc("/cluster/promote", PromoteMember(api))
+	mux.HandleFunc("/cluster/demote", DemoteMember(api))
+	mux.HandleFunc("/cluster/leadership", TransferLeadership(api))
+	mux.HandleFunc("/log/level", ManageLogLevel(logger))
+	mux.HandleFunc("/audit", ManageAudit(api))
+	mux.HandleFunc("/audit/proof", ProveAuditEntry(api))
+	mux.HandleFunc("/audit/incremental", ProveAuditConsistency(api))
 	return mux
 }
 
@@ -58,12 +104,16 @@ func ManageBackup(api MgmtApi) http.HandlerFunc {
 	}
 }
 
-// CreateBackup creates a backup of the RocksDB data up to now:
+// CreateBackup creates a backup of the RocksDB data up to now, and
+// uploads it to the given backup target, if any:
 // The http post url is:
-//   POST /backup
+//   POST /backup[?target=<name>]
 //
 // The following statuses are expected:
-// If everything is alright, the HTTP status is 200 with an empty body.
+// If everything is alright, the HTTP status is 200 with an empty body,
+// or with the manifest of the uploaded backup if there is a target.
+// If the target is unknown, the HTTP status is 400. The backup is kept
+// in the node even if it can not be uploaded.
 func CreateBackup(api MgmtApi, w http.ResponseWriter, r *http.Request) {
 	// Make sure we can only be called with an HTTP POST request.
 	if r.Method != "POST" {
@@ -77,7 +127,17 @@ func CreateBackup(api MgmtApi, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	backups := api.ListBackups()
+	if len(backups) == 0 {
+		http.Error(w, "Backup created but not found", http.StatusInternalServerError)
+		return
+	}
+	uploadBackup(api, w, uint32(backups[len(backups)-1].ID), target)
 }
 
 // ListBackups returns a list of backups along with each backup information.
@@ -17,13 +17,20 @@
 package mgmthttp
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/bbva/qed/testutils/spec"
 
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/storage"
 )
@@ -48,6 +55,115 @@ func (b fakeRaftNode) DeleteBackup(backupID uint32) error {
 	return nil
 }
 
+func (b fakeRaftNode) VerifyBackup(backupID uint32) error {
+	if backupID != 1 {
+		return fmt.Errorf("Backup %d not found", backupID)
+	}
+	return nil
+}
+
+func (b fakeRaftNode) UploadBackup(backupID uint32, target string) (*protocol.BackupManifest, error) {
+	if target != "offsite" {
+		return nil, protocol.ErrUnknownBackupTarget
+	}
+	if backupID != 1 {
+		return nil, fmt.Errorf("Backup %d not found", backupID)
+	}
+	return &protocol.BackupManifest{Name: "20200423T091414Z-server0-1", NodeID: "server0", BackupID: 1}, nil
+}
+
+func (b fakeRaftNode) BackupStatus() *protocol.BackupStatus {
+	return &protocol.BackupStatus{
+		Enabled:      true,
+		Interval:     "1h0m0s",
+		Scheduled:    true,
+		LastRun:      1587633254,
+		LastSuccess:  1587633254,
+		LastBackupID: 1,
+		LastVerified: true,
+		Backups:      1,
+	}
+}
+
+func (b fakeRaftNode) ListMembers() ([]*protocol.MemberInfo, error) {
+	return []*protocol.MemberInfo{
+		{NodeId: "server0", Suffrage: "Voter", Leader: true, Reachable: true},
+		{NodeId: "server1", Suffrage: "Voter", Reachable: false},
+	}, nil
+}
+
+func (b fakeRaftNode) RemoveMember(id string, force bool) error {
+	return b.memberError(id, force)
+}
+
+func (b fakeRaftNode) AddNonvoterMember(id, addr string) error {
+	if id == "server0" {
+		return consensus.ErrMemberExists
+	}
+	return nil
+}
+
+func (b fakeRaftNode) PromoteMember(id string, force bool) error {
+	return b.memberError(id, force)
+}
+
+func (b fakeRaftNode) DemoteMember(id string, force bool) error {
+	return b.memberError(id, force)
+}
+
+func (b fakeRaftNode) TransferLeadership(id string) error {
+	if id != "" && id != "server1" {
+		return consensus.ErrUnknownMember
+	}
+	return nil
+}
+
+func (b fakeRaftNode) AddAuditEntry(ctx context.Context, entry *protocol.AuditEntry) (*protocol.AuditRecord, error) {
+	if entry.Node != "server0" {
+		return nil, consensus.ErrNotLeader
+	}
+	event, _ := entry.Event()
+	return &protocol.AuditRecord{Version: 7, Event: event, Entry: entry}, nil
+}
+
+func (b fakeRaftNode) ListAuditEntries(from uint64, limit int) ([]*protocol.AuditRecord, error) {
+	records := make([]*protocol.AuditRecord, 0)
+	for _, version := range []uint64{2, 5, 9} {
+		if version >= from && len(records) < limit {
+			entry := &protocol.AuditEntry{Node: "server0", Operation: "POST /backup", Status: 200}
+			event, _ := entry.Event()
+			records = append(records, &protocol.AuditRecord{Version: version, Event: event, Entry: entry})
+		}
+	}
+	return records, nil
+}
+
+func (b fakeRaftNode) ProveAuditEntry(version uint64) (*protocol.AuditProof, error) {
+	if version != 5 {
+		return nil, storage.ErrKeyNotFound
+	}
+	return &protocol.AuditProof{Version: 5, CurrentVersion: 9}, nil
+}
+
+func (b fakeRaftNode) ProveAuditConsistency(start, end uint64) (*protocol.AuditIncrementalProof, error) {
+	if end > 9 {
+		return nil, storage.ErrKeyNotFound
+	}
+	return &protocol.AuditIncrementalProof{Start: start, End: end}, nil
+}
+
+func (b fakeRaftNode) memberError(id string, force bool) error {
+	switch {
+	case id == "server0":
+		return consensus.ErrLeaderMember
+	case id != "server1":
+		return consensus.ErrUnknownMember
+	case !force:
+		return consensus.ErrQuorumLoss
+	}
+	return nil
+}
+
 func TestCreateBackup(t *testing.T) {
 	req, err := http.NewRequest("POST", "/backup", nil)
 	if err != nil {
@@ -115,3 +231,373 @@ func TestDeleteBackup(t *testing.T) {
 			status, http.StatusNoContent)
 	}
 }
+
+func TestVerifyBackup(t *testing.T) {
+	testCases := []struct {
+		method   string
+		query    string
+		expected int
+	}{
+		{"POST", "?backupID=1", http.StatusNoContent},
+		{"POST", "?backupID=2", http.StatusInternalServerError},
+		{"POST", "?backupID=foo", http.StatusBadRequest},
+		{"POST", "", http.StatusBadRequest},
+		{"GET", "?backupID=1", http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range testCases {
+		req, err := http.NewRequest(c.method, "/backup/verify"+c.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := VerifyBackup(fakeRaftNode{})
+		handler.ServeHTTP(rr, req)
+
+		spec.Equal(t, c.expected, rr.Code, "Wrong status code for "+c.method+" "+c.query)
+	}
+}
+
+func TestUploadBackup(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected int
+	}{
+		{"/backup/upload?backupID=1&target=offsite", http.StatusOK},
+		{"/backup/upload?backupID=2&target=offsite", http.StatusInternalServerError},
+		{"/backup/upload?backupID=1&target=unknown", http.StatusBadRequest},
+		{"/backup/upload?backupID=foo&target=offsite", http.StatusBadRequest},
+		{"/backup?target=offsite", http.StatusOK},
+		{"/backup?target=unknown", http.StatusBadRequest},
+	}
+
+	handler := NewMgmtHttp(fakeRaftNode{})
+	for _, c := range testCases {
+		req, err := http.NewRequest("POST", c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		spec.Equal(t, c.expected, rr.Code, "Wrong status code for "+c.url)
+		if rr.Code == http.StatusOK {
+			var manifest protocol.BackupManifest
+			spec.NoError(t, json.Unmarshal(rr.Body.Bytes(), &manifest), "Unable to decode the manifest")
+			spec.Equal(t, "20200423T091414Z-server0-1", manifest.Name, "Wrong backup name")
+		}
+	}
+}
+
+func TestBackupStatus(t *testing.T) {
+	req, err := http.NewRequest("GET", "/backups/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := BackupStatus(fakeRaftNode{})
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var status protocol.BackupStatus
+	spec.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status), "Unable to decode the backup status")
+	spec.Equal(t, *fakeRaftNode{}.BackupStatus(), status, "Wrong backup status")
+}
+
+func TestListMembers(t *testing.T) {
+	req, err := http.NewRequest("GET", "/cluster/members", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := ManageMembers(fakeRaftNode{})
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var members []*protocol.MemberInfo
+	_ = json.Unmarshal(rr.Body.Bytes(), &members)
+	spec.True(t, len(members) == 2, "Members list must have 2 elements.")
+	spec.True(t, members[0].Leader && !members[1].Reachable, "Members info must be preserved.")
+}
+
+func TestMembershipChanges(t *testing.T) {
+	testCases := []struct {
+		method, url string
+		handler     http.HandlerFunc
+		expected    int
+	}{
+		{"DELETE", "/cluster/members?id=server1", ManageMembers(fakeRaftNode{}), http.StatusPreconditionFailed},
+		{"DELETE", "/cluster/members?id=server1&force=true", ManageMembers(fakeRaftNode{}), http.StatusNoContent},
+		{"DELETE", "/cluster/members?id=server0", ManageMembers(fakeRaftNode{}), http.StatusPreconditionFailed},
+		{"DELETE", "/cluster/members?id=server9", ManageMembers(fakeRaftNode{}), http.StatusNotFound},
+		{"DELETE", "/cluster/members", ManageMembers(fakeRaftNode{}), http.StatusBadRequest},
+		{"DELETE", "/cluster/members?id=server1&force=maybe", ManageMembers(fakeRaftNode{}), http.StatusBadRequest},
+		{"POST", "/cluster/nonvoters?id=server2&addr=127.0.0.1:8502", AddNonvoter(fakeRaftNode{}), http.StatusNoContent},
+		{"POST", "/cluster/nonvoters?id=server0&addr=127.0.0.1:8500", AddNonvoter(fakeRaftNode{}), http.StatusConflict},
+		{"POST", "/cluster/nonvoters?id=server2", AddNonvoter(fakeRaftNode{}), http.StatusBadRequest},
+		{"GET", "/cluster/nonvoters", AddNonvoter(fakeRaftNode{}), http.StatusMethodNotAllowed},
+		{"POST", "/cluster/promote?id=server1&force=true", PromoteMember(fakeRaftNode{}), http.StatusNoContent},
+		{"POST", "/cluster/demote?id=server1", DemoteMember(fakeRaftNode{}), http.StatusPreconditionFailed},
+		{"POST", "/cluster/leadership", TransferLeadership(fakeRaftNode{}), http.StatusNoContent},
+		{"POST", "/cluster/leadership?id=server1", TransferLeadership(fakeRaftNode{}), http.StatusNoContent},
+		{"POST", "/cluster/leadership?id=server9", TransferLeadership(fakeRaftNode{}), http.StatusNotFound},
+	}
+
+	for i, c := range testCases {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		c.handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v",
+				i, status, c.expected)
+		}
+	}
+}
+
+func TestManageLogLevel(t *testing.T) {
+	logger := log.New(&log.LoggerOptions{Output: ioutil.Discard, Level: log.Info})
+	derived := logger.Named("cluster")
+	handler := ManageLogLevel(logger)
+
+	testCases := []struct {
+		method, url string
+		expected    int
+		level       string
+	}{
+		{"GET", "/log/level", http.StatusOK, "info"},
+		{"PUT", "/log/level?level=debug", http.StatusOK, "debug"},
+		{"PUT", "/log/level?level=verbose", http.StatusBadRequest, ""},
+		{"PUT", "/log/level", http.StatusBadRequest, ""},
+		{"POST", "/log/level?level=info", http.StatusMethodNotAllowed, ""},
+		{"GET", "/log/level", http.StatusOK, "debug"},
+	}
+
+	for i, c := range testCases {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v",
+				i, status, c.expected)
+		}
+		if c.level != "" {
+			var level logLevel
+			_ = json.Unmarshal(rr.Body.Bytes(), &level)
+			spec.Equal(t, c.level, level.Level, "The level must be returned.")
+		}
+	}
+
+	spec.Equal(t, log.Debug, derived.Level(), "Derived loggers must share the level.")
+}
+
+type fakeAuditRecorder struct {
+	entries []*protocol.AuditEntry
+	full    bool
+}
+
+func (r *fakeAuditRecorder) Reserve(ctx context.Context) error {
+	if r.full {
+		return errors.New("queue is full")
+	}
+	return nil
+}
+
+func (r *fakeAuditRecorder) Record(ctx context.Context, entry *protocol.AuditEntry) {
+	r.entries = append(r.entries, entry)
+}
+
+func TestAuditHandler(t *testing.T) {
+	recorder := &fakeAuditRecorder{}
+	handler := AuditHandler(NewMgmtHttp(fakeRaftNode{}), recorder)
+
+	requests := []struct {
+		method, url, key string
+	}{
+		{"GET", "/backups", ""},
+		{"DELETE", "/cluster/members?id=server1&force=true", "my-key"},
+		{"POST", "/backup", ""},
+		{"POST", "/audit", ""},
+	}
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, r.url, bytes.NewBufferString(`{"node":"server0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "127.0.0.1:52346"
+		if r.key != "" {
+			req.Header.Set("Api-Key", r.key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	spec.True(t, len(recorder.entries) == 2, "Only the requests changing the state must be recorded.")
+
+	removal := recorder.entries[0]
+	spec.Equal(t, "DELETE /cluster/members", removal.Operation, "The operation must be recorded.")
+	spec.Equal(t, "id=server1&force=true", removal.Target, "The target must be recorded.")
+	spec.Equal(t, http.StatusNoContent, removal.Status, "The status must be recorded.")
+	spec.Equal(t, "127.0.0.1:52346", removal.RemoteAddr, "The remote address must be recorded.")
+	spec.Equal(t, "api-key:5e78863ed1ffb9fc", removal.Actor, "The actor must be a fingerprint of the key.")
+
+	backup := recorder.entries[1]
+	spec.Equal(t, "POST /backup", backup.Operation, "The operation must be recorded.")
+	spec.Equal(t, "anonymous", backup.Actor, "The actor must be anonymous without a key.")
+	spec.True(t, backup.Timestamp > 0, "The timestamp must be recorded.")
+
+	// requests are refused instead of dropping their entries
+	recorder.full = true
+	req, err := http.NewRequest("POST", "/backup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	spec.Equal(t, http.StatusServiceUnavailable, rr.Code, "The request must be refused.")
+	spec.True(t, len(recorder.entries) == 2, "No entry must be recorded.")
+}
+
+func TestManageAudit(t *testing.T) {
+	testCases := []struct {
+		method, url, body string
+		expected          int
+		versions          []uint64
+	}{
+		{"GET", "/audit", "", http.StatusOK, []uint64{2, 5, 9}},
+		{"GET", "/audit?from=3", "", http.StatusOK, []uint64{5, 9}},
+		{"GET", "/audit?from=3&limit=1", "", http.StatusOK, []uint64{5}},
+		{"GET", "/audit?from=last", "", http.StatusBadRequest, nil},
+		{"GET", "/audit?limit=0", "", http.StatusBadRequest, nil},
+		{"POST", "/audit", `{"node":"server0","operation":"POST /backup","status":200}`, http.StatusCreated, []uint64{7}},
+		{"POST", "/audit", `{"node":"server1","operation":"POST /backup","status":200}`, http.StatusConflict, nil},
+		{"POST", "/audit", `{"node":`, http.StatusBadRequest, nil},
+		{"DELETE", "/audit", "", http.StatusMethodNotAllowed, nil},
+	}
+
+	for i, c := range testCases {
+		req, err := http.NewRequest(c.method, c.url, bytes.NewBufferString(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.2:41000"
+		req.Header.Set("Api-Key", "my-key")
+
+		rr := httptest.NewRecorder()
+		ManageAudit(fakeRaftNode{}).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v",
+				i, status, c.expected)
+		}
+		if c.versions == nil {
+			continue
+		}
+
+		var records []*protocol.AuditRecord
+		if c.method == "POST" {
+			var record protocol.AuditRecord
+			_ = json.Unmarshal(rr.Body.Bytes(), &record)
+			records = append(records, &record)
+			// forwarded entries are stamped with the forwarder
+			spec.Equal(t, "10.0.0.2:41000", record.Entry.ForwardedFrom, "The forwarding address must be recorded.")
+			spec.Equal(t, "api-key:5e78863ed1ffb9fc", record.Entry.ForwardedBy, "The forwarding actor must be recorded.")
+		} else {
+			_ = json.Unmarshal(rr.Body.Bytes(), &records)
+		}
+		spec.True(t, len(records) == len(c.versions), "Unexpected number of records.")
+		for j, record := range records {
+			spec.Equal(t, c.versions[j], record.Version, "Unexpected record version.")
+			spec.True(t, protocol.IsAuditEvent(record.Event), "The record must carry the event.")
+		}
+	}
+}
+
+func TestProveAuditEntry(t *testing.T) {
+	testCases := []struct {
+		method, url string
+		expected    int
+	}{
+		{"GET", "/audit/proof?version=5", http.StatusOK},
+		{"GET", "/audit/proof?version=6", http.StatusNotFound},
+		{"GET", "/audit/proof?version=last", http.StatusBadRequest},
+		{"GET", "/audit/proof", http.StatusBadRequest},
+		{"POST", "/audit/proof?version=5", http.StatusMethodNotAllowed},
+	}
+
+	for i, c := range testCases {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		ProveAuditEntry(fakeRaftNode{}).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v",
+				i, status, c.expected)
+		}
+		if c.expected == http.StatusOK {
+			var proof protocol.AuditProof
+			_ = json.Unmarshal(rr.Body.Bytes(), &proof)
+			spec.Equal(t, uint64(5), proof.Version, "Unexpected proof version.")
+			spec.Equal(t, uint64(9), proof.CurrentVersion, "Unexpected proof current version.")
+		}
+	}
+}
+
+func TestProveAuditConsistency(t *testing.T) {
+	testCases := []struct {
+		method, url string
+		expected    int
+	}{
+		{"GET", "/audit/incremental?start=2&end=9", http.StatusOK},
+		{"GET", "/audit/incremental?start=2&end=2", http.StatusOK},
+		{"GET", "/audit/incremental?start=2&end=10", http.StatusNotFound},
+		{"GET", "/audit/incremental?start=9&end=2", http.StatusBadRequest},
+		{"GET", "/audit/incremental?start=first&end=9", http.StatusBadRequest},
+		{"GET", "/audit/incremental?start=2", http.StatusBadRequest},
+		{"POST", "/audit/incremental?start=2&end=9", http.StatusMethodNotAllowed},
+	}
+
+	for i, c := range testCases {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		ProveAuditConsistency(fakeRaftNode{}).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("test case %d: handler returned wrong status code: got %v want %v",
+				i, status, c.expected)
+		}
+		if c.expected == http.StatusOK {
+			var proof protocol.AuditIncrementalProof
+			_ = json.Unmarshal(rr.Body.Bytes(), &proof)
+			spec.Equal(t, uint64(2), proof.Start, "Unexpected proof start version.")
+		}
+	}
+}
@@ -21,8 +21,10 @@
 package balloon
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"sync"
 
 	"github.com/bbva/qed/balloon/history"
@@ -30,6 +32,8 @@ import (
 	"github.com/bbva/qed/crypto/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
+	"github.com/bbva/qed/tracing"
 	"github.com/bbva/qed/util"
 )
 
@@ -46,8 +50,23 @@ type Balloon struct {
 
 	historyTree *history.HistoryTree
 	hyperTree   *hyper.HyperTree
+	hyperCache  *hyper.BatchCache
+	checkpoint  *hyper.CacheCheckpointInfo // Cache checkpoint loaded on start, if any.
+	archive     *history.Archive           // Archive of cold history nodes, if any.
 	sync.RWMutex
 	log log.Logger
+
+	// view published to serve membership queries
+	view   *readView
+	viewMu sync.Mutex
+}
+
+// readView is an immutable view of the balloon at a given
+// version shared by concurrent membership queries.
+type readView struct {
+	version uint64
+	hyper   *hyper.ReadView
+	refs    int
 }
 
 func NewBalloon(store storage.Store, hasherF func() hashing.Hasher) (*Balloon, error) {
@@ -56,10 +75,59 @@ func NewBalloon(store storage.Store, hasherF func() hashing.Hasher) (*Balloon, e
 
 // NewBalloon function instanciates a balloon given a storage and a hasher function.
 func NewBalloonWithLogger(store storage.Store, hasherF func() hashing.Hasher, logger log.Logger) (*Balloon, error) {
+	return NewBalloonWithOptions(store, hasherF, DefaultCacheOptions(), logger)
+}
+
+// CacheOptions configure the cache of the upper levels of the hyper tree.
+// The cache levels determine which batches are kept in the store, so they
+// must not change once the balloon has stored any event.
+type CacheOptions struct {
+	Levels     uint8  // Number of batch levels to cache, 0 means the default levels.
+	MaxMemory  uint64 // Maximum size in bytes of the cache, 0 means no limit. A cache of the configured levels must fit in it.
+	Path       string // Memory-mapped file that backs the cache, empty for an in-memory cache.
+	Checkpoint string // Checkpoint file to load the cache from on start, empty to always warm it up from the store.
+}
+
+func DefaultCacheOptions() *CacheOptions {
+	return &CacheOptions{
+		Levels: hyper.DefaultBatchLevels,
+	}
+}
+
+// NewBalloonWithOptions function instanciates a balloon given a storage, a hasher
+// function and the options of the hyper cache.
+func NewBalloonWithOptions(store storage.Store, hasherF func() hashing.Hasher, opts *CacheOptions, logger log.Logger) (*Balloon, error) {
+
+	numBits := hasherF().Len()
+	levels := hyper.BatchLevelsFor(numBits, opts.Levels)
+	if size := hyper.BatchCacheMaxSize(numBits, levels); opts.MaxMemory > 0 && size > opts.MaxMemory {
+		return nil, fmt.Errorf("A hyper cache of %d levels needs up to %d bytes, above the limit of %d bytes", levels, size, opts.MaxMemory)
+	}
+
+	var batchCache *hyper.BatchCache
+	if opts.Path != "" {
+		var err error
+		batchCache, err = hyper.OpenBatchCache(opts.Path, numBits, levels)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		batchCache = hyper.NewBatchCache(numBits, levels)
+	}
+
+	// a checkpoint avoids warming up the cache from the store
+	// unless the memory-mapped file already survived the restart
+	var checkpoint *hyper.CacheCheckpointInfo
+	if _, ok := batchCache.Restored(); !ok && opts.Checkpoint != "" {
+		var err error
+		checkpoint, err = batchCache.LoadCheckpoint(opts.Checkpoint)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Infof("Unable to load hyper cache checkpoint: %v", err)
+		}
+	}
 
 	// create trees
 	historyTree := history.NewHistoryTreeWithLogger(hasherF, store, 300, logger.Named("history"))
-	batchCache := hyper.NewBatchCache(hyper.DefaultBatchLevels)
 	hyperTree := hyper.NewHyperTreeWithLogger(hasherF, store, batchCache, logger.Named("hyper"))
 
 	balloon := &Balloon{
@@ -68,15 +136,30 @@ func NewBalloonWithLogger(store storage.Store, hasherF func() hashing.Hasher, lo
 		store:       store,
 		historyTree: historyTree,
 		hyperTree:   hyperTree,
+		hyperCache:  batchCache,
+		checkpoint:  checkpoint,
 		log:         logger,
 	}
 
 	// update version
 	err := balloon.RefreshVersion()
 	if err != nil {
+		batchCache.Close(0)
 		return nil, err
 	}
 
+	// a restored cache is only valid if it was saved
+	// with the same version found in the store
+	if version, ok := batchCache.Restored(); ok {
+		if version != balloon.version {
+			logger.Infof("Hyper cache restored at version %d but store is at version %d", version, balloon.version)
+			hyperTree.RebuildCache()
+			balloon.checkpoint = nil
+		} else {
+			logger.Infof("Hyper cache restored at version %d", version)
+		}
+	}
+
 	return balloon, nil
 }
 
@@ -181,6 +264,14 @@ func (b *Balloon) Version() uint64 {
 	return b.version
 }
 
+// PublishedVersion returns the version of the view serving the queries.
+// Unlike Version, it is safe to call while events are being added.
+func (b *Balloon) PublishedVersion() uint64 {
+	view := b.acquireView()
+	defer b.releaseView(view)
+	return view.version
+}
+
 // RefreshVersion function gets the last stored version from the history-tree table
 // and updates balloon's version.
 func (b *Balloon) RefreshVersion() error {
@@ -196,6 +287,173 @@ func (b *Balloon) RefreshVersion() error {
 	return nil
 }
 
+// RebuildCache function rebuilds the hyper tree cache from the store.
+// It must be called when the contents of the store are replaced.
+func (b *Balloon) RebuildCache() {
+	// the published view would keep a copy of the whole cache
+	b.dropView()
+
+	b.Lock()
+	defer b.Unlock()
+	b.hyperTree.RebuildCache()
+	b.checkpoint = nil
+}
+
+// PublishView takes a view of the balloon at its current version to serve
+// the membership queries from then on, so they do not block insertions nor
+// are blocked by them. It must be called once the mutations of the last
+// insertion have been applied to the store. Until a view is published,
+// every query takes its own view of the current state.
+func (b *Balloon) PublishView() {
+	b.viewMu.Lock()
+	view := b.newView()
+	previous := b.view
+	b.view = view
+	b.viewMu.Unlock()
+
+	if previous != nil {
+		b.releaseView(previous)
+	}
+}
+
+// dropView stops serving queries from the published view, if any.
+func (b *Balloon) dropView() {
+	b.viewMu.Lock()
+	previous := b.view
+	b.view = nil
+	b.viewMu.Unlock()
+
+	if previous != nil {
+		b.releaseView(previous)
+	}
+}
+
+func (b *Balloon) acquireView() *readView {
+	b.viewMu.Lock()
+	defer b.viewMu.Unlock()
+	if b.view != nil {
+		b.view.refs++
+		return b.view
+	}
+	return b.newView()
+}
+
+func (b *Balloon) releaseView(view *readView) {
+	b.viewMu.Lock()
+	view.refs--
+	unused := view.refs == 0
+	b.viewMu.Unlock()
+
+	if unused {
+		view.hyper.Release()
+	}
+}
+
+// newView must be called holding the view lock, since some
+// stores do not support taking snapshots concurrently.
+func (b *Balloon) newView() *readView {
+	b.RLock()
+	defer b.RUnlock()
+	return &readView{
+		version: b.version,
+		hyper:   b.hyperTree.NewReadView(),
+		refs:    1,
+	}
+}
+
+// KeepHyperHistory makes the balloon keep every version of the hyper tree,
+// so membership can be proven against the hyper digest of any snapshot
+// from the current version on. The current contents of the hyper tree are
+// stored in its history the first time, so it must be called before adding
+// any event, and again whenever the contents of the store are replaced.
+func (b *Balloon) KeepHyperHistory() error {
+	b.Lock()
+	defer b.Unlock()
+
+	// the contents of the tree correspond to the last version
+	version := b.version
+	if version > 0 {
+		version--
+	}
+	mutations, err := b.hyperTree.KeepHistory(version)
+	if err != nil {
+		return err
+	}
+	if len(mutations) == 0 {
+		return nil
+	}
+	return b.store.Mutate(mutations, nil)
+}
+
+// SetHistoryArchive moves the frozen subtrees of the history tree to
+// segments in the given backend when calling ArchiveHistory, and reads
+// them back to build proofs for old versions.
+func (b *Balloon) SetHistoryArchive(backend archive.Backend, segmentHeight uint16) {
+	b.Lock()
+	defer b.Unlock()
+	b.archive = history.NewArchive(b.hasherF, b.store, backend, segmentHeight, b.log.Named("archive"))
+	b.historyTree.SetArchive(b.archive)
+}
+
+// ArchiveHistory moves to the archive the history nodes of the events
+// with a version lower than the given one, and returns the number of
+// segments archived.
+func (b *Balloon) ArchiveHistory(before uint64) (int, error) {
+	b.RLock()
+	a := b.archive
+	if before > b.version {
+		before = b.version
+	}
+	b.RUnlock()
+
+	if a == nil {
+		return 0, fmt.Errorf("No history archive configured")
+	}
+	return a.ArchiveUpTo(before)
+}
+
+// CacheCheckpoint returns the description of the checkpoint the hyper
+// cache was loaded from on start, or nil if the cache was warmed up
+// from the store.
+func (b *Balloon) CacheCheckpoint() *hyper.CacheCheckpointInfo {
+	b.RLock()
+	defer b.RUnlock()
+	return b.checkpoint
+}
+
+// SaveCacheCheckpoint writes a checkpoint of the hyper cache in the given
+// path, tagged with the current version and the given Raft index.
+func (b *Balloon) SaveCacheCheckpoint(path string, index uint64) error {
+	b.RLock()
+	defer b.RUnlock()
+	return b.hyperCache.WriteCheckpoint(path, b.version, index)
+}
+
+// VerifyCacheCheckpoint checks that a hyper cache checkpoint matches the
+// contents of the store. The cache is warmed up from the store and compared
+// with the one loaded from the checkpoint, which must also be tagged with
+// the version of the store.
+func VerifyCacheCheckpoint(store storage.Store, hasherF func() hashing.Hasher, opts *CacheOptions, path string) (*hyper.CacheCheckpointInfo, error) {
+	b, err := NewBalloonWithOptions(store, hasherF, &CacheOptions{Levels: opts.Levels, MaxMemory: opts.MaxMemory}, log.L())
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	cache := hyper.NewBatchCache(hasherF().Len(), b.hyperCache.Levels())
+	info, err := cache.LoadCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Version != b.version {
+		return info, fmt.Errorf("Checkpoint at version %d but store is at version %d", info.Version, b.version)
+	}
+	if !cache.Equal(b.hyperCache) {
+		return info, fmt.Errorf("Checkpoint contents do not match the store")
+	}
+	return info, nil
+}
+
 // Add funcion inserts an event hash into the history and hyper trees, creates a snapshot
 // with these insertions results, and returns the snapshot along with certain mutations to
 // do to the persistent storage.
@@ -246,11 +504,22 @@ func (b *Balloon) Add(eventDigest hashing.Digest) (*Snapshot, []*storage.Mutatio
 // array of snapshots with these insertions results, and returns the array of snapshots along
 // with certain mutations to do to the persistent storage.
 func (b *Balloon) AddBulk(eventBulkDigest []hashing.Digest) ([]*Snapshot, []*storage.Mutation, error) {
+	return b.AddBulkWithContext(context.Background(), eventBulkDigest)
+}
+
+// AddBulkWithContext works like AddBulk, tracing the insertion into each tree
+// as a child of the span carried by the context.
+func (b *Balloon) AddBulkWithContext(ctx context.Context, eventBulkDigest []hashing.Digest) ([]*Snapshot, []*storage.Mutation, error) {
+	ctx, span := tracing.StartSpan(ctx, "balloon.add_bulk")
+	defer span.End()
+
 	b.Lock()
 	defer b.Unlock()
 	// Get version
 	initialVersion := b.version
 	b.version += uint64(len(eventBulkDigest))
+	span.SetAttribute("balloon.events", len(eventBulkDigest))
+	span.SetAttribute("balloon.version", initialVersion)
 
 	// Update trees
 	var historyDigests []hashing.Digest
@@ -260,18 +529,28 @@ func (b *Balloon) AddBulk(eventBulkDigest []hashing.Digest) ([]*Snapshot, []*sto
 	wg.Add(1)
 
 	go func() {
+		_, historySpan := tracing.StartSpan(ctx, "history.add_bulk")
 		historyDigests, historyMutations, historyErr = b.historyTree.AddBulk(eventBulkDigest, initialVersion)
+		historySpan.SetAttribute("tree.mutations", len(historyMutations))
+		historySpan.SetError(historyErr)
+		historySpan.End()
 		wg.Done()
 	}()
 
+	_, hyperSpan := tracing.StartSpan(ctx, "hyper.add_bulk")
 	hyperDigest, mutations, hyperErr := b.hyperTree.AddBulk(eventBulkDigest, initialVersion)
+	hyperSpan.SetAttribute("tree.mutations", len(mutations))
+	hyperSpan.SetError(hyperErr)
+	hyperSpan.End()
 
 	wg.Wait()
 
 	if historyErr != nil {
+		span.SetError(historyErr)
 		return nil, nil, historyErr
 	}
 	if hyperErr != nil {
+		span.SetError(hyperErr)
 		return nil, nil, hyperErr
 	}
 
@@ -295,28 +574,76 @@ func (b *Balloon) AddBulk(eventBulkDigest []hashing.Digest) ([]*Snapshot, []*sto
 // against a certain balloon version.
 // It asks the hyper tree for this proof and returns the proof if there is no error.
 func (b *Balloon) QueryDigestMembershipConsistency(keyDigest hashing.Digest, version uint64) (*MembershipProof, error) {
-	b.RLock()
-	defer b.RUnlock()
+	view := b.acquireView()
+	defer b.releaseView(view)
 	var proof MembershipProof
 	var err error
 	proof.Hasher = b.hasherF()
 	proof.KeyDigest = keyDigest
 	proof.QueryVersion = version
-	proof.CurrentVersion = b.version - 1
+	proof.CurrentVersion = view.version - 1
 
 	if version > proof.CurrentVersion {
 		version = proof.CurrentVersion
 	}
 
-	proof.HyperProof, err = b.hyperTree.QueryMembership(keyDigest)
+	proof.HyperProof, err = view.hyper.QueryMembership(keyDigest)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get proof from hyper tree: %v", err)
 	}
 
+	if err := b.proveVersion(&proof, version); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+// QueryDigestMembershipAt function is used when an event digest is given to ask for a membership
+// proof against a certain balloon version, where the hyper proof is built against the hyper tree
+// at that version instead of the current one. So the whole proof can be verified with the
+// snapshot of that version. It requires the balloon to keep the hyper tree history
+// of the version, otherwise it fails with hyper.ErrHistoryNotKept.
+func (b *Balloon) QueryDigestMembershipAt(keyDigest hashing.Digest, version uint64) (*MembershipProof, error) {
+	view := b.acquireView()
+	defer b.releaseView(view)
+	if view.version == 0 {
+		return nil, errors.New("unable to get proof from hyper tree: empty balloon")
+	}
+	var proof MembershipProof
+	var err error
+	proof.Hasher = b.hasherF()
+	proof.KeyDigest = keyDigest
+	proof.CurrentVersion = view.version - 1
+
+	if version > proof.CurrentVersion {
+		version = proof.CurrentVersion
+	}
+	proof.QueryVersion = version
+
+	proof.HyperProof, err = b.hyperTree.QueryMembershipAt(keyDigest, version)
+	if err == hyper.ErrHistoryNotKept {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get proof from hyper tree: %v", err)
+	}
+
+	if err := b.proveVersion(&proof, version); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+// proveVersion completes a membership proof with the version found in its
+// hyper proof and, if the event exists, the history proof of that version
+// against the given one.
+func (b *Balloon) proveVersion(proof *MembershipProof, version uint64) error {
+	var err error
+
 	if len(proof.HyperProof.Value) == 0 {
 		proof.Exists = false
 		proof.ActualVersion = version
-		return &proof, nil
+		return nil
 	}
 
 	proof.Exists = true
@@ -332,13 +659,13 @@ func (b *Balloon) QueryDigestMembershipConsistency(keyDigest hashing.Digest, ver
 	if proof.ActualVersion <= version {
 		proof.HistoryProof, err = b.historyTree.ProveMembership(proof.ActualVersion, version)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get proof from history tree: %v", err)
+			return fmt.Errorf("unable to get proof from history tree: %v", err)
 		}
 	} else {
-		return nil, fmt.Errorf("actual version %d is greater than the query version which is %d", proof.ActualVersion, version)
+		return fmt.Errorf("actual version %d is greater than the query version which is %d", proof.ActualVersion, version)
 	}
 
-	return &proof, nil
+	return nil
 }
 
 // QueryMembership function is used when an event is given to ask for a membership proof against a
@@ -350,20 +677,28 @@ func (b *Balloon) QueryMembershipConsistency(event []byte, version uint64) (*Mem
 	return b.QueryDigestMembershipConsistency(hasher.Do(event), version)
 }
 
+// QueryMembershipAt function is used when an event is given to ask for a membership proof against
+// a certain balloon version and the hyper tree at that version. It just hashes the event and ask
+// QueryDigestMembershipAt.
+func (b *Balloon) QueryMembershipAt(event []byte, version uint64) (*MembershipProof, error) {
+	hasher := b.hasherF()
+	return b.QueryDigestMembershipAt(hasher.Do(event), version)
+}
+
 // QueryDigestMembership function is used when an event digest is given to ask for a membership proof
 // against the latest balloon version.
 // It asks the hyper tree for this proof and returns the proof if there is no error.
 func (b *Balloon) QueryDigestMembership(keyDigest hashing.Digest) (*MembershipProof, error) {
-	b.RLock()
-	defer b.RUnlock()
+	view := b.acquireView()
+	defer b.releaseView(view)
 	var proof MembershipProof
 	var err error
 	proof.Hasher = b.hasherF()
 	proof.KeyDigest = keyDigest
-	proof.QueryVersion = b.version - 1
+	proof.QueryVersion = view.version - 1
 	proof.CurrentVersion = proof.QueryVersion
 
-	proof.HyperProof, err = b.hyperTree.QueryMembership(keyDigest)
+	proof.HyperProof, err = view.hyper.QueryMembership(keyDigest)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get proof from hyper tree: %v", err)
 	}
@@ -431,11 +766,17 @@ func (b *Balloon) QueryConsistency(start, end uint64) (*IncrementalProof, error)
 
 // Close function closes both history and hyper trees, and restarts balloon version.
 func (b *Balloon) Close() {
+	b.dropView()
+
 	b.Lock()
 	defer b.Unlock()
 	b.historyTree.Close()
 	b.hyperTree.Close()
+	if err := b.hyperCache.Close(b.version); err != nil {
+		b.log.Infof("Unable to close hyper cache: %v", err)
+	}
 	b.historyTree = nil
+	b.hyperCache = nil
 	b.hyperTree = nil
 	b.version = 0
 }
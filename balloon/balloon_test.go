@@ -19,13 +19,20 @@ package balloon
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/bbva/qed/balloon/hyper"
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
 	metrics_utils "github.com/bbva/qed/testutils/metrics"
 	"github.com/bbva/qed/testutils/rand"
 	storage_utils "github.com/bbva/qed/testutils/storage"
@@ -288,6 +295,337 @@ func TestCacheWarmingUp(t *testing.T) {
 	}
 }
 
+func TestCacheMaxMemory(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	size := hyper.BatchCacheMaxSize(hashing.NewSha256Hasher().Len(), 4)
+
+	balloon, err := NewBalloonWithOptions(store, hashing.NewSha256Hasher, &CacheOptions{Levels: 4, MaxMemory: size}, log.L())
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), balloon.hyperCache.Levels(), "The memory limit must not change the levels")
+	balloon.Close()
+
+	_, err = NewBalloonWithOptions(store, hashing.NewSha256Hasher, &CacheOptions{Levels: 4, MaxMemory: size - 1}, log.L())
+	require.Error(t, err, "A cache that does not fit in the memory limit must be rejected")
+}
+
+func TestCacheRestore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-balloon-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	opts := &CacheOptions{Levels: 4, Path: filepath.Join(dir, "hyper.cache")}
+	balloon, err := NewBalloonWithOptions(store, hashing.NewSha256Hasher, opts, log.L())
+	require.NoError(t, err)
+
+	hasher := hashing.NewSha256Hasher()
+	add := func(b *Balloon, from, to uint64) *Snapshot {
+		var snapshot *Snapshot
+		for i := from; i < to; i++ {
+			var mutations []*storage.Mutation
+			snapshot, mutations, err = b.Add(hasher.Do(util.Uint64AsBytes(i)))
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations, nil))
+		}
+		return snapshot
+	}
+	verify := func(b *Balloon, snapshot *Snapshot) {
+		for i := uint64(0); i <= snapshot.Version; i++ {
+			digest := hasher.Do(util.Uint64AsBytes(i))
+			proof, err := b.QueryDigestMembershipConsistency(digest, snapshot.Version)
+			require.NoError(t, err)
+			require.Truef(t, proof.DigestVerify(digest, snapshot), "The proof should verify correctly for element %d", i)
+		}
+	}
+
+	snapshot := add(balloon, 0, 50)
+	balloon.Close()
+
+	// the cache is restored at the same version
+	balloon, err = NewBalloonWithOptions(store, hashing.NewSha256Hasher, opts, log.L())
+	require.NoError(t, err)
+	version, ok := balloon.hyperCache.Restored()
+	require.True(t, ok)
+	require.Equal(t, uint64(50), version)
+	verify(balloon, snapshot)
+	balloon.Close()
+
+	// the store moves forward without the cache
+	other, err := NewBalloonWithOptions(store, hashing.NewSha256Hasher, &CacheOptions{Levels: 4}, log.L())
+	require.NoError(t, err)
+	snapshot = add(other, 50, 60)
+	other.Close()
+
+	// so the stale cache must be rebuilt
+	balloon, err = NewBalloonWithOptions(store, hashing.NewSha256Hasher, opts, log.L())
+	require.NoError(t, err)
+	verify(balloon, snapshot)
+	balloon.Close()
+}
+
+func TestCacheCheckpoint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-balloon-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hyper.checkpoint")
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	opts := &CacheOptions{Levels: 4, Checkpoint: path}
+	balloon, err := NewBalloonWithOptions(store, hashing.NewSha256Hasher, opts, log.L())
+	require.NoError(t, err)
+	require.Nil(t, balloon.CacheCheckpoint(), "There should be no checkpoint on a new balloon")
+
+	hasher := hashing.NewSha256Hasher()
+	var snapshot *Snapshot
+	for i := uint64(0); i < 50; i++ {
+		var mutations []*storage.Mutation
+		snapshot, mutations, err = balloon.Add(hasher.Do(util.Uint64AsBytes(i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+	}
+	require.NoError(t, balloon.SaveCacheCheckpoint(path, 7))
+	balloon.Close()
+
+	info, err := VerifyCacheCheckpoint(store, hashing.NewSha256Hasher, opts, path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), info.Version)
+	require.Equal(t, uint64(7), info.Index)
+
+	// the cache is loaded from the checkpoint
+	balloon, err = NewBalloonWithOptions(store, hashing.NewSha256Hasher, opts, log.L())
+	require.NoError(t, err)
+	require.NotNil(t, balloon.CacheCheckpoint())
+	require.Equal(t, uint64(7), balloon.CacheCheckpoint().Index)
+	for i := uint64(0); i < 50; i++ {
+		digest := hasher.Do(util.Uint64AsBytes(i))
+		proof, err := balloon.QueryDigestMembershipConsistency(digest, snapshot.Version)
+		require.NoError(t, err)
+		require.Truef(t, proof.DigestVerify(digest, snapshot), "The proof should verify correctly for element %d", i)
+	}
+
+	// the store moves forward without the checkpoint
+	_, mutations, err := balloon.Add(hasher.Do(util.Uint64AsBytes(50)))
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations, nil))
+	balloon.Close()
+
+	_, err = VerifyCacheCheckpoint(store, hashing.NewSha256Hasher, opts, path)
+	require.Error(t, err, "A stale checkpoint should not verify")
+
+	balloon, err = NewBalloonWithOptions(store, hashing.NewSha256Hasher, opts, log.L())
+	require.NoError(t, err)
+	require.Nil(t, balloon.CacheCheckpoint(), "A stale checkpoint should be discarded")
+	balloon.Close()
+}
+
+func TestPublishView(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	defer balloon.Close()
+
+	hasher := hashing.NewSha256Hasher()
+	add := func(from, to uint64) *Snapshot {
+		var snapshot *Snapshot
+		for i := from; i < to; i++ {
+			var mutations []*storage.Mutation
+			snapshot, mutations, err = balloon.Add(hasher.Do(util.Uint64AsBytes(i)))
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations, nil))
+		}
+		return snapshot
+	}
+
+	published := add(0, 20)
+	balloon.PublishView()
+	last := add(20, 30)
+
+	// queries are served from the published view
+	for i := uint64(0); i < 30; i++ {
+		digest := hasher.Do(util.Uint64AsBytes(i))
+		proof, err := balloon.QueryDigestMembership(digest)
+		require.NoError(t, err)
+		require.Equal(t, published.Version, proof.CurrentVersion)
+		require.Equalf(t, i < 20, proof.Exists, "Wrong existence of element %d", i)
+		if proof.Exists {
+			require.Truef(t, proof.DigestVerify(digest, published), "The proof should verify correctly for element %d", i)
+		}
+	}
+
+	balloon.PublishView()
+	for i := uint64(0); i < 30; i++ {
+		digest := hasher.Do(util.Uint64AsBytes(i))
+		proof, err := balloon.QueryDigestMembershipConsistency(digest, last.Version)
+		require.NoError(t, err)
+		require.Equal(t, last.Version, proof.CurrentVersion)
+		require.Truef(t, proof.DigestVerify(digest, last), "The proof should verify correctly for element %d", i)
+	}
+}
+
+func TestQueryMembershipAt(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	hasher := hashing.NewSha256Hasher()
+	add := func(from, to uint64) []*Snapshot {
+		snapshots := make([]*Snapshot, 0)
+		for i := from; i < to; i++ {
+			snapshot, mutations, err := balloon.Add(hasher.Do(util.Uint64AsBytes(i)))
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations, nil))
+			snapshots = append(snapshots, snapshot)
+		}
+		return snapshots
+	}
+
+	// the history is kept from the last version on
+	add(0, 10)
+	_, err = balloon.QueryDigestMembershipAt(hasher.Do(util.Uint64AsBytes(0)), 9)
+	require.Error(t, err, "The hyper tree history should not be available yet")
+	require.NoError(t, balloon.KeepHyperHistory())
+	snapshots := add(10, 30)
+
+	for _, snapshot := range snapshots {
+		for i := uint64(0); i <= snapshot.Version; i++ {
+			digest := hasher.Do(util.Uint64AsBytes(i))
+			proof, err := balloon.QueryDigestMembershipAt(digest, snapshot.Version)
+			require.NoError(t, err)
+			require.True(t, proof.Exists)
+			require.Equal(t, snapshot.Version, proof.QueryVersion)
+			require.Truef(t, proof.DigestVerify(digest, snapshot), "The proof of element %d should verify with snapshot %d", i, snapshot.Version)
+		}
+	}
+
+	_, err = balloon.QueryDigestMembershipAt(hasher.Do(util.Uint64AsBytes(0)), 8)
+	require.Error(t, err, "Versions before the history was kept should not be available")
+}
+
+func TestArchiveHistory(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	dir, err := ioutil.TempDir("", "qed-balloon-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backend, err := archive.NewLocalBackend(dir)
+	require.NoError(t, err)
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	_, err = balloon.ArchiveHistory(10)
+	require.Error(t, err, "The archive should be configured first")
+	balloon.SetHistoryArchive(backend, 2)
+
+	hasher := hashing.NewSha256Hasher()
+	snapshots := make([]*Snapshot, 0)
+	for i := uint64(0); i < 20; i++ {
+		snapshot, mutations, err := balloon.Add(hasher.Do(util.Uint64AsBytes(i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+		snapshots = append(snapshots, snapshot)
+	}
+
+	// the versions to archive are bounded by the current one
+	archived, err := balloon.ArchiveHistory(100)
+	require.NoError(t, err)
+	require.Equal(t, 5, archived)
+
+	for _, snapshot := range snapshots[len(snapshots)-3:] {
+		for i := uint64(0); i <= snapshot.Version; i++ {
+			digest := hasher.Do(util.Uint64AsBytes(i))
+			proof, err := balloon.QueryDigestMembershipConsistency(digest, snapshot.Version)
+			require.NoError(t, err)
+			require.Truef(t, proof.HistoryProof.Verify(digest, snapshot.HistoryDigest), "The proof of element %d should verify with snapshot %d", i, snapshot.Version)
+		}
+	}
+
+	proof, err := balloon.QueryConsistency(0, 19)
+	require.NoError(t, err)
+	require.True(t, proof.Verify(snapshots[0], snapshots[19]))
+}
+
+func TestCheck(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	balloon, err := NewBalloon(store, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	report, err := balloon.Check(&CheckOptions{Hyper: true})
+	require.NoError(t, err)
+	require.True(t, report.Ok(), "An empty balloon should be consistent")
+
+	hasher := hashing.NewSha256Hasher()
+	snapshots := make(map[uint64]*Snapshot)
+	for i := uint64(0); i < 50; i++ {
+		snapshot, mutations, err := balloon.Add(hasher.Do(util.Uint64AsBytes(i)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+		snapshots[i] = snapshot
+	}
+	balloon.PublishView()
+
+	opts := &CheckOptions{
+		Start: 0,
+		End:   100,
+		Hyper: true,
+		Snapshots: func(version uint64) (*Snapshot, error) {
+			return snapshots[version], nil
+		},
+	}
+	report, err = balloon.Check(opts)
+	require.NoError(t, err)
+	require.Empty(t, report.Corruptions)
+	require.Equal(t, uint64(49), report.End)
+	require.Equal(t, uint64(50), report.HyperLeaves)
+	require.Equal(t, uint64(50), report.Snapshots)
+	require.Equal(t, snapshots[49].HistoryDigest, report.HistoryDigest)
+	require.Equal(t, snapshots[49].HyperDigest, report.HyperDigest)
+
+	// a gossiped snapshot that does not match
+	snapshots[10] = &Snapshot{HistoryDigest: hasher.Do([]byte("wrong")), Version: 10}
+	report, err = balloon.Check(opts)
+	require.NoError(t, err)
+	require.Equal(t, []Corruption{{Tree: "history", Version: 10, Reason: report.Corruptions[0].Reason}}, report.Corruptions)
+
+	// a history leaf that does not match the event of the hyper tree
+	snapshots[10] = nil
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HistoryTable, []byte{0, 0, 0, 0, 0, 0, 0, 30, 0, 0}, hasher.Do([]byte("wrong"))),
+	}, nil))
+	report, err = balloon.Check(opts)
+	require.NoError(t, err)
+	require.False(t, report.Ok())
+	reasons := make(map[string]bool)
+	for _, c := range report.Corruptions {
+		reasons[c.Tree+" "+c.Reason] = true
+	}
+	require.True(t, reasons["history Hash does not match its children"])
+	require.True(t, reasons["hyper Leaf does not match the history leaf of version 30"])
+
+	_, err = balloon.Check(&CheckOptions{Start: 60, End: 70})
+	require.Error(t, err, "Versions beyond the last one should not be checked")
+}
+
 func TestGenIncrementalAndVerify(t *testing.T) {
 
 	store, closeF := storage_utils.OpenRocksDBStore(t, "/var/tmp/balloon.test.3")
@@ -22,8 +22,9 @@ import (
 
 // PassThroughCache is not a cache itself. It stores data directly on disk.
 type PassThroughCache struct {
-	table storage.Table
-	store storage.Store
+	table    storage.Table
+	store    storage.Store
+	fallback Cache
 }
 
 // NewPassThroughCache initializes a cache with the given underlaying storage.
@@ -34,11 +35,24 @@ func NewPassThroughCache(table storage.Table, store storage.Store) *PassThroughC
 	}
 }
 
+// NewPassThroughCacheWithFallback initializes a cache with the given underlaying
+// storage that looks for the keys missing from the storage in the fallback cache.
+func NewPassThroughCacheWithFallback(table storage.Table, store storage.Store, fallback Cache) *PassThroughCache {
+	return &PassThroughCache{
+		table:    table,
+		store:    store,
+		fallback: fallback,
+	}
+}
+
 // Get function returns the value of a given key by looking for it on storage.
 // It also returns a boolean showing if the key is or is not present.
 func (c PassThroughCache) Get(key []byte) ([]byte, bool) {
 	pair, err := c.store.Get(c.table, key)
 	if err != nil {
+		if c.fallback != nil {
+			return c.fallback.Get(key)
+		}
 		return nil, false
 	}
 	return pair.Value, true
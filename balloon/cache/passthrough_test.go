@@ -61,3 +61,30 @@ func TestPassThroughCache(t *testing.T) {
 	}
 
 }
+
+func TestPassThroughCacheWithFallback(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	table := storage.HistoryTable
+
+	fallback := NewSimpleCache(1)
+	fallback.Put([]byte{0x1, 0x0}, []byte{0x2})
+	cache := NewPassThroughCacheWithFallback(table, store, fallback)
+
+	err := store.Mutate([]*storage.Mutation{
+		{Table: table, Key: []byte{0x0, 0x0}, Value: []byte{0x1}},
+	}, nil)
+	require.NoError(t, err)
+
+	value, ok := cache.Get([]byte{0x0, 0x0})
+	require.True(t, ok, "The key should be found in storage")
+	require.Equal(t, []byte{0x1}, value)
+
+	value, ok = cache.Get([]byte{0x1, 0x0})
+	require.True(t, ok, "The key should be found in the fallback cache")
+	require.Equal(t, []byte{0x2}, value)
+
+	_, ok = cache.Get([]byte{0x2, 0x0})
+	require.False(t, ok, "The key should not be found")
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package balloon
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/util"
+)
+
+// Corruption is an inconsistency found in the stored trees.
+type Corruption struct {
+	Tree     string // history or hyper
+	Position string // Position of the node, empty for roots.
+	Version  uint64 // Version of the snapshot for roots.
+	Reason   string
+}
+
+func (c Corruption) String() string {
+	if c.Position == "" {
+		return fmt.Sprintf("%s root at version %d: %s", c.Tree, c.Version, c.Reason)
+	}
+	return fmt.Sprintf("%s node %s: %s", c.Tree, c.Position, c.Reason)
+}
+
+// CheckOptions select the parts of the balloon to check.
+type CheckOptions struct {
+	// Range of versions whose history nodes and roots are checked,
+	// bounded by the last version of the balloon.
+	Start, End uint64
+
+	// Walk the whole hyper tree, and check that its leaves
+	// match the ones of the history tree.
+	Hyper bool
+
+	// Returns the snapshot of a version to compare the roots with,
+	// or nil if it is not available.
+	Snapshots func(version uint64) (*Snapshot, error)
+}
+
+// CheckReport is the result of a consistency check.
+type CheckReport struct {
+	Version       uint64 // Last version of the balloon when checked.
+	Start, End    uint64 // Range of versions checked.
+	HistoryDigest hashing.Digest
+	HyperDigest   hashing.Digest
+	HyperLeaves   uint64
+	Snapshots     uint64 // Number of snapshots compared.
+	Corruptions   []Corruption
+}
+
+// Ok returns true if no corruption was found.
+func (r CheckReport) Ok() bool {
+	return len(r.Corruptions) == 0
+}
+
+// Check recomputes the roots of the trees from the stored nodes and
+// reports the position of every node inconsistent with its children,
+// as well as the roots that do not match the given snapshots. The trees
+// are not locked, so it can run while events are added.
+func (b *Balloon) Check(opts *CheckOptions) (*CheckReport, error) {
+	view := b.acquireView()
+	defer b.releaseView(view)
+
+	if view.version == 0 {
+		return &CheckReport{}, nil
+	}
+	last := view.version - 1
+
+	report := &CheckReport{
+		Version: last,
+		Start:   opts.Start,
+		End:     opts.End,
+	}
+	if report.End > last {
+		report.End = last
+	}
+	if report.Start > report.End {
+		return nil, fmt.Errorf("Invalid range of versions [%d, %d], last version is %d", opts.Start, opts.End, last)
+	}
+
+	corrupted := func(tree string) func(pos, reason string) {
+		return func(pos, reason string) {
+			report.Corruptions = append(report.Corruptions, Corruption{Tree: tree, Position: pos, Reason: reason})
+		}
+	}
+
+	// the snapshot of the last version is compared with both trees
+	var lastSnapshot *Snapshot
+	snapshot := func(version uint64) (*Snapshot, error) {
+		if opts.Snapshots == nil {
+			return nil, nil
+		}
+		if version == last && lastSnapshot != nil {
+			return lastSnapshot, nil
+		}
+		s, err := opts.Snapshots(version)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get snapshot %d: %v", version, err)
+		}
+		if s != nil {
+			report.Snapshots++
+		}
+		if version == last {
+			lastSnapshot = s
+		}
+		return s, nil
+	}
+
+	// history nodes and roots
+	b.historyTree.Check(report.Start, report.End, corrupted("history"))
+	for version := report.Start; ; version++ {
+		root, err := b.historyTree.RootHash(version)
+		if err != nil {
+			report.Corruptions = append(report.Corruptions, Corruption{Tree: "history", Version: version, Reason: err.Error()})
+		} else {
+			s, err := snapshot(version)
+			if err != nil {
+				return nil, err
+			}
+			if s != nil && !bytes.Equal(root, s.HistoryDigest) {
+				report.Corruptions = append(report.Corruptions, Corruption{Tree: "history", Version: version, Reason: fmt.Sprintf("Root %x does not match snapshot root %x", root, s.HistoryDigest)})
+			}
+		}
+		if version == report.End {
+			report.HistoryDigest = root
+			break
+		}
+	}
+
+	if !opts.Hyper {
+		return report, nil
+	}
+
+	// hyper nodes and leaves, whose values are the versions of the events
+	report.HyperDigest = view.hyper.Check(corrupted("hyper"), func(key, value []byte) {
+		report.HyperLeaves++
+		version := util.BytesAsUint64(value[len(value)-8:])
+		switch {
+		case version > last:
+			report.Corruptions = append(report.Corruptions, Corruption{Tree: "hyper", Position: fmt.Sprintf("%#x", key), Reason: fmt.Sprintf("Leaf with future version %d", version)})
+		case !b.historyTree.CheckLeaf(key, version):
+			report.Corruptions = append(report.Corruptions, Corruption{Tree: "hyper", Position: fmt.Sprintf("%#x", key), Reason: fmt.Sprintf("Leaf does not match the history leaf of version %d", version)})
+		}
+	})
+	s, err := snapshot(last)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil && !bytes.Equal(report.HyperDigest, s.HyperDigest) {
+		report.Corruptions = append(report.Corruptions, Corruption{Tree: "hyper", Version: last, Reason: fmt.Sprintf("Root %x does not match snapshot root %x", report.HyperDigest, s.HyperDigest)})
+	}
+
+	return report, nil
+}
+
+// WalkEvents calls f with the digest and the version of every event of
+// the hyper tree, in no particular order, and returns the root of the
+// tree. Events added more than once are only visited with their last
+// version. The nodes of the tree are checked along the way.
+func (b *Balloon) WalkEvents(f func(eventDigest hashing.Digest, version uint64)) (hashing.Digest, error) {
+	view := b.acquireView()
+	defer b.releaseView(view)
+
+	var corruption error
+	root := view.hyper.Check(func(pos, reason string) {
+		if corruption == nil {
+			corruption = fmt.Errorf("Corrupted hyper tree at %s: %s", pos, reason)
+		}
+	}, func(key, value []byte) {
+		f(key, util.BytesAsUint64(value[len(value)-8:]))
+	})
+	return root, corruption
+}
+
+// CheckEvent reports whether the event of the given version
+// is the one of the given digest.
+func (b *Balloon) CheckEvent(eventDigest hashing.Digest, version uint64) bool {
+	return b.historyTree.CheckLeaf(eventDigest, version)
+}
+
+// FindEvent returns the event digest of the given version among the
+// given candidates.
+func (b *Balloon) FindEvent(version uint64, candidates []hashing.Digest) (hashing.Digest, bool) {
+	return b.historyTree.FindLeaf(version, candidates)
+}
+
+// HistoryRoot returns the root of the history tree at the given version.
+func (b *Balloon) HistoryRoot(version uint64) (hashing.Digest, error) {
+	if last := b.PublishedVersion(); version >= last {
+		return nil, fmt.Errorf("Version %d not found, the balloon has %d events", version, last)
+	}
+	return b.historyTree.RootHash(version)
+}
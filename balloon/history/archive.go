@@ -0,0 +1,334 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
+	"github.com/bbva/qed/util"
+)
+
+// DefaultSegmentHeight is the height of the subtrees moved to every
+// archive segment, which hold the hashes of 2^16 events.
+const DefaultSegmentHeight uint16 = 16
+
+// A segment file has a header followed by the hashes of every node of
+// a frozen subtree, ordered by height and then by index, so positions
+// are implied by the offsets.
+const (
+	segmentMagic      string = "QEDHSEG1"
+	segmentHeaderSize int    = 8 + 2 + 8 + 2
+	maxLoadedSegments int    = 4
+)
+
+// Archive moves the nodes of frozen subtrees of the history tree to
+// immutable segments kept in an archive backend, and reads them back
+// when they are no longer in the store. Only the root of every archived
+// subtree is kept in the store, and it is used to verify the segments
+// when they are loaded.
+type Archive struct {
+	hasherF func() hashing.Hasher
+	store   storage.Store
+	backend archive.Backend
+	height  uint16
+
+	// serializes the archiving of segments
+	archiveMu sync.Mutex
+
+	// the last segments loaded, most recent first
+	loaded []*segment
+	sync.Mutex
+
+	log log.Logger
+}
+
+type segment struct {
+	index    uint64 // Position of the segment among the subtrees of its height.
+	height   uint16
+	hashSize int
+	hashes   []byte
+}
+
+func NewArchive(hasherF func() hashing.Hasher, store storage.Store, backend archive.Backend, height uint16, logger log.Logger) *Archive {
+	if height == 0 {
+		height = DefaultSegmentHeight
+	}
+	return &Archive{
+		hasherF: hasherF,
+		store:   store,
+		backend: backend,
+		height:  height,
+		loaded:  make([]*segment, 0, maxLoadedSegments),
+		log:     logger,
+	}
+}
+
+func segmentName(height uint16, index uint64) string {
+	return fmt.Sprintf("history-%02d-%016x.seg", height, index)
+}
+
+// Archived returns the number of segments already moved to the archive.
+// Every event below Archived() << height is archived.
+func (a *Archive) Archived() (uint64, error) {
+	kv, err := a.store.Get(storage.FSMStateTable, storage.HistoryArchiveKey)
+	if err == storage.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return util.BytesAsUint64(kv.Value), nil
+}
+
+// ArchiveUpTo moves to the archive the subtrees whose events all have
+// a version lower than the given one. Every segment is written and read
+// back from the archive before removing its nodes from the store, so
+// nodes are never lost. It returns the number of archived segments.
+func (a *Archive) ArchiveUpTo(version uint64) (int, error) {
+	deleter, ok := a.store.(storage.DeleteStore)
+	if !ok {
+		return 0, fmt.Errorf("The store does not support deletions")
+	}
+
+	a.archiveMu.Lock()
+	defer a.archiveMu.Unlock()
+
+	next, err := a.Archived()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for (next+1)<<a.height <= version {
+		seg, keys, err := a.readSegment(next)
+		if err != nil {
+			return count, err
+		}
+		if err := a.verify(seg); err != nil {
+			return count, fmt.Errorf("Unable to archive segment %d: %v", next, err)
+		}
+		if err := a.backend.Put(segmentName(a.height, next), seg.encode()); err != nil {
+			return count, err
+		}
+		// the segment must be readable before deleting the nodes
+		if _, err := a.fetch(next); err != nil {
+			return count, fmt.Errorf("Unable to read back segment %d: %v", next, err)
+		}
+		if err := deleter.Delete(storage.HistoryTable, keys); err != nil {
+			return count, err
+		}
+		next++
+		err = a.store.Mutate([]*storage.Mutation{
+			storage.NewMutation(storage.FSMStateTable, storage.HistoryArchiveKey, util.Uint64AsBytes(next)),
+		}, nil)
+		if err != nil {
+			return count, err
+		}
+		count++
+		a.log.Debugf("History segment %d archived", next-1)
+	}
+	return count, nil
+}
+
+// readSegment reads from the store the nodes of the given segment and
+// returns it along with the keys of the nodes to delete once archived.
+func (a *Archive) readSegment(index uint64) (*segment, [][]byte, error) {
+	first := index << a.height
+	last := first + 1<<a.height - 1
+	pairs, err := a.store.GetRange(storage.HistoryTable, newPosition(first, 0).Bytes(), newPosition(last, a.height).Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root := newPosition(first, a.height)
+	var seg *segment
+	keys := make([][]byte, 0, len(pairs))
+	filled := 0
+	for _, pair := range pairs {
+		if len(pair.Key) != keySize {
+			continue
+		}
+		pos := newPosition(util.BytesAsUint64(pair.Key[:8]), util.BytesAsUint16(pair.Key[8:]))
+		if pos.Height > a.height {
+			continue
+		}
+		if seg == nil {
+			seg = newSegment(index, a.height, len(pair.Value))
+		}
+		if len(pair.Value) != seg.hashSize {
+			return nil, nil, fmt.Errorf("Unexpected hash size at %v", pos)
+		}
+		copy(seg.hashes[seg.offset(pos):], pair.Value)
+		filled++
+		if pos.Height < a.height {
+			keys = append(keys, pair.Key)
+		}
+	}
+	if seg == nil || filled != seg.numNodes() {
+		return nil, nil, fmt.Errorf("The subtree at %v is not complete in the store", root)
+	}
+	return seg, keys, nil
+}
+
+// verify recomputes the hash of every inner node of the segment and
+// compares the root with the one kept in the store.
+func (a *Archive) verify(seg *segment) error {
+	hasher := a.hasherF()
+	first := seg.index << seg.height
+	for h := uint16(1); h <= seg.height; h++ {
+		for i := first; i < first+1<<seg.height; i += 1 << h {
+			pos := newPosition(i, h)
+			left, right := pos.Left(), pos.Right()
+			expected := hasher.Salted(pos.Bytes(), seg.get(left), seg.get(right))
+			if !bytes.Equal(expected, seg.get(pos)) {
+				return fmt.Errorf("Hash mismatch at %v", pos)
+			}
+		}
+	}
+
+	root := newPosition(first, seg.height)
+	kv, err := a.store.Get(storage.HistoryTable, root.Bytes())
+	if err != nil {
+		return fmt.Errorf("Unable to read the root of the segment at %v: %v", root, err)
+	}
+	if !bytes.Equal(kv.Value, seg.get(root)) {
+		return fmt.Errorf("Root hash mismatch at %v", root)
+	}
+	return nil
+}
+
+// Get returns the hash of the node at the given position if it
+// belongs to an archived segment. It satisfies the cache.Cache interface
+// so it can be used to read through the nodes missing from the store.
+func (a *Archive) Get(key []byte) ([]byte, bool) {
+	if len(key) != keySize {
+		return nil, false
+	}
+	pos := newPosition(util.BytesAsUint64(key[:8]), util.BytesAsUint16(key[8:]))
+	if pos.Height >= a.height {
+		return nil, false
+	}
+
+	seg, err := a.fetch(pos.Index >> a.height)
+	if err != nil {
+		if err != archive.ErrNotFound {
+			a.log.Infof("Unable to load history segment for %v: %v", pos, err)
+		}
+		return nil, false
+	}
+	return seg.get(pos), true
+}
+
+// fetch returns a verified segment from the archive, keeping the
+// last ones loaded in memory.
+func (a *Archive) fetch(index uint64) (*segment, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	for i, seg := range a.loaded {
+		if seg.index == index {
+			copy(a.loaded[1:i+1], a.loaded[:i])
+			a.loaded[0] = seg
+			return seg, nil
+		}
+	}
+
+	data, err := a.backend.Get(segmentName(a.height, index))
+	if err != nil {
+		return nil, err
+	}
+	seg, err := decodeSegment(data)
+	if err != nil {
+		return nil, err
+	}
+	if seg.index != index || seg.height != a.height {
+		return nil, fmt.Errorf("Segment %d of height %d found instead of %d", seg.index, seg.height, index)
+	}
+	if err := a.verify(seg); err != nil {
+		return nil, err
+	}
+
+	if len(a.loaded) < maxLoadedSegments {
+		a.loaded = append(a.loaded, nil)
+	}
+	copy(a.loaded[1:], a.loaded)
+	a.loaded[0] = seg
+	return seg, nil
+}
+
+func newSegment(index uint64, height uint16, hashSize int) *segment {
+	seg := &segment{
+		index:    index,
+		height:   height,
+		hashSize: hashSize,
+	}
+	seg.hashes = make([]byte, seg.numNodes()*hashSize)
+	return seg
+}
+
+func (s *segment) numNodes() int {
+	return 1<<(s.height+1) - 1
+}
+
+// offset returns the position of the hash of a node in the segment.
+// Nodes of every height are stored after the ones of lower heights.
+func (s *segment) offset(pos *position) int {
+	levelStart := 0
+	for h := uint16(0); h < pos.Height; h++ {
+		levelStart += 1 << (s.height - h)
+	}
+	n := int((pos.Index - s.index<<s.height) >> pos.Height)
+	return (levelStart + n) * s.hashSize
+}
+
+func (s *segment) get(pos *position) []byte {
+	offset := s.offset(pos)
+	return s.hashes[offset : offset+s.hashSize]
+}
+
+func (s *segment) encode() []byte {
+	data := make([]byte, segmentHeaderSize+len(s.hashes))
+	copy(data[0:8], segmentMagic)
+	binary.BigEndian.PutUint16(data[8:10], s.height)
+	binary.BigEndian.PutUint64(data[10:18], s.index)
+	binary.BigEndian.PutUint16(data[18:20], uint16(s.hashSize))
+	copy(data[segmentHeaderSize:], s.hashes)
+	return data
+}
+
+func decodeSegment(data []byte) (*segment, error) {
+	if len(data) < segmentHeaderSize || string(data[0:8]) != segmentMagic {
+		return nil, fmt.Errorf("Invalid history segment: wrong magic number")
+	}
+	height := binary.BigEndian.Uint16(data[8:10])
+	if height == 0 || height > 32 {
+		return nil, fmt.Errorf("Invalid history segment: wrong height %d", height)
+	}
+	seg := newSegment(binary.BigEndian.Uint64(data[10:18]), height, int(binary.BigEndian.Uint16(data[18:20])))
+	if len(data)-segmentHeaderSize != len(seg.hashes) {
+		return nil, fmt.Errorf("Invalid history segment: unexpected size %d", len(data))
+	}
+	copy(seg.hashes, data[segmentHeaderSize:])
+	return seg, nil
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+)
+
+func TestArchiveUpTo(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	dir, err := ioutil.TempDir("", "qed-history-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend, err := archive.NewLocalBackend(dir)
+	require.NoError(t, err)
+
+	hasher := hashing.NewSha256Hasher()
+	tree := NewHistoryTree(hashing.NewSha256Hasher, store, 30)
+	a := NewArchive(hashing.NewSha256Hasher, store, backend, 2, log.L())
+	tree.SetArchive(a)
+
+	numEvents := uint64(22)
+	digests := make([]hashing.Digest, numEvents)
+	for i := uint64(0); i < numEvents; i++ {
+		digests[i] = hasher.Do([]byte{byte(i)})
+		_, mutations, err := tree.Add(digests[i], i)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+	}
+
+	proofs := make([]*MembershipProof, numEvents)
+	for i := uint64(0); i < numEvents; i++ {
+		proofs[i], err = tree.ProveMembership(i, numEvents-1)
+		require.NoError(t, err)
+	}
+
+	// segments are 4 events long, so 5 of them are complete
+	archived, err := a.ArchiveUpTo(numEvents)
+	require.NoError(t, err)
+	require.Equal(t, 5, archived)
+
+	next, err := a.Archived()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), next)
+
+	_, err = store.Get(storage.HistoryTable, newPosition(0, 0).Bytes())
+	require.Equal(t, storage.ErrKeyNotFound, err, "Archived nodes should be removed from the store")
+	_, err = store.Get(storage.HistoryTable, newPosition(4, 2).Bytes())
+	require.NoError(t, err, "The roots of the archived subtrees should be kept in the store")
+
+	// nothing else to archive
+	archived, err = a.ArchiveUpTo(numEvents)
+	require.NoError(t, err)
+	require.Equal(t, 0, archived)
+
+	for i := uint64(0); i < numEvents; i++ {
+		proof, err := tree.ProveMembership(i, numEvents-1)
+		require.NoError(t, err)
+		require.Equal(t, proofs[i].AuditPath, proof.AuditPath, "The audit path for index %d should not change", i)
+	}
+
+	// the tree keeps growing after archiving
+	digest := hasher.Do([]byte{byte(numEvents)})
+	rootHash, mutations, err := tree.Add(digest, numEvents)
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations, nil))
+
+	proof, err := tree.ProveMembership(0, numEvents)
+	require.NoError(t, err)
+	require.True(t, proof.Verify(digests[0], rootHash))
+
+	incremental, err := tree.ProveConsistency(1, numEvents)
+	require.NoError(t, err)
+	require.NotEmpty(t, incremental.AuditPath)
+}
+
+func TestArchiveCorruptedSegment(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	dir, err := ioutil.TempDir("", "qed-history-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend, err := archive.NewLocalBackend(dir)
+	require.NoError(t, err)
+
+	hasher := hashing.NewSha256Hasher()
+	tree := NewHistoryTree(hashing.NewSha256Hasher, store, 30)
+	for i := uint64(0); i < 8; i++ {
+		_, mutations, err := tree.Add(hasher.Do([]byte{byte(i)}), i)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+	}
+
+	a := NewArchive(hashing.NewSha256Hasher, store, backend, 2, log.L())
+	archived, err := a.ArchiveUpTo(8)
+	require.NoError(t, err)
+	require.Equal(t, 2, archived)
+
+	_, ok := a.Get(newPosition(1, 0).Bytes())
+	require.True(t, ok, "The node should be read from the archive")
+
+	data, err := backend.Get(segmentName(2, 1))
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, backend.Put(segmentName(2, 1), data))
+
+	// a new archive does not have the segment loaded
+	a = NewArchive(hashing.NewSha256Hasher, store, backend, 2, log.L())
+	_, ok = a.Get(newPosition(5, 0).Bytes())
+	require.False(t, ok, "A corrupted segment should be rejected")
+	_, ok = a.Get(newPosition(1, 0).Bytes())
+	require.True(t, ok, "Other segments should still be readable")
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bbva/qed/crypto/hashing"
+)
+
+// Check verifies the nodes frozen when the events from start to end
+// were added: every leaf must be stored, and every inner node must match
+// the hash of its children. The position of every inconsistent node is
+// reported along with the reason.
+func (t *HistoryTree) Check(start, end uint64, report func(pos, reason string)) {
+	hasher := t.hasherF()
+	for version := start; version <= end; version++ {
+		leaf := newPosition(version, 0)
+		if _, ok := t.readCache.Get(leaf.Bytes()); !ok {
+			report(leaf.StringId(), "Missing leaf")
+		}
+		// the inner nodes frozen by this leaf
+		for height := uint16(1); height < 64 && (version+1)%(1<<height) == 0; height++ {
+			pos := newPosition(version+1-1<<height, height)
+			hash, ok := t.readCache.Get(pos.Bytes())
+			if !ok {
+				report(pos.StringId(), "Missing inner node")
+				continue
+			}
+			left, lok := t.readCache.Get(pos.Left().Bytes())
+			right, rok := t.readCache.Get(pos.Right().Bytes())
+			if !lok || !rok {
+				// already reported
+				continue
+			}
+			if !bytes.Equal(hash, hasher.Salted(pos.Bytes(), left, right)) {
+				report(pos.StringId(), "Hash does not match its children")
+			}
+		}
+		if version == end {
+			break // avoid overflows
+		}
+	}
+}
+
+// RootHash computes the root hash of the tree at the given version from
+// the stored nodes.
+func (t *HistoryTree) RootHash(version uint64) (hashing.Digest, error) {
+	return t.rootHash(t.hasherF(), newRootPosition(version), version)
+}
+
+func (t *HistoryTree) rootHash(hasher hashing.Hasher, pos *position, version uint64) (hashing.Digest, error) {
+	if pos.LastDescendant().Index <= version {
+		// frozen node
+		hash, ok := t.readCache.Get(pos.Bytes())
+		if !ok {
+			return nil, fmt.Errorf("Missing node at %s", pos.StringId())
+		}
+		return hash, nil
+	}
+	left, err := t.rootHash(hasher, pos.Left(), version)
+	if err != nil {
+		return nil, err
+	}
+	if pos.Right().Index > version {
+		return hasher.Salted(pos.Bytes(), left), nil
+	}
+	right, err := t.rootHash(hasher, pos.Right(), version)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Salted(pos.Bytes(), left, right), nil
+}
+
+// CheckLeaf reports whether the leaf of the given version is the one
+// of the given event digest.
+func (t *HistoryTree) CheckLeaf(eventDigest hashing.Digest, version uint64) bool {
+	pos := newPosition(version, 0)
+	hash, ok := t.readCache.Get(pos.Bytes())
+	if !ok {
+		return false
+	}
+	return bytes.Equal(hash, t.hasherF().Salted(pos.Bytes(), eventDigest))
+}
+
+// FindLeaf returns the event digest, among the given candidates, whose
+// leaf is the one of the given version. The leaf is read only once.
+func (t *HistoryTree) FindLeaf(version uint64, candidates []hashing.Digest) (hashing.Digest, bool) {
+	pos := newPosition(version, 0)
+	hash, ok := t.readCache.Get(pos.Bytes())
+	if !ok {
+		return nil, false
+	}
+	hasher := t.hasherF()
+	for _, c := range candidates {
+		if bytes.Equal(hash, hasher.Salted(pos.Bytes(), c)) {
+			return c, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package history
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+)
+
+func TestCheck(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	hasher := hashing.NewSha256Hasher()
+	tree := NewHistoryTree(hashing.NewSha256Hasher, store, 30)
+
+	numEvents := uint64(21)
+	digests := make([]hashing.Digest, numEvents)
+	rootHashes := make([]hashing.Digest, numEvents)
+	for i := uint64(0); i < numEvents; i++ {
+		digests[i] = hasher.Do([]byte{byte(i)})
+		var mutations []*storage.Mutation
+		var err error
+		rootHashes[i], mutations, err = tree.Add(digests[i], i)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+	}
+
+	check := func() map[string]string {
+		corruptions := make(map[string]string)
+		tree.Check(0, numEvents-1, func(pos, reason string) {
+			corruptions[pos] = reason
+		})
+		return corruptions
+	}
+
+	require.Empty(t, check())
+	for i := uint64(0); i < numEvents; i++ {
+		rootHash, err := tree.RootHash(i)
+		require.NoError(t, err)
+		require.Equalf(t, rootHashes[i], rootHash, "The root hash of version %d should match", i)
+		require.True(t, tree.CheckLeaf(digests[i], i))
+	}
+	require.False(t, tree.CheckLeaf(digests[0], 1))
+	found, ok := tree.FindLeaf(5, digests[3:])
+	require.True(t, ok)
+	require.Equal(t, digests[5], found)
+	_, ok = tree.FindLeaf(5, digests[6:])
+	require.False(t, ok)
+
+	// corrupt an inner node
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HistoryTable, newPosition(4, 2).Bytes(), hasher.Do([]byte{0xff})),
+	}, nil))
+	corruptions := check()
+	require.Len(t, corruptions, 2)
+	require.Equal(t, "Hash does not match its children", corruptions["4|2"])
+	require.Equal(t, "Hash does not match its children", corruptions["0|3"], "The parent should not match either")
+
+	rootHash, err := tree.RootHash(7)
+	require.NoError(t, err)
+	require.Equal(t, rootHashes[7], rootHash, "The root of version 7 is a frozen node not modified")
+
+	// corrupt a node used by the last root
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HistoryTable, newPosition(16, 2).Bytes(), hasher.Do([]byte{0xff})),
+	}, nil))
+	corruptions = check()
+	require.Len(t, corruptions, 3)
+	require.Equal(t, "Hash does not match its children", corruptions["16|2"])
+
+	rootHash, err = tree.RootHash(numEvents - 1)
+	require.NoError(t, err)
+	require.NotEqual(t, rootHashes[numEvents-1], rootHash)
+
+	// remove a leaf
+	require.NoError(t, store.Delete(storage.HistoryTable, [][]byte{newPosition(20, 0).Bytes()}))
+	corruptions = check()
+	require.Equal(t, "Missing leaf", corruptions["20|0"])
+	_, err = tree.RootHash(numEvents - 1)
+	require.Error(t, err)
+}
@@ -31,6 +31,7 @@ type HistoryTree struct {
 	hasher     hashing.Hasher
 	writeCache cache.ModifiableCache
 	readCache  cache.Cache
+	table      storage.Table
 
 	log log.Logger
 }
@@ -40,22 +41,36 @@ func NewHistoryTree(hasherF func() hashing.Hasher, store storage.Store, cacheSiz
 }
 
 func NewHistoryTreeWithLogger(hasherF func() hashing.Hasher, store storage.Store, cacheSize uint16, logger log.Logger) *HistoryTree {
+	return NewHistoryTreeOnTable(hasherF, store, storage.HistoryTable, cacheSize, logger)
+}
+
+// NewHistoryTreeOnTable builds a history tree whose nodes are stored in
+// the given table, so other logs than the one of the balloon can be kept
+// in the same store.
+func NewHistoryTreeOnTable(hasherF func() hashing.Hasher, store storage.Store, table storage.Table, cacheSize uint16, logger log.Logger) *HistoryTree {
 
 	// create cache for Adding
-	writeCache := cache.NewLruReadThroughCache(storage.HistoryTable, store, cacheSize)
+	writeCache := cache.NewLruReadThroughCache(table, store, cacheSize)
 
 	// create cache for Membership and Incremental
-	readCache := cache.NewPassThroughCache(storage.HistoryTable, store)
+	readCache := cache.NewPassThroughCache(table, store)
 
 	return &HistoryTree{
 		hasherF:    hasherF,
 		hasher:     hasherF(),
 		writeCache: writeCache,
 		readCache:  readCache,
+		table:      table,
 		log:        logger,
 	}
 }
 
+// SetArchive makes membership and incremental proofs read through the
+// given archive the nodes no longer present in the store.
+func (t *HistoryTree) SetArchive(archive *Archive) {
+	t.readCache = cache.NewPassThroughCacheWithFallback(t.table, archive.store, archive)
+}
+
 // Add function adds an event digest into the history tree.
 // It builds an insert visitor, calculates the expected root hash, and returns it along
 // with the storage mutations to be done at balloon level.
@@ -64,7 +79,7 @@ func (t *HistoryTree) Add(eventDigest hashing.Digest, version uint64) (hashing.D
 	// t.log.Tracef("Adding new event digest %x with version %d", eventDigest, version)
 
 	// build a visitable pruned tree and then visit it to generate the root hash
-	visitor := newInsertVisitor(t.hasher, t.writeCache, storage.HistoryTable)
+	visitor := newInsertVisitor(t.hasher, t.writeCache, t.table)
 	rh := pruneToInsert(version, eventDigest).Accept(visitor)
 
 	return rh, visitor.Result(), nil
@@ -75,7 +90,7 @@ func (t *HistoryTree) Add(eventDigest hashing.Digest, version uint64) (hashing.D
 // with the storage mutations to be done at balloon level.
 func (t *HistoryTree) AddBulk(eventDigests []hashing.Digest, initialVersion uint64) ([]hashing.Digest, []*storage.Mutation, error) {
 
-	visitor := newInsertVisitor(t.hasher, t.writeCache, storage.HistoryTable)
+	visitor := newInsertVisitor(t.hasher, t.writeCache, t.table)
 
 	rootHashes := make([]hashing.Digest, 0)
 	for i, e := range eventDigests {
@@ -19,7 +19,9 @@ package hyper
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math/bits"
+	"os"
 	"sync"
 
 	"github.com/bbva/qed/storage"
@@ -27,29 +29,130 @@ import (
 )
 
 const (
-	treeHeight  uint16 = 256           // Height for a SHA256-based hyper tree
-	batchHeight uint16 = 4             // Fixed size of a single batch
-	batchSize   uint64 = (31 * 33) + 4 // 31 nodes * 33 bytes/node + 4 bytes of bitmap
-	flagSize    uint64 = 1             // to mark (non-)empty buckets
+	batchHeight uint16 = 4 // Fixed size of a single batch
+	flagSize    uint64 = 1 // to mark (non-)empty buckets
+	// maxBatchLevels is limited by the 32 bits of the index
+	// used to locate a batch at its depth.
+	maxBatchLevels uint8 = 8
+	// bucketsPerPage is the number of buckets allocated together
+	// the first time any of them is written.
+	bucketsPerPage uint64 = 64
 	// flags
 	empty  byte = 0x0
 	filled byte = 0x1
 )
 
-// BatchCache is a specific tailor-made cache for a Hyper tree
-// that uses a SHA256 hasher.
-// It stores all batches in a single fixed byte slice.
+// BatchCache is a specific tailor-made cache for a Hyper tree.
+// It stores the batches of the upper levels of the tree in pages
+// of fixed size that are allocated on demand, so its memory footprint
+// grows with the number of batches actually cached. The pages can be
+// backed by a memory-mapped file to preserve the contents between
+// restarts.
 type BatchCache struct {
-	buf        []byte
+	pages      [][]byte
 	entryCount int
 	offsets    []uint64
+	levels     uint8
+	numBits    uint16
+	batchSize  uint64
 	bucketSize uint64
 
+	// memory-mapped file, if any
+	file     *os.File
+	mapped   []byte
+	restored bool
+	version  uint64
+
+	// contents of the buckets overwritten while
+	// there are views of the cache being read
+	views       []*cacheVersion
+	nextVersion uint64
+
 	sync.RWMutex
 }
 
-// NewBatchCache is a constructor for a BatchCache.
-func NewBatchCache(batchLevels uint8) *BatchCache {
+// NewBatchCache is a constructor for an in-memory BatchCache of the given
+// number of batch levels for a tree of numBits height, which must
+// match the length of the hasher used by the tree.
+func NewBatchCache(numBits uint16, batchLevels uint8) *BatchCache {
+	c := newBatchCache(numBits, batchLevels)
+	c.pages = make([][]byte, c.numPages())
+	return c
+}
+
+// OpenBatchCache returns a BatchCache backed by a memory-mapped file in the
+// given path. If the file was written by a cache with the same layout and
+// closed cleanly, its contents are reused and the cache is marked as
+// restored. Otherwise, the cache starts empty. On platforms without
+// memory-mapped files, the contents are kept in the heap and written
+// back to the file when it is synced.
+func OpenBatchCache(path string, numBits uint16, batchLevels uint8) (*BatchCache, error) {
+	c := newBatchCache(numBits, batchLevels)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := bucketsPerPage * c.bucketSize
+	size := int64(cacheHeaderSize + c.numPages()*pageSize)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != size {
+		// the layout has changed or the file is new, so we
+		// start with an empty sparse file
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	mapped, err := mapFile(f, int(size))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to map cache file %s: %v", path, err)
+	}
+	c.file = f
+	c.mapped = mapped
+
+	h := readCacheHeader(mapped)
+	if h.numBits == c.numBits && h.levels == c.levels && h.clean {
+		c.restored = true
+		c.version = h.version
+		c.entryCount = int(h.entries)
+	} else if err := c.reset(); err != nil {
+		unmapFile(f, mapped)
+		f.Close()
+		return nil, err
+	}
+
+	// until the cache is closed cleanly, its contents are not reliable
+	writeCacheHeader(mapped, cacheHeader{numBits: c.numBits, levels: c.levels})
+	if err := c.sync(); err != nil {
+		unmapFile(f, mapped)
+		f.Close()
+		return nil, err
+	}
+
+	c.pages = make([][]byte, c.numPages())
+	for i := range c.pages {
+		start := cacheHeaderSize + uint64(i)*pageSize
+		c.pages[i] = mapped[start : start+pageSize]
+	}
+	BatchCacheBytes.Set(float64(size))
+	BatchCacheEntries.Set(float64(c.entryCount))
+
+	return c, nil
+}
+
+func newBatchCache(numBits uint16, batchLevels uint8) *BatchCache {
 
 	// First, we calculate the offsets for every depth in the
 	// cache. The offset indicates the number of batches stored
@@ -57,48 +160,81 @@ func NewBatchCache(batchLevels uint8) *BatchCache {
 	// For a 6 level cache, we will the following:
 	// [0 1 17 273 4369 69905 1118481]
 	// Note that the last element corresponds to the depth 7.
-	offsets := make([]uint64, batchLevels+1)
-	n := uint64(0)
-	for i := uint8(0); i < uint8(batchLevels); i++ {
-		n = n + (1 << (i * uint8(batchHeight)))
-		offsets[i+1] = n
-	}
-
-	// The number of buckets is the last element of the offset slice.
-	numBuckets := offsets[len(offsets)-1]
+	offsets := batchOffsets(batchLevels)
 
 	// The bucket size is the sum of the batch size and a byte flag.
-	bucketSize := batchSize + flagSize
+	batchSize := batchSizeFor(numBits)
 
-	// We calculate the size of the buffer by multiplying the number
-	// of buckets by the bucket size.
 	return &BatchCache{
-		buf:        make([]byte, numBuckets*bucketSize),
 		entryCount: 0,
 		offsets:    offsets,
-		bucketSize: bucketSize,
+		levels:     batchLevels,
+		numBits:    numBits,
+		batchSize:  batchSize,
+		bucketSize: batchSize + flagSize,
 	}
 }
 
+// BatchLevelsFor returns the number of batch levels that a cache for
+// a tree of numBits height should use, or the default levels if
+// batchLevels is zero. The result is always at least one level.
+//
+// IMPORTANT: the cache levels define which batches are stored and where
+// leaves are placed in the tree, so they change the hyper digests. Every
+// node of a cluster must use the same levels during the whole life of
+// the database, so they never depend on the resources of a node.
+func BatchLevelsFor(numBits uint16, batchLevels uint8) uint8 {
+	// The cache cannot cover more than half of the
+	// tree nor go beyond the limits of the index
+	limit := uint8(numBits / 8)
+	if limit > maxBatchLevels {
+		limit = maxBatchLevels
+	}
+	if batchLevels == 0 {
+		batchLevels = DefaultBatchLevels
+	}
+	if batchLevels > limit {
+		batchLevels = limit
+	}
+
+	if batchLevels == 0 {
+		batchLevels = 1
+	}
+	return batchLevels
+}
+
+// BatchCacheMaxSize returns the size in bytes of a cache of the given
+// batch levels for a tree of numBits height once every batch is cached.
+func BatchCacheMaxSize(numBits uint16, batchLevels uint8) uint64 {
+	bucketSize := batchSizeFor(numBits) + flagSize
+	return batchOffsets(batchLevels)[batchLevels] * bucketSize
+}
+
 // Get returns the value for the given a tree and a flag
 // indicating if the key exists in the cache.
 func (c *BatchCache) Get(key []byte) ([]byte, bool) {
 
-	offset := c.seek(key)
+	page, offset := c.seek(key)
 
 	c.RLock()
 	defer c.RUnlock()
 
-	if c.buf[offset] == filled {
-		value := make([]byte, batchSize)
-		copy(value, c.buf[offset+flagSize:offset+c.bucketSize])
+	return c.get(page, offset)
+}
+
+func (c *BatchCache) get(page, offset uint64) ([]byte, bool) {
+	if c.pages[page] != nil && c.pages[page][offset] == filled {
+		value := make([]byte, c.batchSize)
+		copy(value, c.pages[page][offset+flagSize:offset+c.bucketSize])
 		// IMPORTANT: we are returning the whole batch size although it could
 		// include 0x0s at the end. We could use two flag bytes to indicate
 		// the actual size of the batch, but the cache will tend to be
 		// filled up and thus, it seems to be an unnecessary overhead
+		BatchCacheHits.Inc()
 		return value, true
 	}
 
+	BatchCacheMisses.Inc()
 	return nil, false
 }
 
@@ -106,19 +242,27 @@ func (c *BatchCache) Get(key []byte) ([]byte, bool) {
 // in the cache.
 func (c *BatchCache) Put(key []byte, value []byte) {
 
-	offset := c.seek(key)
+	page, offset := c.seek(key)
 
 	c.Lock()
 	defer c.Unlock()
 
-	if c.buf[offset] == empty {
+	c.preserve(page, offset)
+	if c.pages[page] == nil {
+		c.pages[page] = make([]byte, bucketsPerPage*c.bucketSize)
+		BatchCacheBytes.Add(float64(bucketsPerPage * c.bucketSize))
+	}
+	buf := c.pages[page]
+
+	if buf[offset] == empty {
 		c.entryCount++
+		BatchCacheEntries.Inc()
 	}
 
-	c.buf[offset] = filled
-	copy(c.buf[offset+flagSize:], value)
+	buf[offset] = filled
+	copy(buf[offset+flagSize:], value)
 	for i := offset + flagSize + uint64(len(value)); i < offset+c.bucketSize; i++ {
-		c.buf[i] = 0x0
+		buf[i] = 0x0
 	}
 
 }
@@ -146,12 +290,122 @@ func (c *BatchCache) Size() int {
 	return c.entryCount
 }
 
+// Levels returns the number of batch levels of the tree
+// stored in the cache.
+func (c *BatchCache) Levels() uint8 {
+	return c.levels
+}
+
+// Restored returns true if the contents of the cache were loaded from
+// a file that was closed cleanly, along with the version of the balloon
+// they correspond to.
+func (c *BatchCache) Restored() (uint64, bool) {
+	return c.version, c.restored
+}
+
+// Reset removes every entry of the cache.
+func (c *BatchCache) Reset() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.reset()
+}
+
+func (c *BatchCache) reset() error {
+	// the views being read keep seeing the previous contents
+	if len(c.views) > 0 {
+		for page := range c.pages {
+			if c.pages[page] == nil {
+				continue
+			}
+			for offset := uint64(0); offset < bucketsPerPage*c.bucketSize; offset += c.bucketSize {
+				c.preserve(uint64(page), offset)
+			}
+		}
+	}
+
+	if c.mapped != nil {
+		if err := clearFile(c.file, c.mapped, int(cacheHeaderSize)); err != nil {
+			return err
+		}
+	} else {
+		for i := range c.pages {
+			c.pages[i] = nil
+		}
+		BatchCacheBytes.Set(0)
+	}
+	c.entryCount = 0
+	c.restored = false
+	BatchCacheEntries.Set(0)
+	return nil
+}
+
+// Close releases the resources of the cache. If the cache is backed by
+// a file, its contents are flushed and marked as valid for the given
+// balloon version so they can be reused on the next start.
+func (c *BatchCache) Close(version uint64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.pages = nil
+	if c.mapped == nil {
+		return nil
+	}
+
+	err := c.sync()
+	if err == nil {
+		writeCacheHeader(c.mapped, cacheHeader{
+			numBits: c.numBits,
+			levels:  c.levels,
+			clean:   true,
+			version: version,
+			entries: uint64(c.entryCount),
+		})
+		err = c.sync()
+	}
+
+	if uerr := unmapFile(c.file, c.mapped); uerr != nil && err == nil {
+		err = uerr
+	}
+	if cerr := c.file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	c.mapped = nil
+	c.file = nil
+	return err
+}
+
 // Equal is useful to compare the contents of two caches.
 func (c *BatchCache) Equal(o *BatchCache) bool {
-	return bytes.Equal(c.buf, o.buf)
+	if len(c.pages) != len(o.pages) {
+		return false
+	}
+	zero := make([]byte, bucketsPerPage*c.bucketSize)
+	for i := range c.pages {
+		p, q := c.pages[i], o.pages[i]
+		if p == nil {
+			p = zero
+		}
+		if q == nil {
+			q = zero
+		}
+		if !bytes.Equal(p, q) {
+			return false
+		}
+	}
+	return true
 }
 
-func (c *BatchCache) seek(key []byte) uint64 {
+func (c *BatchCache) numPages() uint64 {
+	// The number of buckets is the last element of the offset slice.
+	numBuckets := c.offsets[len(c.offsets)-1]
+	return (numBuckets + bucketsPerPage - 1) / bucketsPerPage
+}
+
+func (c *BatchCache) sync() error {
+	return syncFile(c.file, c.mapped)
+}
+
+func (c *BatchCache) seek(key []byte) (uint64, uint64) {
 
 	// First, we extract the height and the index from the key
 	height := util.BytesAsUint16(key[0:2])
@@ -199,17 +453,76 @@ func (c *BatchCache) seek(key []byte) uint64 {
 	//
 	// ( offset at depth + index at depth) * bucket size
 
-	// calculate index at depth
-	iPos := uint64(bits.Reverse32(binary.BigEndian.Uint32(index[0:4]))) // 32 levels max -> 4
+	// calculate index at depth, using at most the first 4 bytes
+	// of the index since the cache has 8 levels at most
+	var prefix [4]byte
+	copy(prefix[:], index)
+	iPos := uint64(bits.Reverse32(binary.BigEndian.Uint32(prefix[:]))) // 32 levels max -> 4
 
 	// calculate the tree depth for the given key
-	depth := (treeHeight - height) / batchHeight
+	depth := (c.numBits - height) / batchHeight
 
 	// we get the offset for that depth. This number indicates
 	// how many batches are stored before that position.
 	iPos += c.offsets[depth]
 
-	// we calculate the final offset multiplying the offset by
-	// the bucket size
-	return iPos * c.bucketSize
+	// we locate the page that holds the bucket and the offset
+	// of the bucket inside the page
+	return iPos / bucketsPerPage, (iPos % bucketsPerPage) * c.bucketSize
+}
+
+func batchOffsets(batchLevels uint8) []uint64 {
+	offsets := make([]uint64, batchLevels+1)
+	n := uint64(0)
+	for i := uint8(0); i < batchLevels; i++ {
+		n = n + (1 << (uint64(i) * uint64(batchHeight)))
+		offsets[i+1] = n
+	}
+	return offsets
+}
+
+// batchSizeFor returns the size of a serialized batch: 31 nodes
+// of the hasher length plus a flag byte and 4 bytes of bitmap.
+func batchSizeFor(numBits uint16) uint64 {
+	return 31*(uint64(numBits/8)+1) + 4
+}
+
+// The header of a cache file is stored in its first page, followed
+// by the pages of buckets.
+const (
+	cacheHeaderSize  uint64 = 4096
+	cacheHeaderMagic string = "QEDHYPER"
+)
+
+type cacheHeader struct {
+	numBits uint16
+	levels  uint8
+	clean   bool
+	version uint64
+	entries uint64
+}
+
+func readCacheHeader(buf []byte) cacheHeader {
+	if string(buf[0:8]) != cacheHeaderMagic {
+		return cacheHeader{}
+	}
+	return cacheHeader{
+		numBits: binary.BigEndian.Uint16(buf[8:10]),
+		levels:  buf[10],
+		clean:   buf[11] == filled,
+		version: binary.BigEndian.Uint64(buf[12:20]),
+		entries: binary.BigEndian.Uint64(buf[20:28]),
+	}
+}
+
+func writeCacheHeader(buf []byte, h cacheHeader) {
+	copy(buf[0:8], cacheHeaderMagic)
+	binary.BigEndian.PutUint16(buf[8:10], h.numBits)
+	buf[10] = h.levels
+	buf[11] = empty
+	if h.clean {
+		buf[11] = filled
+	}
+	binary.BigEndian.PutUint64(buf[12:20], h.version)
+	binary.BigEndian.PutUint64(buf[20:28], h.entries)
 }
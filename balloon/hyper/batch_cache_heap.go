@@ -0,0 +1,61 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"io"
+	"os"
+)
+
+// The platforms without support for memory-mapped files keep the
+// contents of the file in the heap and write them back on sync.
+
+// mapFile reads the first size bytes of a file in memory.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	mapped := make([]byte, size)
+	if _, err := f.ReadAt(mapped, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return mapped, nil
+}
+
+// unmapFile releases a file read in memory.
+func unmapFile(f *os.File, mapped []byte) error {
+	return nil
+}
+
+// syncFile writes the contents of a file read in memory to disk.
+func syncFile(f *os.File, mapped []byte) error {
+	if _, err := f.WriteAt(mapped, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// clearFile zeroes a file read in memory from the given offset.
+func clearFile(f *os.File, mapped []byte, offset int) error {
+	for i := offset; i < len(mapped); i++ {
+		mapped[i] = 0
+	}
+	if err := f.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	return f.Truncate(int64(len(mapped)))
+}
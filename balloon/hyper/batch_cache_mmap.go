@@ -0,0 +1,56 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd
+// +build darwin dragonfly freebsd linux openbsd
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mapFile maps the first size bytes of a file in memory
+// with read and write access.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a file mapped in memory.
+func unmapFile(f *os.File, mapped []byte) error {
+	return syscall.Munmap(mapped)
+}
+
+// syncFile flushes the contents of a file mapped in memory to disk.
+func syncFile(f *os.File, mapped []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mapped[0])), uintptr(len(mapped)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// clearFile zeroes a file mapped in memory from the given offset.
+// Shrinking and growing the file again releases the pages on disk
+// and leaves a zeroed sparse file.
+func clearFile(f *os.File, mapped []byte, offset int) error {
+	if err := f.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	return f.Truncate(int64(len(mapped)))
+}
@@ -17,9 +17,15 @@
 package hyper
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/testutils/rand"
+	storage_utils "github.com/bbva/qed/testutils/storage"
 	"github.com/bbva/qed/util"
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +33,7 @@ import (
 func TestBatchCache(t *testing.T) {
 
 	hasher := hashing.NewSha256Hasher()
-	cache := NewBatchCache(1)
+	cache := NewBatchCache(256, 1)
 
 	key := hasher.Do([]byte("this should exist"))
 	value := util.Uint64AsPaddedBytes(uint64(0), 32)
@@ -42,3 +48,157 @@ func TestBatchCache(t *testing.T) {
 	require.Equal(t, batch, parseBatchNode(32, cached))
 
 }
+
+func TestBatchCacheLevels(t *testing.T) {
+
+	testCases := []struct {
+		hasherF func() hashing.Hasher
+		levels  uint8
+	}{
+		{hashing.NewSha256Hasher, 1},
+		{hashing.NewSha256Hasher, 3},
+		{hashing.NewSha256Hasher, DefaultBatchLevels},
+		{hashing.NewPearsonHasher, 1},
+	}
+
+	for i, c := range testCases {
+		numBits := c.hasherF().Len()
+
+		store, closeF := storage_utils.OpenBPlusTreeStore()
+		defer closeF()
+		batchCache := NewBatchCache(numBits, c.levels)
+		tree := NewHyperTree(c.hasherF, store, batchCache)
+		require.Equalf(t, numBits-uint16(c.levels)*batchHeight, tree.cacheHeightLimit, "Wrong cache height limit in test case %d", i)
+
+		hasher := c.hasherF()
+		keys := make([]hashing.Digest, 0)
+		var rootHash hashing.Digest
+		for j := uint64(0); j < 100; j++ {
+			key := hasher.Do(rand.Bytes(32))
+			keys = append(keys, key)
+
+			var mutations []*storage.Mutation
+			var err error
+			rootHash, mutations, err = tree.Add(key, j)
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations, nil))
+		}
+		require.True(t, batchCache.Size() > 0)
+
+		// a new tree rebuilds the same cache from the store
+		rebuiltCache := NewBatchCache(numBits, c.levels)
+		rebuilt := NewHyperTree(c.hasherF, store, rebuiltCache)
+		require.Truef(t, batchCache.Equal(rebuiltCache), "Rebuilt cache should match in test case %d", i)
+
+		for _, key := range keys {
+			proof, err := rebuilt.QueryMembership(key)
+			require.NoError(t, err)
+			require.Truef(t, proof.Verify(key, rootHash), "Membership proof should verify in test case %d", i)
+		}
+	}
+}
+
+func TestBatchLevelsFor(t *testing.T) {
+
+	testCases := []struct {
+		numBits  uint16
+		levels   uint8
+		expected uint8
+	}{
+		{256, 6, 6},
+		{256, 0, DefaultBatchLevels},
+		{256, 12, 8},
+		{16, 0, 2},
+		{8, 6, 1},
+	}
+
+	for i, c := range testCases {
+		require.Equalf(t, c.expected, BatchLevelsFor(c.numBits, c.levels), "Wrong levels in test case %d", i)
+	}
+}
+
+func TestBatchCacheMaxSize(t *testing.T) {
+	bucket := batchSizeFor(256) + flagSize
+	require.Equal(t, 273*bucket, BatchCacheMaxSize(256, 3))
+	require.Equal(t, 17*bucket, BatchCacheMaxSize(256, 2))
+}
+
+func TestBatchCacheAllocation(t *testing.T) {
+
+	cache := NewBatchCache(256, DefaultBatchLevels)
+	for _, p := range cache.pages {
+		require.Nil(t, p, "Pages should not be allocated in advance")
+	}
+
+	cache.Put(pos(0, 256).Bytes(), []byte{0x1})
+	allocated := 0
+	for _, p := range cache.pages {
+		if p != nil {
+			allocated++
+		}
+	}
+	require.Equal(t, 1, allocated)
+	require.Equal(t, 1, cache.Size())
+
+	require.NoError(t, cache.Reset())
+	require.Equal(t, 0, cache.Size())
+	_, ok := cache.Get(pos(0, 256).Bytes())
+	require.False(t, ok)
+}
+
+func TestOpenBatchCache(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-hyper-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hyper.cache")
+
+	key := pos(0, 256).Bytes()
+	value := []byte{0x1, 0x2, 0x3}
+
+	cache, err := OpenBatchCache(path, 256, 2)
+	require.NoError(t, err)
+	_, ok := cache.Restored()
+	require.False(t, ok, "A new cache file should not be restored")
+	cache.Put(key, value)
+
+	// the file is not valid until the cache is closed
+	dirty, err := OpenBatchCache(path+".copy", 256, 2)
+	require.NoError(t, err)
+	require.NoError(t, dirty.Close(0))
+	copyFile(t, path, path+".copy")
+	dirty, err = OpenBatchCache(path+".copy", 256, 2)
+	require.NoError(t, err)
+	_, ok = dirty.Restored()
+	require.False(t, ok, "A cache file not closed should not be restored")
+	require.Equal(t, 0, dirty.Size())
+	require.NoError(t, dirty.Close(0))
+
+	require.NoError(t, cache.Close(10))
+
+	cache, err = OpenBatchCache(path, 256, 2)
+	require.NoError(t, err)
+	version, ok := cache.Restored()
+	require.True(t, ok, "A cache file closed cleanly should be restored")
+	require.Equal(t, uint64(10), version)
+	require.Equal(t, 1, cache.Size())
+	cached, ok := cache.Get(key)
+	require.True(t, ok)
+	require.Equal(t, value, cached[:len(value)])
+	require.NoError(t, cache.Close(10))
+
+	// a different layout starts from scratch
+	cache, err = OpenBatchCache(path, 256, 3)
+	require.NoError(t, err)
+	_, ok = cache.Restored()
+	require.False(t, ok)
+	_, ok = cache.Get(key)
+	require.False(t, ok)
+	require.NoError(t, cache.Close(10))
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	content, err := ioutil.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dst, content, 0644))
+}
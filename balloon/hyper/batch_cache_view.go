@@ -0,0 +1,123 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+// cacheVersion keeps the previous contents of the buckets modified
+// after a view of the cache was taken and before the next one.
+type cacheVersion struct {
+	seq  uint64
+	refs int
+	// bucket position -> batch, nil if the bucket was empty
+	saved map[uint64][]byte
+}
+
+// BatchCacheView is a read-only view of the contents of a BatchCache at
+// the time it was taken. It is not affected by later writes to the cache,
+// so it can be read while the tree keeps being modified. Views must be
+// released once they are no longer used.
+type BatchCacheView struct {
+	cache   *BatchCache
+	version *cacheVersion
+}
+
+// View returns a view of the current contents of the cache. Taking a view
+// is cheap, but while it is not released every write to the cache keeps a
+// copy of the previous contents of the bucket.
+func (c *BatchCache) View() *BatchCacheView {
+	c.Lock()
+	defer c.Unlock()
+
+	// consecutive views with no writes in between share their version
+	if n := len(c.views); n > 0 && len(c.views[n-1].saved) == 0 {
+		c.views[n-1].refs++
+		return &BatchCacheView{cache: c, version: c.views[n-1]}
+	}
+
+	version := &cacheVersion{
+		seq:   c.nextVersion,
+		refs:  1,
+		saved: make(map[uint64][]byte),
+	}
+	c.nextVersion++
+	c.views = append(c.views, version)
+	return &BatchCacheView{cache: c, version: version}
+}
+
+// Get returns the value of the given key as it was when
+// the view was taken.
+func (v *BatchCacheView) Get(key []byte) ([]byte, bool) {
+	c := v.cache
+	page, offset := c.seek(key)
+	bucket := page*bucketsPerPage + offset/c.bucketSize
+
+	c.RLock()
+	defer c.RUnlock()
+
+	// the first copy saved after the view was taken holds the value
+	// the bucket had at that time
+	for _, version := range c.views[v.version.seq-c.views[0].seq:] {
+		if value, ok := version.saved[bucket]; ok {
+			if value == nil {
+				BatchCacheMisses.Inc()
+				return nil, false
+			}
+			BatchCacheHits.Inc()
+			return append([]byte(nil), value...), true
+		}
+	}
+
+	return c.get(page, offset)
+}
+
+// Release frees the view. It must not be used afterwards.
+func (v *BatchCacheView) Release() {
+	c := v.cache
+	c.Lock()
+	defer c.Unlock()
+
+	v.version.refs--
+	v.version = nil
+
+	// the copies saved for a version are needed by the views
+	// of that version and any previous one
+	n := 0
+	for n < len(c.views) && c.views[n].refs == 0 {
+		c.views[n] = nil
+		n++
+	}
+	c.views = c.views[n:]
+}
+
+// preserve saves the contents of a bucket before it is written for the
+// first time since the last view was taken. It must be called with the
+// cache locked.
+func (c *BatchCache) preserve(page, offset uint64) {
+	if len(c.views) == 0 {
+		return
+	}
+	latest := c.views[len(c.views)-1]
+	bucket := page*bucketsPerPage + offset/c.bucketSize
+	if _, ok := latest.saved[bucket]; ok {
+		return
+	}
+	var value []byte
+	if c.pages[page] != nil && c.pages[page][offset] == filled {
+		value = make([]byte, c.batchSize)
+		copy(value, c.pages[page][offset+flagSize:offset+c.bucketSize])
+	}
+	latest.saved[bucket] = value
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"testing"
+
+	"github.com/bbva/qed/balloon/cache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchCacheView(t *testing.T) {
+
+	batchCache := NewBatchCache(256, 2)
+	root := pos(0, 256).Bytes()
+	child := pos(0, 252).Bytes()
+
+	get := func(c cache.Cache, key []byte) []byte {
+		value, ok := c.Get(key)
+		if !ok {
+			return nil
+		}
+		return value[:1]
+	}
+
+	batchCache.Put(root, []byte{0x1})
+	first := batchCache.View()
+	shared := batchCache.View()
+	require.Equal(t, 1, len(batchCache.views), "Views with no writes in between should share their version")
+
+	batchCache.Put(root, []byte{0x2})
+	batchCache.Put(child, []byte{0x2})
+	second := batchCache.View()
+	batchCache.Put(root, []byte{0x3})
+
+	require.Equal(t, []byte{0x1}, get(first, root))
+	require.Nil(t, get(first, child))
+	require.Equal(t, []byte{0x1}, get(shared, root))
+	require.Equal(t, []byte{0x2}, get(second, root))
+	require.Equal(t, []byte{0x2}, get(second, child))
+	require.Equal(t, []byte{0x3}, get(batchCache, root))
+
+	// a reset does not affect the views
+	require.NoError(t, batchCache.Reset())
+	require.Equal(t, []byte{0x1}, get(first, root))
+	require.Equal(t, []byte{0x2}, get(second, child))
+	require.Nil(t, get(batchCache, root))
+
+	// the saved contents are discarded once released
+	first.Release()
+	require.Equal(t, 2, len(batchCache.views))
+	shared.Release()
+	require.Equal(t, 1, len(batchCache.views))
+	require.Equal(t, []byte{0x2}, get(second, root))
+	second.Release()
+	require.Equal(t, 0, len(batchCache.views))
+
+	batchCache.Put(root, []byte{0x4})
+	view := batchCache.View()
+	require.Equal(t, []byte{0x4}, get(view, root))
+	view.Release()
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A cache checkpoint file has a header, followed by every filled bucket
+// of the cache prefixed by its position, and a CRC-32C of all the
+// previous bytes.
+const (
+	checkpointMagic      string = "QEDHCKPT"
+	checkpointHeaderSize int    = 8 + 2 + 1 + 8 + 8 + 8
+)
+
+var checkpointCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CacheCheckpointInfo describes the state of the tree
+// saved in a hyper cache checkpoint.
+type CacheCheckpointInfo struct {
+	NumBits uint16
+	Levels  uint8
+	Version uint64 // Balloon version the contents correspond to.
+	Index   uint64 // Raft index of the last command applied to the balloon.
+	Entries uint64
+}
+
+// WriteCheckpoint saves the contents of the cache in the given path
+// tagged with the balloon version and the Raft index they correspond to.
+// The file is replaced atomically once it has been written.
+func (c *BatchCache) WriteCheckpoint(path string, version, index uint64) error {
+	c.RLock()
+	defer c.RUnlock()
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	crc := crc32.New(checkpointCrcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+
+	header := make([]byte, checkpointHeaderSize)
+	copy(header[0:8], checkpointMagic)
+	binary.BigEndian.PutUint16(header[8:10], c.numBits)
+	header[10] = c.levels
+	binary.BigEndian.PutUint64(header[11:19], version)
+	binary.BigEndian.PutUint64(header[19:27], index)
+	binary.BigEndian.PutUint64(header[27:35], uint64(c.entryCount))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	pos := make([]byte, 8)
+	for i, page := range c.pages {
+		if page == nil {
+			continue
+		}
+		for j := uint64(0); j < bucketsPerPage; j++ {
+			offset := j * c.bucketSize
+			if page[offset] != filled {
+				continue
+			}
+			binary.BigEndian.PutUint64(pos, uint64(i)*bucketsPerPage+j)
+			if _, err := w.Write(pos); err != nil {
+				return err
+			}
+			if _, err := w.Write(page[offset+flagSize : offset+c.bucketSize]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	if _, err := f.Write(sum); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadCheckpoint replaces the contents of the cache with the ones saved
+// in a checkpoint. The checkpoint must have been written by a cache with
+// the same layout. If the checkpoint is corrupted, the cache is left
+// empty. Once loaded, the cache is marked as restored with the balloon
+// version of the checkpoint.
+func (c *BatchCache) LoadCheckpoint(path string) (*CacheCheckpointInfo, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	info, err := c.loadCheckpoint(path)
+	if err != nil {
+		if rerr := c.reset(); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+
+	c.restored = true
+	c.version = info.Version
+	return info, nil
+}
+
+func (c *BatchCache) loadCheckpoint(path string) (*CacheCheckpointInfo, error) {
+	if err := c.reset(); err != nil {
+		return nil, err
+	}
+
+	info, err := readCheckpoint(path, func(info *CacheCheckpointInfo) error {
+		if info.NumBits != c.numBits || info.Levels != c.levels {
+			return fmt.Errorf("Checkpoint of a %d bits tree with %d cache levels does not match the cache", info.NumBits, info.Levels)
+		}
+		return nil
+	}, func(pos uint64, value []byte) error {
+		if pos >= c.numPages()*bucketsPerPage {
+			return fmt.Errorf("Invalid cache position %d", pos)
+		}
+		page, offset := pos/bucketsPerPage, (pos%bucketsPerPage)*c.bucketSize
+		c.preserve(page, offset)
+		if c.pages[page] == nil {
+			c.pages[page] = make([]byte, bucketsPerPage*c.bucketSize)
+			BatchCacheBytes.Add(float64(bucketsPerPage * c.bucketSize))
+		}
+		c.pages[page][offset] = filled
+		copy(c.pages[page][offset+flagSize:offset+c.bucketSize], value)
+		c.entryCount++
+		return nil
+	})
+	BatchCacheEntries.Set(float64(c.entryCount))
+	return info, err
+}
+
+// ReadCacheCheckpointInfo reads the header of a hyper cache checkpoint
+// and verifies the integrity of the whole file.
+func ReadCacheCheckpointInfo(path string) (*CacheCheckpointInfo, error) {
+	return readCheckpoint(path, nil, nil)
+}
+
+// readCheckpoint reads a checkpoint file calling the given functions with
+// its header and every entry, and verifies its checksum at the end.
+func readCheckpoint(path string, onHeader func(*CacheCheckpointInfo) error, onEntry func(pos uint64, value []byte) error) (*CacheCheckpointInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	crc := crc32.New(checkpointCrcTable)
+	r := io.TeeReader(bufio.NewReader(f), crc)
+
+	header := make([]byte, checkpointHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("Invalid hyper cache checkpoint: %v", err)
+	}
+	if string(header[0:8]) != checkpointMagic {
+		return nil, fmt.Errorf("Invalid hyper cache checkpoint: wrong magic number")
+	}
+	info := &CacheCheckpointInfo{
+		NumBits: binary.BigEndian.Uint16(header[8:10]),
+		Levels:  header[10],
+		Version: binary.BigEndian.Uint64(header[11:19]),
+		Index:   binary.BigEndian.Uint64(header[19:27]),
+		Entries: binary.BigEndian.Uint64(header[27:35]),
+	}
+	if onHeader != nil {
+		if err := onHeader(info); err != nil {
+			return nil, err
+		}
+	}
+
+	entrySize := 8 + batchSizeFor(info.NumBits)
+	if uint64(stat.Size()) != uint64(checkpointHeaderSize)+info.Entries*entrySize+4 {
+		return nil, fmt.Errorf("Invalid hyper cache checkpoint: unexpected size %d for %d entries", stat.Size(), info.Entries)
+	}
+
+	entry := make([]byte, entrySize)
+	for i := uint64(0); i < info.Entries; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, fmt.Errorf("Invalid hyper cache checkpoint: %v", err)
+		}
+		if onEntry != nil {
+			if err := onEntry(binary.BigEndian.Uint64(entry[0:8]), entry[8:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the checksum itself is read after the tee reader has consumed
+	// every previous byte
+	expected := crc.Sum32()
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return nil, fmt.Errorf("Invalid hyper cache checkpoint: %v", err)
+	}
+	if binary.BigEndian.Uint32(sum) != expected {
+		return nil, fmt.Errorf("Invalid hyper cache checkpoint: checksum mismatch")
+	}
+	return info, nil
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/testutils/rand"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheCheckpoint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qed-hyper-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hyper.checkpoint")
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	cache := NewBatchCache(256, 3)
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, cache)
+
+	hasher := hashing.NewSha256Hasher()
+	for i := uint64(0); i < 100; i++ {
+		_, mutations, err := tree.Add(hasher.Do(rand.Bytes(32)), i)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+	}
+
+	require.NoError(t, cache.WriteCheckpoint(path, 100, 42))
+
+	info, err := ReadCacheCheckpointInfo(path)
+	require.NoError(t, err)
+	require.Equal(t, &CacheCheckpointInfo{
+		NumBits: 256,
+		Levels:  3,
+		Version: 100,
+		Index:   42,
+		Entries: uint64(cache.Size()),
+	}, info)
+
+	// the loaded cache matches the saved one
+	loaded := NewBatchCache(256, 3)
+	info, err = loaded.LoadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), info.Index)
+	require.Equal(t, cache.Size(), loaded.Size())
+	require.True(t, cache.Equal(loaded), "The loaded cache should match")
+	version, ok := loaded.Restored()
+	require.True(t, ok, "A loaded cache should be restored")
+	require.Equal(t, uint64(100), version)
+
+	// a different layout is rejected
+	_, err = NewBatchCache(256, 2).LoadCheckpoint(path)
+	require.Error(t, err)
+
+	// a corrupted checkpoint is rejected and leaves the cache empty
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	content[len(content)/2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, content, 0644))
+	_, err = ReadCacheCheckpointInfo(path)
+	require.Error(t, err)
+	_, err = loaded.LoadCheckpoint(path)
+	require.Error(t, err)
+	require.Equal(t, 0, loaded.Size())
+	_, ok = loaded.Restored()
+	require.False(t, ok)
+
+	// a truncated checkpoint is rejected too
+	require.NoError(t, ioutil.WriteFile(path, content[:len(content)-10], 0644))
+	_, err = ReadCacheCheckpointInfo(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+)
+
+const (
+	innerNodeFlag byte = 0
+	leafNodeFlag  byte = 1
+	keyValueFlag  byte = 2
+)
+
+// Check walks every batch of the tree as seen by the view and reports
+// the position of the nodes whose hash does not match the one derived
+// from their children, along with the reason. Unparseable batches and
+// shortcut leaves out of their subtree are also reported. The leaf
+// function, if any, is called with the key and value of every leaf.
+// It returns the root hash of the tree, or nil if it is empty.
+func (v *ReadView) Check(report func(pos, reason string), leaf func(key, value []byte)) hashing.Digest {
+	loader, ok := v.batchLoader.(*defaultBatchLoader)
+	if !ok {
+		panic("Oops, something went wrong. Unexpected batch loader")
+	}
+	c := &checker{
+		hasher:        v.hasherF(),
+		loader:        loader,
+		defaultHashes: v.defaultHashes,
+		report:        report,
+		leaf:          leaf,
+	}
+
+	root := newRootPosition(uint16(c.hasher.Len() / 8))
+	batch, err := c.loadBatch(root)
+	if err != nil {
+		c.report(root.StringId(), err.Error())
+		return nil
+	}
+	if batch == nil {
+		return nil
+	}
+	c.checkNode(root, batch, 0)
+	return batch.GetElementAt(0)
+}
+
+type checker struct {
+	hasher        hashing.Hasher
+	loader        *defaultBatchLoader
+	defaultHashes []hashing.Digest
+	report        func(pos, reason string)
+	leaf          func(key, value []byte)
+}
+
+// loadBatch loads the batch at the given position, or
+// nil if there is none.
+func (c *checker) loadBatch(pos position) (*batchNode, error) {
+	value, err := c.loader.loadRaw(pos)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load batch: %v", err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	nodeSize := len(pos.Index)
+	if err := checkSerializedBatch(nodeSize, value); err != nil {
+		return nil, err
+	}
+	batch := parseBatchNode(nodeSize, value)
+	if !batch.HasElementAt(0) {
+		return nil, fmt.Errorf("Batch without root node")
+	}
+	return batch, nil
+}
+
+// checkNode checks the node stored at the given index of the batch.
+func (c *checker) checkNode(pos position, batch *batchNode, i int8) {
+	hash := batch.GetElementAt(i)
+	nodeSize := batch.nodeSize
+
+	switch batch.batch[i][nodeSize] {
+	case leafNodeFlag:
+		if i >= 15 || !batch.HasElementAt(2*i+1) || !batch.HasElementAt(2*i+2) {
+			c.report(pos.StringId(), "Shortcut leaf without key and value")
+			return
+		}
+		key, value := batch.GetLeafKVAt(i)
+		if bytes.Compare(key, pos.Index) < 0 || bytes.Compare(key, pos.LastDescendant().Index) > 0 {
+			c.report(pos.StringId(), fmt.Sprintf("Shortcut leaf with key %#x out of its subtree", key))
+			return
+		}
+		if !bytes.Equal(hash, c.hasher.Salted(pos.Bytes(), value)) {
+			c.report(pos.StringId(), "Leaf hash does not match its value")
+		}
+		if c.leaf != nil {
+			c.leaf(key, value)
+		}
+
+	case innerNodeFlag:
+		if i > 0 && pos.Height%4 == 0 {
+			// the root of the next batch
+			next, err := c.loadBatch(pos)
+			if err != nil {
+				c.report(pos.StringId(), err.Error())
+				return
+			}
+			if next == nil {
+				c.report(pos.StringId(), "Missing batch")
+				return
+			}
+			c.checkNode(pos, next, 0)
+			if !bytes.Equal(hash, next.GetElementAt(0)) {
+				c.report(pos.StringId(), "Hash does not match the root of its batch")
+			}
+			return
+		}
+		if pos.IsLeaf() {
+			c.report(pos.StringId(), "Inner node at a leaf")
+			return
+		}
+		left := c.childHash(pos.Left(), batch, 2*i+1)
+		right := c.childHash(pos.Right(), batch, 2*i+2)
+		if left == nil || right == nil {
+			return
+		}
+		// the operations of the tree pop the right hash first
+		if !bytes.Equal(hash, c.hasher.Salted(pos.Bytes(), right, left)) {
+			c.report(pos.StringId(), "Hash does not match its children")
+		}
+
+	default:
+		c.report(pos.StringId(), "Unexpected node type")
+	}
+}
+
+// childHash checks a child node and returns its hash, or
+// nil if it is not a valid node.
+func (c *checker) childHash(pos position, batch *batchNode, i int8) hashing.Digest {
+	if !batch.HasElementAt(i) {
+		return c.defaultHashes[pos.Height]
+	}
+	if batch.batch[i][batch.nodeSize] == keyValueFlag {
+		c.report(pos.StringId(), "Unexpected key or value of a leaf")
+		return nil
+	}
+	c.checkNode(pos, batch, i)
+	return batch.GetElementAt(i)
+}
+
+// checkSerializedBatch checks that a serialized batch holds as many
+// nodes as its bitmap declares. Batches read from the cache are padded
+// with zeros up to the maximum batch size.
+func checkSerializedBatch(nodeSize int, value []byte) error {
+	if len(value) < 4 {
+		return fmt.Errorf("Batch too short: %d bytes", len(value))
+	}
+	if bitIsSet(value[:4], 31) {
+		return fmt.Errorf("Invalid batch bitmap %#x", value[:4])
+	}
+	count := 0
+	for i := 0; i < 31; i++ {
+		if bitIsSet(value[:4], i) {
+			count++
+		}
+	}
+	expected := 4 + count*(nodeSize+1)
+	if len(value) < expected || len(bytes.Trim(value[expected:], "\x00")) > 0 {
+		return fmt.Errorf("Batch of %d bytes, expected %d", len(value), expected)
+	}
+	return nil
+}
+
+// loadRaw returns the serialized batch at the given position,
+// or nil if there is none.
+func (l defaultBatchLoader) loadRaw(pos position) ([]byte, error) {
+	if pos.Height > l.cacheHeightLimit {
+		value, ok := l.cache.Get(pos.Bytes())
+		if !ok {
+			return nil, nil
+		}
+		return value, nil
+	}
+	kv, err := l.store.Get(storage.HyperTable, pos.Bytes())
+	if err == storage.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
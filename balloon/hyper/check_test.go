@@ -0,0 +1,97 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/testutils/rand"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+	"github.com/bbva/qed/util"
+)
+
+func TestCheck(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	hasher := hashing.NewSha256Hasher()
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, NewBatchCache(256, 2))
+
+	view := tree.NewReadView()
+	require.Nil(t, view.Check(func(pos, reason string) {
+		t.Errorf("Unexpected corruption in an empty tree at %s: %s", pos, reason)
+	}, nil))
+	view.Release()
+
+	var rootHash hashing.Digest
+	for i := uint64(0); i < 200; i++ {
+		var mutations []*storage.Mutation
+		var err error
+		rootHash, mutations, err = tree.Add(hasher.Do(rand.Bytes(32)), i)
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+	}
+
+	check := func() (hashing.Digest, map[string]string, int) {
+		view := tree.NewReadView()
+		defer view.Release()
+		corruptions := make(map[string]string)
+		leaves := 0
+		root := view.Check(func(pos, reason string) {
+			corruptions[pos] = reason
+		}, func(key, value []byte) {
+			leaves++
+		})
+		return root, corruptions, leaves
+	}
+
+	root, corruptions, leaves := check()
+	require.Empty(t, corruptions)
+	require.Equal(t, rootHash, root)
+	require.Equal(t, 200, leaves)
+
+	// corrupt the hash of a node of a stored batch
+	reader := store.GetAll(storage.HyperTable)
+	kvs := make([]*storage.KVPair, 1)
+	n, err := reader.Read(kvs)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	reader.Close()
+
+	key, value := kvs[0].Key, append([]byte{}, kvs[0].Value...)
+	value[4] ^= 0xff // first byte of the root node
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HyperTable, key, value),
+	}, nil))
+
+	_, corruptions, _ = check()
+	require.Len(t, corruptions, 1)
+	pos := newPosition(key[2:], util.BytesAsUint16(key[:2]))
+	require.Contains(t, corruptions, pos.StringId(), "The corrupted batch should be reported")
+
+	// truncated batches are reported too
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HyperTable, key, value[:10]),
+	}, nil))
+	_, corruptions, _ = check()
+	require.Contains(t, corruptions[pos.StringId()], "Batch of 10 bytes")
+}
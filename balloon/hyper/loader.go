@@ -17,6 +17,8 @@
 package hyper
 
 import (
+	"bytes"
+
 	"github.com/bbva/qed/log"
 
 	"github.com/bbva/qed/balloon/cache"
@@ -27,11 +29,17 @@ type batchLoader interface {
 	Load(pos position) *batchNode
 }
 
+// batchReader is the part of a store, or a read snapshot
+// of it, needed to load batches.
+type batchReader interface {
+	Get(table storage.Table, key []byte) (*storage.KVPair, error)
+}
+
 // TODO maybe use a function
 type defaultBatchLoader struct {
 	cacheHeightLimit uint16
 	cache            cache.Cache
-	store            storage.Store
+	store            batchReader
 
 	log log.Logger
 }
@@ -81,3 +89,29 @@ func (l defaultBatchLoader) loadBatchFromStore(pos position) *batchNode {
 	batch := parseBatchNode(len(pos.Index), kv.Value)
 	return batch
 }
+
+// historicalBatchLoader loads the batches of the tree as they
+// were once the given version was inserted.
+type historicalBatchLoader struct {
+	store   storage.FloorStore
+	version uint64
+
+	log log.Logger
+}
+
+func (l historicalBatchLoader) Load(pos position) *batchNode {
+	key := pos.Bytes()
+	// the last version of the batch inserted up to the given one
+	kv, err := l.store.GetFloor(storage.HyperHistoryTable, historyKey(key, l.version))
+	if err != nil {
+		if err == storage.ErrKeyNotFound {
+			return newEmptyBatchNode(len(pos.Index))
+		}
+		l.log.Fatalf("Oops, something went wrong. Unable to load batch: %v", err)
+	}
+	if len(kv.Key) != len(key)+8 || !bytes.HasPrefix(kv.Key, key) {
+		// the batch did not exist at that version
+		return newEmptyBatchNode(len(pos.Index))
+	}
+	return parseBatchNode(len(pos.Index), kv.Value)
+}
@@ -41,3 +41,49 @@ var (
 		},
 	)
 )
+
+// Hyper cache metrics
+var (
+	BatchCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subSystem,
+			Name:      "cache_hits_total",
+			Help:      "Number of batches found in the hyper cache.",
+		},
+	)
+	BatchCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subSystem,
+			Name:      "cache_misses_total",
+			Help:      "Number of batches not found in the hyper cache.",
+		},
+	)
+	BatchCacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subSystem,
+			Name:      "cache_entries",
+			Help:      "Number of batches stored in the hyper cache.",
+		},
+	)
+	BatchCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subSystem,
+			Name:      "cache_bytes",
+			Help:      "Bytes allocated or mapped by the hyper cache.",
+		},
+	)
+)
+
+// CacheCollectors returns the prometheus collectors of the hyper cache.
+func CacheCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		BatchCacheHits,
+		BatchCacheMisses,
+		BatchCacheEntries,
+		BatchCacheBytes,
+	}
+}
@@ -32,6 +32,11 @@ type pruningContext struct {
 	Mutations      []*storage.Mutation
 	AuditPath      AuditPath
 	Value          []byte
+
+	// when the tree keeps its history, every batch written
+	// is also stored tagged with the version being inserted
+	KeepHistory bool
+	Version     uint64
 }
 
 type operationCode int
@@ -153,6 +158,9 @@ func putInCache(pos position, batch *batchNode) *operation {
 			if pos.Height == c.RecoveryHeight {
 				c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperCacheTable, key, val))
 			}
+			if c.KeepHistory {
+				c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperHistoryTable, historyKey(key, c.Version), val))
+			}
 			return hash, nil
 		},
 	}
@@ -167,7 +175,12 @@ func mutateBatch(pos position, batch *batchNode) *operation {
 			if err != nil {
 				return nil, err
 			}
-			c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperTable, pos.Bytes(), batch.Serialize()))
+			key := pos.Bytes()
+			val := batch.Serialize()
+			c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperTable, key, val))
+			if c.KeepHistory {
+				c.Mutations = append(c.Mutations, storage.NewMutation(storage.HyperHistoryTable, historyKey(key, c.Version), val))
+			}
 			return hash, nil
 		},
 	}
@@ -0,0 +1,101 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"github.com/bbva/qed/balloon/cache"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+)
+
+// viewableCache is implemented by caches able to provide
+// views of their contents unaffected by later writes.
+type viewableCache interface {
+	View() *BatchCacheView
+}
+
+// ReadView is an immutable view of the hyper tree at the time it was
+// taken. Membership queries on a view neither block nor are blocked
+// by insertions in the tree.
+//
+// The view is only immutable if the cache of the tree can provide views
+// and the store can provide read snapshots. Otherwise, it reads their
+// current contents.
+type ReadView struct {
+	hasherF          func() hashing.Hasher
+	cacheHeightLimit uint16
+	defaultHashes    []hashing.Digest
+	batchLoader      batchLoader
+
+	cacheView *BatchCacheView
+	snapshot  storage.ReadSnapshot
+
+	log log.Logger
+}
+
+// NewReadView takes a view of the current state of the tree. The store must
+// hold the mutations of every insertion made so far, otherwise the view is
+// not consistent. The view must be released once it is no longer used.
+func (t *HyperTree) NewReadView() *ReadView {
+	t.RLock()
+	defer t.RUnlock()
+
+	view := &ReadView{
+		hasherF:          t.hasherF,
+		cacheHeightLimit: t.cacheHeightLimit,
+		defaultHashes:    t.defaultHashes,
+		log:              t.log,
+	}
+
+	var c cache.Cache = t.cache
+	if vc, ok := t.cache.(viewableCache); ok {
+		view.cacheView = vc.View()
+		c = view.cacheView
+	}
+	var reader batchReader = t.store
+	if ss, ok := t.store.(storage.SnapshotStore); ok {
+		view.snapshot = ss.NewReadSnapshot()
+		reader = view.snapshot
+	}
+	view.batchLoader = &defaultBatchLoader{
+		cacheHeightLimit: t.cacheHeightLimit,
+		cache:            c,
+		store:            reader,
+		log:              t.log,
+	}
+
+	return view
+}
+
+// QueryMembership builds the membership proof of the given event digest
+// against the state of the tree when the view was taken.
+func (v *ReadView) QueryMembership(eventDigest hashing.Digest) (*QueryProof, error) {
+	return queryMembership(eventDigest, v.hasherF, v.batchLoader, v.cacheHeightLimit, v.defaultHashes, v.log), nil
+}
+
+// Release frees the resources held by the view.
+func (v *ReadView) Release() {
+	if v.cacheView != nil {
+		v.cacheView.Release()
+		v.cacheView = nil
+	}
+	if v.snapshot != nil {
+		v.snapshot.Release()
+		v.snapshot = nil
+	}
+}
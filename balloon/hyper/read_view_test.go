@@ -0,0 +1,155 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/testutils/rand"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadView(t *testing.T) {
+
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+
+	hasher := hashing.NewSha256Hasher()
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, NewBatchCache(256, 2))
+
+	keys := make([]hashing.Digest, 0)
+	var rootHash hashing.Digest
+	add := func(from, to uint64) {
+		for i := from; i < to; i++ {
+			key := hasher.Do(rand.Bytes(32))
+			var mutations []*storage.Mutation
+			var err error
+			rootHash, mutations, err = tree.Add(key, i)
+			require.NoError(t, err)
+			require.NoError(t, store.Mutate(mutations, nil))
+			keys = append(keys, key)
+		}
+	}
+
+	add(0, 100)
+	view := tree.NewReadView()
+	viewRootHash := rootHash
+
+	// the view is not affected by later insertions
+	add(100, 200)
+
+	for i, key := range keys {
+		proof, err := view.QueryMembership(key)
+		require.NoError(t, err)
+		if i < 100 {
+			require.Truef(t, proof.Verify(key, viewRootHash), "The proof of key %d should verify against the view", i)
+		} else {
+			require.Nilf(t, proof.Value, "Key %d should not exist in the view", i)
+		}
+
+		proof, err = tree.QueryMembership(key)
+		require.NoError(t, err)
+		require.Truef(t, proof.Verify(key, rootHash), "The proof of key %d should verify against the tree", i)
+	}
+
+	view.Release()
+}
+
+// benchmarkMixedLoad runs the given membership query in parallel while
+// a single writer keeps adding events to the tree, and reports the
+// insertion throughput along with the query throughput.
+func benchmarkMixedLoad(b *testing.B, query func(tree *HyperTree, key hashing.Digest)) {
+
+	store, closeF := storage_utils.OpenRocksDBStore(b, "/var/tmp/hyper_tree_mixed_test.db")
+	defer closeF()
+
+	hasher := hashing.NewSha256Hasher()
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, NewBatchCache(256, DefaultBatchLevels))
+
+	keys := make([]hashing.Digest, 10000)
+	for i := range keys {
+		keys[i] = hasher.Do(rand.Bytes(32))
+		_, mutations, err := tree.Add(keys[i], uint64(i))
+		require.NoError(b, err)
+		require.NoError(b, store.Mutate(mutations, nil))
+	}
+
+	var adds uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hasher := hashing.NewSha256Hasher()
+		for version := uint64(len(keys)); ; version++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, mutations, err := tree.Add(hasher.Do(rand.Bytes(32)), version)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if err := store.Mutate(mutations, nil); err != nil {
+				b.Error(err)
+				return
+			}
+			atomic.AddUint64(&adds, 1)
+		}
+	}()
+
+	var next uint64
+	start := time.Now()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&next, 1)
+			query(tree, keys[i%uint64(len(keys))])
+		}
+	})
+	b.StopTimer()
+	elapsed := time.Since(start).Seconds()
+	close(done)
+	wg.Wait()
+
+	b.ReportMetric(float64(atomic.LoadUint64(&adds))/elapsed, "adds/s")
+	b.ReportMetric(float64(b.N)/elapsed, "queries/s")
+}
+
+func BenchmarkQueryMembershipMixedLoad(b *testing.B) {
+	benchmarkMixedLoad(b, func(tree *HyperTree, key hashing.Digest) {
+		_, err := tree.QueryMembership(key)
+		require.NoError(b, err)
+	})
+}
+
+func BenchmarkReadViewQueryMembershipMixedLoad(b *testing.B) {
+	benchmarkMixedLoad(b, func(tree *HyperTree, key hashing.Digest) {
+		view := tree.NewReadView()
+		defer view.Release()
+		_, err := view.QueryMembership(key)
+		require.NoError(b, err)
+	})
+}
@@ -39,6 +39,9 @@ type HyperTree struct {
 	defaultHashes    []hashing.Digest
 	batchLoader      batchLoader
 
+	keepHistory  bool
+	historySince uint64
+
 	log log.Logger
 
 	sync.RWMutex
@@ -53,6 +56,10 @@ func NewHyperTreeWithLogger(hasherF func() hashing.Hasher, store storage.Store,
 	hasher := hasherF()
 	numBits := hasher.Len()
 	cacheHeightLimit := numBits - min(24, numBits/8*4)
+	if c, ok := cache.(levelledCache); ok {
+		// the cache decides how many levels of the tree it holds
+		cacheHeightLimit = numBits - min(uint16(c.Levels())*DefaultBatchHeight, numBits)
+	}
 
 	tree := &HyperTree{
 		store:            store,
@@ -70,12 +77,33 @@ func NewHyperTreeWithLogger(hasherF func() hashing.Hasher, store storage.Store,
 		tree.defaultHashes[i] = tree.hasher.Do(tree.defaultHashes[i-1], tree.defaultHashes[i-1])
 	}
 
-	// warm-up cache
-	tree.RebuildCache()
+	// warm-up cache unless its contents survived a restart, in which
+	// case the balloon decides whether they are still valid
+	if c, ok := cache.(restoredCache); !ok || !restored(c) {
+		tree.RebuildCache()
+	}
 
 	return tree
 }
 
+// levelledCache is implemented by caches that hold a fixed
+// number of batch levels of the tree.
+type levelledCache interface {
+	Levels() uint8
+}
+
+// restoredCache is implemented by caches whose contents
+// can be restored from a previous execution.
+type restoredCache interface {
+	Restored() (uint64, bool)
+	Reset() error
+}
+
+func restored(c restoredCache) bool {
+	_, ok := c.Restored()
+	return ok
+}
+
 // Add function adds an event digest into the hyper tree.
 // It builds a stack of operations and then interpret it to calculates the expected
 // root hash, and returns it along with the storage mutations to be done at balloon level.
@@ -95,6 +123,8 @@ func (t *HyperTree) Add(eventDigest hashing.Digest, version uint64) (hashing.Dig
 		RecoveryHeight: t.cacheHeightLimit + 4,
 		DefaultHashes:  t.defaultHashes,
 		Mutations:      make([]*storage.Mutation, 0),
+		KeepHistory:    t.keepHistory,
+		Version:        version,
 	}
 
 	rh, err := ops.Pop().Interpret(ops, ctx)
@@ -127,6 +157,10 @@ func (t *HyperTree) AddBulk(eventDigests []hashing.Digest, initialVersion uint64
 		RecoveryHeight: t.cacheHeightLimit + 4,
 		DefaultHashes:  t.defaultHashes,
 		Mutations:      make([]*storage.Mutation, 0),
+		// the whole bulk is kept as a single version, since the
+		// snapshots of every event share the same root hash
+		KeepHistory: t.keepHistory,
+		Version:     initialVersion,
 	}
 
 	rh, err := ops.Pop().Interpret(ops, ctx)
@@ -139,30 +173,36 @@ func (t *HyperTree) AddBulk(eventDigests []hashing.Digest, initialVersion uint64
 
 // QueryMembership function builds the membership proof of the given event digest.
 // It builds a stack of operations and then interpret it to generate and return the audit
-// path.
+// path. Concurrent queries do not block each other, but they are blocked by
+// insertions. Use a ReadView to avoid it.
 func (t *HyperTree) QueryMembership(eventDigest hashing.Digest) (proof *QueryProof, err error) {
-	t.Lock()
-	defer t.Unlock()
+	t.RLock()
+	defer t.RUnlock()
 
 	//t.log.Tracef("Proving membership for index %d", eventDigest)
 
+	return queryMembership(eventDigest, t.hasherF, t.batchLoader, t.cacheHeightLimit, t.defaultHashes, t.log), nil
+}
+
+func queryMembership(eventDigest hashing.Digest, hasherF func() hashing.Hasher, loader batchLoader, cacheHeightLimit uint16, defaultHashes []hashing.Digest, logger log.Logger) *QueryProof {
+
 	// build a stack of operations and then interpret it to generate the audit path
-	ops := pruneToFind(eventDigest, t.batchLoader)
+	ops := pruneToFind(eventDigest, loader)
 	ctx := &pruningContext{
-		Hasher:         t.hasher,
-		Cache:          t.cache,
-		RecoveryHeight: t.cacheHeightLimit + 4,
-		DefaultHashes:  t.defaultHashes,
+		// the hasher of the tree cannot be shared between concurrent queries
+		Hasher:         hasherF(),
+		RecoveryHeight: cacheHeightLimit + 4,
+		DefaultHashes:  defaultHashes,
 		AuditPath:      make(AuditPath, 0),
 	}
 
-	_, err = ops.Pop().Interpret(ops, ctx)
+	_, err := ops.Pop().Interpret(ops, ctx)
 	if err != nil {
-		t.log.Fatalf("Invalid operation: %v", err)
+		logger.Fatalf("Invalid operation: %v", err)
 	}
 
 	// ctx.Value is nil if the digest does not exist
-	return NewQueryProof(eventDigest, ctx.Value, ctx.AuditPath, t.hasherF()), nil
+	return NewQueryProof(eventDigest, ctx.Value, ctx.AuditPath, hasherF())
 }
 
 // RebuildCache function reads the hypercache rocksDB table to create indexes and cache.
@@ -174,6 +214,13 @@ func (t *HyperTree) RebuildCache() {
 	// warm up cache
 	t.log.Info("Warming up hyper cache...")
 
+	// stale entries must not survive the rebuild
+	if c, ok := t.cache.(restoredCache); ok {
+		if err := c.Reset(); err != nil {
+			t.log.Fatalf("Unable to reset hyper cache: %v", err)
+		}
+	}
+
 	indexes := make([][]byte, 0)
 
 	tileReader := t.store.GetAll(storage.HyperCacheTable)
@@ -185,6 +232,9 @@ func (t *HyperTree) RebuildCache() {
 		}
 
 		for i := 0; i < n; i++ {
+			if height := util.BytesAsUint16(tiles[i].Key[:2]); height != t.cacheHeightLimit+4 {
+				t.log.Fatalf("Hyper cache entries at height %d do not match the configured cache levels", height)
+			}
 			indexes = append(indexes, tiles[i].Key[2:])
 			t.cache.Put(tiles[i].Key, tiles[i].Value)
 		}
@@ -0,0 +1,155 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/util"
+)
+
+// ErrHistoryNotKept is returned by the historical queries of a version
+// the tree does not keep in its history.
+var ErrHistoryNotKept = errors.New("The hyper tree history is not kept")
+
+// historySinceKey holds the first version of the tree kept in the
+// history table. It never collides with the key of a batch.
+var historySinceKey = []byte("since")
+
+// historyKey returns the key of a batch in the history table,
+// which sorts every version of a batch by version.
+func historyKey(pos []byte, version uint64) []byte {
+	key := make([]byte, len(pos)+8)
+	copy(key, pos)
+	copy(key[len(pos):], util.Uint64AsBytes(version))
+	return key
+}
+
+// KeepHistory makes the tree keep every version of its batches, so
+// membership can be proven against the root hash of the tree at any
+// version inserted from then on.
+//
+// The first time it is called, the current contents of the tree are kept
+// as the ones of the given version, and the mutations to store them are
+// returned. Once stored, later calls restore the first version kept.
+func (t *HyperTree) KeepHistory(version uint64) ([]*storage.Mutation, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.store.(storage.FloorStore); !ok {
+		return nil, fmt.Errorf("The store does not support keeping the hyper tree history")
+	}
+
+	kv, err := t.store.Get(storage.HyperHistoryTable, historySinceKey)
+	if err == nil {
+		t.keepHistory = true
+		t.historySince = util.BytesAsUint64(kv.Value)
+		return nil, nil
+	}
+	if err != storage.ErrKeyNotFound {
+		return nil, err
+	}
+
+	t.log.Infof("Keeping hyper tree history since version %d", version)
+
+	mutations := []*storage.Mutation{
+		storage.NewMutation(storage.HyperHistoryTable, historySinceKey, util.Uint64AsBytes(version)),
+	}
+
+	// batches below the cache are copied from the store...
+	reader := t.store.GetAll(storage.HyperTable)
+	defer reader.Close()
+	batches := make([]*storage.KVPair, 1000)
+	for {
+		n, err := reader.Read(batches)
+		if n == 0 || err != nil {
+			break
+		}
+		for i := 0; i < n; i++ {
+			mutations = append(mutations, storage.NewMutation(storage.HyperHistoryTable, historyKey(batches[i].Key, version), batches[i].Value))
+		}
+	}
+
+	// ...as well as the lowest ones in the cache, and the rest
+	// of the cache is visited rebuilding it from them
+	indexes := make([][]byte, 0)
+	tileReader := t.store.GetAll(storage.HyperCacheTable)
+	defer tileReader.Close()
+	tiles := make([]*storage.KVPair, 1000)
+	for {
+		n, err := tileReader.Read(tiles)
+		if n == 0 || err != nil {
+			break
+		}
+		for i := 0; i < n; i++ {
+			indexes = append(indexes, tiles[i].Key[2:])
+			mutations = append(mutations, storage.NewMutation(storage.HyperHistoryTable, historyKey(tiles[i].Key, version), tiles[i].Value))
+		}
+	}
+	if len(indexes) > 0 {
+		ops := pruneToRebuild(indexes, t.cacheHeightLimit+4, t.batchLoader)
+		ctx := &pruningContext{
+			Hasher:         t.hasher,
+			Cache:          t.cache,
+			RecoveryHeight: t.cacheHeightLimit + 4,
+			DefaultHashes:  t.defaultHashes,
+			Mutations:      mutations,
+			KeepHistory:    true,
+			Version:        version,
+		}
+		if _, err := ops.Pop().Interpret(ops, ctx); err != nil {
+			return nil, err
+		}
+		mutations = ctx.Mutations
+	}
+
+	t.keepHistory = true
+	t.historySince = version
+	return mutations, nil
+}
+
+// HistorySince returns the first version of the tree kept
+// in its history, and false if the history is not kept.
+func (t *HyperTree) HistorySince() (uint64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.historySince, t.keepHistory
+}
+
+// QueryMembershipAt builds the membership proof of the given event digest
+// against the root hash of the tree once the given version was inserted.
+// The version must have been kept in the history of the tree, otherwise
+// it fails with ErrHistoryNotKept, and its insertion must have been
+// applied to the store.
+func (t *HyperTree) QueryMembershipAt(eventDigest hashing.Digest, version uint64) (*QueryProof, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if !t.keepHistory || version < t.historySince {
+		return nil, ErrHistoryNotKept
+	}
+
+	loader := &historicalBatchLoader{
+		store:   t.store.(storage.FloorStore),
+		version: version,
+		log:     t.log,
+	}
+	return queryMembership(eventDigest, t.hasherF, loader, t.cacheHeightLimit, t.defaultHashes, t.log), nil
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package hyper
+
+import (
+	"testing"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/testutils/rand"
+	storage_utils "github.com/bbva/qed/testutils/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryMembershipAt(t *testing.T) {
+
+	hasher := hashing.NewSha256Hasher()
+	store, closeF := storage_utils.OpenBPlusTreeStore()
+	defer closeF()
+	tree := NewHyperTree(hashing.NewSha256Hasher, store, NewBatchCache(hasher.Len(), 2))
+
+	_, err := tree.QueryMembershipAt(hasher.Do([]byte("event")), 0)
+	require.Equal(t, ErrHistoryNotKept, err, "Historical queries should fail if the history is not kept")
+
+	keys := make([]hashing.Digest, 0)
+	rootHashes := make([]hashing.Digest, 0)
+	add := func() {
+		key := hasher.Do(rand.Bytes(32))
+		rootHash, mutations, err := tree.Add(key, uint64(len(keys)))
+		require.NoError(t, err)
+		require.NoError(t, store.Mutate(mutations, nil))
+		keys = append(keys, key)
+		rootHashes = append(rootHashes, rootHash)
+	}
+
+	// the history starts with the contents of the tree
+	for i := 0; i < 20; i++ {
+		add()
+	}
+	mutations, err := tree.KeepHistory(19)
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations, nil))
+	since, ok := tree.HistorySince()
+	require.True(t, ok)
+	require.Equal(t, uint64(19), since)
+
+	for i := 0; i < 20; i++ {
+		add()
+	}
+
+	// a bulk is kept as the version of its first event
+	bulk := make([]hashing.Digest, 0)
+	for i := 0; i < 10; i++ {
+		bulk = append(bulk, hasher.Do(rand.Bytes(32)))
+	}
+	rootHash, mutations, err := tree.AddBulk(bulk, uint64(len(keys)))
+	require.NoError(t, err)
+	require.NoError(t, store.Mutate(mutations, nil))
+	for _, key := range bulk {
+		keys = append(keys, key)
+		rootHashes = append(rootHashes, rootHash)
+	}
+
+	for version := since; version < uint64(len(keys)); version++ {
+		for i, key := range keys {
+			proof, err := tree.QueryMembershipAt(key, version)
+			require.NoError(t, err)
+			inBulk := i >= 40 && version >= 40
+			if uint64(i) > version && !inBulk {
+				require.Emptyf(t, proof.Value, "Key %d should not exist at version %d", i, version)
+				continue
+			}
+			require.Truef(t, proof.Verify(key, rootHashes[version]), "Key %d should be a member at version %d", i, version)
+		}
+	}
+
+	_, err = tree.QueryMembershipAt(keys[0], since-1)
+	require.Equal(t, ErrHistoryNotKept, err, "Versions before the history was kept should not be available")
+
+	// the history is restored once stored
+	restored := NewHyperTree(hashing.NewSha256Hasher, store, NewBatchCache(hasher.Len(), 2))
+	mutations, err = restored.KeepHistory(100)
+	require.NoError(t, err)
+	require.Empty(t, mutations)
+	since, _ = restored.HistorySince()
+	require.Equal(t, uint64(19), since)
+}
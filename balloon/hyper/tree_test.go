@@ -380,7 +380,7 @@ func TestAddAndQuery(t *testing.T) {
 	defer closeF()
 
 	hasher := hashing.NewSha256Hasher()
-	batchCache := NewBatchCache(DefaultBatchLevels)
+	batchCache := NewBatchCache(256, DefaultBatchLevels)
 	tree := NewHyperTree(hashing.NewSha256Hasher, store, batchCache)
 
 	size := 1000
@@ -407,7 +407,7 @@ func BenchmarkAdd(b *testing.B) {
 	defer closeF()
 
 	hasher := hashing.NewSha256Hasher()
-	batchCache := NewBatchCache(DefaultBatchLevels)
+	batchCache := NewBatchCache(256, DefaultBatchLevels)
 	tree := NewHyperTree(hashing.NewSha256Hasher, store, batchCache)
 
 	hyperMetrics := metrics_utils.CustomRegister(AddTotal)
@@ -434,7 +434,7 @@ func BenchmarkAddBulk(b *testing.B) {
 	defer closeF()
 
 	hasher := hashing.NewSha256Hasher()
-	batchCache := NewBatchCache(DefaultBatchLevels)
+	batchCache := NewBatchCache(256, DefaultBatchLevels)
 	tree := NewHyperTree(hashing.NewSha256Hasher, store, batchCache)
 
 	hyperMetrics := metrics_utils.CustomRegister(AddTotal)
@@ -473,7 +473,7 @@ func BenchmarkRebuildCacheTime(b *testing.B) {
 	defer closeF()
 
 	hasher := hashing.NewSha256Hasher()
-	batchCache := NewBatchCache(DefaultBatchLevels)
+	batchCache := NewBatchCache(256, DefaultBatchLevels)
 	tree := NewHyperTree(hashing.NewSha256Hasher, store, batchCache)
 
 	hyperMetrics := metrics_utils.CustomRegister(AddTotal)
@@ -494,7 +494,7 @@ func BenchmarkRebuildCacheTime(b *testing.B) {
 	b.ResetTimer()
 
 	tree.Close()
-	nBatchCache := NewBatchCache(DefaultBatchLevels)
+	nBatchCache := NewBatchCache(256, DefaultBatchLevels)
 	before := time.Now()
 	ntree := NewHyperTree(hashing.NewSha256Hasher, store, nBatchCache)
 	after := time.Now()
@@ -30,11 +30,18 @@ import (
 
 	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
 )
 
 // HTTPClient is an HTTP QED client.
+//
+// Every operation has a WithContext variant. Its context cancels the
+// operation or bounds it with a deadline, aborting the requests in flight,
+// their retries and the topology discovery they trigger. The variants
+// without context use a background one, bounded only by Config.Timeout.
 type HTTPClient struct {
 	httpClient          *http.Client
 	retrier             RequestRetrier
@@ -48,6 +55,7 @@ type HTTPClient struct {
 	healthCheckInterval time.Duration
 	discoveryEnabled    bool
 	hasherF             func() hashing.Hasher
+	trust               *trustedHead
 	log                 log.Logger
 
 	mu                sync.RWMutex // guards the next block
@@ -175,6 +183,7 @@ func NewHTTPClient(options ...HTTPClientOptionF) (*HTTPClient, error) {
 		discoveryEnabled:    DefaultTopologyDiscoveryEnabled,
 		readPreference:      Primary,
 		maxRetries:          DefaultMaxRetries,
+		hasherF:             hashing.NewSha256Hasher,
 		healthCheckStopCh:   make(chan bool),
 		discoveryStopCh:     make(chan bool),
 		log:                 log.L(),
@@ -195,14 +204,14 @@ func NewHTTPClient(options ...HTTPClientOptionF) (*HTTPClient, error) {
 	// Initial topology assignment
 	if client.discoveryEnabled {
 		// try to discover the cluster topology initially
-		if err := client.discover(); err != nil {
+		if err := client.discover(context.Background()); err != nil {
 			client.log.Infof("Unable to get QED topology, we will try it later: %v", err)
 		}
 	}
 
 	if client.healthCheckEnabled {
 		// perform an initial healthcheck
-		client.clusterHealthCheck(client.healthCheckTimeout)
+		client.clusterHealthCheck(context.Background(), client.healthCheckTimeout)
 	}
 
 	// Ensure that we have at least one endpoint, the primary, available
@@ -277,7 +286,7 @@ func (c *HTTPClient) startDiscoverer() {
 
 }
 
-func (c *HTTPClient) callPrimary(method, path string, data []byte) ([]byte, error) {
+func (c *HTTPClient) callPrimary(ctx context.Context, method, path string, data []byte) ([]byte, error) {
 
 	var endpoint *endpoint
 	var err error
@@ -288,7 +297,7 @@ func (c *HTTPClient) callPrimary(method, path string, data []byte) ([]byte, erro
 
 		if err == ErrPrimaryDead {
 			if c.healthCheckEnabled && !healthRetried {
-				c.clusterHealthCheck(c.healthCheckTimeout)
+				c.clusterHealthCheck(ctx, c.healthCheckTimeout)
 				healthRetried = true
 				continue
 			}
@@ -297,7 +306,7 @@ func (c *HTTPClient) callPrimary(method, path string, data []byte) ([]byte, erro
 
 		if err == ErrNoPrimary || (err == ErrPrimaryDead && healthRetried) {
 			if c.discoveryEnabled && !discoveryRetried {
-				err = c.discover()
+				err = c.discover(ctx)
 				discoveryRetried = true
 				if err != nil {
 					return nil, err
@@ -309,10 +318,10 @@ func (c *HTTPClient) callPrimary(method, path string, data []byte) ([]byte, erro
 
 		break
 	}
-	return c.doReq(method, endpoint, path, data)
+	return c.doReq(ctx, method, endpoint, path, data)
 }
 
-func (c *HTTPClient) callAny(method, path string, data []byte) ([]byte, error) {
+func (c *HTTPClient) callAny(ctx context.Context, method, path string, data []byte) ([]byte, error) {
 
 	var endpoint *endpoint
 	var retried bool
@@ -324,7 +333,7 @@ func (c *HTTPClient) callAny(method, path string, data []byte) ([]byte, error) {
 		endpoint, errTopology = c.topology.NextReadEndpoint(c.readPreference)
 		if errTopology != nil {
 			if !retried && c.discoveryEnabled {
-				_ = c.discover()
+				_ = c.discover(ctx)
 				retried = true
 				continue
 			}
@@ -333,10 +342,15 @@ func (c *HTTPClient) callAny(method, path string, data []byte) ([]byte, error) {
 			}
 			return nil, errTopology
 		}
-		result, errRequest = c.doReq(method, endpoint, path, data)
+		result, errRequest = c.doReq(ctx, method, endpoint, path, data)
 		if errRequest == nil {
 			break
 		}
+		// neither a cancelled request nor one rejected by the server
+		// say anything about the endpoint
+		if _, rejected := errRequest.(*RequestError); rejected || ctx.Err() != nil {
+			return nil, errRequest
+		}
 		endpoint.MarkAsDead()
 	}
 	if errRequest != nil {
@@ -346,31 +360,42 @@ func (c *HTTPClient) callAny(method, path string, data []byte) ([]byte, error) {
 	return result, errTopology
 }
 
-func (c *HTTPClient) doReq(method string, endpoint *endpoint, path string, data []byte) ([]byte, error) {
+func (c *HTTPClient) doReq(ctx context.Context, method string, endpoint *endpoint, path string, data []byte) ([]byte, error) {
 
 	url, err := url.Parse(endpoint.URL() + path)
 	if err != nil {
 		return nil, err
 	}
 
+	// The span is propagated to the server, which continues the trace
+	ctx, span := tracing.StartSpan(ctx, "client "+method+" "+path)
+	defer span.End()
+
 	// Build request
-	req, err := NewRetriableRequest(method, url.String(), data)
+	req, err := NewRetriableRequestWithContext(ctx, method, url.String(), data)
 	if err != nil {
 		return nil, err
 	}
+	span.SetAttribute("http.url", url.String())
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Api-Key", c.apiKey)
+	tracing.Inject(ctx, req.Header)
 
 	// Get response
 	resp, err := c.retrier.DoReq(req)
 	if err != nil {
+		span.SetError(err)
 		c.log.Infof("Request error: %v\n", err)
+		if ctx.Err() != nil {
+			return nil, err
+		}
 		endpoint.MarkAsDead()
 		c.log.Infof("%s is dead\n", endpoint)
 		return nil, err
 	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
 
 	var bodyBytes []byte
 	if resp.Body != nil {
@@ -382,7 +407,7 @@ func (c *HTTPClient) doReq(method string, endpoint *endpoint, path string, data
 	}
 
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		return nil, fmt.Errorf("Invalid request %v", string(bodyBytes))
+		return nil, &RequestError{StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	// we successfully made a request to this endpoint
@@ -394,7 +419,7 @@ func (c *HTTPClient) doReq(method string, endpoint *endpoint, path string, data
 // healthCheck does a health check on all nodes in the cluster.
 // Depending on the node state, it marks connections as dead, alive etc.
 // The timeout specifies how long to wait for a response from QED.
-func (c *HTTPClient) clusterHealthCheck(timeout time.Duration) {
+func (c *HTTPClient) clusterHealthCheck(ctx context.Context, timeout time.Duration) {
 
 	var wg sync.WaitGroup
 	for _, e := range c.topology.Endpoints() {
@@ -406,7 +431,7 @@ func (c *HTTPClient) clusterHealthCheck(timeout time.Duration) {
 			defer wg.Done()
 
 			// Run a HEAD request against QED with a timeout
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			ctx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
 			req, err := http.NewRequest("HEAD", endpointURL+"/healthcheck", nil)
@@ -441,7 +466,7 @@ func (c *HTTPClient) clusterHealthCheck(timeout time.Duration) {
 // discover uses the shards info API to return the list of nodes in the cluster.
 // It uses the list of URLs passed on startup plus the list of URLs found
 // by the preceding discovery process (if discovery is enabled).
-func (c *HTTPClient) discover() error {
+func (c *HTTPClient) discover(ctx context.Context) error {
 
 	for {
 		e, err := c.topology.NextReadEndpoint(Any)
@@ -449,7 +474,10 @@ func (c *HTTPClient) discover() error {
 			return err
 		}
 
-		body, err := c.doReq("GET", e, "/info/shards", nil)
+		body, err := c.doReq(ctx, "GET", e, "/info/shards", nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
 		if err == nil {
 			var shards protocol.Shards
@@ -490,14 +518,19 @@ func (c *HTTPClient) startHealthChecker() {
 		case <-c.healthCheckStopCh:
 			return
 		case <-ticker.C:
-			c.clusterHealthCheck(timeout)
+			c.clusterHealthCheck(context.Background(), timeout)
 		}
 	}
 }
 
 // Ping will do a healthcheck request to the primary node
 func (c *HTTPClient) Ping() error {
-	_, err := c.callPrimary("HEAD", "/healthcheck", nil)
+	return c.PingWithContext(context.Background())
+}
+
+// PingWithContext is like Ping with a context.
+func (c *HTTPClient) PingWithContext(ctx context.Context) error {
+	_, err := c.callPrimary(ctx, "HEAD", "/healthcheck", nil)
 	if err != nil {
 		return err
 	}
@@ -506,9 +539,14 @@ func (c *HTTPClient) Ping() error {
 
 // Add will do a request to the server with a post data to store a new event.
 func (c *HTTPClient) Add(event string) (*protocol.Snapshot, error) {
+	return c.AddWithContext(context.Background(), event)
+}
+
+// AddWithContext is like Add with a context.
+func (c *HTTPClient) AddWithContext(ctx context.Context, event string) (*protocol.Snapshot, error) {
 
 	data, _ := json.Marshal(&protocol.Event{Event: []byte(event)})
-	body, err := c.callPrimary("POST", "/events", data)
+	body, err := c.callPrimary(ctx, "POST", "/events", data)
 	if err != nil {
 		return nil, err
 	}
@@ -524,14 +562,22 @@ func (c *HTTPClient) Add(event string) (*protocol.Snapshot, error) {
 
 // AddBulk will do a request to the server with a post data to store a bulk of new events.
 func (c *HTTPClient) AddBulk(events []string) ([]*protocol.Snapshot, error) {
+	return c.AddBulkWithContext(context.Background(), events)
+}
+
+// AddBulkWithContext is like AddBulk with a context.
+func (c *HTTPClient) AddBulkWithContext(ctx context.Context, events []string) ([]*protocol.Snapshot, error) {
 
 	eventBulk := protocol.EventsBulk{}
 	for _, e := range events {
 		eventBulk.Events = append(eventBulk.Events, []byte(e))
 	}
+	return c.addBulk(ctx, &eventBulk)
+}
 
+func (c *HTTPClient) addBulk(ctx context.Context, eventBulk *protocol.EventsBulk) ([]*protocol.Snapshot, error) {
 	data, _ := json.Marshal(eventBulk)
-	body, err := c.callPrimary("POST", "/events/bulk", data)
+	body, err := c.callPrimary(ctx, "POST", "/events/bulk", data)
 	if err != nil {
 		return nil, err
 	}
@@ -547,6 +593,11 @@ func (c *HTTPClient) AddBulk(events []string) ([]*protocol.Snapshot, error) {
 
 // Membership will ask for a Proof to the server.
 func (c *HTTPClient) Membership(key []byte, version *uint64) (*balloon.MembershipProof, error) {
+	return c.MembershipWithContext(context.Background(), key, version)
+}
+
+// MembershipWithContext is like Membership with a context.
+func (c *HTTPClient) MembershipWithContext(ctx context.Context, key []byte, version *uint64) (*balloon.MembershipProof, error) {
 	var query []byte
 
 	if version == nil {
@@ -560,7 +611,7 @@ func (c *HTTPClient) Membership(key []byte, version *uint64) (*balloon.Membershi
 		})
 
 	}
-	body, err := c.callAny("POST", "/proofs/membership", query)
+	body, err := c.callAny(ctx, "POST", "/proofs/membership", query)
 	if err != nil {
 		return nil, err
 	}
@@ -577,6 +628,11 @@ func (c *HTTPClient) Membership(key []byte, version *uint64) (*balloon.Membershi
 
 // Membership will ask for a Proof to the server.
 func (c *HTTPClient) MembershipDigest(keyDigest hashing.Digest, version *uint64) (*balloon.MembershipProof, error) {
+	return c.MembershipDigestWithContext(context.Background(), keyDigest, version)
+}
+
+// MembershipDigestWithContext is like MembershipDigest with a context.
+func (c *HTTPClient) MembershipDigestWithContext(ctx context.Context, keyDigest hashing.Digest, version *uint64) (*balloon.MembershipProof, error) {
 	var query []byte
 
 	if version == nil {
@@ -590,7 +646,7 @@ func (c *HTTPClient) MembershipDigest(keyDigest hashing.Digest, version *uint64)
 		})
 	}
 
-	body, err := c.callAny("POST", "/proofs/digest-membership", query)
+	body, err := c.callAny(ctx, "POST", "/proofs/digest-membership", query)
 	if err != nil {
 		return nil, err
 	}
@@ -605,6 +661,71 @@ func (c *HTTPClient) MembershipDigest(keyDigest hashing.Digest, version *uint64)
 	return proof, nil
 }
 
+// MembershipAt will ask for a Proof to the server against the given version,
+// and the hyper tree at that version, so it can be verified with the snapshot
+// of that version. The server must keep the hyper tree history of the version,
+// otherwise it fails with ErrHistoricalUnsupported.
+func (c *HTTPClient) MembershipAt(key []byte, version uint64) (*balloon.MembershipProof, error) {
+	return c.MembershipAtWithContext(context.Background(), key, version)
+}
+
+// MembershipAtWithContext is like MembershipAt with a context.
+func (c *HTTPClient) MembershipAtWithContext(ctx context.Context, key []byte, version uint64) (*balloon.MembershipProof, error) {
+	query, _ := json.Marshal(&protocol.MembershipQuery{
+		Key:        key,
+		Version:    &version,
+		Historical: true,
+	})
+	body, err := c.callAny(ctx, "POST", "/proofs/membership", query)
+	if err != nil {
+		return nil, historicalError(err)
+	}
+
+	var result *protocol.MembershipResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.ToBalloonProof(result, c.hasherF), nil
+}
+
+// MembershipDigestAt is like MembershipAt but queries with the
+// digest of the event.
+func (c *HTTPClient) MembershipDigestAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	return c.MembershipDigestAtWithContext(context.Background(), keyDigest, version)
+}
+
+// MembershipDigestAtWithContext is like MembershipDigestAt with a context.
+func (c *HTTPClient) MembershipDigestAtWithContext(ctx context.Context, keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	query, _ := json.Marshal(&protocol.MembershipDigest{
+		KeyDigest:  keyDigest,
+		Version:    &version,
+		Historical: true,
+	})
+	body, err := c.callAny(ctx, "POST", "/proofs/digest-membership", query)
+	if err != nil {
+		return nil, historicalError(err)
+	}
+
+	var result *protocol.MembershipResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.ToBalloonProof(result, c.hasherF), nil
+}
+
+// historicalError translates the rejection of a historical query by a
+// server not keeping the hyper tree history of the version.
+func historicalError(err error) error {
+	if e, ok := err.(*RequestError); ok && e.StatusCode == http.StatusUnprocessableEntity {
+		return ErrHistoricalUnsupported
+	}
+	return err
+}
+
 // MembershipVerify will compute the Proof given in Membership and the snapshot from the
 // add and returns the verification result.
 func (c *HTTPClient) MembershipVerify(
@@ -612,17 +733,41 @@ func (c *HTTPClient) MembershipVerify(
 	proof *balloon.MembershipProof,
 	snapshot *balloon.Snapshot,
 ) (bool, error) {
+	return c.MembershipVerifyWithContext(context.Background(), eventDigest, proof, snapshot)
+}
 
-	return proof.DigestVerify(eventDigest, snapshot), nil
+// MembershipVerifyWithContext is like MembershipVerify with a context.
+func (c *HTTPClient) MembershipVerifyWithContext(
+	ctx context.Context,
+	eventDigest hashing.Digest,
+	proof *balloon.MembershipProof,
+	snapshot *balloon.Snapshot,
+) (bool, error) {
+
+	if !proof.DigestVerify(eventDigest, snapshot) {
+		return false, nil
+	}
+	// the history digest is only proved for events of the query version
+	if proof.Exists && proof.ActualVersion <= proof.QueryVersion {
+		if err := c.checkTrustedHead(ctx, proof.QueryVersion, snapshot.HistoryDigest, nil); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 // MembershipAutoVerify will compute the Proof given in Membership,
 // get hyper and history digests from the snapshot store,
 // and returns the verification result.
 func (c *HTTPClient) MembershipAutoVerify(eventDigest hashing.Digest, version *uint64) (bool, error) {
+	return c.MembershipAutoVerifyWithContext(context.Background(), eventDigest, version)
+}
+
+// MembershipAutoVerifyWithContext is like MembershipAutoVerify with a context.
+func (c *HTTPClient) MembershipAutoVerifyWithContext(ctx context.Context, eventDigest hashing.Digest, version *uint64) (bool, error) {
 
 	// Get membership proof
-	proof, err := c.MembershipDigest(eventDigest, version)
+	proof, err := c.MembershipDigestWithContext(ctx, eventDigest, version)
 	if err != nil {
 		c.log.Infof("Error getting membership proof: %s", err)
 		return false, err
@@ -636,34 +781,64 @@ func (c *HTTPClient) MembershipAutoVerify(eventDigest hashing.Digest, version *u
 		EventDigest:   eventDigest,
 	}
 
-	s, err := c.GetSnapshot(proof.QueryVersion)
+	s, err := c.GetSignedSnapshotWithContext(ctx, proof.QueryVersion)
 	if err != nil {
 		c.log.Infof("Error getting snapshot from snapshot store: %s", err)
 		return false, err
 	}
+	signed := []*protocol.SignedSnapshot{s}
 
-	snapshot.HistoryDigest = s.HistoryDigest
-	snapshot.HyperDigest = s.HyperDigest
+	snapshot.HistoryDigest = s.Snapshot.HistoryDigest
+	snapshot.HyperDigest = s.Snapshot.HyperDigest
 
 	if proof.CurrentVersion != proof.ActualVersion {
-		s, err := c.GetSnapshot(proof.CurrentVersion)
+		s, err := c.GetSignedSnapshotWithContext(ctx, proof.CurrentVersion)
 		if err != nil {
 			c.log.Infof("Error getting snapshot from snapshot store: %s", err)
 			return false, err
 		}
-		snapshot.HyperDigest = s.HyperDigest
+		snapshot.HyperDigest = s.Snapshot.HyperDigest
+		signed = append(signed, s)
 	}
 
 	// Verify
-	return proof.DigestVerify(eventDigest, snapshot), nil
+	if !proof.DigestVerify(eventDigest, snapshot) {
+		return false, nil
+	}
+	for _, s := range signed {
+		if err := c.checkTrustedHead(ctx, s.Snapshot.Version, s.Snapshot.HistoryDigest, s); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 // GetSnapshot will ask for a given snapshot version to the snapshot store
 // and returns the required snapshot
 func (c *HTTPClient) GetSnapshot(version uint64) (*protocol.Snapshot, error) {
+	return c.GetSnapshotWithContext(context.Background(), version)
+}
+
+// GetSnapshotWithContext is like GetSnapshot with a context.
+func (c *HTTPClient) GetSnapshotWithContext(ctx context.Context, version uint64) (*protocol.Snapshot, error) {
+	ss, err := c.GetSignedSnapshotWithContext(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return ss.Snapshot, nil
+}
+
+// GetSignedSnapshot is like GetSnapshot but keeps the signature
+// of the snapshot.
+func (c *HTTPClient) GetSignedSnapshot(version uint64) (*protocol.SignedSnapshot, error) {
+	return c.GetSignedSnapshotWithContext(context.Background(), version)
+}
+
+// GetSignedSnapshotWithContext is like GetSignedSnapshot with a context.
+func (c *HTTPClient) GetSignedSnapshotWithContext(ctx context.Context, version uint64) (*protocol.SignedSnapshot, error) {
 	var ss protocol.SignedSnapshot
 
-	body, err := c.doReq("GET", c.snapshotStore, fmt.Sprintf("/snapshot?v=%d", version), nil)
+	body, err := c.doReq(ctx, "GET", c.snapshotStore, fmt.Sprintf("/snapshot?v=%d", version), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -672,19 +847,105 @@ func (c *HTTPClient) GetSnapshot(version uint64) (*protocol.Snapshot, error) {
 	if err != nil {
 		return nil, err
 	}
+	if ss.Snapshot == nil {
+		return nil, fmt.Errorf("Snapshot %d not found in the snapshot store", version)
+	}
 
-	return ss.Snapshot, nil
+	return &ss, nil
+}
+
+// GetSignedAuditRoot asks the snapshot store for the signed root of the
+// audit log at the given version, to verify audit proofs against it.
+func (c *HTTPClient) GetSignedAuditRoot(version uint64) (*protocol.SignedAuditRoot, error) {
+	return c.GetSignedAuditRootWithContext(context.Background(), version)
+}
+
+// GetSignedAuditRootWithContext is like GetSignedAuditRoot with a context.
+func (c *HTTPClient) GetSignedAuditRootWithContext(ctx context.Context, version uint64) (*protocol.SignedAuditRoot, error) {
+	var root protocol.SignedAuditRoot
+
+	body, err := c.doReq(ctx, "GET", c.snapshotStore, fmt.Sprintf("/audit/root?v=%d", version), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(body, &root)
+	if err != nil {
+		return nil, err
+	}
+	if root.Root == nil {
+		return nil, fmt.Errorf("Audit root %d not found in the snapshot store", version)
+	}
+
+	return &root, nil
+}
+
+// MembershipBundle asks for the membership proof of an event digest and
+// the signed snapshots to verify it, and packs them along with the public
+// key of the snapshots into a proof bundle, to be verified offline with
+// its Verify method. A historical bundle proves the event against the
+// hyper tree of the given version, which must be set.
+func (c *HTTPClient) MembershipBundle(eventDigest hashing.Digest, version *uint64, historical bool, publicKey []byte) (*protocol.ProofBundle, error) {
+	return c.MembershipBundleWithContext(context.Background(), eventDigest, version, historical, publicKey)
+}
+
+// MembershipBundleWithContext is like MembershipBundle with a context.
+func (c *HTTPClient) MembershipBundleWithContext(ctx context.Context, eventDigest hashing.Digest, version *uint64, historical bool, publicKey []byte) (*protocol.ProofBundle, error) {
+	if historical && version == nil {
+		return nil, errors.New("A historical proof bundle needs a version")
+	}
+
+	query, _ := json.Marshal(&protocol.MembershipDigest{
+		KeyDigest:  eventDigest,
+		Version:    version,
+		Historical: historical,
+	})
+	body, err := c.callAny(ctx, "POST", "/proofs/digest-membership", query)
+	if err != nil {
+		return nil, err
+	}
+	var result *protocol.MembershipResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if !result.Exists {
+		return nil, errors.New("The event does not exist, only its membership can be proved")
+	}
+
+	bundle := &protocol.ProofBundle{
+		FormatVersion: protocol.ProofBundleFormatVersion,
+		Hasher:        "sha256",
+		EventDigest:   eventDigest,
+		Historical:    historical,
+		Proof:         result,
+		PublicKey:     publicKey,
+		KeyID:         sign.KeyID(publicKey),
+	}
+	for _, v := range protocol.BundleSnapshotVersions(result, historical) {
+		s, err := c.GetSignedSnapshotWithContext(ctx, v)
+		if err != nil {
+			c.log.Infof("Error getting snapshot from snapshot store: %s", err)
+			return nil, err
+		}
+		bundle.Snapshots = append(bundle.Snapshots, s)
+	}
+	return bundle, nil
 }
 
 // Incremental will ask for an IncrementalProof to the server.
 func (c *HTTPClient) Incremental(start, end uint64) (*balloon.IncrementalProof, error) {
+	return c.IncrementalWithContext(context.Background(), start, end)
+}
+
+// IncrementalWithContext is like Incremental with a context.
+func (c *HTTPClient) IncrementalWithContext(ctx context.Context, start, end uint64) (*balloon.IncrementalProof, error) {
 
 	query, _ := json.Marshal(&protocol.IncrementalRequest{
 		Start: start,
 		End:   end,
 	})
 
-	body, err := c.callAny("POST", "/proofs/incremental", query)
+	body, err := c.callAny(ctx, "POST", "/proofs/incremental", query)
 	if err != nil {
 		return nil, err
 	}
@@ -702,8 +963,26 @@ func (c *HTTPClient) IncrementalVerify(
 	proof *balloon.IncrementalProof,
 	startSnapshot, endSnapshot *balloon.Snapshot,
 ) (bool, error) {
+	return c.IncrementalVerifyWithContext(context.Background(), proof, startSnapshot, endSnapshot)
+}
 
-	return proof.Verify(startSnapshot, endSnapshot), nil
+// IncrementalVerifyWithContext is like IncrementalVerify with a context.
+func (c *HTTPClient) IncrementalVerifyWithContext(
+	ctx context.Context,
+	proof *balloon.IncrementalProof,
+	startSnapshot, endSnapshot *balloon.Snapshot,
+) (bool, error) {
+
+	if !proof.Verify(startSnapshot, endSnapshot) {
+		return false, nil
+	}
+	if err := c.checkTrustedHead(ctx, proof.Start, startSnapshot.HistoryDigest, nil); err != nil {
+		return false, err
+	}
+	if err := c.checkTrustedHead(ctx, proof.End, endSnapshot.HistoryDigest, nil); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // IncrementalAutoVerify will ask for an Incremental proof to the server, given both a
@@ -713,9 +992,17 @@ func (c *HTTPClient) IncrementalVerify(
 func (c *HTTPClient) IncrementalAutoVerify(
 	start, end uint64,
 ) (bool, error) {
+	return c.IncrementalAutoVerifyWithContext(context.Background(), start, end)
+}
+
+// IncrementalAutoVerifyWithContext is like IncrementalAutoVerify with a context.
+func (c *HTTPClient) IncrementalAutoVerifyWithContext(
+	ctx context.Context,
+	start, end uint64,
+) (bool, error) {
 
 	// Get incrementral proof
-	proof, err := c.Incremental(start, end)
+	proof, err := c.IncrementalWithContext(ctx, start, end)
 	if err != nil {
 		return false, err
 	}
@@ -727,12 +1014,12 @@ func (c *HTTPClient) IncrementalAutoVerify(
 		HyperDigest: hashing.Digest{},
 		Version:     start,
 	}
-	s, err := c.GetSnapshot(start)
+	signedStart, err := c.GetSignedSnapshotWithContext(ctx, start)
 	if err != nil {
 		c.log.Infof("Error getting snapshot from snapshot store: %s", err)
 		return false, err
 	}
-	startSnapshot.HistoryDigest = s.HistoryDigest
+	startSnapshot.HistoryDigest = signedStart.Snapshot.HistoryDigest
 
 	// End snapshot
 	endSnapshot := balloon.Snapshot{
@@ -740,13 +1027,21 @@ func (c *HTTPClient) IncrementalAutoVerify(
 		HyperDigest: hashing.Digest{},
 		Version:     end,
 	}
-	s, err = c.GetSnapshot(end)
+	signedEnd, err := c.GetSignedSnapshotWithContext(ctx, end)
 	if err != nil {
 		c.log.Infof("Error getting snapshot from snapshot store: %s", err)
 		return false, err
 	}
-	endSnapshot.HistoryDigest = s.HistoryDigest
+	endSnapshot.HistoryDigest = signedEnd.Snapshot.HistoryDigest
 
 	// Verify
-	return c.IncrementalVerify(proof, &startSnapshot, &endSnapshot)
+	if !proof.Verify(&startSnapshot, &endSnapshot) {
+		return false, nil
+	}
+	for _, s := range []*protocol.SignedSnapshot{signedStart, signedEnd} {
+		if err := c.checkTrustedHead(ctx, s.Snapshot.Version, s.Snapshot.HistoryDigest, s); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
@@ -18,6 +18,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -38,6 +39,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -108,7 +110,7 @@ func TestCallPrimaryWorking(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.NoError(t, err, "The requests should not fail")
 	require.True(t, len(resp) > 0, "The response should not be empty")
 	require.Equal(t, 1, numRequests, "The number of requests should match")
@@ -138,7 +140,7 @@ func TestCallPrimaryFails(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.Error(t, err, "The requests should fail")
 	require.True(t, len(resp) == 0, "The response should be empty")
 	require.Equal(t, 2, numRequests, "The number of requests should match")
@@ -164,7 +166,7 @@ func TestCallPrimaryUnreachable(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.Error(t, err, "The requests should fail")
 	require.True(t, len(resp) == 0, "The response should be empty")
 	require.Equal(t, 1, numRequests, "The number of requests should match")
@@ -211,7 +213,7 @@ func TestCallPrimaryUnreachableWithHealthChecks(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.Error(t, err, "The requests should fail")
 	require.True(t, len(resp) == 0, "The response should be empty")
 }
@@ -293,7 +295,7 @@ func TestCallPrimaryUnreachableWithDiscovery(t *testing.T) {
 	// Mark node as dead after NewHTTPClient to simulate a primary failure.
 	client.topology.primary.MarkAsDead()
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.NoError(t, err, "The requests should not fail")
 	require.True(t, len(resp) > 0, "The response should not be empty")
 	require.Equal(t, 3, numRequests, "The number of requests should match")
@@ -385,7 +387,7 @@ func TestCallPrimaryRedirect(t *testing.T) {
 	// Mark node as dead after NewHTTPClient to simulate a primary failure.
 	// client.topology.primary.MarkAsDead()
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.NoError(t, err, "The requests should not fail")
 	require.True(t, len(resp) > 0, "The response should not be empty")
 	require.Equal(t, 0, priReqs, "The number of requests should match to primary node")
@@ -473,7 +475,7 @@ func TestCallPrimaryUnreachableWithDiscoveryAndHealtChecks(t *testing.T) {
 	// Mark node as dead after NewHTTPClient to simulate a primary failure.
 	client.topology.primary.MarkAsDead()
 
-	resp, err := client.callPrimary("GET", "/test", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/test", nil)
 	require.NoError(t, err, "The requests should not fail")
 	require.True(t, len(resp) > 0, "The response should not be empty")
 }
@@ -508,7 +510,7 @@ func TestCallAnyPrimaryFails(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callAny("GET", "/test", nil)
+	resp, err := client.callAny(context.Background(), "GET", "/test", nil)
 	require.NoError(t, err, "The requests should not fail")
 	require.True(t, len(resp) > 0, "The response should not be empty")
 	require.Equal(t, 3, numRequests, "The number of requests should match")
@@ -537,7 +539,7 @@ func TestCallAnyAllFail(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callAny("GET", "/test", nil)
+	resp, err := client.callAny(context.Background(), "GET", "/test", nil)
 	require.Error(t, err, "The request should fail")
 	require.True(t, len(resp) == 0, "The response should be empty")
 	require.Equal(t, 6, numRequests, "The number of requests should match")
@@ -573,12 +575,12 @@ func TestHealthCheck(t *testing.T) {
 	require.NoError(t, err)
 
 	// force all endpoints to get marked as dead
-	_, err = client.callAny("GET", "/events", nil)
+	_, err = client.callAny(context.Background(), "GET", "/events", nil)
 	require.Error(t, err)
 	require.False(t, client.topology.HasActiveEndpoint())
 
 	// try to revive them
-	client.clusterHealthCheck(5 * time.Second)
+	client.clusterHealthCheck(context.Background(), 5*time.Second)
 	time.Sleep(1 * time.Second)
 	require.True(t, client.topology.HasActiveEndpoint())
 }
@@ -621,12 +623,12 @@ func TestPeriodicHealthCheck(t *testing.T) {
 	spec.RetryOnFalse(t, 50, 200*time.Millisecond, func() bool {
 		return !client.topology.HasActiveEndpoint()
 	}, "The topology still have active endpoints")
-	_, err = client.callAny("GET", "/events", nil)
+	_, err = client.callAny(context.Background(), "GET", "/events", nil)
 	require.Error(t, err)
 
 	// wait for all endpoints to get marked as alive
 	spec.Retry(t, 50, 200*time.Millisecond, func() error {
-		_, err = client.callAny("GET", "/events", nil)
+		_, err = client.callAny(context.Background(), "GET", "/events", nil)
 		return err
 	})
 
@@ -675,14 +677,14 @@ func TestManualDiscoveryPrimaryLost(t *testing.T) {
 	require.NoError(t, err)
 
 	// force all endpoints to get marked as dead
-	_, err = client.callPrimary("GET", "/events", nil)
+	_, err = client.callPrimary(context.Background(), "GET", "/events", nil)
 	require.Error(t, err)
 	require.False(t, client.topology.HasActivePrimary())
 
 	// try to discovery a new primary endpoint
-	_ = client.discover()
+	_ = client.discover(context.Background())
 	require.True(t, client.topology.HasActivePrimary())
-	resp, err := client.callPrimary("GET", "/events", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/events", nil)
 	require.NoError(t, err)
 	require.Equal(t, "primary2.foo", string(resp))
 }
@@ -729,7 +731,7 @@ func TestAutoDiscoveryPrimaryLost(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	resp, err := client.callPrimary("GET", "/events", nil)
+	resp, err := client.callPrimary(context.Background(), "GET", "/events", nil)
 	require.NoError(t, err)
 	require.True(t, client.topology.HasActivePrimary())
 	require.Equal(t, "primary2.foo", string(resp))
@@ -792,6 +794,37 @@ func TestAddBulkSuccess(t *testing.T) {
 	assert.Equal(t, bulk, snapshotBulk, "The snapshots should match")
 }
 
+func TestAddWithContextDeadline(t *testing.T) {
+	// the server never answers until the test ends
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := NewHTTPClient(
+		SetURLs(server.URL),
+		SetMaxRetries(2),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(false),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.AddWithContext(ctx, "Hello QED!")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second, "The request must be aborted by the deadline")
+
+	// the endpoint is not blamed for the deadline
+	primary, err := client.topology.Primary()
+	require.NoError(t, err)
+	require.False(t, primary.IsDead())
+}
+
 func TestAddWithServerFailure(t *testing.T) {
 
 	serverURL, tearDown := setupServer(nil)
@@ -803,6 +836,40 @@ func TestAddWithServerFailure(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestAddPropagatesTraceContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-tracing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exporter, err := tracing.NewFileExporter(dir + "/spans.json")
+	require.NoError(t, err)
+	tracer := tracing.NewTracer(exporter, nil)
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(tracing.TraceParentHeader)
+		_ = json.NewEncoder(w).Encode(&protocol.Snapshot{})
+	}))
+	defer server.Close()
+	client := setupClient(t, []string{server.URL})
+
+	_, err = client.Add("Hello world!")
+	require.NoError(t, err)
+	require.NoError(t, tracer.Close())
+
+	spans, err := tracing.ReadSpans(dir + "/spans.json")
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	require.Equal(t, "client POST /events", spans[0].Name)
+
+	sc, err := tracing.Parse(traceparent)
+	require.NoError(t, err)
+	require.Equal(t, spans[0].TraceID, sc.TraceID.String())
+	require.Equal(t, spans[0].SpanID, sc.SpanID.String())
+}
+
 func TestMembership(t *testing.T) {
 
 	event := []byte{0x0}
@@ -869,6 +936,43 @@ func TestMembershipDigest(t *testing.T) {
 	client.Close()
 }
 
+func TestMembershipDigestAt(t *testing.T) {
+
+	eventDigest := hashing.Digest([]byte{0x0})
+	version := uint64(3)
+
+	fakeHttpClient := NewTestHttpClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/proofs/digest-membership" {
+			var query protocol.MembershipDigest
+			if err := json.NewDecoder(req.Body).Decode(&query); err != nil || !query.Historical || *query.Version != version {
+				return buildResponse(http.StatusBadRequest, "wrong query"), nil
+			}
+			m := protocol.MembershipResult{QueryVersion: version}
+			body, _ := json.Marshal(m)
+			return buildResponse(http.StatusOK, string(body)), nil
+		}
+		return nil, errors.New("Unreachable")
+	})
+
+	client, err := NewHTTPClient(
+		SetHttpClient(fakeHttpClient),
+		SetAPIKey("my-awesome-api-key"),
+		SetURLs("http://primary.foo"),
+		SetReadPreference(Primary),
+		SetMaxRetries(0),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(false),
+		SetHasherFunction(hashing.NewSha256Hasher),
+	)
+	require.NoError(t, err)
+
+	proof, err := client.MembershipDigestAt(eventDigest, version)
+	require.NoError(t, err)
+	require.Equal(t, version, proof.QueryVersion)
+
+	client.Close()
+}
+
 func TestMembershipWithServerFailure(t *testing.T) {
 
 	serverURL, tearDown := setupServer(nil)
@@ -1069,6 +1173,71 @@ func TestMembershipAutoVerify(t *testing.T) {
 	client.Close()
 }
 
+func TestMembershipBundle(t *testing.T) {
+
+	eventDigest := hashing.Digest([]byte{0x0})
+	publicKey := []byte("public key")
+	exists := true
+	var versions []string
+
+	fakeHttpClient := NewTestHttpClient(func(req *http.Request) (*http.Response, error) {
+		if req.Host == "primary.foo" && req.URL.Path == "/proofs/digest-membership" {
+			m := protocol.MembershipResult{
+				Exists:         exists,
+				CurrentVersion: uint64(3),
+				QueryVersion:   uint64(1),
+				ActualVersion:  uint64(1),
+				KeyDigest:      eventDigest,
+			}
+			body, _ := json.Marshal(m)
+			return buildResponse(http.StatusOK, string(body)), nil
+		}
+		if req.Host == "snapshotStore.foo" && req.URL.Path == "/snapshot" {
+			version := req.URL.Query().Get("v")
+			versions = append(versions, version)
+			ss := fmt.Sprintf(`{"Snapshot":{"Version":%s},"Signature":"c2lnbmF0dXJl"}`, version)
+			return buildResponse(http.StatusOK, ss), nil
+		}
+		return nil, errors.New("Unreachable")
+	})
+
+	client, err := NewHTTPClient(
+		SetHttpClient(fakeHttpClient),
+		SetAPIKey("my-awesome-api-key"),
+		SetURLs("http://primary.foo"),
+		SetSnapshotStoreURL("http://snapshotStore.foo"),
+		SetMaxRetries(0),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(false),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	version := uint64(1)
+	bundle, err := client.MembershipBundle(eventDigest, &version, false, publicKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "3"}, versions, "The snapshots of the query and current versions are needed")
+	require.Equal(t, "sha256", bundle.Hasher)
+	require.Equal(t, eventDigest, bundle.EventDigest)
+	require.Equal(t, publicKey, bundle.PublicKey)
+	require.Len(t, bundle.KeyID, 16)
+	require.Len(t, bundle.Snapshots, 2)
+	require.Equal(t, []byte("signature"), bundle.Snapshots[0].Signature)
+
+	versions = nil
+	bundle, err = client.MembershipBundle(eventDigest, &version, true, publicKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, versions, "Only the snapshot of the query version is needed")
+	require.True(t, bundle.Historical)
+
+	_, err = client.MembershipBundle(eventDigest, nil, true, publicKey)
+	require.Error(t, err, "A historical bundle needs a version")
+
+	exists = false
+	_, err = client.MembershipBundle(eventDigest, &version, false, publicKey)
+	require.Error(t, err, "There are no bundles of events that do not exist")
+}
+
 func TestIncrementalAutoVerify(t *testing.T) {
 
 	start := uint64(0)
@@ -1180,3 +1349,41 @@ func infoHandler(serverURL string) func(http.ResponseWriter, *http.Request) {
 		_, _ = w.Write(out)
 	}
 }
+
+func TestGetSignedAuditRoot(t *testing.T) {
+
+	fakeHttpClient := NewTestHttpClient(func(req *http.Request) (*http.Response, error) {
+		if req.Host == "snapshotStore.foo" && req.URL.Path == "/audit/root" {
+			if req.URL.Query().Get("v") != "3" {
+				return buildResponse(http.StatusNotFound, "Version not found"), nil
+			}
+			root := protocol.SignedAuditRoot{
+				Root:      &protocol.AuditRoot{Version: 3, HistoryDigest: hashing.Digest{0x1}},
+				Signature: []byte{0x2},
+			}
+			body, _ := json.Marshal(root)
+			return buildResponse(http.StatusOK, string(body)), nil
+		}
+		return nil, errors.New("Unreachable")
+	})
+
+	client, err := NewHTTPClient(
+		SetHttpClient(fakeHttpClient),
+		SetAPIKey("my-awesome-api-key"),
+		SetURLs("http://primary.foo"),
+		SetSnapshotStoreURL("http://snapshotStore.foo"),
+		SetMaxRetries(0),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(false),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	root, err := client.GetSignedAuditRoot(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), root.Root.Version)
+	require.Equal(t, []byte{0x2}, root.Signature)
+
+	_, err = client.GetSignedAuditRoot(4)
+	require.Error(t, err)
+}
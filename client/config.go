@@ -144,6 +144,15 @@ type Config struct {
 
 	// HasherFunction sets which function will use the client to do its work: verify, ask for proofs, ...
 	HasherFunction func() hashing.Hasher `desc:"Hashing function to verify proofs"`
+
+	// TrustedHeadPath is the file where the client keeps the last verified
+	// snapshot, to detect forked histories across queries. It requires
+	// a PublicKeyPath.
+	TrustedHeadPath string `desc:"File where the last verified snapshot is kept to detect forked histories, disabled if empty"`
+
+	// PublicKeyPath is the public key that verifies the signed snapshots
+	// before trusting them, including the one read from TrustedHeadPath.
+	PublicKeyPath string `desc:"Path to the ed25519 public key that verifies the signed snapshots before trusting them"`
 }
 
 // DefaultConfig creates a Config structures with default values.
@@ -16,7 +16,10 @@
 
 package client
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrNoEndpoint is raised when no QED node is available.
@@ -34,4 +37,18 @@ var (
 
 	// ErrTimeout is raised when a request timed out.
 	ErrTimeout = errors.New("timeout")
+
+	// ErrHistoricalUnsupported is raised when the QED server does not keep
+	// the hyper tree history needed by a historical membership query.
+	ErrHistoricalUnsupported = errors.New("historical membership queries not supported by the QED server")
 )
+
+// RequestError is raised when QED rejects a request with a 4xx status.
+type RequestError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Invalid request %v", e.Body)
+}
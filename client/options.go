@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
 	"github.com/bbva/qed/log"
 )
 
@@ -47,6 +48,16 @@ func configToOptions(conf *Config) ([]HTTPClientOptionF, error) {
 		if len(conf.Endpoints) > 0 {
 			options = append(options, SetURLs(conf.Endpoints[0], conf.Endpoints[1:]...))
 		}
+		if conf.TrustedHeadPath != "" {
+			if conf.PublicKeyPath == "" {
+				return nil, errors.New("A public key path is required to keep a trusted head")
+			}
+			verifier, err := sign.NewEd25519VerifierFromFile(conf.PublicKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, SetTrustedHead(conf.TrustedHeadPath, verifier))
+		}
 
 		defaultTransport := http.DefaultTransport.(*http.Transport)
 		options = append(options, SetHttpClient(&http.Client{
@@ -171,6 +182,21 @@ func SetHasherFunction(hasherF func() hashing.Hasher) HTTPClientOptionF {
 	}
 }
 
+// SetTrustedHead makes the client keep the last verified signed snapshot,
+// persisted to the given file unless the path is empty, and check that
+// every snapshot it verifies afterwards is consistent with it. The
+// signatures of the snapshots are verified if a verifier is given.
+func SetTrustedHead(path string, verifier sign.Verifier) HTTPClientOptionF {
+	return func(c *HTTPClient) error {
+		trust, err := newTrustedHead(path, verifier)
+		if err != nil {
+			return err
+		}
+		c.trust = trust
+		return nil
+	}
+}
+
 func SetLogger(logger log.Logger) HTTPClientOptionF {
 	return func(c *HTTPClient) error {
 		c.log = logger
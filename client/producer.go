@@ -0,0 +1,300 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+)
+
+// ErrProducerClosed is raised when producing events after closing the producer.
+var ErrProducerClosed = errors.New("producer closed")
+
+const (
+	// DefaultProducerMaxBatchSize is the default number of events of a bulk.
+	DefaultProducerMaxBatchSize = 500
+
+	// DefaultProducerMaxLatency is the default time an event waits for
+	// its bulk to be full before sending it anyway.
+	DefaultProducerMaxLatency = 50 * time.Millisecond
+
+	// DefaultProducerMaxPending is the default number of events waiting
+	// to be batched before Produce blocks.
+	DefaultProducerMaxPending = 10000
+
+	// DefaultProducerMaxInFlight is the default number of bulks sent
+	// concurrently.
+	DefaultProducerMaxInFlight = 2
+
+	// DefaultProducerMaxRetries is the default number of times a failed
+	// bulk is sent again.
+	DefaultProducerMaxRetries = 3
+)
+
+// ProducerConfig sets how a Producer batches the events.
+type ProducerConfig struct {
+	// MaxBatchSize is the maximum number of events of a bulk.
+	MaxBatchSize int
+
+	// MaxLatency is the maximum time an event waits for its bulk
+	// to be full before sending it anyway.
+	MaxLatency time.Duration
+
+	// MaxPending bounds the events waiting to be batched. Produce blocks
+	// while it is reached, until the bulks in flight are done.
+	MaxPending int
+
+	// MaxInFlight is the number of bulks sent concurrently.
+	MaxInFlight int
+
+	// MaxRetries is the number of times a failed bulk is sent again,
+	// waiting as told by Backoff between attempts. A bulk whose response
+	// is lost is sent again too, so its events may be added twice.
+	MaxRetries int
+	Backoff    Backoff
+}
+
+// DefaultProducerConfig creates a ProducerConfig with default values.
+func DefaultProducerConfig() *ProducerConfig {
+	return &ProducerConfig{
+		MaxBatchSize: DefaultProducerMaxBatchSize,
+		MaxLatency:   DefaultProducerMaxLatency,
+		MaxPending:   DefaultProducerMaxPending,
+		MaxInFlight:  DefaultProducerMaxInFlight,
+		MaxRetries:   DefaultProducerMaxRetries,
+		Backoff:      NewExponentialBackoff(100*time.Millisecond, 5*time.Second),
+	}
+}
+
+// Future is the result of an event given to a Producer, available once
+// its bulk has been added.
+type Future struct {
+	done     chan struct{}
+	snapshot *protocol.Snapshot
+	err      error
+}
+
+func (f *Future) resolve(snapshot *protocol.Snapshot, err error) {
+	f.snapshot, f.err = snapshot, err
+	close(f.done)
+}
+
+// Done is closed once the event has been added or has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Get waits for the event to be added and returns its snapshot.
+func (f *Future) Get() (*protocol.Snapshot, error) {
+	<-f.done
+	return f.snapshot, f.err
+}
+
+// GetWithContext is like Get but stops waiting when the context is done.
+func (f *Future) GetWithContext(ctx context.Context) (*protocol.Snapshot, error) {
+	select {
+	case <-f.done:
+		return f.snapshot, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type producedEvent struct {
+	event  []byte
+	future *Future
+}
+
+// Producer adds events given by many goroutines in bulks, sent when they
+// are full or their first event has waited for the maximum latency. The
+// bulks are sent to the primary node with the client, which follows the
+// leader and retries the requests as configured.
+type Producer struct {
+	client *HTTPClient
+	conf   *ProducerConfig
+
+	mu        sync.RWMutex  // guards sending to events
+	closing   chan struct{} // closed when closing, to stop blocked producers
+	closeOnce sync.Once
+	events    chan *producedEvent
+	bulks     chan []*producedEvent
+	wg        sync.WaitGroup
+}
+
+// NewProducer creates a producer that adds the events with the client.
+func NewProducer(client *HTTPClient, conf *ProducerConfig) (*Producer, error) {
+	if conf == nil {
+		conf = DefaultProducerConfig()
+	}
+	if conf.MaxBatchSize <= 0 || conf.MaxLatency <= 0 || conf.MaxPending < 0 || conf.MaxInFlight <= 0 || conf.MaxRetries < 0 {
+		return nil, fmt.Errorf("Invalid producer configuration: %+v", *conf)
+	}
+	if conf.Backoff == nil {
+		conf.Backoff = NewStopBackoff()
+	}
+
+	p := &Producer{
+		client:  client,
+		conf:    conf,
+		closing: make(chan struct{}),
+		events:  make(chan *producedEvent, conf.MaxPending),
+		bulks:   make(chan []*producedEvent),
+	}
+	p.wg.Add(1 + conf.MaxInFlight)
+	go p.batch()
+	for i := 0; i < conf.MaxInFlight; i++ {
+		go p.send()
+	}
+	return p, nil
+}
+
+// Produce queues an event to be added in the next bulk and returns its
+// future. It blocks while the producer has the maximum number of pending
+// events, until there is room for it, the context is done or the producer
+// is closed, which fails it with ErrProducerClosed.
+func (p *Producer) Produce(ctx context.Context, event []byte) (*Future, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.closing:
+		return nil, ErrProducerClosed
+	default:
+	}
+
+	e := &producedEvent{event: event, future: &Future{done: make(chan struct{})}}
+	select {
+	case p.events <- e:
+		return e.future, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.closing:
+		return nil, ErrProducerClosed
+	}
+}
+
+// Close stops accepting events and waits until the pending ones have
+// been added or have failed. The Produce calls blocked waiting for room
+// fail with ErrProducerClosed, so Close never waits for them.
+func (p *Producer) Close() error {
+	closing := false
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		closing = true
+	})
+	if !closing {
+		return ErrProducerClosed
+	}
+
+	// no producer sends events once the lock is taken
+	p.mu.Lock()
+	close(p.events)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// batch groups the events in bulks of at most the maximum size, sending
+// each one as soon as it is full or its first event has waited for the
+// maximum latency.
+func (p *Producer) batch() {
+	defer p.wg.Done()
+	defer close(p.bulks)
+
+	var bulk []*producedEvent
+	timer := time.NewTimer(p.conf.MaxLatency)
+	// a stopped timer must be drained if it already fired, or a stale
+	// tick would send the next bulk right after its first event
+	stop := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+	stop()
+	flush := func() {
+		stop()
+		if len(bulk) > 0 {
+			p.bulks <- bulk
+			bulk = nil
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-p.events:
+			if !ok {
+				flush()
+				return
+			}
+			if len(bulk) == 0 {
+				timer.Reset(p.conf.MaxLatency)
+			}
+			bulk = append(bulk, e)
+			if len(bulk) >= p.conf.MaxBatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// send adds the bulks, resolving the futures of their events.
+func (p *Producer) send() {
+	defer p.wg.Done()
+
+	for bulk := range p.bulks {
+		eventBulk := &protocol.EventsBulk{Events: make([][]byte, len(bulk))}
+		for i, e := range bulk {
+			eventBulk.Events[i] = e.event
+		}
+
+		var snapshots []*protocol.Snapshot
+		var err error
+		for attempt := 0; ; attempt++ {
+			snapshots, err = p.client.addBulk(context.Background(), eventBulk)
+			if err == nil || attempt >= p.conf.MaxRetries {
+				break
+			}
+			wait, goahead := p.conf.Backoff.Next(attempt)
+			if !goahead {
+				break
+			}
+			p.client.log.Infof("Unable to add a bulk of %d events, retrying in %s: %v", len(bulk), wait, err)
+			time.Sleep(wait)
+		}
+		if err == nil && len(snapshots) != len(bulk) {
+			err = fmt.Errorf("Received %d snapshots for a bulk of %d events", len(snapshots), len(bulk))
+		}
+
+		for i, e := range bulk {
+			if err != nil {
+				e.future.resolve(nil, err)
+				continue
+			}
+			e.future.resolve(snapshots[i], nil)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/protocol"
+)
+
+// setupBulkServer answers each bulk with a snapshot per event, numbering
+// them sequentially, and records the size of the bulks.
+func setupBulkServer(handler func(w http.ResponseWriter, r *http.Request) bool) (string, func() []int, func()) {
+	var mu sync.Mutex
+	var version uint64
+	var sizes []int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events/bulk" {
+			return
+		}
+		if handler != nil && !handler(w, r) {
+			return
+		}
+		var bulk protocol.EventsBulk
+		if err := json.NewDecoder(r.Body).Decode(&bulk); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		snapshots := make([]*protocol.Snapshot, len(bulk.Events))
+		for i, event := range bulk.Events {
+			snapshots[i] = &protocol.Snapshot{Version: version, EventDigest: event}
+			version++
+		}
+		sizes = append(sizes, len(bulk.Events))
+		mu.Unlock()
+		out, _ := json.Marshal(snapshots)
+		_, _ = w.Write(out)
+	}))
+
+	return server.URL, func() []int {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]int{}, sizes...)
+		}, func() {
+			server.Close()
+		}
+}
+
+func TestProducer(t *testing.T) {
+	serverURL, bulkSizes, tearDown := setupBulkServer(nil)
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	conf := DefaultProducerConfig()
+	conf.MaxBatchSize = 10
+	conf.MaxLatency = 10 * time.Millisecond
+	producer, err := NewProducer(client, conf)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	futures := make([][]*Future, 8)
+	for g := range futures {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				f, err := producer.Produce(context.Background(), []byte(fmt.Sprintf("event %d-%d", g, i)))
+				require.NoError(t, err)
+				futures[g] = append(futures[g], f)
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.NoError(t, producer.Close())
+
+	versions := make(map[uint64]bool)
+	for g := range futures {
+		for i, f := range futures[g] {
+			select {
+			case <-f.Done():
+			default:
+				t.Fatalf("The future of event %d-%d must be resolved after closing", g, i)
+			}
+			snapshot, err := f.Get()
+			require.NoError(t, err)
+			require.Equal(t, hashing.Digest(fmt.Sprintf("event %d-%d", g, i)), snapshot.EventDigest)
+			require.False(t, versions[snapshot.Version], "Versions must not be repeated")
+			versions[snapshot.Version] = true
+		}
+	}
+	require.Len(t, versions, 400)
+
+	for _, size := range bulkSizes() {
+		require.True(t, size <= conf.MaxBatchSize, "Bulks must not exceed the maximum size")
+	}
+
+	_, err = producer.Produce(context.Background(), []byte("late event"))
+	require.Equal(t, ErrProducerClosed, err)
+}
+
+func TestProducerMaxLatency(t *testing.T) {
+	serverURL, bulkSizes, tearDown := setupBulkServer(nil)
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	conf := DefaultProducerConfig()
+	conf.MaxBatchSize = 100
+	conf.MaxLatency = 20 * time.Millisecond
+	producer, err := NewProducer(client, conf)
+	require.NoError(t, err)
+	defer producer.Close()
+
+	f, err := producer.Produce(context.Background(), []byte("lonely event"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	snapshot, err := f.GetWithContext(ctx)
+	require.NoError(t, err, "The bulk must be sent after the maximum latency")
+	require.Equal(t, hashing.Digest("lonely event"), snapshot.EventDigest)
+	require.Equal(t, []int{1}, bulkSizes())
+}
+
+func TestProducerBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	serverURL, _, tearDown := setupBulkServer(func(w http.ResponseWriter, r *http.Request) bool {
+		<-release
+		return true
+	})
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	conf := DefaultProducerConfig()
+	conf.MaxBatchSize = 1
+	conf.MaxPending = 2
+	conf.MaxInFlight = 1
+	producer, err := NewProducer(client, conf)
+	require.NoError(t, err)
+
+	// one bulk in flight, one waiting to be sent and two pending
+	var futures []*Future
+	for i := 0; i < 4; i++ {
+		f, err := producer.Produce(context.Background(), []byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		futures = append(futures, f)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = producer.Produce(ctx, []byte("blocked event"))
+	require.Equal(t, context.DeadlineExceeded, err, "Produce must block while the producer is full")
+
+	close(release)
+	require.NoError(t, producer.Close())
+	for i, f := range futures {
+		snapshot, err := f.Get()
+		require.NoError(t, err, "in test case %d", i)
+		require.Equal(t, hashing.Digest(fmt.Sprintf("event %d", i)), snapshot.EventDigest, "in test case %d", i)
+	}
+}
+
+func TestProducerCloseBlockedProduce(t *testing.T) {
+	release := make(chan struct{})
+	serverURL, _, tearDown := setupBulkServer(func(w http.ResponseWriter, r *http.Request) bool {
+		<-release
+		return true
+	})
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	conf := DefaultProducerConfig()
+	conf.MaxBatchSize = 1
+	conf.MaxPending = 1
+	conf.MaxInFlight = 1
+	producer, err := NewProducer(client, conf)
+	require.NoError(t, err)
+
+	// one bulk in flight, one waiting to be sent and one pending
+	var futures []*Future
+	for i := 0; i < 3; i++ {
+		f, err := producer.Produce(context.Background(), []byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		futures = append(futures, f)
+	}
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := producer.Produce(context.Background(), []byte("blocked event"))
+		blocked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- producer.Close()
+	}()
+	select {
+	case err := <-blocked:
+		require.Equal(t, ErrProducerClosed, err, "The blocked event must fail when closing")
+	case <-time.After(time.Second):
+		t.Fatal("Close must not wait for the blocked events")
+	}
+
+	close(release)
+	require.NoError(t, <-closed)
+	require.Equal(t, ErrProducerClosed, producer.Close())
+	for i, f := range futures {
+		_, err := f.Get()
+		require.NoError(t, err, "in test case %d", i)
+	}
+}
+
+func TestProducerRetries(t *testing.T) {
+	var mu sync.Mutex
+	failures := 2
+	serverURL, _, tearDown := setupBulkServer(func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		return true
+	})
+	defer tearDown()
+
+	// the health checks revive the primary marked as dead by a failure
+	client, err := NewHTTPClient(
+		SetURLs(serverURL),
+		SetRequestRetrier(NewNoRequestRetrier(http.DefaultClient)),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(true),
+		SetHealthCheckInterval(time.Hour),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	testCases := []struct {
+		maxRetries int
+		expectErr  bool
+	}{
+		{maxRetries: 1, expectErr: true},
+		{maxRetries: 2, expectErr: false},
+	}
+
+	for i, c := range testCases {
+		mu.Lock()
+		failures = 2
+		mu.Unlock()
+
+		conf := DefaultProducerConfig()
+		conf.MaxRetries = c.maxRetries
+		conf.Backoff = NewConstantBackoff(time.Millisecond)
+		producer, err := NewProducer(client, conf)
+		require.NoError(t, err, "in test case %d", i)
+
+		f, err := producer.Produce(context.Background(), []byte("event"))
+		require.NoError(t, err, "in test case %d", i)
+		require.NoError(t, producer.Close(), "in test case %d", i)
+
+		snapshot, err := f.Get()
+		if c.expectErr {
+			require.Error(t, err, "in test case %d", i)
+			require.Nil(t, snapshot, "in test case %d", i)
+		} else {
+			require.NoError(t, err, "in test case %d", i)
+			require.Equal(t, hashing.Digest("event"), snapshot.EventDigest, "in test case %d", i)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 )
@@ -39,6 +40,13 @@ type RetriableRequest struct {
 
 // NewRetriableRequest creates a new retriable request.
 func NewRetriableRequest(method, url string, rawBody []byte) (*RetriableRequest, error) {
+	return NewRetriableRequestWithContext(context.Background(), method, url, rawBody)
+}
+
+// NewRetriableRequestWithContext creates a new retriable request bound to
+// the given context. Cancelling it aborts the request in flight and the
+// pending retries.
+func NewRetriableRequestWithContext(ctx context.Context, method, url string, rawBody []byte) (*RetriableRequest, error) {
 
 	var body ReaderFunc
 	var contentLength int64
@@ -50,7 +58,7 @@ func NewRetriableRequest(method, url string, rawBody []byte) (*RetriableRequest,
 		contentLength = int64(len(rawBody))
 	}
 
-	httpReq, err := http.NewRequest(method, url, nil)
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
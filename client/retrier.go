@@ -65,6 +65,12 @@ func (r *NoRequestRetrier) DoReq(req *RetriableRequest) (*http.Response, error)
 		}
 	}
 	resp, err := r.Do(req.Request)
+	if ctxErr := req.Context().Err(); ctxErr != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, ctxErr
+	}
 	// Check the response code. We retry on 500-range responses to allow
 	// the server time to recover, as 500's are typically not permanent
 	// errors and may relate to outages on the server side. This will catch
@@ -72,6 +78,9 @@ func (r *NoRequestRetrier) DoReq(req *RetriableRequest) (*http.Response, error)
 	if err == nil && resp.StatusCode > 0 && resp.StatusCode < 500 {
 		return resp, nil
 	}
+	if err == nil {
+		resp.Body.Close()
+	}
 	return nil, fmt.Errorf("%s %s: giving up after %d attempts",
 		req.Method, req.URL, 1)
 }
@@ -143,6 +152,14 @@ func (r *BackoffRequestRetrier) DoReq(req *RetriableRequest) (*http.Response, er
 			return resp, nil
 		}
 
+		// a cancelled request is not retried
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctxErr
+		}
+
 		// we decide to continue with retrying
 
 		// We do this before drainBody beause there's no need for the I/O if
@@ -172,7 +189,16 @@ func (r *BackoffRequestRetrier) DoReq(req *RetriableRequest) (*http.Response, er
 		}
 		r.log.Infof("%s: retrying in %s (%d left)", desc, wait, remain)
 
-		time.Sleep(wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
 
 	}
 
@@ -18,10 +18,13 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -132,3 +135,70 @@ func TestBackoffRequestRetrierTwoRetries(t *testing.T) {
 	require.Equal(t, 2, numFailedReqs, "The expected number of failed requests does not match")
 
 }
+
+func TestBackoffRequestRetrierCancelled(t *testing.T) {
+	var numFailedReqs int
+	fail := func(req *http.Request) (*http.Response, error) {
+		numFailedReqs++
+		return nil, errors.New("request failed")
+	}
+
+	httpClient := NewTestHttpClient(
+		NewFailingTransport("/fail", fail, nil),
+	)
+	retrier := NewBackoffRequestRetrier(httpClient, 5,
+		NewSimpleBackoff(10000, 10000, 10000, 10000, 10000))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := NewRetriableRequestWithContext(ctx, "GET", "http://foo.bar/fail", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	resp, err := retrier.DoReq(req)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Nil(t, resp)
+	require.True(t, time.Since(start) < time.Second, "The backoff must be interrupted by the context")
+	require.Equal(t, 1, numFailedReqs, "The expected number of failed requests does not match")
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestNoRequestRetrierClosesBody(t *testing.T) {
+	testCases := []struct {
+		status int
+		cancel bool
+	}{
+		{status: http.StatusOK, cancel: true},
+		{status: http.StatusInternalServerError, cancel: false},
+	}
+
+	for i, c := range testCases {
+		ctx, cancel := context.WithCancel(context.Background())
+		body := &closeRecorder{Reader: bytes.NewBufferString("response")}
+		respond := func(req *http.Request) (*http.Response, error) {
+			if c.cancel {
+				cancel()
+			}
+			return &http.Response{StatusCode: c.status, Body: body}, nil
+		}
+		retrier := NewNoRequestRetrier(NewTestHttpClient(NewFailingTransport("/", respond, nil)))
+
+		req, err := NewRetriableRequestWithContext(ctx, "GET", "http://foo.bar/", nil)
+		require.NoError(t, err, "in test case %d", i)
+
+		resp, err := retrier.DoReq(req)
+		require.Error(t, err, "in test case %d", i)
+		require.Nil(t, resp, "in test case %d", i)
+		require.True(t, body.closed, "The discarded response body must be closed in test case %d", i)
+		cancel()
+	}
+}
@@ -0,0 +1,614 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	spoolPendingBucket = []byte("pending")
+	spoolShippedBucket = []byte("shipped")
+	spoolFailedBucket  = []byte("failed")
+)
+
+// ErrSpoolClosed is raised when using the spool after closing it.
+var ErrSpoolClosed = errors.New("spool closed")
+
+// SpoolRecord is an event appended to a Spool. Once shipped, it holds
+// the snapshot QED returned for it. If QED rejected it, it holds the
+// error instead.
+type SpoolRecord struct {
+	ID        uint64
+	Event     []byte
+	SpooledAt time.Time
+	ShippedAt time.Time          `json:",omitempty"`
+	Snapshot  *protocol.Snapshot `json:",omitempty"`
+	FailedAt  time.Time          `json:",omitempty"`
+	Error     string             `json:",omitempty"`
+}
+
+func (r *SpoolRecord) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *SpoolRecord) Decode(msg []byte) error {
+	return json.Unmarshal(msg, r)
+}
+
+// SpoolConfig is the configuration of a Spool.
+type SpoolConfig struct {
+	Path         string        `desc:"Path to the local database where events are spooled until QED adds them"`
+	MaxBatchSize int           `desc:"Maximum number of spooled events shipped in a bulk"`
+	Interval     time.Duration `desc:"Interval to check for spooled events when idle"`
+	MinBackoff   time.Duration `desc:"Initial wait time before shipping again after a failure"`
+	MaxBackoff   time.Duration `desc:"Maximum wait time before shipping again after a failure"`
+}
+
+// DefaultSpoolConfig returns the default configuration of a Spool.
+func DefaultSpoolConfig() *SpoolConfig {
+	return &SpoolConfig{
+		MaxBatchSize: 500,
+		Interval:     1 * time.Second,
+		MinBackoff:   100 * time.Millisecond,
+		MaxBackoff:   30 * time.Second,
+	}
+}
+
+// Spool keeps the events in a local database until QED adds them, so
+// they are not lost while the cluster is unreachable or has no leader.
+//
+// The events are durably appended to the spool and shipped in bulks with
+// the client, in the same order they were appended. A bulk that fails is
+// shipped again, waiting between attempts, and the events after it wait
+// for it. Shipping is at-least-once: a bulk whose response is lost is
+// shipped again, so its events may be added twice. A bulk that QED
+// rejects as invalid would fail forever, so its events are moved to the
+// failed events instead, to be inspected.
+//
+// The shipped events keep the snapshot QED returned for them until they
+// are acknowledged, so their final versions can be reported even after a
+// restart. Events still pending when the spool is closed are shipped when
+// it is opened again.
+type Spool struct {
+	client       *HTTPClient
+	db           *bolt.DB
+	maxBatchSize int
+	interval     time.Duration
+	backoff      Backoff
+	maxBackoff   time.Duration
+	metrics      *spoolMetrics
+
+	mu       sync.RWMutex // guards closed, read along with the database
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	notifyCh chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewSpool opens (or creates) the spool database in the configured path
+// and starts shipping its pending events with the client.
+func NewSpool(client *HTTPClient, conf *SpoolConfig) (*Spool, error) {
+	if conf.Path == "" || conf.MaxBatchSize <= 0 || conf.Interval <= 0 || conf.MinBackoff <= 0 || conf.MaxBackoff < conf.MinBackoff {
+		return nil, fmt.Errorf("Invalid spool configuration: %+v", *conf)
+	}
+
+	db, err := bolt.Open(conf.Path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open spool database %s: %v", conf.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{spoolPendingBucket, spoolShippedBucket, spoolFailedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Spool{
+		client:       client,
+		db:           db,
+		maxBatchSize: conf.MaxBatchSize,
+		interval:     conf.Interval,
+		backoff:      NewExponentialBackoff(conf.MinBackoff, conf.MaxBackoff),
+		maxBackoff:   conf.MaxBackoff,
+		ctx:          ctx,
+		cancel:       cancel,
+		notifyCh:     make(chan struct{}, 1),
+	}
+	s.metrics = newSpoolMetrics(s)
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// Append durably stores an event in the spool to be shipped to QED,
+// returning its id in the spool.
+func (s *Spool) Append(event []byte) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrSpoolClosed
+	}
+
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(spoolPendingBucket)
+		var err error
+		id, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return putSpoolRecord(bucket, &SpoolRecord{
+			ID:        id,
+			Event:     event,
+			SpooledAt: time.Now(),
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// wake up the shipper
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// Depth returns the number of events pending of being shipped.
+func (s *Spool) Depth() (int, error) {
+	return s.count(spoolPendingBucket)
+}
+
+// OldestAge returns how long the oldest pending event has been waiting
+// in the spool, or zero if there are no pending events.
+func (s *Spool) OldestAge() (time.Duration, error) {
+	var age time.Duration
+	err := s.view(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(spoolPendingBucket).Cursor().First()
+		if v == nil {
+			return nil
+		}
+		r := new(SpoolRecord)
+		if err := r.Decode(v); err != nil {
+			return err
+		}
+		age = time.Since(r.SpooledAt)
+		return nil
+	})
+	return age, err
+}
+
+// Result returns the record of a spooled event. Its snapshot is nil
+// while the event is pending of being shipped or if it failed.
+func (s *Spool) Result(id uint64) (*SpoolRecord, error) {
+	r := new(SpoolRecord)
+	err := s.view(func(tx *bolt.Tx) error {
+		var v []byte
+		for _, bucket := range [][]byte{spoolShippedBucket, spoolPendingBucket, spoolFailedBucket} {
+			if v = tx.Bucket(bucket).Get(spoolKey(id)); v != nil {
+				break
+			}
+		}
+		if v == nil {
+			return fmt.Errorf("Event %d not found in the spool", id)
+		}
+		return r.Decode(v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Shipped returns up to limit shipped events not acknowledged yet,
+// in the order they were appended.
+func (s *Spool) Shipped(limit int) ([]*SpoolRecord, error) {
+	return s.records(spoolShippedBucket, limit)
+}
+
+// Failed returns up to limit events rejected by QED and not
+// acknowledged yet, in the order they were appended.
+func (s *Spool) Failed(limit int) ([]*SpoolRecord, error) {
+	return s.records(spoolFailedBucket, limit)
+}
+
+// Acknowledge removes shipped or failed events from the spool once
+// their results have been handled.
+func (s *Spool) Acknowledge(ids ...uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		shipped := tx.Bucket(spoolShippedBucket)
+		failed := tx.Bucket(spoolFailedBucket)
+		for _, id := range ids {
+			bucket := shipped
+			if bucket.Get(spoolKey(id)) == nil {
+				bucket = failed
+			}
+			if bucket.Get(spoolKey(id)) == nil {
+				return fmt.Errorf("Event %d is neither shipped nor failed", id)
+			}
+			if err := bucket.Delete(spoolKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Flush waits until every pending event has been shipped or has
+// failed, or the context is done.
+func (s *Spool) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		depth, err := s.Depth()
+		if err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops shipping events, aborting the bulk in flight, and closes
+// the spool database. Pending events are shipped when it is opened again.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSpoolClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+// Metrics returns the collectors of the spool metrics.
+func (s *Spool) Metrics() []prometheus.Collector {
+	return s.metrics.collectors()
+}
+
+// run ships the pending events as soon as they are appended, waiting
+// between attempts as told by the backoff policy while shipping fails.
+func (s *Spool) run() {
+	defer s.wg.Done()
+
+	var attempt int
+	for {
+		shipped, err := s.shipNext()
+
+		wait := s.interval
+		notifyCh := s.notifyCh
+		switch {
+		case err != nil && s.ctx.Err() != nil:
+			return
+		case err != nil:
+			s.metrics.ErrorsTotal.Inc()
+			var retry bool
+			wait, retry = s.backoff.Next(attempt)
+			if !retry {
+				wait = s.maxBackoff
+			}
+			attempt++
+			// new events do not hurry a failed bulk
+			notifyCh = nil
+			s.client.log.Infof("Unable to ship spooled events, retrying in %s: %v", wait, err)
+		case shipped > 0:
+			attempt = 0
+			continue
+		default:
+			attempt = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-notifyCh:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// shipNext adds the oldest pending events to QED, moving them to the
+// shipped events with their snapshots. It returns how many were shipped.
+func (s *Spool) shipNext() (int, error) {
+	var records []*SpoolRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return forEachSpoolRecord(tx.Bucket(spoolPendingBucket), s.maxBatchSize, func(r *SpoolRecord) {
+			records = append(records, r)
+		})
+	})
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	eventBulk := &protocol.EventsBulk{Events: make([][]byte, len(records))}
+	for i, r := range records {
+		eventBulk.Events[i] = r.Event
+	}
+	snapshots, err := s.client.addBulk(s.ctx, eventBulk)
+	if isPermanentSpoolError(err) {
+		return s.fail(records, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) != len(records) {
+		return 0, fmt.Errorf("Received %d snapshots for a bulk of %d events", len(snapshots), len(records))
+	}
+
+	now := time.Now()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(spoolPendingBucket)
+		shipped := tx.Bucket(spoolShippedBucket)
+		for i, r := range records {
+			r.ShippedAt = now
+			r.Snapshot = snapshots[i]
+			if err := pending.Delete(spoolKey(r.ID)); err != nil {
+				return err
+			}
+			if err := putSpoolRecord(shipped, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.metrics.ShippedTotal.Add(float64(len(records)))
+	return len(records), nil
+}
+
+// fail moves the events of a bulk rejected by QED to the failed events,
+// so they do not block the events after them. It returns how many were
+// moved.
+func (s *Spool) fail(records []*SpoolRecord, cause error) (int, error) {
+	now := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(spoolPendingBucket)
+		failed := tx.Bucket(spoolFailedBucket)
+		for _, r := range records {
+			r.FailedAt = now
+			r.Error = cause.Error()
+			if err := pending.Delete(spoolKey(r.ID)); err != nil {
+				return err
+			}
+			if err := putSpoolRecord(failed, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.metrics.FailedTotal.Add(float64(len(records)))
+	s.client.log.Infof("Unable to ship %d spooled events, moved to the failed events: %v", len(records), cause)
+	return len(records), nil
+}
+
+// isPermanentSpoolError tells whether QED rejected a bulk as invalid, so
+// shipping it again would fail too. Any other error, like the ones of a
+// cluster restarting or changing its leader, may go away.
+func isPermanentSpoolError(err error) bool {
+	reqErr, ok := err.(*RequestError)
+	if !ok {
+		return false
+	}
+	switch reqErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// view runs a read-only transaction unless the spool is closed.
+func (s *Spool) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+	return s.db.View(fn)
+}
+
+func (s *Spool) records(bucket []byte, limit int) ([]*SpoolRecord, error) {
+	records := make([]*SpoolRecord, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		return forEachSpoolRecord(tx.Bucket(bucket), limit, func(r *SpoolRecord) {
+			records = append(records, r)
+		})
+	})
+	return records, err
+}
+
+func (s *Spool) count(bucket []byte) (int, error) {
+	var n int
+	err := s.view(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// gaugeValue reports the closed spools as NaN rather than as empty.
+func gaugeValue(v float64, err error) float64 {
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
+func forEachSpoolRecord(b *bolt.Bucket, limit int, f func(r *SpoolRecord)) error {
+	c := b.Cursor()
+	n := 0
+	for k, v := c.First(); k != nil && n < limit; k, v = c.Next() {
+		r := new(SpoolRecord)
+		if err := r.Decode(v); err != nil {
+			return err
+		}
+		f(r)
+		n++
+	}
+	return nil
+}
+
+func putSpoolRecord(b *bolt.Bucket, r *SpoolRecord) error {
+	value, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	return b.Put(spoolKey(r.ID), value)
+}
+
+// spoolKey encodes event ids in big endian to
+// iterate them in the order they were appended.
+func spoolKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+type spoolMetrics struct {
+	Depth        prometheus.GaugeFunc
+	OldestAge    prometheus.GaugeFunc
+	Shipped      prometheus.GaugeFunc
+	Failed       prometheus.GaugeFunc
+	ShippedTotal prometheus.Counter
+	FailedTotal  prometheus.Counter
+	ErrorsTotal  prometheus.Counter
+}
+
+func newSpoolMetrics(s *Spool) *spoolMetrics {
+	return &spoolMetrics{
+		Depth: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "qed_client_spool_depth",
+				Help: "Number of spooled events pending of being shipped.",
+			},
+			func() float64 {
+				depth, err := s.Depth()
+				return gaugeValue(float64(depth), err)
+			},
+		),
+		OldestAge: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "qed_client_spool_oldest_age_seconds",
+				Help: "Seconds the oldest pending event has been in the spool.",
+			},
+			func() float64 {
+				age, err := s.OldestAge()
+				return gaugeValue(age.Seconds(), err)
+			},
+		),
+		Shipped: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "qed_client_spool_shipped",
+				Help: "Number of shipped events not acknowledged yet.",
+			},
+			func() float64 {
+				n, err := s.count(spoolShippedBucket)
+				return gaugeValue(float64(n), err)
+			},
+		),
+		Failed: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "qed_client_spool_failed",
+				Help: "Number of spooled events rejected by QED not acknowledged yet.",
+			},
+			func() float64 {
+				n, err := s.count(spoolFailedBucket)
+				return gaugeValue(float64(n), err)
+			},
+		),
+		ShippedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_client_spool_shipped_total",
+				Help: "Number of spooled events shipped to QED.",
+			},
+		),
+		FailedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_client_spool_failed_total",
+				Help: "Number of spooled events rejected by QED.",
+			},
+		),
+		ErrorsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_client_spool_errors_total",
+				Help: "Number of failed attempts to ship spooled events.",
+			},
+		),
+	}
+}
+
+func (m *spoolMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.Depth,
+		m.OldestAge,
+		m.Shipped,
+		m.Failed,
+		m.ShippedTotal,
+		m.FailedTotal,
+		m.ErrorsTotal,
+	}
+}
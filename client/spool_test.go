@@ -0,0 +1,285 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/crypto/hashing"
+)
+
+func testSpoolConfig(dir string) *SpoolConfig {
+	conf := DefaultSpoolConfig()
+	conf.Path = filepath.Join(dir, "spool.db")
+	conf.MaxBatchSize = 10
+	conf.Interval = 10 * time.Millisecond
+	conf.MinBackoff = 10 * time.Millisecond
+	conf.MaxBackoff = 50 * time.Millisecond
+	return conf
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// QED is unreachable until the test says otherwise
+	var up int32
+	serverURL, bulkSizes, tearDown := setupBulkServer(func(w http.ResponseWriter, r *http.Request) bool {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	})
+	defer tearDown()
+
+	// the health checks revive the primary marked as dead by a failure
+	client, err := NewHTTPClient(
+		SetURLs(serverURL),
+		SetRequestRetrier(NewNoRequestRetrier(http.DefaultClient)),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(true),
+		SetHealthCheckInterval(time.Hour),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	spool, err := NewSpool(client, testSpoolConfig(dir))
+	require.NoError(t, err)
+	defer spool.Close()
+
+	ids := make([]uint64, 25)
+	for i := range ids {
+		ids[i], err = spool.Append([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	depth, err := spool.Depth()
+	require.NoError(t, err)
+	require.Equal(t, 25, depth, "Events must wait in the spool while QED is unreachable")
+	age, err := spool.OldestAge()
+	require.NoError(t, err)
+	require.True(t, age >= 100*time.Millisecond)
+	require.True(t, testutil.ToFloat64(spool.metrics.ErrorsTotal) > 0)
+
+	atomic.StoreInt32(&up, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, spool.Flush(ctx))
+	depth, err = spool.Depth()
+	require.NoError(t, err)
+	require.Equal(t, 0, depth)
+	age, err = spool.OldestAge()
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), age)
+	require.Equal(t, []int{10, 10, 5}, bulkSizes(), "Events must be shipped in bulks")
+	require.Equal(t, float64(25), testutil.ToFloat64(spool.metrics.ShippedTotal))
+
+	shipped, err := spool.Shipped(100)
+	require.NoError(t, err)
+	require.Len(t, shipped, 25)
+	for i, r := range shipped {
+		require.Equal(t, ids[i], r.ID, "in test case %d", i)
+		require.Equal(t, uint64(i), r.Snapshot.Version, "Events must be shipped in order in test case %d", i)
+		require.Equal(t, hashing.Digest(fmt.Sprintf("event %d", i)), r.Snapshot.EventDigest, "in test case %d", i)
+	}
+
+	require.NoError(t, spool.Acknowledge(ids[:20]...))
+	shipped, err = spool.Shipped(100)
+	require.NoError(t, err)
+	require.Len(t, shipped, 5)
+	require.Error(t, spool.Acknowledge(ids[0]), "Acknowledged events must be gone")
+}
+
+func TestSpoolFailedEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// QED rejects the bulks until the test says otherwise
+	var rejecting int32 = 1
+	serverURL, _, tearDown := setupBulkServer(func(w http.ResponseWriter, r *http.Request) bool {
+		if atomic.LoadInt32(&rejecting) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		return true
+	})
+	defer tearDown()
+	client := setupClient(t, []string{serverURL})
+
+	spool, err := NewSpool(client, testSpoolConfig(dir))
+	require.NoError(t, err)
+	defer spool.Close()
+
+	ids := make([]uint64, 3)
+	for i := range ids {
+		ids[i], err = spool.Append([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, spool.Flush(ctx), "Rejected events must not block the spool")
+	require.Equal(t, float64(3), testutil.ToFloat64(spool.metrics.FailedTotal))
+	require.Equal(t, float64(0), testutil.ToFloat64(spool.metrics.ShippedTotal))
+
+	// the events after them are shipped
+	atomic.StoreInt32(&rejecting, 0)
+	id, err := spool.Append([]byte("event 3"))
+	require.NoError(t, err)
+	require.NoError(t, spool.Flush(ctx))
+	record, err := spool.Result(id)
+	require.NoError(t, err)
+	require.NotNil(t, record.Snapshot)
+
+	failed, err := spool.Failed(100)
+	require.NoError(t, err)
+	require.Len(t, failed, 3)
+	for i, r := range failed {
+		require.Equal(t, ids[i], r.ID, "in test case %d", i)
+		require.Nil(t, r.Snapshot, "in test case %d", i)
+		require.NotEmpty(t, r.Error, "in test case %d", i)
+	}
+	record, err = spool.Result(ids[0])
+	require.NoError(t, err)
+	require.NotEmpty(t, record.Error)
+
+	require.NoError(t, spool.Acknowledge(ids...))
+	failed, err = spool.Failed(100)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+}
+
+func TestSpoolUnavailableCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// QED fails while restarting until the test says otherwise
+	var status int32 = http.StatusPreconditionFailed
+	serverURL, _, tearDown := setupBulkServer(func(w http.ResponseWriter, r *http.Request) bool {
+		if s := atomic.LoadInt32(&status); s != http.StatusOK {
+			w.WriteHeader(int(s))
+			return false
+		}
+		return true
+	})
+	defer tearDown()
+
+	// the health checks revive the primary marked as dead by a failure
+	client, err := NewHTTPClient(
+		SetURLs(serverURL),
+		SetRequestRetrier(NewNoRequestRetrier(http.DefaultClient)),
+		SetTopologyDiscovery(false),
+		SetHealthChecks(true),
+		SetHealthCheckInterval(time.Hour),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	spool, err := NewSpool(client, testSpoolConfig(dir))
+	require.NoError(t, err)
+	defer spool.Close()
+
+	id, err := spool.Append([]byte("event"))
+	require.NoError(t, err)
+
+	for i, s := range []int32{http.StatusPreconditionFailed, http.StatusServiceUnavailable} {
+		atomic.StoreInt32(&status, s)
+		before := testutil.ToFloat64(spool.metrics.ErrorsTotal)
+		time.Sleep(100 * time.Millisecond)
+		require.True(t, testutil.ToFloat64(spool.metrics.ErrorsTotal) > before, "The bulk must be shipped again in test case %d", i)
+
+		depth, err := spool.Depth()
+		require.NoError(t, err)
+		require.Equal(t, 1, depth, "The event must stay pending in test case %d", i)
+		failed, err := spool.Failed(100)
+		require.NoError(t, err)
+		require.Empty(t, failed, "The event must not fail in test case %d", i)
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, spool.Flush(ctx))
+	record, err := spool.Result(id)
+	require.NoError(t, err)
+	require.NotNil(t, record.Snapshot)
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := testSpoolConfig(dir)
+
+	// spool the events with QED down
+	serverURL, _, tearDown := setupBulkServer(nil)
+	tearDown()
+	client := setupClient(t, []string{serverURL})
+	spool, err := NewSpool(client, conf)
+	require.NoError(t, err)
+
+	id, err := spool.Append([]byte("event"))
+	require.NoError(t, err)
+	record, err := spool.Result(id)
+	require.NoError(t, err)
+	require.Nil(t, record.Snapshot, "Pending events must not have a snapshot")
+	require.NoError(t, spool.Close())
+
+	_, err = spool.Append([]byte("late event"))
+	require.Equal(t, ErrSpoolClosed, err)
+	_, err = spool.Depth()
+	require.Equal(t, ErrSpoolClosed, err)
+	require.Equal(t, ErrSpoolClosed, spool.Flush(context.Background()))
+	require.True(t, math.IsNaN(testutil.ToFloat64(spool.metrics.Depth)), "Closed spools must not report an empty depth")
+
+	// ship them after a restart
+	serverURL, _, tearDown = setupBulkServer(nil)
+	defer tearDown()
+	client = setupClient(t, []string{serverURL})
+	spool, err = NewSpool(client, conf)
+	require.NoError(t, err)
+	defer spool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, spool.Flush(ctx))
+
+	record, err = spool.Result(id)
+	require.NoError(t, err)
+	require.NotNil(t, record.Snapshot)
+	require.Equal(t, hashing.Digest("event"), record.Snapshot.EventDigest)
+	require.Equal(t, uint64(0), record.Snapshot.Version)
+
+	_, err = spool.Result(id + 1)
+	require.Error(t, err)
+}
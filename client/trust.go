@@ -0,0 +1,208 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/protocol"
+)
+
+// ForkError is raised when a snapshot is not consistent with the trusted
+// head of the client, which proves that it has been shown a forked history.
+type ForkError struct {
+	Trusted       *protocol.Snapshot // Trusted head of the client.
+	Version       uint64             // Version of the inconsistent snapshot.
+	HistoryDigest hashing.Digest     // History digest of the inconsistent snapshot.
+}
+
+func (e *ForkError) Error() string {
+	return fmt.Sprintf("forked history: version %d with history digest %x is not consistent with the trusted version %d with history digest %x",
+		e.Version, e.HistoryDigest, e.Trusted.Version, e.Trusted.HistoryDigest)
+}
+
+// trustedHead keeps the last verified signed snapshot of the client,
+// persisted to a file if it has a path.
+type trustedHead struct {
+	sync.Mutex
+	path     string
+	verifier sign.Verifier
+	head     *protocol.SignedSnapshot
+}
+
+func newTrustedHead(path string, verifier sign.Verifier) (*trustedHead, error) {
+	if verifier == nil {
+		return nil, fmt.Errorf("A verifier is required to keep a trusted head")
+	}
+	t := &trustedHead{path: path, verifier: verifier}
+	if path == "" {
+		return t, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	head := new(protocol.SignedSnapshot)
+	if err := head.Decode(content); err != nil || head.Snapshot == nil {
+		return nil, fmt.Errorf("Unable to read the trusted head from %s: %v", path, err)
+	}
+	// the file could have been tampered with since it was saved
+	ok, err := head.VerifySignature(verifier)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("Unable to verify the signature of the trusted head from %s", path)
+	}
+	t.head = head
+	return t, nil
+}
+
+// save replaces the file of the trusted head, so it is never left
+// half written, syncing the new content before the rename.
+func (t *trustedHead) save() error {
+	if t.path == "" {
+		return nil
+	}
+	content, err := t.head.Encode()
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// TrustedHead returns the last verified signed snapshot, or nil if the
+// client does not keep one or has not verified any snapshot yet.
+func (c *HTTPClient) TrustedHead() *protocol.SignedSnapshot {
+	if c.trust == nil {
+		return nil
+	}
+	c.trust.Lock()
+	defer c.trust.Unlock()
+	return c.trust.head
+}
+
+// CheckSnapshot verifies the signature of a snapshot and its consistency
+// with the trusted head, asking for an incremental proof between them.
+// A newer snapshot becomes the trusted head. It returns a *ForkError if
+// the snapshot is not consistent with the trusted head.
+func (c *HTTPClient) CheckSnapshot(s *protocol.SignedSnapshot) error {
+	return c.CheckSnapshotWithContext(context.Background(), s)
+}
+
+// CheckSnapshotWithContext is like CheckSnapshot with a context.
+func (c *HTTPClient) CheckSnapshotWithContext(ctx context.Context, s *protocol.SignedSnapshot) error {
+	if s == nil || s.Snapshot == nil {
+		return fmt.Errorf("Invalid snapshot")
+	}
+	return c.checkTrustedHead(ctx, s.Snapshot.Version, s.Snapshot.HistoryDigest, s)
+}
+
+// checkTrustedHead verifies that the history digest of the version is
+// consistent with the trusted head. Only signed snapshots, whose signature
+// is verified first, become the trusted head.
+func (c *HTTPClient) checkTrustedHead(ctx context.Context, version uint64, historyDigest hashing.Digest, signed *protocol.SignedSnapshot) error {
+	if c.trust == nil {
+		return nil
+	}
+	t := c.trust
+	t.Lock()
+	defer t.Unlock()
+
+	if signed != nil {
+		ok, err := signed.VerifySignature(t.verifier)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Invalid signature of snapshot %d", version)
+		}
+	}
+
+	if t.head != nil {
+		trusted := t.head.Snapshot
+		fork := &ForkError{Trusted: trusted, Version: version, HistoryDigest: historyDigest}
+		switch {
+		case version == trusted.Version:
+			if !bytes.Equal(historyDigest, trusted.HistoryDigest) {
+				return fork
+			}
+			return nil
+		case version > trusted.Version:
+			ok, err := c.consistent(ctx, trusted.Version, trusted.HistoryDigest, version, historyDigest)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fork
+			}
+		default:
+			ok, err := c.consistent(ctx, version, historyDigest, trusted.Version, trusted.HistoryDigest)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fork
+			}
+			return nil
+		}
+	}
+
+	if signed == nil {
+		return nil
+	}
+	c.log.Debugf("New trusted head at version %d", version)
+	t.head = signed
+	return t.save()
+}
+
+// consistent asks for the incremental proof between two versions and
+// verifies it with their history digests.
+func (c *HTTPClient) consistent(ctx context.Context, start uint64, startDigest hashing.Digest, end uint64, endDigest hashing.Digest) (bool, error) {
+	proof, err := c.IncrementalWithContext(ctx, start, end)
+	if err != nil {
+		return false, err
+	}
+	return proof.Verify(
+		&balloon.Snapshot{HistoryDigest: startDigest, Version: start},
+		&balloon.Snapshot{HistoryDigest: endDigest, Version: end},
+	), nil
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage/bolt"
+)
+
+// signedHistory adds the events to a new balloon and returns it along with
+// the signed snapshot of every version.
+func signedHistory(t *testing.T, dir string, privateKey ed25519.PrivateKey, events ...string) (*balloon.Balloon, []*protocol.SignedSnapshot) {
+	db, err := bolt.NewBoltStore(dir, 0)
+	require.NoError(t, err)
+	bln, err := balloon.NewBalloon(db, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+
+	var signed []*protocol.SignedSnapshot
+	for _, e := range events {
+		s, mutations, err := bln.Add(hashing.NewSha256Hasher().Do([]byte(e)))
+		require.NoError(t, err)
+		require.NoError(t, db.Mutate(mutations, nil))
+		snapshot := protocol.ToSnapshot(s)
+		signed = append(signed, &protocol.SignedSnapshot{Snapshot: snapshot, Signature: ed25519.Sign(privateKey, snapshot.SigningMessage())})
+	}
+	return bln, signed
+}
+
+func TestTrustedHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-trust")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	verifier, err := sign.NewEd25519Verifier(publicKey)
+	require.NoError(t, err)
+
+	// the forked history shares the first three events
+	bln, history := signedHistory(t, dir+"/history", privateKey, "e0", "e1", "e2", "e3", "e4", "e5")
+	defer bln.Close()
+	forkedBln, forked := signedHistory(t, dir+"/forked", privateKey, "e0", "e1", "e2", "f3", "f4", "f5")
+	defer forkedBln.Close()
+
+	// the server and the snapshot store show the history until forked
+	server, snapshots := bln, history
+	fakeHttpClient := NewTestHttpClient(func(req *http.Request) (*http.Response, error) {
+		if req.Host == "primary.foo" && req.URL.Path == "/proofs/incremental" {
+			var query protocol.IncrementalRequest
+			_ = json.NewDecoder(req.Body).Decode(&query)
+			proof, err := server.QueryConsistency(query.Start, query.End)
+			require.NoError(t, err)
+			body, _ := json.Marshal(protocol.ToIncrementalResponse(proof))
+			return buildResponse(http.StatusOK, string(body)), nil
+		}
+		if req.Host == "snapshotStore.foo" && req.URL.Path == "/snapshot" {
+			version, _ := strconv.Atoi(req.URL.Query().Get("v"))
+			body, _ := json.Marshal(snapshots[version])
+			return buildResponse(http.StatusOK, string(body)), nil
+		}
+		return nil, errors.New("Unreachable")
+	})
+
+	newClient := func(verifier sign.Verifier) (*HTTPClient, error) {
+		return NewHTTPClient(
+			SetHttpClient(fakeHttpClient),
+			SetURLs("http://primary.foo"),
+			SetSnapshotStoreURL("http://snapshotStore.foo"),
+			SetMaxRetries(0),
+			SetTopologyDiscovery(false),
+			SetHealthChecks(false),
+			SetTrustedHead(dir+"/head.json", verifier),
+		)
+	}
+	client, err := newClient(verifier)
+	require.NoError(t, err)
+	require.Nil(t, client.TrustedHead())
+
+	invalid := *history[5]
+	invalid.Signature = []byte("invalid")
+
+	testCases := []struct {
+		snapshot *protocol.SignedSnapshot
+		head     uint64
+		fork     bool
+		err      bool
+	}{
+		{history[2], 2, false, false},
+		{history[4], 4, false, false},
+		{history[3], 4, false, false},
+		{history[4], 4, false, false},
+		{forked[5], 4, true, true},
+		{forked[4], 4, true, true},
+		{forked[1], 4, false, false},
+		{&invalid, 4, false, true},
+		{history[5], 5, false, false},
+	}
+
+	for i, c := range testCases {
+		err := client.CheckSnapshot(c.snapshot)
+		var fork *ForkError
+		require.Equal(t, c.fork, errors.As(err, &fork), "Wrong fork detection in test case %d: %v", i, err)
+		require.Equal(t, c.err, err != nil, "Wrong result in test case %d: %v", i, err)
+		require.Equal(t, c.head, client.TrustedHead().Snapshot.Version, "Wrong trusted head in test case %d", i)
+	}
+	client.Close()
+
+	// the trusted head survives the client
+	client, err = newClient(verifier)
+	require.NoError(t, err)
+	defer client.Close()
+	require.Equal(t, history[5], client.TrustedHead())
+
+	ok, err := client.IncrementalAutoVerify(1, 3)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// a forked snapshot store is detected, even with consistent proofs
+	server, snapshots = forkedBln, forked
+	ok, err = client.IncrementalAutoVerify(1, 4)
+	var fork *ForkError
+	require.True(t, errors.As(err, &fork), "Fork not detected: %v", err)
+	require.False(t, ok)
+	require.Equal(t, uint64(5), fork.Trusted.Version)
+
+	// a tampered trusted head is rejected
+	tampered := *history[5]
+	tampered.Signature = []byte("tampered")
+	content, err := tampered.Encode()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dir+"/head.json", content, 0600))
+	_, err = newClient(verifier)
+	require.Error(t, err)
+
+	// the trusted head needs a verifier
+	_, err = newClient(nil)
+	require.Error(t, err)
+	_, err = NewHTTPClientFromConfig(&Config{TrustedHeadPath: dir + "/head.json"})
+	require.Error(t, err)
+}
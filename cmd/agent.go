@@ -22,6 +22,8 @@ import (
 	"os"
 
 	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/tracing"
 	"github.com/octago/sflags/gen/gpflag"
 	"github.com/spf13/cobra"
 )
@@ -88,3 +90,41 @@ func runAgent(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// newTasksManager returns a durable tasks manager if a path for
+// its database has been configured, or a simple one otherwise.
+func newTasksManager(simple *gossip.SimpleTasksManagerConfig, durable *gossip.DurableTasksManagerConfig, l log.Logger) (gossip.TasksManager, error) {
+	if durable.Path == "" {
+		return gossip.NewSimpleTasksManagerFromConfig(simple, l), nil
+	}
+	return gossip.NewDurableTasksManagerFromConfig(durable, l)
+}
+
+// registerTasksManager exposes the metrics and the dead-letter
+// queue of durable tasks managers through the agent metrics server.
+func registerTasksManager(agent *gossip.Agent, tm gossip.TasksManager) {
+	if dtm, ok := tm.(*gossip.DurableTasksManager); ok {
+		agent.RegisterMetrics(dtm.Metrics())
+		agent.RegisterHandler("/tasks/dead", dtm.DeadLetterHandler())
+	}
+}
+
+// startAgentTracing installs a tracer for the agent if an exporter has been
+// configured. The returned function flushes the pending spans.
+func startAgentTracing(conf *gossip.Config, service string) (func(), error) {
+	if conf.TracingExporter == "" {
+		return func() {}, nil
+	}
+	exporter, err := tracing.NewExporter(conf.TracingExporter, conf.TracingEndpoint, service)
+	if err != nil {
+		return nil, err
+	}
+	tracerConf := tracing.DefaultTracerConfig()
+	tracerConf.SampleRatio = conf.TracingSampleRatio
+	tracer := tracing.NewTracerWithLogger(exporter, tracerConf, log.L().Named("tracing"))
+	tracing.SetTracer(tracer)
+	return func() {
+		tracing.SetTracer(nil)
+		_ = tracer.Close()
+	}, nil
+}
@@ -82,6 +82,8 @@ type auditorConfig struct {
 	Notifier *gossip.SimpleNotifierConfig
 	Store    *gossip.RestSnapshotStoreConfig
 	Tasks    *gossip.SimpleTasksManagerConfig
+	Queue    *gossip.DurableTasksManagerConfig
+	Audit    *auditStrategyConfig
 }
 
 func newAuditorConfig() *auditorConfig {
@@ -94,6 +96,8 @@ func newAuditorConfig() *auditorConfig {
 		Notifier: gossip.DefaultSimpleNotifierConfig(),
 		Store:    gossip.DefaultRestSnapshotStoreConfig(),
 		Tasks:    gossip.DefaultSimpleTasksManagerConfig(),
+		Queue:    gossip.DefaultDurableTasksManagerConfig(),
+		Audit:    newAuditStrategyConfig(),
 	}
 }
 
@@ -119,6 +123,7 @@ func runAgentAuditor(cmd *cobra.Command, args []string) error {
 		Name:            "qed.auditor",
 		IncludeLocation: true,
 		Level:           log.LevelFromString(agentConfig.Log),
+		Format:          agentConfig.LogFormat,
 		Output:          log.DefaultOutput,
 		TimeFormat:      log.DefaultTimeFormat,
 	}
@@ -130,26 +135,45 @@ func runAgentAuditor(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	stopTracing, err := startAgentTracing(agentConfig, "qed-auditor")
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
 	notifier := gossip.NewSimpleNotifierFromConfig(conf.Notifier, log.L().Named("agent.notifier"))
 	qed, err := client.NewHTTPClientFromConfig(conf.Qed)
 	if err != nil {
 		return err
 	}
-	tm := gossip.NewSimpleTasksManagerFromConfig(conf.Tasks, log.L().Named("agent.task-manager"))
+	tm, err := newTasksManager(conf.Tasks, conf.Queue, log.L().Named("agent.task-manager"))
+	if err != nil {
+		return err
+	}
 	store := gossip.NewRestSnapshotStoreFromConfig(conf.Store)
 
 	agent, err := gossip.NewDefaultAgent(agentConfig, qed, store, tm, notifier, log.L().Named("agent"))
 	if err != nil {
 		return err
 	}
+	registerTasksManager(agent, tm)
 
-	memF := membershipFactory{log.L().Named("agent.membership-factory")}
+	strategy, err := newAuditStrategy(conf.Audit, log.L().Named("agent.audit-strategy"))
+	if err != nil {
+		return err
+	}
+	memF := membershipFactory{strategy, log.L().Named("agent.membership-factory")}
 	bp := gossip.NewBatchProcessor(agent, []gossip.TaskFactory{memF}, log.L().Named("agent.processor"))
 	agent.In.Subscribe(gossip.BatchMessageType, bp, 255)
 	defer bp.Stop()
 
 	agent.Start()
 
+	if coverage, ok := strategy.(*coverageStrategy); ok {
+		coverage.run(agent, memF.audit)
+		defer coverage.stop()
+	}
+
 	QedAuditorInstancesCount.Inc()
 
 	util.AwaitTermSignal(agent.Shutdown)
@@ -177,7 +201,8 @@ func checkAuditorParams(conf *auditorConfig) error {
 }
 
 type membershipFactory struct {
-	log log.Logger
+	strategy auditStrategy
+	log      log.Logger
 }
 
 func (m membershipFactory) Metrics() []prometheus.Collector {
@@ -186,59 +211,89 @@ func (m membershipFactory) Metrics() []prometheus.Collector {
 		QedAuditorBatchesProcessSeconds,
 		QedAuditorBatchesReceivedTotal,
 		QedAuditorGetMembershipProofErrTotal,
+		QedAuditorSnapshotsSkippedTotal,
+		QedAuditorAuditedVersionsTotal,
+		QedAuditorCoveragePercent,
 	}
 }
 
+// Select chooses the snapshots of the batch to audit. It is called
+// once per batch, so retried tasks audit the same sample.
+func (i membershipFactory) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	return i.strategy.Select(b)
+}
+
 func (i membershipFactory) New(ctx context.Context) gossip.Task {
 	a := ctx.Value("agent").(*gossip.Agent)
 	b := ctx.Value("batch").(*protocol.BatchSnapshots)
 
-	s := b.Snapshots[0]
+	// the batch only contains the snapshots selected by the strategy
+	snapshots := b.Snapshots
+	coverage, _ := i.strategy.(*coverageStrategy)
 
-	QedAuditorBatchesReceivedTotal.Inc()
+	if !gossip.Retried(ctx) {
+		QedAuditorBatchesReceivedTotal.Inc()
+	}
 
 	return func() error {
 		timer := prometheus.NewTimer(QedAuditorBatchesProcessSeconds)
 		defer timer.ObserveDuration()
 
-		// TODO Get hasher via negotiation between agent and QED
-		proof, err := a.Qed.MembershipDigest(s.Snapshot.EventDigest, &s.Snapshot.Version)
-		if err != nil {
-			i.log.Infof("Auditor is unable to get membership proof from QED server: %v", err)
-
-			switch fmt.Sprintf("%T", err) {
-			case "*errors.errorString":
-				_ = a.Notifier.Alert(fmt.Sprintf("Auditor is unable to get membership proof from QED server: %v", err))
-			default:
-				QedAuditorGetMembershipProofErrTotal.Inc()
+		var lastErr error
+		for _, s := range snapshots {
+			err := i.audit(a, s)
+			if coverage != nil {
+				coverage.done(s.Snapshot.Version, err == nil)
+			}
+			if err != nil {
+				lastErr = err
 			}
-
-			return err
 		}
+		return lastErr
+	}
+}
 
-		storedSnap, err := a.SnapshotStore.GetSnapshot(proof.CurrentVersion)
-		if err != nil {
-			i.log.Infof("Unable to get snapshot with version %d from storage: %v", proof.CurrentVersion, err)
-			return err
-		}
+// audit verifies the membership of the event of the given
+// snapshot, alerting if the verification fails.
+func (i membershipFactory) audit(a *gossip.Agent, s *protocol.SignedSnapshot) error {
+	// TODO Get hasher via negotiation between agent and QED
+	proof, err := a.Qed.MembershipDigest(s.Snapshot.EventDigest, &s.Snapshot.Version)
+	if err != nil {
+		i.log.Infof("Auditor is unable to get membership proof from QED server: %v", err)
 
-		checkSnap := &balloon.Snapshot{
-			HistoryDigest: s.Snapshot.HistoryDigest,
-			HyperDigest:   storedSnap.Snapshot.HyperDigest,
-			Version:       s.Snapshot.Version,
-			EventDigest:   s.Snapshot.EventDigest,
+		switch fmt.Sprintf("%T", err) {
+		case "*errors.errorString":
+			_ = a.Notifier.Alert(fmt.Sprintf("Auditor is unable to get membership proof from QED server: %v", err))
+		default:
+			QedAuditorGetMembershipProofErrTotal.Inc()
 		}
 
-		ok, err := a.Qed.MembershipVerify(s.Snapshot.EventDigest, proof, checkSnap)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			_ = a.Notifier.Alert(fmt.Sprintf("Unable to verify snapshot %v", s.Snapshot))
-			i.log.Infof("Unable to verify snapshot %v", s.Snapshot)
-		}
+		return err
+	}
+
+	storedSnap, err := a.SnapshotStore.GetSnapshot(proof.CurrentVersion)
+	if err != nil {
+		i.log.Infof("Unable to get snapshot with version %d from storage: %v", proof.CurrentVersion, err)
+		return err
+	}
 
-		i.log.Infof("Snapshot %v has been verified by QED", s.Snapshot)
-		return nil
+	checkSnap := &balloon.Snapshot{
+		HistoryDigest: s.Snapshot.HistoryDigest,
+		HyperDigest:   storedSnap.Snapshot.HyperDigest,
+		Version:       s.Snapshot.Version,
+		EventDigest:   s.Snapshot.EventDigest,
 	}
+
+	ok, err := a.Qed.MembershipVerify(s.Snapshot.EventDigest, proof, checkSnap)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		_ = a.Notifier.Alert(fmt.Sprintf("Unable to verify snapshot %v", s.Snapshot))
+		i.log.Infof("Unable to verify snapshot %v", s.Snapshot)
+		return fmt.Errorf("Unable to verify snapshot %v", s.Snapshot)
+	}
+
+	i.log.Infof("Snapshot %v has been verified by QED", s.Snapshot)
+	return nil
 }
@@ -0,0 +1,534 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	QedAuditorSnapshotsSkippedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "qed_auditor_snapshots_skipped_total",
+			Help: "Number of snapshots not selected for auditing by the auditing strategy.",
+		},
+	)
+
+	QedAuditorAuditedVersionsTotal = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "qed_auditor_audited_versions_total",
+			Help: "Number of versions audited in coverage mode.",
+		},
+	)
+
+	QedAuditorCoveragePercent = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "qed_auditor_coverage_percent",
+			Help: "Percentage of the versions seen by the auditor that have been audited in coverage mode.",
+		},
+	)
+)
+
+const (
+	auditFirst    = "first"
+	auditAll      = "all"
+	auditSample   = "sample"
+	auditPriority = "priority"
+	auditCoverage = "coverage"
+)
+
+// auditStrategyConfig is the configuration of the auditing
+// strategy used to select the snapshots to be verified.
+type auditStrategyConfig struct {
+	Mode             string        `desc:"Auditing strategy: first, all, sample, priority or coverage"`
+	Rate             float64       `desc:"Ratio [0..1] of snapshots verified by the sample strategy, and by the priority strategy for versions out of any class"`
+	Classes          []string      `desc:"Event classes for the priority strategy as version ranges with its own ratio: start-end:rate,start-:rate..."`
+	CoverageStart    uint64        `desc:"First version to be audited in coverage mode"`
+	CoverageInterval time.Duration `desc:"Interval to schedule the audit of pending versions in coverage mode"`
+	CoverageBatch    int           `desc:"Maximum number of pending versions scheduled each interval in coverage mode"`
+	CoverageFile     string        `desc:"File to persist the audited versions in coverage mode"`
+}
+
+func newAuditStrategyConfig() *auditStrategyConfig {
+	return &auditStrategyConfig{
+		Mode:             auditFirst,
+		Rate:             1.0,
+		CoverageInterval: 10 * time.Second,
+		CoverageBatch:    100,
+	}
+}
+
+// auditStrategy selects the snapshots of a batch
+// that must be verified by the auditor.
+type auditStrategy interface {
+	Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot
+}
+
+func newAuditStrategy(conf *auditStrategyConfig, l log.Logger) (auditStrategy, error) {
+	if conf.Rate < 0 || conf.Rate > 1 {
+		return nil, fmt.Errorf("Invalid audit rate %f: it must be between 0 and 1", conf.Rate)
+	}
+	switch conf.Mode {
+	case auditFirst:
+		return firstStrategy{}, nil
+	case auditAll:
+		return allStrategy{}, nil
+	case auditSample:
+		return &sampleStrategy{rate: conf.Rate}, nil
+	case auditPriority:
+		classes, err := parseAuditClasses(conf.Classes)
+		if err != nil {
+			return nil, err
+		}
+		return &priorityStrategy{classes: classes, rate: conf.Rate}, nil
+	case auditCoverage:
+		return newCoverageStrategy(conf, l)
+	}
+	return nil, fmt.Errorf("Unknown audit mode %q", conf.Mode)
+}
+
+// firstStrategy verifies only the first snapshot of each batch.
+type firstStrategy struct{}
+
+func (s firstStrategy) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	if len(b.Snapshots) == 0 {
+		return nil
+	}
+	QedAuditorSnapshotsSkippedTotal.Add(float64(len(b.Snapshots) - 1))
+	return b.Snapshots[:1]
+}
+
+// allStrategy verifies every snapshot of each batch.
+type allStrategy struct{}
+
+func (s allStrategy) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	return b.Snapshots
+}
+
+// sampleStrategy verifies a random sample of the snapshots
+// received with the configured rate.
+type sampleStrategy struct {
+	rate float64
+}
+
+func (s *sampleStrategy) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	return sample(b.Snapshots, func(*protocol.SignedSnapshot) float64 { return s.rate })
+}
+
+// auditClass groups the versions in the range [start, end]
+// to be sampled with its own rate.
+type auditClass struct {
+	start, end uint64
+	rate       float64
+}
+
+// parseAuditClasses parses classes with the format start-end:rate.
+// The end of the range can be omitted to include all the versions
+// from start on.
+func parseAuditClasses(defs []string) ([]auditClass, error) {
+	classes := make([]auditClass, 0, len(defs))
+	for _, d := range defs {
+		parts := strings.Split(d, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid audit class %q: expected start-end:rate", d)
+		}
+		bounds := strings.Split(parts[0], "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid audit class %q: expected start-end:rate", d)
+		}
+		var c auditClass
+		var err error
+		c.start, err = strconv.ParseUint(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid audit class %q: %v", d, err)
+		}
+		c.end = math.MaxUint64
+		if bounds[1] != "" {
+			c.end, err = strconv.ParseUint(bounds[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid audit class %q: %v", d, err)
+			}
+		}
+		c.rate, err = strconv.ParseFloat(parts[1], 64)
+		if err != nil || c.rate < 0 || c.rate > 1 {
+			return nil, fmt.Errorf("Invalid audit class %q: rate must be between 0 and 1", d)
+		}
+		if c.start > c.end {
+			return nil, fmt.Errorf("Invalid audit class %q: start greater than end", d)
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
+
+// priorityStrategy samples the snapshots with the rate of the
+// first class containing its version, or with the default rate
+// if no class contains it.
+type priorityStrategy struct {
+	classes []auditClass
+	rate    float64
+}
+
+func (s *priorityStrategy) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	return sample(b.Snapshots, func(snap *protocol.SignedSnapshot) float64 {
+		v := snap.Snapshot.Version
+		for _, c := range s.classes {
+			if v >= c.start && v <= c.end {
+				return c.rate
+			}
+		}
+		return s.rate
+	})
+}
+
+func sample(snapshots []*protocol.SignedSnapshot, rate func(*protocol.SignedSnapshot) float64) []*protocol.SignedSnapshot {
+	selected := make([]*protocol.SignedSnapshot, 0)
+	for _, s := range snapshots {
+		if rand.Float64() < rate(s) {
+			selected = append(selected, s)
+			continue
+		}
+		QedAuditorSnapshotsSkippedTotal.Inc()
+	}
+	return selected
+}
+
+// coverageStrategy verifies every snapshot received and
+// keeps track of the audited versions. Versions lost by the
+// gossip network or whose audit failed are periodically
+// scheduled to be audited from the snapshot store.
+type coverageStrategy struct {
+	sync.Mutex
+	audited  *versionSet
+	inflight map[uint64]bool
+	start    uint64
+	last     uint64
+	interval time.Duration
+	batch    int
+	file     string
+	quitCh   chan struct{}
+	log      log.Logger
+}
+
+func newCoverageStrategy(conf *auditStrategyConfig, l log.Logger) (*coverageStrategy, error) {
+	s := &coverageStrategy{
+		audited:  newVersionSet(),
+		inflight: make(map[uint64]bool),
+		start:    conf.CoverageStart,
+		last:     conf.CoverageStart,
+		interval: conf.CoverageInterval,
+		batch:    conf.CoverageBatch,
+		file:     conf.CoverageFile,
+		quitCh:   make(chan struct{}),
+		log:      l,
+	}
+	if s.file != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *coverageStrategy) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	s.Lock()
+	defer s.Unlock()
+	selected := make([]*protocol.SignedSnapshot, 0)
+	for _, snap := range b.Snapshots {
+		v := snap.Snapshot.Version
+		if v > s.last {
+			s.last = v
+		}
+		if v < s.start || s.audited.Contains(v) || s.inflight[v] {
+			continue
+		}
+		s.inflight[v] = true
+		selected = append(selected, snap)
+	}
+	return selected
+}
+
+// done marks a version as processed, and as audited
+// if the verification succeeded.
+func (s *coverageStrategy) done(version uint64, audited bool) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.inflight, version)
+	if audited {
+		s.audited.Add(version)
+	}
+	s.updateMetrics()
+}
+
+// Coverage returns the percentage of versions audited between
+// the first version to audit and the last version seen.
+func (s *coverageStrategy) Coverage() float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.coverage()
+}
+
+func (s *coverageStrategy) coverage() float64 {
+	if s.last < s.start {
+		return 0
+	}
+	total := s.last - s.start + 1
+	return 100 * float64(s.audited.CountRange(s.start, s.last)) / float64(total)
+}
+
+func (s *coverageStrategy) updateMetrics() {
+	QedAuditorAuditedVersionsTotal.Set(float64(s.audited.Count()))
+	QedAuditorCoveragePercent.Set(s.coverage())
+}
+
+// pending returns up to limit versions not yet audited
+// nor being audited.
+func (s *coverageStrategy) pending(limit int) []uint64 {
+	s.Lock()
+	defer s.Unlock()
+	versions := make([]uint64, 0, limit)
+	for _, v := range s.audited.Missing(s.start, s.last, limit+len(s.inflight)) {
+		if len(versions) >= limit {
+			break
+		}
+		if s.inflight[v] {
+			continue
+		}
+		s.inflight[v] = true
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// run launches the loop scheduling the audit of the pending
+// versions, which are fetched from the agent snapshot store.
+func (s *coverageStrategy) run(a *gossip.Agent, audit func(*gossip.Agent, *protocol.SignedSnapshot) error) {
+	ticker := time.NewTicker(s.interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				for _, v := range s.pending(s.batch) {
+					version := v
+					err := a.Tasks.Add(func() error {
+						snap, err := a.SnapshotStore.GetSnapshot(version)
+						if err != nil {
+							s.done(version, false)
+							return fmt.Errorf("Unable to get snapshot with version %d from storage: %v", version, err)
+						}
+						err = audit(a, snap)
+						s.done(version, err == nil)
+						return err
+					})
+					if err != nil {
+						s.done(version, false)
+					}
+				}
+				if s.file != "" {
+					if err := s.save(); err != nil {
+						s.log.Infof("Unable to save audit coverage: %v", err)
+					}
+				}
+			case <-s.quitCh:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (s *coverageStrategy) stop() {
+	close(s.quitCh)
+	if s.file != "" {
+		if err := s.save(); err != nil {
+			s.log.Infof("Unable to save audit coverage: %v", err)
+		}
+	}
+}
+
+type coverageState struct {
+	Start   uint64
+	Last    uint64
+	Audited [][2]uint64
+}
+
+func (s *coverageStrategy) save() error {
+	s.Lock()
+	state := coverageState{Start: s.start, Last: s.last, Audited: s.audited.Ranges()}
+	s.Unlock()
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func (s *coverageStrategy) load() error {
+	buf, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state coverageState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return fmt.Errorf("Unable to load audit coverage from %s: %v", s.file, err)
+	}
+	if state.Last > s.last {
+		s.last = state.Last
+	}
+	for _, r := range state.Audited {
+		s.audited.AddRange(r[0], r[1])
+	}
+	s.updateMetrics()
+	return nil
+}
+
+// versionSet stores a set of versions as a sorted list
+// of disjoint closed intervals.
+type versionSet struct {
+	ranges [][2]uint64
+}
+
+func newVersionSet() *versionSet {
+	return &versionSet{ranges: make([][2]uint64, 0)}
+}
+
+// search returns the index of the first range
+// whose end is greater or equal than v.
+func (s *versionSet) search(v uint64) int {
+	return sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i][1] >= v
+	})
+}
+
+func (s *versionSet) Contains(v uint64) bool {
+	i := s.search(v)
+	return i < len(s.ranges) && s.ranges[i][0] <= v
+}
+
+func (s *versionSet) Add(v uint64) {
+	s.AddRange(v, v)
+}
+
+// AddRange adds all versions in [start, end], merging
+// the ranges that overlap or are adjacent.
+func (s *versionSet) AddRange(start, end uint64) {
+	lo := start
+	if lo > 0 {
+		lo--
+	}
+	i := s.search(lo)
+	j := i
+	for j < len(s.ranges) && (end == math.MaxUint64 || s.ranges[j][0] <= end+1) {
+		if s.ranges[j][0] < start {
+			start = s.ranges[j][0]
+		}
+		if s.ranges[j][1] > end {
+			end = s.ranges[j][1]
+		}
+		j++
+	}
+	merged := append([][2]uint64{}, s.ranges[:i]...)
+	merged = append(merged, [2]uint64{start, end})
+	s.ranges = append(merged, s.ranges[j:]...)
+}
+
+// Count returns the number of versions in the set.
+func (s *versionSet) Count() uint64 {
+	var n uint64
+	for _, r := range s.ranges {
+		n += r[1] - r[0] + 1
+	}
+	return n
+}
+
+// CountRange returns the number of versions of the set in [start, end].
+func (s *versionSet) CountRange(start, end uint64) uint64 {
+	var n uint64
+	for _, r := range s.ranges {
+		lo, hi := r[0], r[1]
+		if hi < start || lo > end {
+			continue
+		}
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		n += hi - lo + 1
+	}
+	return n
+}
+
+// Missing returns up to limit versions in [start, end]
+// not included in the set.
+func (s *versionSet) Missing(start, end uint64, limit int) []uint64 {
+	missing := make([]uint64, 0)
+	v := start
+	for _, r := range s.ranges {
+		if len(missing) >= limit || v > end {
+			return missing
+		}
+		if r[1] < v {
+			continue
+		}
+		for ; v < r[0] && v <= end && len(missing) < limit; v++ {
+			missing = append(missing, v)
+		}
+		if r[1] == math.MaxUint64 {
+			return missing
+		}
+		if r[1]+1 > v {
+			v = r[1] + 1
+		}
+	}
+	for ; v <= end && len(missing) < limit; v++ {
+		missing = append(missing, v)
+		if v == math.MaxUint64 {
+			break
+		}
+	}
+	return missing
+}
+
+// Ranges returns a copy of the intervals of the set.
+func (s *versionSet) Ranges() [][2]uint64 {
+	return append([][2]uint64{}, s.ranges...)
+}
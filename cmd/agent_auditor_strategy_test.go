@@ -0,0 +1,123 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBatch(versions ...uint64) *protocol.BatchSnapshots {
+	b := &protocol.BatchSnapshots{}
+	for _, v := range versions {
+		b.Snapshots = append(b.Snapshots, &protocol.SignedSnapshot{
+			Snapshot: &protocol.Snapshot{Version: v},
+		})
+	}
+	return b
+}
+
+func TestAuditStrategies(t *testing.T) {
+
+	testCases := []struct {
+		conf     *auditStrategyConfig
+		batch    *protocol.BatchSnapshots
+		expected int
+	}{
+		{&auditStrategyConfig{Mode: auditFirst}, newTestBatch(0, 1, 2), 1},
+		{&auditStrategyConfig{Mode: auditAll}, newTestBatch(0, 1, 2), 3},
+		{&auditStrategyConfig{Mode: auditSample, Rate: 1}, newTestBatch(0, 1, 2), 3},
+		{&auditStrategyConfig{Mode: auditSample, Rate: 0}, newTestBatch(0, 1, 2), 0},
+		{&auditStrategyConfig{Mode: auditPriority, Rate: 0, Classes: []string{"1-1:1", "5-:1"}}, newTestBatch(0, 1, 2, 5, 6), 3},
+		{&auditStrategyConfig{Mode: auditCoverage}, newTestBatch(0, 1, 2), 3},
+	}
+
+	for i, c := range testCases {
+		s, err := newAuditStrategy(c.conf, log.L())
+		require.NoError(t, err, "Unexpected error in test case %d", i)
+		require.Len(t, s.Select(c.batch), c.expected, "Wrong number of snapshots selected in test case %d", i)
+	}
+
+	_, err := newAuditStrategy(&auditStrategyConfig{Mode: "unknown"}, log.L())
+	require.Error(t, err)
+	_, err = newAuditStrategy(&auditStrategyConfig{Mode: auditSample, Rate: 2}, log.L())
+	require.Error(t, err)
+	_, err = newAuditStrategy(&auditStrategyConfig{Mode: auditPriority, Classes: []string{"5-1:1"}}, log.L())
+	require.Error(t, err)
+}
+
+func TestCoverageStrategy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-coverage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := newAuditStrategyConfig()
+	conf.Mode = auditCoverage
+	conf.CoverageFile = filepath.Join(dir, "coverage.json")
+
+	s, err := newCoverageStrategy(conf, log.L())
+	require.NoError(t, err)
+
+	selected := s.Select(newTestBatch(0, 1, 2, 5))
+	require.Len(t, selected, 4)
+	require.Len(t, s.Select(newTestBatch(0, 1)), 0, "In flight versions must not be selected again")
+
+	s.done(0, true)
+	s.done(1, true)
+	s.done(2, false)
+	s.done(5, true)
+
+	require.Equal(t, 50.0, s.Coverage())
+	require.Equal(t, []uint64{2, 3, 4}, s.pending(10))
+	require.Len(t, s.Select(newTestBatch(2)), 0, "Scheduled versions must not be selected again")
+
+	require.NoError(t, s.save())
+	s, err = newCoverageStrategy(conf, log.L())
+	require.NoError(t, err)
+	require.Equal(t, 50.0, s.Coverage(), "Coverage must be restored from file")
+}
+
+func TestVersionSet(t *testing.T) {
+	s := newVersionSet()
+	s.Add(5)
+	s.Add(3)
+	s.Add(4)
+	s.AddRange(10, 12)
+	s.Add(0)
+
+	require.Equal(t, [][2]uint64{{0, 0}, {3, 5}, {10, 12}}, s.Ranges())
+	require.True(t, s.Contains(4))
+	require.False(t, s.Contains(6))
+	require.Equal(t, uint64(7), s.Count())
+	require.Equal(t, uint64(3), s.CountRange(4, 10))
+	require.Equal(t, []uint64{1, 2, 6, 7, 8, 9, 13}, s.Missing(0, 13, 100))
+	require.Equal(t, []uint64{1, 2}, s.Missing(0, 13, 2))
+
+	s.AddRange(1, 9)
+	require.Equal(t, [][2]uint64{{0, 12}}, s.Ranges())
+
+	s.AddRange(20, math.MaxUint64)
+	require.Equal(t, []uint64{13, 14}, s.Missing(10, math.MaxUint64, 2))
+	require.True(t, s.Contains(math.MaxUint64))
+}
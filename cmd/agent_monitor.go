@@ -22,7 +22,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/client"
 	"github.com/bbva/qed/gossip"
 	"github.com/bbva/qed/log"
@@ -86,6 +85,7 @@ type monitorConfig struct {
 	Notifier *gossip.SimpleNotifierConfig
 	Store    *gossip.RestSnapshotStoreConfig
 	Tasks    *gossip.SimpleTasksManagerConfig
+	Queue    *gossip.DurableTasksManagerConfig
 }
 
 func newMonitorConfig() *monitorConfig {
@@ -98,6 +98,7 @@ func newMonitorConfig() *monitorConfig {
 		Notifier: gossip.DefaultSimpleNotifierConfig(),
 		Store:    gossip.DefaultRestSnapshotStoreConfig(),
 		Tasks:    gossip.DefaultSimpleTasksManagerConfig(),
+		Queue:    gossip.DefaultDurableTasksManagerConfig(),
 	}
 }
 
@@ -123,6 +124,7 @@ func runAgentMonitor(cmd *cobra.Command, args []string) error {
 		Name:            "qed.monitor",
 		IncludeLocation: true,
 		Level:           log.LevelFromString(agentConfig.Log),
+		Format:          agentConfig.LogFormat,
 		Output:          log.DefaultOutput,
 		TimeFormat:      log.DefaultTimeFormat,
 	}
@@ -134,18 +136,28 @@ func runAgentMonitor(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	stopTracing, err := startAgentTracing(agentConfig, "qed-monitor")
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
 	notifier := gossip.NewSimpleNotifierFromConfig(conf.Notifier, log.L().Named("agent.notifier"))
 	qed, err := client.NewHTTPClientFromConfig(conf.Qed)
 	if err != nil {
 		return err
 	}
-	tm := gossip.NewSimpleTasksManagerFromConfig(conf.Tasks, log.L().Named("agent.task-manager"))
+	tm, err := newTasksManager(conf.Tasks, conf.Queue, log.L().Named("agent.task-manager"))
+	if err != nil {
+		return err
+	}
 	store := gossip.NewRestSnapshotStoreFromConfig(conf.Store)
 
 	agent, err := gossip.NewDefaultAgent(agentConfig, qed, store, tm, notifier, log.L().Named("agent"))
 	if err != nil {
 		return err
 	}
+	registerTasksManager(agent, tm)
 
 	lagf := newLagFactory(1*time.Second, log.L().Named("agent.lag-factory"))
 	lagf.start()
@@ -203,8 +215,8 @@ func (i incrementalFactory) New(ctx context.Context) gossip.Task {
 		timer := prometheus.NewTimer(QedMonitorBatchesProcessSeconds)
 		defer timer.ObserveDuration()
 
-		firstSnap := balloon.Snapshot(*b.Snapshots[0].Snapshot)
-		lastSnap := balloon.Snapshot(*b.Snapshots[len(b.Snapshots)-1].Snapshot)
+		firstSnap := protocol.ToBalloonSnapshot(b.Snapshots[0].Snapshot)
+		lastSnap := protocol.ToBalloonSnapshot(b.Snapshots[len(b.Snapshots)-1].Snapshot)
 
 		proof, err := a.Qed.Incremental(firstSnap.Version, lastSnap.Version)
 		if err != nil {
@@ -214,7 +226,7 @@ func (i incrementalFactory) New(ctx context.Context) gossip.Task {
 			return err
 		}
 
-		ok, err := a.Qed.IncrementalVerify(proof, &firstSnap, &lastSnap)
+		ok, err := a.Qed.IncrementalVerify(proof, firstSnap, lastSnap)
 		if err != nil {
 			i.log.Infof("Error verifying incremental proof: %v", err)
 			return nil
@@ -279,7 +291,9 @@ func (l *lagFactory) New(ctx context.Context) gossip.Task {
 	counter := atomic.AddUint64(&l.counter, uint64(len(b.Snapshots)))
 	lastVersion := atomic.LoadUint64(&l.lastVersion)
 
-	QedMonitorBatchesReceivedTotal.Inc()
+	if !gossip.Retried(ctx) {
+		QedMonitorBatchesReceivedTotal.Inc()
+	}
 
 	return func() error {
 		timer := prometheus.NewTimer(QedMonitorBatchesProcessSeconds)
@@ -105,6 +105,7 @@ func runAgentPublisher(cmd *cobra.Command, args []string) error {
 		Name:            "qed.publisher",
 		IncludeLocation: true,
 		Level:           log.LevelFromString(agentConfig.Log),
+		Format:          agentConfig.LogFormat,
 		Output:          log.DefaultOutput,
 		TimeFormat:      log.DefaultTimeFormat,
 	}
@@ -116,6 +117,12 @@ func runAgentPublisher(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	stopTracing, err := startAgentTracing(agentConfig, "qed-publisher")
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
 	notifier := gossip.NewSimpleNotifierFromConfig(conf.Notifier, log.L().Named("agent.notifier"))
 	tm := gossip.NewSimpleTasksManagerFromConfig(conf.Tasks, log.L().Named("agent.task-manager"))
 	store := gossip.NewRestSnapshotStoreFromConfig(conf.Store)
@@ -130,6 +137,11 @@ func runAgentPublisher(cmd *cobra.Command, args []string) error {
 	agent.In.Subscribe(gossip.BatchMessageType, bp, 255)
 	defer bp.Stop()
 
+	// the signed audit roots are stored along with the snapshots
+	arp := gossip.NewAuditRootProcessor(agent, log.L().Named("agent.audit-root-processor"))
+	agent.In.Subscribe(gossip.AuditRootMessageType, arp, 255)
+	defer arp.Stop()
+
 	agent.Start()
 	util.AwaitTermSignal(agent.Shutdown)
 	return nil
@@ -165,7 +177,9 @@ func (p publisherFactory) Metrics() []prometheus.Collector {
 var errorNoSnapshots error = fmt.Errorf("No snapshots were found on this batch!!")
 
 func (p publisherFactory) New(ctx context.Context) gossip.Task {
-	QedPublisherBatchesReceivedTotal.Inc()
+	if !gossip.Retried(ctx) {
+		QedPublisherBatchesReceivedTotal.Inc()
+	}
 	p.log.Infof("PublisherFactory creating new Task!")
 	a := ctx.Value("agent").(*gossip.Agent)
 	b := ctx.Value("batch").(*protocol.BatchSnapshots)
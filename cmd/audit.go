@@ -0,0 +1,371 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd *cobra.Command = &cobra.Command{
+	Use:   "audit",
+	Short: "Audit a range of versions stored in a snapshot store",
+	Long: `Fetch the signed snapshots of a range of versions from a snapshot store,
+verify their signatures, verify the incremental proofs between consecutive
+stored snapshots and the membership proofs of a sample of versions,
+and write a JSON report with the discrepancies found`,
+	RunE: runAudit,
+}
+
+var auditCtx context.Context
+
+func init() {
+	auditCtx = configAudit()
+	Root.AddCommand(auditCmd)
+}
+
+type auditParams struct {
+	Qed        *client.Config
+	Store      *gossip.RestSnapshotStoreConfig
+	Start      uint64  `desc:"First version of the range to audit"`
+	End        uint64  `desc:"Last version of the range to audit"`
+	PublicKey  string  `desc:"Path to the ed25519 public key used to verify snapshot signatures"`
+	SampleRate float64 `desc:"Ratio [0..1] of versions whose membership proof is verified"`
+	Output     string  `desc:"File to write the JSON audit report, standard output if empty"`
+}
+
+func configAudit() context.Context {
+
+	conf := &auditParams{
+		Qed:        client.DefaultConfig(),
+		Store:      gossip.DefaultRestSnapshotStoreConfig(),
+		SampleRate: 0.1,
+	}
+
+	err := gpflag.ParseTo(conf, auditCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("audit.params"), conf)
+}
+
+func runAudit(cmd *cobra.Command, args []string) error {
+
+	params := auditCtx.Value(k("audit.params")).(*auditParams)
+
+	// create main logger
+	logOpts := &log.LoggerOptions{
+		Name:            "qed.audit",
+		IncludeLocation: true,
+		Level:           log.LevelFromString(params.Qed.Log),
+		Output:          log.DefaultOutput,
+		TimeFormat:      log.DefaultTimeFormat,
+	}
+	log.SetDefault(log.New(logOpts))
+
+	err := checkAuditParams(params)
+	if err != nil {
+		return err
+	}
+
+	verifier, err := sign.NewEd25519VerifierFromFile(params.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	qed, err := client.NewHTTPClientFromConfigWithLogger(params.Qed, log.L().Named("client"))
+	if err != nil {
+		return err
+	}
+	defer qed.Close()
+
+	store := gossip.NewRestSnapshotStoreFromConfig(params.Store)
+
+	a := newRangeAuditor(qed, store, verifier, params.SampleRate, log.L())
+	report := a.Audit(params.Start, params.End)
+
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if params.Output == "" {
+		fmt.Println(string(buf))
+	} else {
+		err = ioutil.WriteFile(params.Output, buf, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n := len(report.Discrepancies); n > 0 {
+		return fmt.Errorf("Audit found %d discrepancies", n)
+	}
+	return nil
+}
+
+func checkAuditParams(params *auditParams) error {
+	if params.Start > params.End {
+		return fmt.Errorf("Invalid range: start version %d is greater than end version %d", params.Start, params.End)
+	}
+	if params.SampleRate < 0 || params.SampleRate > 1 {
+		return fmt.Errorf("Invalid sample rate %v: must be in range [0..1]", params.SampleRate)
+	}
+	if params.PublicKey == "" {
+		return fmt.Errorf("Public key is required to verify snapshot signatures")
+	}
+
+	err := urlParse(params.Store.Endpoint...)
+	if err != nil {
+		return fmt.Errorf("Store endpoint: %v", err)
+	}
+
+	err = urlParse(params.Qed.Endpoints...)
+	if err != nil {
+		return fmt.Errorf("QED endpoint: %v", err)
+	}
+
+	return nil
+}
+
+// Kinds of discrepancies reported by the audit.
+const (
+	discrepancyMissingSnapshot  = "missing-snapshot"
+	discrepancyInvalidSignature = "invalid-signature"
+	discrepancyIncremental      = "incremental-proof"
+	discrepancyMembership       = "membership-proof"
+)
+
+// auditDiscrepancy describes a failed check over a version, or over
+// a range of versions in the case of incremental proofs.
+type auditDiscrepancy struct {
+	Kind       string
+	Version    uint64
+	EndVersion uint64 `json:",omitempty"`
+	Detail     string
+}
+
+// auditReport is the machine-readable result of auditing a range
+// of versions.
+type auditReport struct {
+	Start, End          uint64
+	StartedAt           time.Time
+	FinishedAt          time.Time
+	SnapshotsFound      int
+	SignaturesVerified  int
+	IncrementalVerified int
+	MembershipVerified  int
+	Discrepancies       []auditDiscrepancy
+}
+
+func (r *auditReport) add(kind string, version, end uint64, format string, args ...interface{}) {
+	r.Discrepancies = append(r.Discrepancies, auditDiscrepancy{
+		Kind:       kind,
+		Version:    version,
+		EndVersion: end,
+		Detail:     fmt.Sprintf(format, args...),
+	})
+}
+
+// proofQuerier is the subset of the QED client used by the audit.
+type proofQuerier interface {
+	Incremental(start, end uint64) (*balloon.IncrementalProof, error)
+	MembershipDigest(keyDigest hashing.Digest, version *uint64) (*balloon.MembershipProof, error)
+	MembershipDigestAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error)
+}
+
+// snapshotGetter is the subset of the snapshot store used by the audit.
+type snapshotGetter interface {
+	GetSnapshot(version uint64) (*protocol.SignedSnapshot, error)
+}
+
+// rangeAuditor verifies a range of versions against the signed
+// snapshots kept in a snapshot store.
+type rangeAuditor struct {
+	qed      proofQuerier
+	store    snapshotGetter
+	verifier sign.Verifier
+	rate     float64
+	log      log.Logger
+
+	// signed snapshots already fetched from the store
+	snapshots map[uint64]snapshotEntry
+}
+
+type snapshotEntry struct {
+	snapshot *protocol.SignedSnapshot
+	err      error
+}
+
+func newRangeAuditor(qed proofQuerier, store snapshotGetter, verifier sign.Verifier, rate float64, logger log.Logger) *rangeAuditor {
+	return &rangeAuditor{
+		qed:       qed,
+		store:     store,
+		verifier:  verifier,
+		rate:      rate,
+		log:       logger,
+		snapshots: make(map[uint64]snapshotEntry),
+	}
+}
+
+// Audit verifies every version in the range [start, end] and returns
+// a report with the discrepancies found.
+func (a *rangeAuditor) Audit(start, end uint64) *auditReport {
+	report := &auditReport{
+		Start:     start,
+		End:       end,
+		StartedAt: time.Now(),
+	}
+
+	var prev *protocol.SignedSnapshot
+	for v := start; ; v++ {
+		s, err := a.snapshot(v, report)
+		if err != nil {
+			report.add(discrepancyMissingSnapshot, v, 0, "%v", err)
+		}
+
+		if s != nil {
+			if prev != nil {
+				a.verifyIncremental(prev, s, report)
+			}
+			if rand.Float64() < a.rate {
+				a.verifyMembership(s, report)
+			}
+			prev = s
+		}
+
+		if v == end {
+			break
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	a.log.Infof("Audit of versions [%d, %d] finished with %d discrepancies", start, end, len(report.Discrepancies))
+	return report
+}
+
+// snapshot returns the signed snapshot of the given version, fetching it
+// from the store and verifying its signature the first time. It returns
+// nil if the snapshot is missing or its signature is not valid.
+func (a *rangeAuditor) snapshot(version uint64, report *auditReport) (*protocol.SignedSnapshot, error) {
+	if e, ok := a.snapshots[version]; ok {
+		return e.snapshot, e.err
+	}
+
+	s, err := a.fetch(version, report)
+	a.snapshots[version] = snapshotEntry{s, err}
+	return s, err
+}
+
+func (a *rangeAuditor) fetch(version uint64, report *auditReport) (*protocol.SignedSnapshot, error) {
+	s, err := a.store.GetSnapshot(version)
+	if err != nil {
+		return nil, err
+	}
+	if s.Snapshot == nil || s.Snapshot.Version != version {
+		return nil, fmt.Errorf("Store returned a wrong snapshot for version %d", version)
+	}
+
+	// snapshots out of the audited range, like the one of the last
+	// version used by non historical membership proofs, are not counted
+	inRange := version >= report.Start && version <= report.End
+	if inRange {
+		report.SnapshotsFound++
+	}
+
+	ok, err := s.VerifySignature(a.verifier)
+	if err != nil || !ok {
+		report.add(discrepancyInvalidSignature, version, 0, "Unable to verify signature of snapshot %v", s.Snapshot)
+		return nil, nil
+	}
+	if inRange {
+		report.SignaturesVerified++
+	}
+
+	return s, nil
+}
+
+func (a *rangeAuditor) verifyIncremental(start, end *protocol.SignedSnapshot, report *auditReport) {
+	startVersion, endVersion := start.Snapshot.Version, end.Snapshot.Version
+
+	proof, err := a.qed.Incremental(startVersion, endVersion)
+	if err != nil {
+		report.add(discrepancyIncremental, startVersion, endVersion, "Unable to get incremental proof from QED server: %v", err)
+		return
+	}
+
+	if proof.Start != startVersion || proof.End != endVersion || !proof.Verify(protocol.ToBalloonSnapshot(start.Snapshot), protocol.ToBalloonSnapshot(end.Snapshot)) {
+		report.add(discrepancyIncremental, startVersion, endVersion, "Unable to verify incremental proof between versions %d and %d", startVersion, endVersion)
+		return
+	}
+	report.IncrementalVerified++
+}
+
+func (a *rangeAuditor) verifyMembership(s *protocol.SignedSnapshot, report *auditReport) {
+	version := s.Snapshot.Version
+
+	// servers keeping the hyper tree history prove membership against
+	// the tree at the version of the snapshot
+	historical := true
+	proof, err := a.qed.MembershipDigestAt(s.Snapshot.EventDigest, version)
+	if err == client.ErrHistoricalUnsupported {
+		historical = false
+		proof, err = a.qed.MembershipDigest(s.Snapshot.EventDigest, &version)
+	}
+	if err != nil {
+		report.add(discrepancyMembership, version, 0, "Unable to get membership proof from QED server: %v", err)
+		return
+	}
+	if !proof.Exists || proof.ActualVersion != version {
+		report.add(discrepancyMembership, version, 0, "Event of snapshot %v not found in QED server", s.Snapshot)
+		return
+	}
+
+	checkSnap := protocol.ToBalloonSnapshot(s.Snapshot)
+	if !historical {
+		// otherwise the hyper proof is computed against the last
+		// version of the tree so we need the hyper digest of that version
+		current, _ := a.snapshot(proof.CurrentVersion, report)
+		if current == nil {
+			report.add(discrepancyMembership, version, 0, "Unable to get a valid snapshot with version %d from the store", proof.CurrentVersion)
+			return
+		}
+		checkSnap.HyperDigest = current.Snapshot.HyperDigest
+	}
+
+	if !proof.DigestVerify(s.Snapshot.EventDigest, checkSnap) {
+		report.add(discrepancyMembership, version, 0, "Unable to verify membership proof of snapshot %v", s.Snapshot)
+		return
+	}
+	report.MembershipVerified++
+}
@@ -0,0 +1,170 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage/bplus"
+	"github.com/stretchr/testify/require"
+)
+
+type balloonQuerier struct {
+	b *balloon.Balloon
+}
+
+func (q balloonQuerier) Incremental(start, end uint64) (*balloon.IncrementalProof, error) {
+	return q.b.QueryConsistency(start, end)
+}
+
+func (q balloonQuerier) MembershipDigest(keyDigest hashing.Digest, version *uint64) (*balloon.MembershipProof, error) {
+	return q.b.QueryDigestMembershipConsistency(keyDigest, *version)
+}
+
+func (q balloonQuerier) MembershipDigestAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	return q.b.QueryDigestMembershipAt(keyDigest, version)
+}
+
+type mapSnapshotStore map[uint64]*protocol.SignedSnapshot
+
+func (m mapSnapshotStore) GetSnapshot(version uint64) (*protocol.SignedSnapshot, error) {
+	s, ok := m[version]
+	if !ok {
+		return nil, fmt.Errorf("Snapshot %d not found", version)
+	}
+	return s, nil
+}
+
+func newTestAuditEnv(t *testing.T, events int) (balloonQuerier, mapSnapshotStore, sign.Signer) {
+	db := bplus.NewBPlusTreeStore()
+	b, err := balloon.NewBalloon(db, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.NoError(t, b.KeepHyperHistory())
+
+	signer := sign.NewEd25519Signer()
+	store := make(mapSnapshotStore)
+	hasher := hashing.NewSha256Hasher()
+
+	for i := 0; i < events; i++ {
+		s, mutations, err := b.Add(hasher.Do([]byte(fmt.Sprintf("event %d", i))))
+		require.NoError(t, err)
+		require.NoError(t, db.Mutate(mutations, nil))
+		snap := &protocol.Snapshot{
+			EventDigest:   s.EventDigest,
+			HistoryDigest: s.HistoryDigest,
+			HyperDigest:   s.HyperDigest,
+			Version:       s.Version,
+		}
+		sig, err := signer.Sign(snap.SigningMessage())
+		require.NoError(t, err)
+		store[s.Version] = &protocol.SignedSnapshot{Snapshot: snap, Signature: sig}
+	}
+
+	return balloonQuerier{b}, store, signer
+}
+
+func TestRangeAuditor(t *testing.T) {
+	qed, store, signer := newTestAuditEnv(t, 10)
+
+	report := newRangeAuditor(qed, store, signer, 1, log.L()).Audit(0, 9)
+	require.Empty(t, report.Discrepancies)
+	require.Equal(t, 10, report.SnapshotsFound)
+	require.Equal(t, 10, report.SignaturesVerified)
+	require.Equal(t, 9, report.IncrementalVerified)
+	require.Equal(t, 10, report.MembershipVerified)
+
+	// remove a snapshot and tamper others
+	delete(store, 3)
+	store[5].Signature = []byte("wrong signature")
+	store[7] = &protocol.SignedSnapshot{
+		Snapshot: &protocol.Snapshot{
+			EventDigest:   store[7].Snapshot.EventDigest,
+			HistoryDigest: store[6].Snapshot.HistoryDigest,
+			HyperDigest:   store[7].Snapshot.HyperDigest,
+			Version:       7,
+		},
+	}
+	store[7].Signature, _ = signer.Sign(store[7].Snapshot.SigningMessage())
+
+	report = newRangeAuditor(qed, store, signer, 0, log.L()).Audit(0, 8)
+	kinds := make(map[string][]uint64)
+	for _, d := range report.Discrepancies {
+		kinds[d.Kind] = append(kinds[d.Kind], d.Version)
+	}
+	require.Equal(t, []uint64{3}, kinds[discrepancyMissingSnapshot])
+	require.Equal(t, []uint64{5}, kinds[discrepancyInvalidSignature])
+	require.Equal(t, []uint64{6, 7}, kinds[discrepancyIncremental], "Tampered history digest must break both incremental proofs")
+	require.Equal(t, 4, report.IncrementalVerified)
+	require.Equal(t, 0, report.MembershipVerified)
+}
+
+func TestRangeAuditorHyperHistory(t *testing.T) {
+	qed, store, signer := newTestAuditEnv(t, 10)
+
+	// membership is proven against the hyper digest of each snapshot, so
+	// the last one is not needed
+	delete(store, 9)
+	report := newRangeAuditor(qed, store, signer, 1, log.L()).Audit(0, 8)
+	require.Empty(t, report.Discrepancies)
+	require.Equal(t, 9, report.MembershipVerified)
+
+	// servers not keeping the history need the last snapshot
+	report = newRangeAuditor(currentQuerier{qed}, store, signer, 1, log.L()).Audit(0, 8)
+	require.Equal(t, 0, report.MembershipVerified)
+	require.Len(t, report.Discrepancies, 9)
+
+	// the last snapshot is not counted as it is out of the audited range
+	qed, store, signer = newTestAuditEnv(t, 10)
+	report = newRangeAuditor(currentQuerier{qed}, store, signer, 1, log.L()).Audit(0, 8)
+	require.Empty(t, report.Discrepancies)
+	require.Equal(t, 9, report.MembershipVerified)
+	require.Equal(t, 9, report.SnapshotsFound)
+	require.Equal(t, 9, report.SignaturesVerified)
+
+	// other errors are discrepancies instead of falling back
+	report = newRangeAuditor(failingQuerier{qed}, store, signer, 1, log.L()).Audit(0, 8)
+	require.Equal(t, 0, report.MembershipVerified)
+	require.Len(t, report.Discrepancies, 9)
+	for _, d := range report.Discrepancies {
+		require.Equal(t, discrepancyMembership, d.Kind)
+	}
+}
+
+// currentQuerier queries a server not keeping the hyper tree history.
+type currentQuerier struct {
+	balloonQuerier
+}
+
+func (q currentQuerier) MembershipDigestAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	return nil, client.ErrHistoricalUnsupported
+}
+
+// failingQuerier queries a server failing the historical queries.
+type failingQuerier struct {
+	balloonQuerier
+}
+
+func (q failingQuerier) MembershipDigestAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	return nil, fmt.Errorf("Internal server error")
+}
@@ -18,11 +18,17 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 
+	"github.com/octago/sflags/gen/gpflag"
 	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/protocol"
 )
 
 var backupCreateCmd *cobra.Command = &cobra.Command{
@@ -31,30 +37,62 @@ var backupCreateCmd *cobra.Command = &cobra.Command{
 	RunE:  runBackupCreate,
 }
 
+type backupCreateParams struct {
+	Target string `desc:"Backup target of the server where the backup is uploaded"`
+}
+
 var backupCreateCtx context.Context
 
 func init() {
+	backupCreateCtx = configBackupCreate()
 	backupCmd.AddCommand(backupCreateCmd)
 }
 
+func configBackupCreate() context.Context {
+	conf := &backupCreateParams{}
+
+	err := gpflag.ParseTo(conf, backupCreateCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("backup.create.params"), conf)
+}
+
 func runBackupCreate(cmd *cobra.Command, args []string) error {
 
 	config := backupCtx.Value(k("backup.config")).(*BackupConfig)
+	params := backupCreateCtx.Value(k("backup.create.params")).(*backupCreateParams)
 
-	_, err := createBackup(config)
+	body, err := createBackup(config, params.Target)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Backup created!")
+	if params.Target == "" {
+		fmt.Println("Backup created!")
+		return nil
+	}
+
+	var manifest protocol.BackupManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+	fmt.Printf("Backup created and uploaded to %s as %s (version %d)\n", params.Target, manifest.Name, manifest.Version)
 
 	return nil
 }
 
-func createBackup(config *BackupConfig) ([]byte, error) {
+func createBackup(config *BackupConfig, target string) ([]byte, error) {
+
+	query := url.Values{}
+	if target != "" {
+		query.Set("target", target)
+	}
 
 	// Build request
-	req, err := http.NewRequest("POST", config.Endpoint+"/backup", nil)
+	req, err := http.NewRequest("POST", config.Endpoint+"/backup?"+query.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +119,9 @@ func createBackup(config *BackupConfig) ([]byte, error) {
 	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
 		return nil, fmt.Errorf("Invalid request %v", string(bodyBytes))
 	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("Backup failed: %v", string(bodyBytes))
+	}
 
 	return bodyBytes, nil
 }
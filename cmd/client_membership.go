@@ -20,7 +20,9 @@ import (
 	"bufio"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -32,6 +34,7 @@ import (
 	"github.com/bbva/qed/client"
 	"github.com/bbva/qed/crypto/hashing"
 	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
 )
 
 var clientMembershipCmd *cobra.Command = &cobra.Command{
@@ -51,12 +54,15 @@ func init() {
 
 type membershipParams struct {
 	Version       *uint64 `desc:"Version for the membership proof"`
+	Historical    bool    `desc:"Prove against the hyper digest of the given version instead of the current one"`
 	Event         string  `desc:"QED event to build the proof"`
 	EventDigest   string  `desc:"QED event digest to build the proof"`
 	HistoryDigest string  `desc:"QED history digest is used to verify the proof"`
 	HyperDigest   string  `desc:"QED hyper digest is used to verify the proof"`
 	Verify        bool    `desc:"Set to enable proof verification process"`
 	AutoVerify    bool    `desc:"Set to enable proof automatic verification process"`
+	ExportBundle  string  `desc:"Write a proof bundle, with the signed snapshots to verify it offline with qed verify, to the given file"`
+	PublicKey     string  `desc:"Path to the ed25519 public key of the snapshots, required to export a proof bundle"`
 }
 
 func configClientMembership() context.Context {
@@ -105,6 +111,7 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 
 	if !checkVersionSet(cmd) {
 		params.Version = nil
+		params.Historical = false
 		msg += " with latest version"
 	} else {
 		msg += fmt.Sprintf(" with version [ %d ]", *params.Version)
@@ -130,7 +137,15 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	proof, err = client.MembershipDigest(digest, params.Version)
+	if params.ExportBundle != "" {
+		return exportProofBundle(client, params, digest)
+	}
+
+	if params.Historical {
+		proof, err = client.MembershipDigestAt(digest, *params.Version)
+	} else {
+		proof, err = client.MembershipDigest(digest, params.Version)
+	}
 	if err != nil {
 		return err
 	}
@@ -147,7 +162,25 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 		var ok bool
 		var err error
 
-		if params.AutoVerify {
+		// a historical proof is verified with the digests of the query version
+		hyperVersion := proof.CurrentVersion
+		if params.Historical {
+			hyperVersion = proof.QueryVersion
+		}
+
+		if params.AutoVerify && params.Historical {
+			fmt.Printf("\nAuto-Verifying event with: \n\n EventDigest: %x\n Version: %d\n", digest, proof.QueryVersion)
+			var s *protocol.Snapshot
+			s, err = client.GetSnapshot(proof.QueryVersion)
+			if err == nil {
+				ok = proof.DigestVerify(digest, &balloon.Snapshot{
+					HistoryDigest: s.HistoryDigest,
+					HyperDigest:   s.HyperDigest,
+					Version:       s.Version,
+					EventDigest:   digest,
+				})
+			}
+		} else if params.AutoVerify {
 			fmt.Printf("\nAuto-Verifying event with: \n\n EventDigest: %x\n Version: %d\n", digest, proof.QueryVersion)
 			ok, err = client.MembershipAutoVerify(digest, params.Version)
 		} else {
@@ -155,7 +188,7 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 			hyperDigest := params.HyperDigest
 			historyDigest := params.HistoryDigest
 			for hyperDigest == "" {
-				hyperDigest = readLine(fmt.Sprintf("Please, provide the hyperDigest for current version [ %d ]: ", proof.CurrentVersion))
+				hyperDigest = readLine(fmt.Sprintf("Please, provide the hyperDigest for version [ %d ]: ", hyperVersion))
 			}
 			if proof.Exists {
 				for historyDigest == "" {
@@ -188,6 +221,39 @@ func runClientMembership(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// exportProofBundle writes the proof bundle of the event digest once
+// verified, so it is known to verify offline.
+func exportProofBundle(c *client.HTTPClient, params *membershipParams, digest hashing.Digest) error {
+	if params.PublicKey == "" {
+		return errors.New("Public key is required to export a proof bundle.")
+	}
+	publicKey, err := ioutil.ReadFile(params.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := c.MembershipBundle(digest, params.Version, params.Historical, publicKey)
+	if err != nil {
+		return err
+	}
+	if params.EventDigest == "" {
+		bundle.Event = []byte(params.Event)
+	}
+	if err := bundle.Verify(publicKey); err != nil {
+		return fmt.Errorf("Unable to verify the proof bundle: %v", err)
+	}
+
+	content, err := bundle.Encode()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(params.ExportBundle, content, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("\nProof bundle of version %d written to %s, key ID: %s\n\n", bundle.Proof.QueryVersion, params.ExportBundle, bundle.KeyID)
+	return nil
+}
+
 func readLine(query string) string {
 	fmt.Print(query)
 	reader := bufio.NewReader(os.Stdin)
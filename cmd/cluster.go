@@ -0,0 +1,136 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+)
+
+type ClusterConfig struct {
+	// Endpoint [host:port] to ask for QED management APIs.
+	Endpoint string `desc:"QED Log service management endpoint http://ip:port"`
+
+	// ApiKey to query the server endpoint.
+	APIKey string `desc:"Set API Key to talk to QED Log service"`
+}
+
+func defaultClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		Endpoint: "http://127.0.0.1:8700",
+		APIKey:   "my-key",
+	}
+}
+
+var clusterCmd *cobra.Command = &cobra.Command{
+	Use:               "cluster",
+	Short:             "Manages QED log cluster membership",
+	TraverseChildren:  true,
+	PersistentPreRunE: runCluster,
+}
+
+var clusterCtx context.Context
+
+func init() {
+	clusterCtx = configCluster()
+	Root.AddCommand(clusterCmd)
+}
+
+func configCluster() context.Context {
+
+	conf := defaultClusterConfig()
+
+	err := gpflag.ParseTo(conf, clusterCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("cluster.config"), conf)
+}
+
+func runCluster(cmd *cobra.Command, args []string) error {
+	var err error
+
+	endpoint, _ := cmd.Flags().GetString("endpoint")
+	err = urlParse(endpoint)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// memberParams are the flags shared by the commands that change
+// the role of a cluster member.
+type memberParams struct {
+	NodeID string `desc:"Id of the cluster member"`
+	Force  bool   `desc:"Skip the quorum safety checks"`
+}
+
+func configMemberCommand(cmd *cobra.Command, key string) context.Context {
+	conf := &memberParams{}
+
+	err := gpflag.ParseTo(conf, cmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k(key), conf)
+}
+
+func clusterRequest(config *ClusterConfig, method, path string, query url.Values) ([]byte, error) {
+
+	// Build request
+	req, err := http.NewRequest(method, config.Endpoint+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Api-Key", config.APIKey)
+
+	// Get response
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("Request error: %v\n", err)
+		return nil, err
+	}
+
+	var bodyBytes []byte
+	if resp.Body != nil {
+		defer resp.Body.Close()
+		bodyBytes, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("Invalid request: %v", string(bodyBytes))
+	}
+
+	return bodyBytes, nil
+}
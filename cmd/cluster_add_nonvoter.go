@@ -0,0 +1,78 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+)
+
+var clusterAddNonvoterCmd *cobra.Command = &cobra.Command{
+	Use:   "add-nonvoter",
+	Short: "Add a nonvoter member to the QED Log cluster",
+	RunE:  runClusterAddNonvoter,
+}
+
+var clusterAddNonvoterCtx context.Context
+
+type addNonvoterParams struct {
+	NodeID   string `desc:"Id of the new cluster member"`
+	RaftAddr string `desc:"Raft address of the new cluster member"`
+}
+
+func init() {
+	clusterAddNonvoterCtx = configClusterAddNonvoter()
+	clusterCmd.AddCommand(clusterAddNonvoterCmd)
+}
+
+func configClusterAddNonvoter() context.Context {
+	conf := &addNonvoterParams{}
+
+	err := gpflag.ParseTo(conf, clusterAddNonvoterCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("cluster.add-nonvoter.params"), conf)
+}
+
+func runClusterAddNonvoter(cmd *cobra.Command, args []string) error {
+	params := clusterAddNonvoterCtx.Value(k("cluster.add-nonvoter.params")).(*addNonvoterParams)
+
+	config := clusterCtx.Value(k("cluster.config")).(*ClusterConfig)
+
+	if params.NodeID == "" || params.RaftAddr == "" {
+		return fmt.Errorf("Node id and raft address are required")
+	}
+
+	query := url.Values{}
+	query.Set("id", params.NodeID)
+	query.Set("addr", params.RaftAddr)
+	_, err := clusterRequest(config, "POST", "/cluster/nonvoters", query)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Nonvoter member added!")
+	return nil
+}
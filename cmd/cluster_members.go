@@ -0,0 +1,58 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/protocol"
+)
+
+var clusterMembersCmd *cobra.Command = &cobra.Command{
+	Use:   "members",
+	Short: "List QED Log cluster members",
+	RunE:  runClusterMembers,
+}
+
+func init() {
+	clusterCmd.AddCommand(clusterMembersCmd)
+}
+
+func runClusterMembers(cmd *cobra.Command, args []string) error {
+
+	config := clusterCtx.Value(k("cluster.config")).(*ClusterConfig)
+
+	body, err := clusterRequest(config, "GET", "/cluster/members", nil)
+	if err != nil {
+		return err
+	}
+
+	var members []protocol.MemberInfo
+	err = json.Unmarshal(body, &members)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Cluster members:")
+	for _, m := range members {
+		fmt.Printf("Id: %s\tRaftAddr: %s\tSuffrage: %s\tLeader: %t\tReachable: %t\t \n", m.NodeId, m.RaftAddr, m.Suffrage, m.Leader, m.Reachable)
+	}
+	return nil
+}
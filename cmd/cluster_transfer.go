@@ -0,0 +1,76 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+)
+
+var clusterTransferCmd *cobra.Command = &cobra.Command{
+	Use:   "transfer-leadership",
+	Short: "Transfer the leadership of the QED Log cluster",
+	Long: `Transfer the leadership of the QED Log cluster to the given voter,
+or to the most up to date voter if no node id is given`,
+	RunE: runClusterTransfer,
+}
+
+var clusterTransferCtx context.Context
+
+type transferParams struct {
+	NodeID string `desc:"Id of the voter to transfer the leadership to"`
+}
+
+func init() {
+	clusterTransferCtx = configClusterTransfer()
+	clusterCmd.AddCommand(clusterTransferCmd)
+}
+
+func configClusterTransfer() context.Context {
+	conf := &transferParams{}
+
+	err := gpflag.ParseTo(conf, clusterTransferCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("cluster.transfer-leadership.params"), conf)
+}
+
+func runClusterTransfer(cmd *cobra.Command, args []string) error {
+	params := clusterTransferCtx.Value(k("cluster.transfer-leadership.params")).(*transferParams)
+
+	config := clusterCtx.Value(k("cluster.config")).(*ClusterConfig)
+
+	query := url.Values{}
+	if params.NodeID != "" {
+		query.Set("id", params.NodeID)
+	}
+	_, err := clusterRequest(config, "POST", "/cluster/leadership", query)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Leadership transferred!")
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/server"
+	"github.com/bbva/qed/storage"
+)
+
+type ExportConfig struct {
+	// Database of a stopped server to export.
+	DBPath string `desc:"Path of the database to export"`
+
+	// Storage engine of the database.
+	Engine string `desc:"Storage engine of the database: rocksdb or bolt"`
+
+	// File to write.
+	Output string `desc:"Path of the export file"`
+
+	// Versions between consecutive checkpoints.
+	CheckpointInterval uint64 `desc:"Versions between consecutive signed checkpoints, the last version always has one"`
+
+	// Private key used to sign the checkpoints.
+	PrivateKeyPath string `desc:"Path to the ed25519 private key used to sign the checkpoints"`
+
+	// Node recorded in the header of the file.
+	NodeID string `desc:"Name of the exported node, recorded in the file"`
+}
+
+func defaultExportConfig() *ExportConfig {
+	return &ExportConfig{
+		Engine:             storage.RocksDBEngine,
+		CheckpointInterval: 10000,
+	}
+}
+
+var exportCmd *cobra.Command = &cobra.Command{
+	Use:   "export",
+	Short: "Export the QED log to a file",
+	Long: `Export the digests of every event of a database in version order, with the
+payloads of the audit entries, to a compressed file. The roots of the trees are
+signed as checkpoints every --checkpoint-interval versions and at the last
+version, so the log can be imported with qed import into a fresh database of
+any storage engine. The server must be stopped.`,
+	TraverseChildren: true,
+	RunE:             runExport,
+}
+
+var exportCtx context.Context
+
+func init() {
+	exportCtx = configExport()
+	Root.AddCommand(exportCmd)
+}
+
+func configExport() context.Context {
+
+	conf := defaultExportConfig()
+
+	err := gpflag.ParseTo(conf, exportCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("export.config"), conf)
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+
+	params := exportCtx.Value(k("export.config")).(*ExportConfig)
+
+	if params.DBPath == "" {
+		return errors.New("Database path is empty.")
+	}
+	if params.Output == "" {
+		return errors.New("Output file is empty.")
+	}
+	if params.PrivateKeyPath == "" {
+		return errors.New("Private key is required to sign the checkpoints.")
+	}
+	signer, err := sign.NewEd25519SignerFromFile(params.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := server.OpenStore(params.Engine, params.DBPath, 0, true)
+	if err != nil {
+		return fmt.Errorf("Unable to open the database: %v", err)
+	}
+	defer db.Close()
+
+	file, err := os.Create(params.Output)
+	if err != nil {
+		return err
+	}
+	report, err := consensus.ExportLog(db, file, &consensus.ExportOptions{
+		CheckpointInterval: params.CheckpointInterval,
+		Signer:             signer,
+		NodeID:             params.NodeID,
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(params.Output)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Export completed! %d events, %d payloads and %d checkpoints written to %s, history root %x, hyper root %x\n",
+		report.Events, report.Payloads, report.Checkpoints, params.Output, report.HistoryRoot, report.HyperRoot)
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/export"
+	"github.com/bbva/qed/server"
+	"github.com/bbva/qed/storage"
+)
+
+type ImportConfig struct {
+	// File written by qed export.
+	Input string `desc:"Path of the export file"`
+
+	// Fresh database to import the log into.
+	DBPath string `desc:"Path of the new database"`
+
+	// Storage engine of the new database.
+	Engine string `desc:"Storage engine of the new database: rocksdb or bolt"`
+
+	// Public key used to verify the checkpoints.
+	PublicKey string `desc:"Path to the ed25519 public key used to verify the signed checkpoints"`
+}
+
+func defaultImportConfig() *ImportConfig {
+	return &ImportConfig{
+		Engine: storage.RocksDBEngine,
+	}
+}
+
+var importCmd *cobra.Command = &cobra.Command{
+	Use:   "import",
+	Short: "Import the QED log from a file",
+	Long: `Import a file written by qed export into a new database, rebuilding the
+balloon from the digests of its events. The roots of the trees are recomputed
+and compared with every signed checkpoint of the file, and the import fails at
+the first mismatch. A server started on the imported database must use an
+empty Raft directory.`,
+	TraverseChildren: true,
+	RunE:             runImport,
+}
+
+var importCtx context.Context
+
+func init() {
+	importCtx = configImport()
+	Root.AddCommand(importCmd)
+}
+
+func configImport() context.Context {
+
+	conf := defaultImportConfig()
+
+	err := gpflag.ParseTo(conf, importCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("import.config"), conf)
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+
+	params := importCtx.Value(k("import.config")).(*ImportConfig)
+
+	if params.Input == "" {
+		return errors.New("Input file is empty.")
+	}
+	if params.DBPath == "" {
+		return errors.New("Database path is empty.")
+	}
+	if params.PublicKey == "" {
+		return errors.New("Public key is required to verify the checkpoints.")
+	}
+	verifier, err := sign.NewEd25519VerifierFromFile(params.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(params.Input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := export.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	db, err := server.OpenStore(params.Engine, params.DBPath, 0, false)
+	if err != nil {
+		return fmt.Errorf("Unable to open the database: %v", err)
+	}
+	defer db.Close()
+
+	report, err := consensus.ImportLog(db, reader, verifier)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Import completed! %d events, %d payloads and %d checkpoints verified, history root %x, hyper root %x\n",
+		report.Events, report.Payloads, report.Checkpoints, report.HistoryRoot, report.HyperRoot)
+	fmt.Println("Start the server with an empty Raft directory.")
+	return nil
+}
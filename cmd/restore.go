@@ -20,12 +20,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/octago/sflags/gen/gpflag"
 	"github.com/spf13/cobra"
 
-	"github.com/bbva/qed/rocksdb"
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/server"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
 )
 
 type RestoreConfig struct {
@@ -37,19 +45,72 @@ type RestoreConfig struct {
 
 	// Path to restore a backup.
 	RestorePath string `desc:"Path to restore a backup"`
+
+	// Storage engine of the backups.
+	Engine string `desc:"Storage engine of the backups: rocksdb or bolt"`
+
+	// Backup target to download the backup from, instead of the backup directory.
+	Source string `desc:"Backup target to restore from: a directory, s3://bucket/prefix or ssh://user@host:port/path"`
+
+	// Backup to restore from the backup target.
+	BackupName string `desc:"Name of the backup to restore from the source, the latest one by default"`
+
+	// Endpoint, region and credentials of S3 sources.
+	S3Endpoint  string `desc:"Endpoint of the S3 source, https://s3.amazonaws.com by default"`
+	S3Region    string `desc:"Region of the S3 source"`
+	S3AccessKey string `desc:"Access key of the S3 source"`
+	S3SecretKey string `desc:"Secret key of the S3 source"`
+
+	// Private key and known_hosts file used to connect to SSH sources.
+	SSHKeyPath        string `flag:"ssh-key-path" desc:"Private key used to connect to the SSH source"`
+	SSHKnownHostsPath string `flag:"ssh-known-hosts-path" desc:"Known hosts file used to verify the SSH source, ~/.ssh/known_hosts by default"`
+
+	// Version to restore, from the closest backup before it.
+	Version uint64 `desc:"Version to restore, replaying the WAL and the Raft log after the closest backup"`
+
+	// Database and Raft directory of a stopped server, replayed after the backup.
+	DBPath   string `desc:"Path of the database whose WAL is replayed after the backup"`
+	RaftPath string `desc:"Path of the Raft directory whose log is replayed after the backup and the WAL"`
+
+	// Keep every version of the hyper tree, as the servers do.
+	HyperHistory bool `desc:"Keep every version of the hyper tree in the replayed events"`
+
+	// Verify the restored database against the signed snapshot of its version.
+	Verify bool `desc:"Verify the roots of the restored database against the signed snapshot of its version, and mark it unusable on mismatch"`
+
+	// Snapshot store or file, and public key, to verify the restored version with.
+	SnapshotStore *gossip.RestSnapshotStoreConfig
+	SnapshotFile  string `desc:"JSON file with the signed snapshot of the restored version, instead of the snapshot store"`
+	PublicKey     string `desc:"Path to the ed25519 public key used to verify the signed snapshot of the restored version and the manifest of backups restored from a source"`
 }
 
 func defaultRestoreConfig() *RestoreConfig {
 	return &RestoreConfig{
-		BackupDir:   "",
-		BackupID:    0,
-		RestorePath: "",
+		BackupDir:     "",
+		BackupID:      0,
+		RestorePath:   "",
+		Engine:        storage.RocksDBEngine,
+		S3Region:      "us-east-1",
+		SnapshotStore: gossip.DefaultRestSnapshotStoreConfig(),
 	}
 }
 
 var restoreCmd *cobra.Command = &cobra.Command{
-	Use:              "restore",
-	Short:            "Restore a QED log backup",
+	Use:   "restore",
+	Short: "Restore a QED log backup",
+	Long: `Restore a QED log backup from the backups directory of a database or
+from a backup target. The manifest of a backup restored from a backup target
+must be signed by the key given with --public-key. With --version, the closest
+backup at or before the version is restored and the events added after it are
+replayed from the WAL of the database and the Raft log up to exactly that
+version, validating the history root against the signed snapshot of the
+version. A server started on a database restored to a version must use an
+empty Raft directory.
+
+With --verify, the history and hyper roots of the last version of the restored
+database are recomputed and compared with the signed snapshot of the version,
+taken from the snapshot store, a snapshot file or the manifest of the backup.
+Servers refuse to start on a restored database that fails verification.`,
 	TraverseChildren: true,
 	RunE:             runRestore,
 }
@@ -78,6 +139,12 @@ func runRestore(cmd *cobra.Command, args []string) error {
 
 	params := restoreCtx.Value(k("restore.config")).(*RestoreConfig)
 
+	if params.Source != "" {
+		return runRemoteRestore(params)
+	}
+	if checkVersionSet(cmd) {
+		return runPointInTimeRestore(params)
+	}
 	if params.BackupDir == "" {
 		return errors.New("Backup directory is empty.")
 	}
@@ -85,27 +152,156 @@ func runRestore(cmd *cobra.Command, args []string) error {
 		return errors.New("Restore directory is empty.")
 	}
 
-	bo := rocksdb.NewDefaultOptions()
-	be, err := rocksdb.OpenBackupEngine(bo, params.BackupDir)
+	var snapshots func(version uint64) (*balloon.Snapshot, error)
+	if params.Verify {
+		var err error
+		snapshots, err = signedSnapshots(params, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := server.RestoreBackup(params.Engine, params.BackupDir, params.BackupID, params.RestorePath)
 	if err != nil {
 		return err
 	}
+	if params.BackupID == 0 {
+		fmt.Println("Restore from latest backup completed!")
+	} else {
+		fmt.Printf("Restore from backup %d completed!\n", params.BackupID)
+	}
+	if params.Verify {
+		return verifyRestore(params.Engine, params.RestorePath, snapshots, true)
+	}
+	return nil
+}
 
-	ro := rocksdb.NewRestoreOptions()
-	defer ro.Destroy()
+func runRemoteRestore(params *RestoreConfig) error {
+	if params.RestorePath == "" {
+		return errors.New("Restore directory is empty.")
+	}
+	if params.PublicKey == "" {
+		return errors.New("Public key is required to verify the manifest of the backup.")
+	}
+	verifier, err := sign.NewEd25519VerifierFromFile(params.PublicKey)
+	if err != nil {
+		return err
+	}
 
-	if params.BackupID == 0 {
-		err = be.RestoreDBFromLatestBackup(params.RestorePath, params.RestorePath, ro)
+	opts := &archive.Options{
+		S3: &archive.S3Options{
+			Endpoint:        params.S3Endpoint,
+			Region:          params.S3Region,
+			AccessKeyID:     params.S3AccessKey,
+			SecretAccessKey: params.S3SecretKey,
+		},
+		SSH: &archive.SSHOptions{
+			KeyPath:        params.SSHKeyPath,
+			KnownHostsPath: params.SSHKnownHostsPath,
+		},
+	}
+	manifest, err := server.RestoreRemoteBackup(params.Source, opts, params.BackupName, params.RestorePath, verifier)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restore from backup %s completed! Engine %s, version %d\n", manifest.Name, manifest.Engine, manifest.Version)
+	if params.Verify {
+		snapshots, err := signedSnapshots(params, manifest.Snapshot)
 		if err != nil {
 			return err
 		}
-		fmt.Println("Restore from latest backup completed!")
-	} else {
-		err = be.RestoreDBFromBackup(params.BackupID, params.RestorePath, params.RestorePath, ro)
-		if err != nil {
+		return verifyRestore(manifest.Engine, params.RestorePath, snapshots, true)
+	}
+	return nil
+}
+
+func runPointInTimeRestore(params *RestoreConfig) error {
+	if params.BackupDir == "" {
+		return errors.New("Backup directory is empty.")
+	}
+	if params.RestorePath == "" {
+		return errors.New("Restore directory is empty.")
+	}
+	snapshots, err := signedSnapshots(params, nil)
+	if err != nil {
+		return err
+	}
+
+	backup, report, err := server.RestoreToVersion(&server.PointInTimeRestore{
+		Engine:       params.Engine,
+		BackupDir:    params.BackupDir,
+		RestorePath:  params.RestorePath,
+		Version:      params.Version,
+		DBPath:       params.DBPath,
+		RaftPath:     params.RaftPath,
+		HyperHistory: params.HyperHistory,
+		HasherF:      hashing.NewSha256Hasher,
+		Snapshots:    snapshots,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restore to version %d completed! Backup %d at version %d, %d WAL batches and %d Raft log entries replayed, history root %x validated\n",
+		report.Version, backup.ID, report.FromVersion, report.WALBatches, report.RaftEntries, report.HistoryRoot)
+	if params.Verify {
+		// the hyper root of a version in the middle of a bulk is not signed
+		if err := verifyRestore(params.Engine, params.RestorePath, snapshots, !report.Partial); err != nil {
 			return err
 		}
-		fmt.Printf("Restore from backup %d completed!\n", params.BackupID)
+	}
+	fmt.Println("Start the server with an empty Raft directory.")
+	return nil
+}
+
+// signedSnapshots returns the signed snapshots to verify the restored
+// database with, from the snapshot file or the snapshot store, or the
+// given one if none of them is configured.
+func signedSnapshots(params *RestoreConfig, fallback *protocol.SignedSnapshot) (func(version uint64) (*balloon.Snapshot, error), error) {
+	if params.PublicKey == "" {
+		return nil, errors.New("Public key is required to verify the signed snapshot of the restored version.")
+	}
+	verifier, err := sign.NewEd25519VerifierFromFile(params.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case params.SnapshotFile != "":
+		content, err := ioutil.ReadFile(params.SnapshotFile)
+		if err != nil {
+			return nil, err
+		}
+		var signed protocol.SignedSnapshot
+		if err := signed.Decode(content); err != nil {
+			return nil, fmt.Errorf("Unable to decode signed snapshot %s: %v", params.SnapshotFile, err)
+		}
+		return server.VerifiedSnapshots(func(version uint64) (*protocol.SignedSnapshot, error) {
+			return &signed, nil
+		}, verifier), nil
+	case len(params.SnapshotStore.Endpoint) > 0:
+		if err := urlParse(params.SnapshotStore.Endpoint...); err != nil {
+			return nil, fmt.Errorf("Snapshot store endpoint: %v", err)
+		}
+		store := gossip.NewRestSnapshotStoreFromConfig(params.SnapshotStore)
+		return server.VerifiedSnapshotsFromStore(store, verifier), nil
+	case fallback != nil:
+		return server.VerifiedSnapshots(func(version uint64) (*protocol.SignedSnapshot, error) {
+			return fallback, nil
+		}, verifier), nil
+	default:
+		return nil, errors.New("A snapshot store or a snapshot file is required to verify the restored version.")
+	}
+}
+
+func verifyRestore(engine, path string, snapshots func(version uint64) (*balloon.Snapshot, error), hyper bool) error {
+	report, err := server.VerifyRestore(engine, path, snapshots, hyper)
+	if err != nil {
+		return fmt.Errorf("The restored database is not usable: %v", err)
+	}
+	if hyper {
+		fmt.Printf("Verification of version %d succeeded! History root %x and hyper root %x match the signed snapshot\n", report.Version, report.HistoryDigest, report.HyperDigest)
+	} else {
+		fmt.Printf("Verification of version %d succeeded! History root %x matches the signed snapshot\n", report.Version, report.HistoryDigest)
 	}
 	return nil
 }
@@ -0,0 +1,97 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package cmd
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/protocol"
+)
+
+func TestSignedSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore-verify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicKeyPath := filepath.Join(dir, "qed_ed25519.pub")
+	require.NoError(t, ioutil.WriteFile(publicKeyPath, publicKey, 0644))
+
+	snapshot := &protocol.Snapshot{
+		EventDigest:   []byte{0x1},
+		HistoryDigest: []byte{0x2},
+		HyperDigest:   []byte{0x3},
+		Version:       7,
+	}
+	signed := &protocol.SignedSnapshot{Snapshot: snapshot, Signature: ed25519.Sign(privateKey, snapshot.SigningMessage())}
+	content, err := signed.Encode()
+	require.NoError(t, err)
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	require.NoError(t, ioutil.WriteFile(snapshotPath, content, 0644))
+
+	forged := &protocol.SignedSnapshot{Snapshot: snapshot, Signature: make([]byte, ed25519.SignatureSize)}
+
+	testCases := []struct {
+		snapshotFile string
+		fallback     *protocol.SignedSnapshot
+		version      uint64
+		configErr    bool
+		verifyErr    bool
+	}{
+		{snapshotPath, nil, 7, false, false},
+		{snapshotPath, nil, 8, false, true},
+		{snapshotPath, forged, 7, false, false},
+		{"", signed, 7, false, false},
+		{"", forged, 7, false, true},
+		{"", nil, 7, true, false},
+		{filepath.Join(dir, "missing.json"), nil, 7, true, false},
+	}
+
+	for i, c := range testCases {
+		params := defaultRestoreConfig()
+		params.PublicKey = publicKeyPath
+		params.SnapshotFile = c.snapshotFile
+		snapshots, err := signedSnapshots(params, c.fallback)
+		if c.configErr {
+			require.Error(t, err, "Expected configuration error in test case %d", i)
+			continue
+		}
+		require.NoError(t, err, "Unexpected configuration error in test case %d", i)
+
+		s, err := snapshots(c.version)
+		if c.verifyErr {
+			require.Error(t, err, "Expected verification error in test case %d", i)
+			continue
+		}
+		require.NoError(t, err, "Unexpected verification error in test case %d", i)
+		require.Equal(t, snapshot.HistoryDigest, s.HistoryDigest, "Wrong snapshot in test case %d", i)
+	}
+
+	// the public key is mandatory
+	params := defaultRestoreConfig()
+	params.SnapshotStore = &gossip.RestSnapshotStoreConfig{Endpoint: []string{"http://127.0.0.1:8888"}}
+	_, err = signedSnapshots(params, nil)
+	require.Error(t, err)
+}
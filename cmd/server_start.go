@@ -46,6 +46,7 @@ func runServerStart(cmd *cobra.Command, args []string) error {
 		Name:            "qed",
 		IncludeLocation: true,
 		Level:           log.LevelFromString(conf.Log),
+		Format:          conf.LogFormat,
 		Output:          log.DefaultOutput,
 		TimeFormat:      log.DefaultTimeFormat,
 	}
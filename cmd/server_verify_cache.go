@@ -0,0 +1,72 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/server"
+)
+
+var serverVerifyCacheCheckpoint *cobra.Command = &cobra.Command{
+	Use:   "verify-cache-checkpoint",
+	Short: "Verify a hyper cache checkpoint against the database",
+	Long: `Loads the hyper cache checkpoint and compares it with the cache
+built from the database, which is opened in read-only mode. The checkpoint
+must also be tagged with the last version and Raft index applied to the
+database to be used on start.`,
+	RunE: runServerVerifyCacheCheckpoint,
+}
+
+func init() {
+	serverCmd.AddCommand(serverVerifyCacheCheckpoint)
+}
+
+func runServerVerifyCacheCheckpoint(cmd *cobra.Command, args []string) error {
+	conf := serverCtx.Value(k("server.config")).(*server.Config)
+
+	path := conf.HyperCacheCheckpointPath
+	if path == "" {
+		path = conf.RaftPath + "/hypercache.checkpoint"
+	}
+
+	store, err := server.OpenStore(conf.DBEngine, conf.DBPath, 0, true)
+	if err != nil {
+		return fmt.Errorf("Unable to open the database: %v", err)
+	}
+	defer store.Close()
+
+	info, err := consensus.VerifyHyperCacheCheckpoint(store, hashing.NewSha256Hasher, &balloon.CacheOptions{
+		Levels:    conf.HyperCacheLevels,
+		MaxMemory: conf.HyperCacheMaxMemory,
+	}, path)
+	if info != nil {
+		fmt.Printf("Checkpoint %s: version %d, index %d, %d entries, %d cache levels\n",
+			path, info.Version, info.Index, info.Entries, info.Levels)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid hyper cache checkpoint: %v", err)
+	}
+
+	fmt.Println("Checkpoint matches the database")
+	return nil
+}
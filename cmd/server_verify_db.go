@@ -0,0 +1,132 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/server"
+	"github.com/bbva/qed/storage/archive"
+)
+
+type verifyDBParams struct {
+	Start         uint64   `desc:"First version whose history nodes are checked"`
+	End           uint64   `desc:"Last version whose history nodes are checked, the last one of the database by default"`
+	Hyper         bool     `desc:"Check the whole hyper tree"`
+	SnapshotStore []string `desc:"REST snapshot store endpoints whose snapshots are compared with the roots"`
+}
+
+var verifyDB = &verifyDBParams{
+	End:   math.MaxUint64,
+	Hyper: true,
+}
+
+var serverVerifyDB *cobra.Command = &cobra.Command{
+	Use:   "verify-db",
+	Short: "Check the stored trees for corruption",
+	Long: `Opens the database in read-only mode and checks that every history
+node in the range of versions matches its children, that the roots
+computed from the stored nodes match the snapshots of the snapshot store,
+and that every hyper tree node matches its children and every hyper leaf
+the history leaf of its version. The position of every corrupted node is
+reported.`,
+	RunE: runServerVerifyDB,
+}
+
+func init() {
+	if err := gpflag.ParseTo(verifyDB, serverVerifyDB.Flags()); err != nil {
+		panic(fmt.Sprintf("Unable to parse verify-db flags: %v", err))
+	}
+	serverCmd.AddCommand(serverVerifyDB)
+}
+
+func runServerVerifyDB(cmd *cobra.Command, args []string) error {
+	conf := serverCtx.Value(k("server.config")).(*server.Config)
+
+	store, err := server.OpenStore(conf.DBEngine, conf.DBPath, 0, true)
+	if err != nil {
+		return fmt.Errorf("Unable to open the database: %v", err)
+	}
+	defer store.Close()
+
+	b, err := balloon.NewBalloonWithOptions(store, hashing.NewSha256Hasher, &balloon.CacheOptions{
+		Levels:    conf.HyperCacheLevels,
+		MaxMemory: conf.HyperCacheMaxMemory,
+	}, log.L())
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	if conf.HistoryArchivePath != "" {
+		backend, err := archive.NewBackend(conf.HistoryArchivePath, &archive.S3Options{
+			Endpoint:        conf.HistoryArchiveS3Endpoint,
+			Region:          conf.HistoryArchiveS3Region,
+			AccessKeyID:     conf.HistoryArchiveS3AccessKey,
+			SecretAccessKey: conf.HistoryArchiveS3SecretKey,
+		})
+		if err != nil {
+			return err
+		}
+		b.SetHistoryArchive(backend, 0)
+	}
+
+	opts := &balloon.CheckOptions{
+		Start: verifyDB.Start,
+		End:   verifyDB.End,
+		Hyper: verifyDB.Hyper,
+	}
+	if len(verifyDB.SnapshotStore) > 0 {
+		storeConf := gossip.DefaultRestSnapshotStoreConfig()
+		storeConf.Endpoint = verifyDB.SnapshotStore
+		opts.Snapshots = server.SnapshotsFromStore(gossip.NewRestSnapshotStoreFromConfig(storeConf), log.L())
+	}
+
+	if b.Version() == 0 {
+		fmt.Println("The database is empty")
+		return nil
+	}
+	report, err := b.Check(opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("History versions %d to %d checked, root %x\n", report.Start, report.End, report.HistoryDigest)
+	if opts.Hyper {
+		fmt.Printf("Hyper tree checked with %d leaves, root %x\n", report.HyperLeaves, report.HyperDigest)
+	}
+	if opts.Snapshots != nil {
+		fmt.Printf("%d snapshots compared\n", report.Snapshots)
+	}
+	for _, c := range report.Corruptions {
+		fmt.Printf("Corrupted %v\n", c)
+	}
+	if !report.Ok() {
+		return fmt.Errorf("%d corruptions found in the database", len(report.Corruptions))
+	}
+
+	fmt.Println("The database is consistent")
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/octago/sflags/gen/gpflag"
+	"github.com/spf13/cobra"
+
+	"github.com/bbva/qed/protocol"
+)
+
+type VerifyConfig struct {
+	// Public key the bundle must be signed with.
+	PublicKey string `desc:"Path to the trusted ed25519 public key the bundle must be signed with"`
+}
+
+var verifyCmd *cobra.Command = &cobra.Command{
+	Use:   "verify <bundle.json>",
+	Short: "Verify a proof bundle offline",
+	Long: `Verify a proof bundle written by qed client membership --export-bundle,
+without contacting QED or the snapshot store. The signatures of the snapshots
+in the bundle are verified with its public key, which must be the trusted one
+given with the mandatory --public-key, and the membership proof is verified against the
+digests of the snapshots.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVerify,
+}
+
+var verifyCtx context.Context
+
+func init() {
+	verifyCtx = configVerify()
+	Root.AddCommand(verifyCmd)
+}
+
+func configVerify() context.Context {
+
+	conf := &VerifyConfig{}
+
+	err := gpflag.ParseTo(conf, verifyCmd.PersistentFlags())
+	if err != nil {
+		fmt.Printf("Cannot parse command flags: %v\n", err)
+		fmt.Println("Exiting...")
+		os.Exit(1)
+	}
+	return context.WithValue(Ctx, k("verify.config"), conf)
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+
+	params := verifyCtx.Value(k("verify.config")).(*VerifyConfig)
+
+	// SilenceUsage is set to true -> https://github.com/spf13/cobra/issues/340
+	cmd.SilenceUsage = true
+
+	if params.PublicKey == "" {
+		return errors.New("Public key is required to verify the proof bundle.")
+	}
+	trustedKey, err := ioutil.ReadFile(params.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var bundle protocol.ProofBundle
+	if err := bundle.Decode(content); err != nil {
+		return fmt.Errorf("Unable to read the proof bundle: %v", err)
+	}
+
+	fmt.Printf("\nVerifying proof bundle with:\n\n EventDigest: %x\n Key ID: %s\n", bundle.EventDigest, bundle.KeyID)
+	if err := bundle.Verify(trustedKey); err != nil {
+		fmt.Printf("\nVerify: KO\n\n")
+		return err
+	}
+	fmt.Printf("\nVerify: OK\n\n")
+	fmt.Printf("The event exists at version %d, proved at version %d\n", bundle.Proof.ActualVersion, bundle.Proof.QueryVersion)
+	return nil
+}
@@ -0,0 +1,253 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/bbva/qed/balloon/history"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/util"
+)
+
+// auditListPageSize bounds the number of audit entries read at once
+// while listing them.
+const auditListPageSize = 256
+
+// auditRootsQueueSize bounds the number of audit roots waiting to be
+// published.
+const auditRootsQueueSize = 1024
+
+// auditLog is the internal log of the administrative operations. It is
+// an append only history tree of its own, kept apart from the balloon,
+// so audit entries never change the versions of the events added by
+// clients nor reach the gossip agents.
+type auditLog struct {
+	hasherF func() hashing.Hasher
+	store   storage.Store
+	log     log.Logger
+}
+
+func newAuditLog(hasherF func() hashing.Hasher, store storage.Store, logger log.Logger) *auditLog {
+	return &auditLog{hasherF: hasherF, store: store, log: logger}
+}
+
+// tree builds the history tree of the audit log on every use, so it
+// always reads the nodes of the store, even after loading a checkpoint.
+func (l *auditLog) tree() *history.HistoryTree {
+	return history.NewHistoryTreeOnTable(l.hasherF, l.store, storage.AuditHistoryTable, 30, l.log)
+}
+
+// length returns the number of entries of the audit log, which is the
+// version of the next entry.
+func (l *auditLog) length() (uint64, error) {
+	kv, err := l.store.GetLast(storage.AuditTable)
+	if err == storage.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return util.BytesAsUint64(kv.Key) + 1, nil
+}
+
+// add returns the root of the audit log with the event as its next entry
+// along with the mutations that store it.
+func (l *auditLog) add(event []byte) (*protocol.AuditRoot, []*storage.Mutation, error) {
+	version, err := l.length()
+	if err != nil {
+		return nil, nil, err
+	}
+	digest, mutations, err := l.tree().Add(l.hasherF().Do(event), version)
+	if err != nil {
+		return nil, nil, err
+	}
+	mutations = append(mutations, storage.NewMutation(storage.AuditTable, util.Uint64AsBytes(version), event))
+	return &protocol.AuditRoot{Version: version, HistoryDigest: digest}, mutations, nil
+}
+
+// AddAuditEntry records an administrative operation in the audit log of
+// every node, so it can be listed and proved. This must be called from
+// the Leader or it will fail. It also fails while the cluster does not
+// enable extended commands, as older nodes cannot apply them.
+func (n *RaftNode) AddAuditEntry(ctx context.Context, entry *protocol.AuditEntry) (*protocol.AuditRecord, error) {
+	if !n.raftExtendedCommands {
+		return nil, ErrExtendedCommandsDisabled
+	}
+	if !n.IsLeader() {
+		return nil, ErrNotLeader
+	}
+
+	event, err := entry.Event()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := newCommand(addAuditEventCommandType)
+	if err := cmd.encode(&addAuditEvent{RequestID: log.RequestID(ctx), Event: event}); err != nil {
+		return nil, err
+	}
+	resp, err := n.propose(cmd)
+	if err != nil {
+		return nil, err
+	}
+	fsmResp := resp.(*fsmResponse)
+	if fsmResp.err != nil {
+		return nil, fsmResp.err
+	}
+
+	root := fsmResp.val.(*protocol.AuditRoot)
+	n.metrics.AuditEntries.Inc()
+
+	// the root is published to be signed, but a slow publisher must not
+	// block the audit log: any later root covers the entry as well
+	select {
+	case n.auditRootsCh <- root:
+	default:
+		n.log.Warnf("Audit roots channel full, not publishing the root of version %d", root.Version)
+	}
+
+	log.FromContext(ctx, n.log).Infof("Audit entry added at version %d: %s %s", root.Version, entry.Operation, entry.Target)
+	return &protocol.AuditRecord{Version: root.Version, Event: event, Entry: entry}, nil
+}
+
+// AuditRoots returns the channel of the roots of the audit entries added
+// through this node, to be signed and published.
+func (n *RaftNode) AuditRoots() <-chan *protocol.AuditRoot {
+	return n.auditRootsCh
+}
+
+// ListAuditEntries returns up to limit audit entries added at the given
+// version or after it, ordered by version. Entries are read in pages,
+// as their versions have no gaps.
+func (n *RaftNode) ListAuditEntries(from uint64, limit int) ([]*protocol.AuditRecord, error) {
+	records := make([]*protocol.AuditRecord, 0)
+	for limit <= 0 || len(records) < limit {
+		size := uint64(auditListPageSize)
+		if limit > 0 && uint64(limit-len(records)) < size {
+			size = uint64(limit - len(records))
+		}
+		to := from + size - 1
+		if to < from {
+			to = math.MaxUint64
+		}
+		kvs, err := n.db.GetRange(storage.AuditTable, util.Uint64AsBytes(from), util.Uint64AsBytes(to))
+		if err != nil && err != storage.ErrKeyNotFound {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			entry, err := protocol.ParseAuditEvent(kv.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read the audit entry at version %d: %v", util.BytesAsUint64(kv.Key), err)
+			}
+			records = append(records, &protocol.AuditRecord{
+				Version: util.BytesAsUint64(kv.Key),
+				Event:   kv.Value,
+				Entry:   entry,
+			})
+		}
+		if uint64(len(kvs)) < size || to == math.MaxUint64 {
+			break
+		}
+		from = to + 1
+	}
+	return records, nil
+}
+
+// ProveAuditEntry returns the proof that the audit entry of the given
+// version is part of the audit log at its last version.
+func (n *RaftNode) ProveAuditEntry(version uint64) (*protocol.AuditProof, error) {
+	kv, err := n.db.Get(storage.AuditTable, util.Uint64AsBytes(version))
+	if err != nil {
+		return nil, err
+	}
+	length, err := n.audit.length()
+	if err != nil {
+		return nil, err
+	}
+	tree := n.audit.tree()
+	root, err := tree.RootHash(length - 1)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := tree.ProveMembership(version, length-1)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.ToAuditProof(kv.Value, root, proof), nil
+}
+
+// ProveAuditConsistency returns the proof that the audit log at the end
+// version is an extension of the one at the start version.
+func (n *RaftNode) ProveAuditConsistency(start, end uint64) (*protocol.AuditIncrementalProof, error) {
+	if start > end {
+		return nil, fmt.Errorf("Start version %d after end version %d", start, end)
+	}
+	length, err := n.audit.length()
+	if err != nil {
+		return nil, err
+	}
+	if end >= length {
+		return nil, storage.ErrKeyNotFound
+	}
+	proof, err := n.audit.tree().ProveConsistency(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.ToAuditIncrementalProof(proof), nil
+}
+
+// applyAuditEntry adds the event of an audit command to the audit log.
+// The balloon is left untouched, so the version metadata of the batch
+// marks it as an audit one at the current version of the balloon.
+func (n *RaftNode) applyAuditEntry(ctx context.Context, event []byte, index uint64) *fsmResponse {
+	logger := log.FromContext(ctx, n.log).With("raft_index", index)
+
+	root, mutations, err := n.audit.add(event)
+	if err != nil {
+		logger.Panicf("Unable to add audit entry: %v", err)
+	}
+
+	state := &fsmState{Index: index, BalloonVersion: n.state.BalloonVersion, Snapshot: n.state.Snapshot}
+	stateBuff, err := state.encode()
+	if err != nil {
+		logger.Panicf("Unable to encode state: %v", err)
+	}
+	mutations = append(mutations, storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff))
+
+	meta := &VersionMetadata{
+		PreviousVersion: n.state.BalloonVersion,
+		NewVersion:      n.state.BalloonVersion,
+		Audit:           true,
+	}
+	metaBytes, err := meta.encode()
+	if err != nil {
+		logger.Panicf("Unable to encode version metadata: %v", err)
+	}
+	if err := n.db.Mutate(mutations, metaBytes); err != nil {
+		logger.With("db_engine", n.dbEngine).Panicf("Unable to mutate database: %v", err)
+	}
+	n.state = state
+
+	logger.Debugf("Node [%s] - Applied audit entry at version %d", n.info.NodeId, root.Version)
+	return &fsmResponse{nil, root}
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+)
+
+func TestBoltAuditEntries(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.RaftExtendedCommands = true
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	// older nodes cannot apply the audit commands
+	backup := &protocol.AuditEntry{Node: t.Name(), Actor: "anonymous", Operation: "POST /backup", Status: 200}
+	node.raftExtendedCommands = false
+	_, err = node.AddAuditEntry(context.Background(), backup)
+	require.Equal(t, ErrExtendedCommandsDisabled, err)
+	node.raftExtendedCommands = true
+
+	record, err := node.AddAuditEntry(context.Background(), backup)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), record.Version)
+
+	// the entries do not change the versions of the balloon
+	snapshot, err := node.Add([]byte("event 0"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), snapshot.Version)
+	<-snapshotsCh
+
+	removal := &protocol.AuditEntry{Node: t.Name(), Actor: "anonymous", Operation: "DELETE /cluster/members", Target: "id=server1", Status: 204}
+	_, err = node.AddAuditEntry(log.ContextWithRequestID(context.Background(), "request-2"), removal)
+	require.NoError(t, err)
+	require.Len(t, snapshotsCh, 0, "Audit entries must not be published")
+
+	records, err := node.ListAuditEntries(0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(0), records[0].Version)
+	require.Equal(t, backup, records[0].Entry)
+	require.Equal(t, uint64(1), records[1].Version)
+	require.Equal(t, removal, records[1].Entry)
+
+	records, err = node.ListAuditEntries(1, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(1), records[0].Version)
+
+	records, err = node.ListAuditEntries(0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(0), records[0].Version)
+
+	// the entries are provable in the audit log, not in the balloon
+	proof, err := node.ProveAuditEntry(0)
+	require.NoError(t, err)
+	require.Equal(t, records[0].Event, proof.Event)
+	require.Equal(t, uint64(1), proof.CurrentVersion)
+	require.True(t, proof.Verify(proof.HistoryDigest, hashing.NewSha256Hasher))
+	require.False(t, proof.Verify(snapshot.HistoryDigest, hashing.NewSha256Hasher))
+
+	_, err = node.ProveAuditEntry(2)
+	require.Equal(t, storage.ErrKeyNotFound, err)
+
+	// the roots of the entries are published to be signed
+	first := <-node.AuditRoots()
+	last := <-node.AuditRoots()
+	require.Equal(t, uint64(0), first.Version)
+	require.Equal(t, uint64(1), last.Version)
+	require.Equal(t, proof.HistoryDigest, last.HistoryDigest)
+
+	consistency, err := node.ProveAuditConsistency(0, 1)
+	require.NoError(t, err)
+	require.True(t, consistency.Verify(first.HistoryDigest, last.HistoryDigest, hashing.NewSha256Hasher))
+	_, err = node.ProveAuditConsistency(1, 2)
+	require.Equal(t, storage.ErrKeyNotFound, err)
+
+	membership, err := node.QueryMembership(records[0].Event)
+	require.NoError(t, err)
+	require.False(t, membership.Exists)
+}
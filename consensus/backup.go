@@ -50,3 +50,9 @@ func (n *RaftNode) ListBackups() []*storage.BackupInfo {
 	n.log.Debugf("Retrieving backups information")
 	return n.db.GetBackupsInfo()
 }
+
+// VerifyBackup function is a passthough to store's equivalent funcion.
+func (n *RaftNode) VerifyBackup(backupID uint32) error {
+	n.log.Debugf("Verifying backup %d", backupID)
+	return n.db.VerifyBackup(backupID)
+}
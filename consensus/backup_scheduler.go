@@ -0,0 +1,245 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+)
+
+// BackupRetention tells which of the backups of a node are kept after
+// a scheduled backup: the last KeepLast ones, and the newest one of each
+// of the last KeepDaily days and KeepWeekly weeks with backups. Days and
+// weeks are in UTC. The rest are deleted, unless every field is 0, in
+// which case every backup is kept.
+type BackupRetention struct {
+	KeepLast   int
+	KeepDaily  int
+	KeepWeekly int
+}
+
+// expired returns the backups, sorted by ID, not kept by the retention.
+func (r *BackupRetention) expired(backups []*storage.BackupInfo) []*storage.BackupInfo {
+	if r == nil || (r.KeepLast <= 0 && r.KeepDaily <= 0 && r.KeepWeekly <= 0) {
+		return nil
+	}
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	expired := make([]*storage.BackupInfo, 0)
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		t := time.Unix(b.Timestamp, 0).UTC()
+		day := t.Format("2006-01-02")
+		year, week := t.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+
+		keep := len(backups)-1-i < r.KeepLast
+		if !days[day] && len(days) < r.KeepDaily {
+			days[day] = true
+			keep = true
+		}
+		if !weeks[weekKey] && len(weeks) < r.KeepWeekly {
+			weeks[weekKey] = true
+			keep = true
+		}
+		if !keep {
+			expired = append(expired, b)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].ID < expired[j].ID
+	})
+	return expired
+}
+
+// scheduleBackups periodically creates a backup of the database, if this
+// node is the one in charge of them, until the node is closed.
+func (n *RaftNode) scheduleBackups() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.backupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			_ = n.runScheduledBackup()
+		}
+	}
+}
+
+// isBackupNode tells whether this node has to create the scheduled
+// backups. They are created by a single reachable follower, preferring
+// nonvoters and then the lowest node ID, to avoid loading the leader.
+// The leader only creates them when no follower is reachable, e.g. in
+// a single node cluster.
+func (n *RaftNode) isBackupNode() (bool, error) {
+	members, err := n.ListMembers()
+	if err != nil {
+		return false, err
+	}
+
+	var chosen *protocol.MemberInfo
+	for _, m := range members {
+		if m.Leader || !m.Reachable {
+			continue
+		}
+		if chosen == nil ||
+			(m.Suffrage != chosen.Suffrage && m.Suffrage == raft.Nonvoter.String()) ||
+			(m.Suffrage == chosen.Suffrage && m.NodeId < chosen.NodeId) {
+			chosen = m
+		}
+	}
+	if chosen == nil {
+		return n.IsLeader(), nil
+	}
+	return chosen.NodeId == n.info.NodeId, nil
+}
+
+// runScheduledBackup creates a backup if this node is in charge of
+// them, verifies and uploads it, and deletes the backups that expired
+// according to the retention. Expired backups are not deleted if the new
+// backup can not be verified or uploaded.
+func (n *RaftNode) runScheduledBackup() error {
+	n.backupMu.Lock()
+	defer n.backupMu.Unlock()
+
+	run := time.Now().Unix()
+	n.updateBackupStatus(func(s *protocol.BackupStatus) {
+		s.LastRun = run
+	})
+	err := n.scheduledBackup()
+	if err != nil {
+		n.metrics.BackupErrors.Inc()
+		n.updateBackupStatus(func(s *protocol.BackupStatus) {
+			s.LastError = err.Error()
+		})
+		n.log.Errorf("Scheduled backup failed: %v", err)
+		return err
+	}
+	n.updateBackupStatus(func(s *protocol.BackupStatus) {
+		if s.Scheduled {
+			s.LastSuccess = run
+			s.LastError = ""
+			n.metrics.LastBackup.Set(float64(run))
+		}
+	})
+	return nil
+}
+
+// updateBackupStatus changes the state of the scheduled backups, which
+// is read while a backup is running.
+func (n *RaftNode) updateBackupStatus(update func(*protocol.BackupStatus)) {
+	n.backupStatusMu.Lock()
+	defer n.backupStatusMu.Unlock()
+	update(&n.backupStatus)
+}
+
+func (n *RaftNode) scheduledBackup() error {
+	scheduled, err := n.isBackupNode()
+	if err != nil {
+		return fmt.Errorf("Unable to find the node in charge of the backups: %v", err)
+	}
+	n.updateBackupStatus(func(s *protocol.BackupStatus) {
+		s.Scheduled = scheduled
+	})
+	if !scheduled {
+		n.log.Debugf("Skipping scheduled backup: another node is in charge of them")
+		return nil
+	}
+
+	begin := time.Now()
+	n.updateBackupStatus(func(s *protocol.BackupStatus) {
+		s.LastVerified = false
+		s.LastUpload = ""
+		s.LastDeleted = 0
+	})
+	if err := n.CreateBackup(); err != nil {
+		return fmt.Errorf("Unable to create backup: %v", err)
+	}
+	backups := n.ListBackups()
+	if len(backups) == 0 {
+		return fmt.Errorf("Backup created but not found")
+	}
+	last := backups[len(backups)-1]
+	n.updateBackupStatus(func(s *protocol.BackupStatus) {
+		s.LastBackupID = last.ID
+		s.Backups = len(backups)
+	})
+	n.metrics.BackupsCreated.Inc()
+
+	if n.backupVerify {
+		if err := n.VerifyBackup(uint32(last.ID)); err != nil {
+			return fmt.Errorf("Unable to verify backup %d: %v", last.ID, err)
+		}
+		n.updateBackupStatus(func(s *protocol.BackupStatus) {
+			s.LastVerified = true
+		})
+	}
+
+	if n.backupUpload != nil {
+		name, err := n.backupUpload(uint32(last.ID))
+		if err != nil {
+			return fmt.Errorf("Unable to upload backup %d: %v", last.ID, err)
+		}
+		n.updateBackupStatus(func(s *protocol.BackupStatus) {
+			s.LastUpload = name
+		})
+	}
+
+	deleted := 0
+	for _, b := range n.backupRetention.expired(backups) {
+		if b.ID == last.ID {
+			continue
+		}
+		if err := n.DeleteBackup(uint32(b.ID)); err != nil {
+			return fmt.Errorf("Unable to delete expired backup %d: %v", b.ID, err)
+		}
+		deleted++
+		n.updateBackupStatus(func(s *protocol.BackupStatus) {
+			s.LastDeleted++
+			s.Backups--
+		})
+		n.metrics.BackupsDeleted.Inc()
+	}
+
+	n.log.Infof("Scheduled backup %d created in %v, %d expired backups deleted", last.ID, time.Since(begin), deleted)
+	return nil
+}
+
+// BackupStatus returns the state of the scheduled backups of this node.
+func (n *RaftNode) BackupStatus() *protocol.BackupStatus {
+	n.backupStatusMu.Lock()
+	defer n.backupStatusMu.Unlock()
+
+	status := n.backupStatus
+	status.Enabled = n.backupInterval > 0
+	if status.Enabled {
+		status.Interval = n.backupInterval.String()
+	}
+	return &status
+}
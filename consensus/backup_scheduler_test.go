@@ -0,0 +1,146 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+)
+
+func TestBackupRetention(t *testing.T) {
+	at := func(day, hour int) int64 {
+		return time.Date(2020, time.April, day, hour, 0, 0, 0, time.UTC).Unix()
+	}
+	backups := []*storage.BackupInfo{
+		{ID: 1, Timestamp: at(6, 12)},
+		{ID: 2, Timestamp: at(13, 10)},
+		{ID: 3, Timestamp: at(13, 11)},
+		{ID: 4, Timestamp: at(18, 12)},
+		{ID: 5, Timestamp: at(19, 12)},
+		{ID: 6, Timestamp: at(20, 8)},
+		{ID: 7, Timestamp: at(20, 9)},
+		{ID: 8, Timestamp: at(20, 10)},
+	}
+
+	testCases := []struct {
+		retention *BackupRetention
+		expired   []int64
+	}{
+		{nil, nil},
+		{&BackupRetention{}, nil},
+		{&BackupRetention{KeepLast: 3}, []int64{1, 2, 3, 4, 5}},
+		{&BackupRetention{KeepLast: 10}, nil},
+		{&BackupRetention{KeepDaily: 3}, []int64{1, 2, 3, 6, 7}},
+		{&BackupRetention{KeepWeekly: 2}, []int64{1, 2, 3, 4, 6, 7}},
+		{&BackupRetention{KeepLast: 2, KeepDaily: 2, KeepWeekly: 2}, []int64{1, 2, 3, 4, 6}},
+		{&BackupRetention{KeepLast: 2, KeepDaily: 2, KeepWeekly: 3}, []int64{2, 3, 4, 6}},
+	}
+
+	for i, c := range testCases {
+		var expired []int64
+		for _, b := range c.retention.expired(backups) {
+			expired = append(expired, b.ID)
+		}
+		require.Equal(t, c.expired, expired, "Wrong expired backups in test case %d", i)
+	}
+}
+
+func TestBoltScheduledBackups(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.BackupInterval = time.Hour
+	opts.BackupRetention = &BackupRetention{KeepLast: 2}
+	opts.BackupVerify = true
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	snapshotsDrainer(snapshotsCh)
+	defer close(snapshotsCh)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	status := node.BackupStatus()
+	require.True(t, status.Enabled)
+	require.Equal(t, "1h0m0s", status.Interval)
+	require.Zero(t, status.LastRun)
+
+	for i := 0; i < 3; i++ {
+		_, err := node.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		// the only node of the cluster is in charge of the backups
+		require.NoError(t, node.runScheduledBackup())
+	}
+
+	backups := node.ListBackups()
+	require.Len(t, backups, 2)
+	require.Equal(t, int64(2), backups[0].ID)
+	require.Equal(t, int64(3), backups[1].ID)
+	require.Equal(t, "2", backups[1].Metadata)
+
+	status = node.BackupStatus()
+	require.True(t, status.Scheduled)
+	require.Equal(t, int64(3), status.LastBackupID)
+	require.True(t, status.LastVerified)
+	require.Equal(t, 1, status.LastDeleted)
+	require.Equal(t, 2, status.Backups)
+	require.Equal(t, status.LastRun, status.LastSuccess)
+	require.Empty(t, status.LastError)
+
+	// the status is available while a backup is running
+	uploading := make(chan struct{})
+	release := make(chan struct{})
+	node.backupUpload = func(id uint32) (string, error) {
+		close(uploading)
+		<-release
+		return fmt.Sprintf("backup-%d", id), nil
+	}
+	done := make(chan error)
+	go func() {
+		done <- node.runScheduledBackup()
+	}()
+	<-uploading
+	status = node.BackupStatus()
+	require.Equal(t, int64(4), status.LastBackupID)
+	require.True(t, status.LastVerified)
+	require.Empty(t, status.LastUpload)
+	close(release)
+	require.NoError(t, <-done)
+	require.Equal(t, "backup-4", node.BackupStatus().LastUpload)
+}
@@ -0,0 +1,75 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/balloon/hyper"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/storage"
+)
+
+// saveCacheCheckpoint writes a checkpoint of the hyper cache tagged with
+// the index of the last applied command. It must be called from the FSM
+// goroutine, or once it has stopped, so the cache and the FSM state are
+// consistent. Unless forced, checkpoints are written at most once per
+// configured interval.
+func (n *RaftNode) saveCacheCheckpoint(force bool) {
+	if n.cacheCheckpointInterval <= 0 {
+		return
+	}
+	if !force && time.Since(n.lastCacheCheckpoint) < n.cacheCheckpointInterval {
+		return
+	}
+
+	start := time.Now()
+	err := n.balloon.SaveCacheCheckpoint(n.cacheCheckpointPath, n.state.Index)
+	if err != nil {
+		n.log.Infof("Unable to write hyper cache checkpoint: %v", err)
+		return
+	}
+	n.lastCacheCheckpoint = time.Now()
+	n.log.Debugf("Hyper cache checkpoint written at index %d in %v", n.state.Index, time.Since(start))
+}
+
+// VerifyHyperCacheCheckpoint checks that a hyper cache checkpoint matches
+// the contents of the store, built with the given hasher, and the last
+// state applied to it.
+func VerifyHyperCacheCheckpoint(store storage.Store, hasherF func() hashing.Hasher, opts *balloon.CacheOptions, path string) (*hyper.CacheCheckpointInfo, error) {
+	var state fsmState
+	kv, err := store.Get(storage.FSMStateTable, storage.FSMStateTableKey)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return nil, err
+	}
+	if err == nil {
+		if err := state.decode(kv.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := balloon.VerifyCacheCheckpoint(store, hasherF, opts, path)
+	if err != nil {
+		return info, err
+	}
+	if info.Index != state.Index {
+		return info, fmt.Errorf("Checkpoint at index %d but FSM state is at index %d", info.Index, state.Index)
+	}
+	return info, nil
+}
@@ -0,0 +1,316 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// checkpointChunkSize is the maximum size of the chunks
+	// used to stream checkpoint files.
+	checkpointChunkSize = 1 << 20 // 1MB
+	// checkpointMaxAttempts is the number of times a checkpoint file
+	// transfer is resumed before giving up.
+	checkpointMaxAttempts = 5
+	// checkpointTTL is the time a checkpoint is kept in the leader
+	// if no follower releases it.
+	checkpointTTL = time.Hour
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CreateCheckpoint builds a checkpoint of the database and returns a manifest
+// with the files that a follower has to fetch to rebuild the whole state.
+func (n *RaftNode) CreateCheckpoint(ctx context.Context, req *CreateCheckpointRequest) (*CheckpointManifest, error) {
+	n.removeStaleCheckpoints()
+
+	err := os.MkdirAll(n.checkpointsPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	dir := filepath.Join(n.checkpointsPath, id)
+	seqNum, err := n.db.Checkpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := checkpointFiles(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	n.log.Infof("Checkpoint %s created until seqNum %d with %d files", id, seqNum, len(files))
+	return &CheckpointManifest{
+		CheckpointId: id,
+		LastSeqNum:   seqNum,
+		Files:        files,
+	}, nil
+}
+
+// FetchCheckpointFile streams a checkpoint file from the requested offset
+// in chunks that carry their own offset and checksum.
+func (n *RaftNode) FetchCheckpointFile(req *FetchCheckpointFileRequest, srv ClusterService_FetchCheckpointFileServer) error {
+	path, err := n.checkpointPath(req.CheckpointId, req.Name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "Checkpoint file %s not found", req.Name)
+	}
+	defer f.Close()
+
+	offset := req.Offset
+	if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+
+	buf := make([]byte, checkpointChunkSize)
+	for {
+		size, err := io.ReadFull(f, buf)
+		if size > 0 {
+			chunk := &CheckpointChunk{
+				Offset:   offset,
+				Content:  buf[:size],
+				Checksum: crc32.Checksum(buf[:size], crcTable),
+			}
+			if err := srv.Send(chunk); err != nil {
+				return err
+			}
+			offset += uint64(size)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReleaseCheckpoint removes a checkpoint once a follower has fetched it.
+func (n *RaftNode) ReleaseCheckpoint(ctx context.Context, req *ReleaseCheckpointRequest) (*ReleaseCheckpointResponse, error) {
+	path, err := n.checkpointPath(req.CheckpointId, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseCheckpointResponse{}, os.RemoveAll(path)
+}
+
+func (n *RaftNode) checkpointPath(id, name string) (string, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid checkpoint id %q", id)
+	}
+	if name != "" && filepath.Base(name) != name {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid checkpoint file name %q", name)
+	}
+	return filepath.Join(n.checkpointsPath, id, name), nil
+}
+
+// removeStaleCheckpoints removes those checkpoints that have not been
+// released by the followers after the checkpoint TTL.
+func (n *RaftNode) removeStaleCheckpoints() {
+	entries, err := ioutil.ReadDir(n.checkpointsPath)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		created, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		if time.Since(time.Unix(0, created)) > checkpointTTL {
+			n.log.Infof("Removing stale checkpoint %s", e.Name())
+			os.RemoveAll(filepath.Join(n.checkpointsPath, e.Name()))
+		}
+	}
+}
+
+// attemptToFetchCheckpoint asks the leader for a new checkpoint and fetches
+// all its files into a local directory, resuming the transfer of any file
+// that is interrupted. It returns the directory with the checkpoint and
+// the sequence number of the last transaction it includes.
+func (n *RaftNode) attemptToFetchCheckpoint() (string, uint64, error) {
+	conn, err := n.dialLeader()
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	client := NewClusterServiceClient(conn)
+
+	manifest, err := client.CreateCheckpoint(context.Background(), &CreateCheckpointRequest{})
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_, err := client.ReleaseCheckpoint(context.Background(), &ReleaseCheckpointRequest{CheckpointId: manifest.CheckpointId})
+		if err != nil {
+			n.log.Infof("Unable to release checkpoint %s: %v", manifest.CheckpointId, err)
+		}
+	}()
+
+	dir := filepath.Join(n.checkpointsPath, "restore-"+manifest.CheckpointId)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n.log.Infof("Fetching checkpoint %s until seqNum %d with %d files", manifest.CheckpointId, manifest.LastSeqNum, len(manifest.Files))
+	for _, file := range manifest.Files {
+		err := n.fetchCheckpointFile(client, manifest.CheckpointId, file, filepath.Join(dir, file.Name))
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", 0, err
+		}
+	}
+
+	return dir, manifest.LastSeqNum, nil
+}
+
+// fetchCheckpointFile fetches a checkpoint file to the given path. If the
+// transfer fails, it is resumed from the last chunk written to disk.
+func (n *RaftNode) fetchCheckpointFile(client ClusterServiceClient, id string, file *CheckpointFile, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset uint64
+	for attempt := 1; ; attempt++ {
+		if info, err := f.Stat(); err == nil {
+			offset = uint64(info.Size())
+		}
+		if offset < file.Size {
+			err = n.resumeCheckpointFile(client, id, file.Name, f, offset)
+		} else {
+			err = f.Sync()
+		}
+		if err == nil {
+			err = verifyCheckpointFile(path, file)
+			if err == nil {
+				return nil
+			}
+			// the file is corrupted, so we start from scratch
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+		}
+		if attempt >= checkpointMaxAttempts {
+			return fmt.Errorf("Unable to fetch checkpoint file %s after %d attempts: %v", file.Name, attempt, err)
+		}
+		n.log.Infof("Resuming transfer of checkpoint file %s after error: %v", file.Name, err)
+	}
+}
+
+func (n *RaftNode) resumeCheckpointFile(client ClusterServiceClient, id, name string, f *os.File, offset uint64) error {
+	stream, err := client.FetchCheckpointFile(context.Background(), &FetchCheckpointFileRequest{
+		CheckpointId: id,
+		Name:         name,
+		Offset:       offset,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return f.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.Offset != offset {
+			return fmt.Errorf("Unexpected chunk offset %d, expected %d", chunk.Offset, offset)
+		}
+		if crc32.Checksum(chunk.Content, crcTable) != chunk.Checksum {
+			return fmt.Errorf("Corrupted chunk at offset %d", chunk.Offset)
+		}
+		if _, err := f.WriteAt(chunk.Content, int64(offset)); err != nil {
+			return err
+		}
+		offset += uint64(len(chunk.Content))
+	}
+}
+
+// checkpointFiles returns the description of every file in a checkpoint
+// directory, including its SHA-256 checksum.
+func checkpointFiles(dir string) ([]*CheckpointFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*CheckpointFile, 0, len(entries))
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		checksum, err := fileChecksum(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &CheckpointFile{
+			Name:     e.Name(),
+			Size:     uint64(e.Size()),
+			Checksum: checksum,
+		})
+	}
+	return files, nil
+}
+
+func verifyCheckpointFile(path string, file *CheckpointFile) error {
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, file.Checksum) {
+		return fmt.Errorf("Checksum mismatch for checkpoint file %s", file.Name)
+	}
+	return nil
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
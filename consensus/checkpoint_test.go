@@ -0,0 +1,82 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbva/qed/log"
+	utilrand "github.com/bbva/qed/testutils/rand"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestFetchCheckpointFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the leader serves a checkpoint file bigger than a chunk
+	node := &RaftNode{checkpointsPath: filepath.Join(dir, "leader"), log: log.L()}
+	content := utilrand.Bytes(2*checkpointChunkSize + 100)
+	require.NoError(t, os.MkdirAll(filepath.Join(node.checkpointsPath, "1"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(node.checkpointsPath, "1", "000001.sst"), content, 0644))
+
+	files, err := checkpointFiles(filepath.Join(node.checkpointsPath, "1"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	srv.RegisterService(&_ClusterService_serviceDesc, node)
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := NewClusterServiceClient(conn)
+
+	// resume an interrupted transfer
+	path := filepath.Join(dir, "resumed.sst")
+	require.NoError(t, ioutil.WriteFile(path, content[:checkpointChunkSize+10], 0644))
+	require.NoError(t, node.fetchCheckpointFile(client, "1", files[0], path))
+	fetched, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, fetched, "The resumed file should match")
+
+	// fetch again a corrupted file
+	path = filepath.Join(dir, "corrupted.sst")
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, len(content)), 0644))
+	require.NoError(t, node.fetchCheckpointFile(client, "1", files[0], path))
+	fetched, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, fetched, "The corrupted file should be fetched again")
+
+	// files out of the checkpoint cannot be fetched
+	_, err = node.checkpointPath("1", "../../leader.key")
+	require.Error(t, err)
+	_, err = node.checkpointPath("../1", "")
+	require.Error(t, err)
+	missing := &CheckpointFile{Name: "missing.sst", Size: 10}
+	require.Error(t, node.fetchCheckpointFile(client, "1", missing, filepath.Join(dir, "missing.sst")))
+}
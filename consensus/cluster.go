@@ -30,12 +30,14 @@ import (
 	"google.golang.org/grpc/credentials"
 
 	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/balloon/hyper"
 	"github.com/bbva/qed/crypto/hashing"
 	"github.com/bbva/qed/crypto/tlsutil"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/metrics"
 	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
 )
 
 const (
@@ -53,6 +55,10 @@ var (
 
 	// ErrCannotSync is raised when a node cannot synchronize its cluster info.
 	ErrCannotSync = errors.New("Unable to sync cluster info")
+
+	// ErrExtendedCommandsDisabled is raised when an operation needs a Raft
+	// command that the cluster does not enable yet.
+	ErrExtendedCommandsDisabled = errors.New("Raft extended commands are not enabled in the cluster")
 )
 
 // ClusteringOptions contains node options related to clustering.
@@ -64,19 +70,74 @@ type ClusteringOptions struct {
 	Bootstrap         bool     // Bootstrap the cluster as a seed node if there is no existing state.
 	Seeds             []string // List of cluster peer node IDs to bootstrap the cluster state.
 	RaftLogPath       string   // Path to Raft log store directory.
+	CheckpointPath    string   // Path to the directory used to build and receive database checkpoints.
 	LogCacheSize      int      // Number of Raft log entries to cache in memory to reduce disk IO.
 	LogSnapshots      int      // Number of Raft log snapshots to retain.
 	SnapshotThreshold uint64   // Controls how many outstanding logs there must be before we perform a snapshot.
 	TrailingLogs      uint64   // Number of logs left after a snapshot.
 	Sync              bool     // Do a file sync after every write to the Raft log and stable store.
+	RaftLogEngine     string   // Storage engine of the Raft log and stable store, rocksdb by default.
 	RaftLogging       bool     // Enable logging of Raft library (disabled by default since really verbose).
 
+	// Propose the commands introduced after the plain add command: the add
+	// commands carrying the trace context and the request id, and the
+	// audit log commands. Nodes that predate them stop applying the log,
+	// so it must only be enabled once every node of the cluster is
+	// upgraded. Disabled by default.
+	RaftExtendedCommands bool
+
 	// These will be set to some sane defaults. Change only if experiencing raft issues.
 	RaftHeartbeatTimeout time.Duration
 	RaftElectionTimeout  time.Duration
 	RaftLeaseTimeout     time.Duration
 	RaftCommitTimeout    time.Duration
 	RaftApplyTimeout     time.Duration // Amount of time we wait for the command to be started.
+
+	// Options of the hyper tree cache. The cache levels must be the same in
+	// every node since they determine the hyper digests.
+	HyperCache *balloon.CacheOptions
+
+	// Checkpoints of the hyper cache are written along with the Raft
+	// snapshots, at most once per interval, and on shutdown, so the
+	// cache does not have to be warmed up on start. An interval of 0
+	// disables them.
+	HyperCacheCheckpointPath     string
+	HyperCacheCheckpointInterval time.Duration
+
+	// Keep every version of the hyper tree to prove membership against
+	// the hyper digest of past snapshots. It should be enabled in every
+	// node of the cluster.
+	HyperHistory bool
+
+	// Frozen nodes of the history tree are moved to the archive once per
+	// interval, except for the ones of the last versions kept. Nodes
+	// received in checkpoints from other nodes are only readable if the
+	// archive is shared by the whole cluster. A nil archive disables it.
+	HistoryArchive             archive.Backend
+	HistoryArchiveKeepVersions uint64
+	HistoryArchiveInterval     time.Duration
+
+	// Height of the archived history subtrees, 16 by default. It must
+	// not change once the history is archived.
+	HistoryArchiveSegmentHeight uint16
+
+	// The stored trees are checked for corruption once per interval, and
+	// their roots compared with the snapshots returned by the given
+	// function, if any. Every run checks the history nodes added since
+	// the previous one and walks the whole hyper tree. An interval of 0
+	// disables it.
+	ConsistencyCheckInterval  time.Duration
+	ConsistencyCheckSnapshots func(version uint64) (*balloon.Snapshot, error)
+
+	// A backup of the database is created once per interval by a single
+	// node, a reachable follower if any, verified if BackupVerify is set,
+	// and uploaded with BackupUpload, if any, which returns the name of
+	// the uploaded backup. The backups not kept by the retention are
+	// deleted afterwards. An interval of 0 disables them.
+	BackupInterval  time.Duration
+	BackupRetention *BackupRetention
+	BackupVerify    bool
+	BackupUpload    func(backupID uint32) (string, error)
 }
 
 func DefaultClusteringOptions() *ClusteringOptions {
@@ -86,6 +147,7 @@ func DefaultClusteringOptions() *ClusteringOptions {
 		Bootstrap:         false,
 		Seeds:             make([]string, 0),
 		RaftLogPath:       "",
+		RaftLogEngine:     storage.RocksDBEngine,
 		LogCacheSize:      512,
 		LogSnapshots:      2,
 		SnapshotThreshold: 8192,
@@ -93,17 +155,57 @@ func DefaultClusteringOptions() *ClusteringOptions {
 		RaftApplyTimeout:  10 * time.Second,
 		Sync:              false,
 		RaftLogging:       false,
+		HyperCache:        balloon.DefaultCacheOptions(),
+
+		HistoryArchiveKeepVersions: 1 << 20,
+		HistoryArchiveInterval:     time.Hour,
 	}
 }
 
+// TracedSnapshot is a snapshot published by the node along with the trace
+// context of the request that added its event, so the gossip message
+// carrying it continues the trace. TraceParent is empty if the request
+// was not traced.
+type TracedSnapshot struct {
+	Snapshot    *protocol.Snapshot
+	TraceParent string
+}
+
 type RaftNode struct {
 	info *NodeInfo
 
 	applyTimeout time.Duration
 
 	db        storage.ManagedStore    // Persistent database
-	raftLog   *raftLog                // Underlying rocksdb-backed persistent log store
+	raftLog   logStore                // Underlying persistent log store
 	snapshots *raft.FileSnapshotStore // Persistent snapstop store
+	dbEngine  string                  // Storage engine the server runs on, used to annotate traces
+
+	checkpointsPath string // Directory used to build and receive database checkpoints
+
+	cacheCheckpointPath     string        // File where the hyper cache checkpoints are written
+	cacheCheckpointInterval time.Duration // Minimum time between two hyper cache checkpoints
+	lastCacheCheckpoint     time.Time
+
+	hyperHistory bool // Keep every version of the hyper tree
+
+	raftExtendedCommands bool // Propose the commands older nodes cannot apply
+
+	archiveKeepVersions uint64        // Number of versions whose history nodes are not archived
+	archiveInterval     time.Duration // Time between two runs of the history archiving
+
+	checkInterval  time.Duration                                   // Time between two consistency checks
+	checkSnapshots func(version uint64) (*balloon.Snapshot, error) // Snapshots to compare the roots with
+	lastChecked    uint64                                          // Number of versions whose history was checked
+	checkMu        sync.Mutex
+
+	backupInterval  time.Duration                // Time between two scheduled backups
+	backupRetention *BackupRetention             // Backups kept after a scheduled backup
+	backupVerify    bool                         // Verify the scheduled backups once created
+	backupUpload    func(uint32) (string, error) // Upload the scheduled backups once verified
+	backupMu        sync.Mutex                   // Serializes the scheduled backups
+	backupStatus    protocol.BackupStatus        // State of the last scheduled backup
+	backupStatusMu  sync.Mutex
 
 	raft            *raft.Raft             // The consensus mechanism
 	transport       *raft.NetworkTransport // Raft network transport
@@ -111,8 +213,11 @@ type RaftNode struct {
 	tlsConfigurator *tlsutil.TLSConfigurator
 
 	balloon     *balloon.Balloon // Balloon's finite state machine
+	audit       *auditLog        // Log of the administrative operations
 	state       *fsmState
-	snapshotsCh chan *protocol.Snapshot // channel to publish snapshots
+	snapshotsCh chan *TracedSnapshot // channel to publish snapshots
+
+	auditRootsCh chan *protocol.AuditRoot // channel to publish audit roots
 
 	hasherF     func() hashing.Hasher
 	metrics     *raftNodeMetrics     // Raft node metrics.
@@ -123,13 +228,14 @@ type RaftNode struct {
 	sync.Mutex
 	closed bool
 	done   chan struct{}
+	wg     sync.WaitGroup // background jobs
 }
 
-func NewRaftNode(opts *ClusteringOptions, store storage.ManagedStore, snapshotsCh chan *protocol.Snapshot, tlsConfigurator *tlsutil.TLSConfigurator) (*RaftNode, error) {
+func NewRaftNode(opts *ClusteringOptions, store storage.ManagedStore, snapshotsCh chan *TracedSnapshot, tlsConfigurator *tlsutil.TLSConfigurator) (*RaftNode, error) {
 	return NewRaftNodeWithLogger(opts, store, snapshotsCh, tlsConfigurator, log.L())
 }
 
-func NewRaftNodeWithLogger(opts *ClusteringOptions, store storage.ManagedStore, snapshotsCh chan *protocol.Snapshot, tlsConfigurator *tlsutil.TLSConfigurator, logger log.Logger) (*RaftNode, error) {
+func NewRaftNodeWithLogger(opts *ClusteringOptions, store storage.ManagedStore, snapshotsCh chan *TracedSnapshot, tlsConfigurator *tlsutil.TLSConfigurator, logger log.Logger) (*RaftNode, error) {
 
 	// We try to resolve the raft addr to avoid binding to hostnames
 	// because Raft library does not support FQDNs
@@ -155,6 +261,7 @@ func NewRaftNodeWithLogger(opts *ClusteringOptions, store storage.ManagedStore,
 	node := &RaftNode{
 		info:            info,
 		snapshotsCh:     snapshotsCh,
+		auditRootsCh:    make(chan *protocol.AuditRoot, auditRootsQueueSize),
 		log:             logger,
 		tlsConfigurator: tlsConfigurator,
 		applyTimeout:    opts.RaftApplyTimeout,
@@ -162,11 +269,7 @@ func NewRaftNodeWithLogger(opts *ClusteringOptions, store storage.ManagedStore,
 	}
 
 	// Create the log store
-	raftLog, err := newRaftLogOpts(raftLogOptions{
-		Path:             opts.RaftLogPath + "/wal",
-		NoSync:           !opts.Sync,
-		EnableStatistics: true},
-	)
+	raftLog, err := openLogStore(opts.RaftLogEngine, opts.RaftLogPath+"/wal", !opts.Sync)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create a new Raft log: %s", err)
 	}
@@ -175,23 +278,66 @@ func NewRaftNodeWithLogger(opts *ClusteringOptions, store storage.ManagedStore,
 		return nil, fmt.Errorf("cannot create a new cached log store: %s", err)
 	}
 	node.db = store
+	node.dbEngine = opts.RaftLogEngine
 	node.raftLog = raftLog
+	node.checkpointsPath = opts.CheckpointPath
+	if node.checkpointsPath == "" {
+		node.checkpointsPath = opts.RaftLogPath + "/checkpoints"
+	}
 
 	// Set hashing function
 	hasherF := hashing.NewSha256Hasher
 	node.hasherF = hasherF
 
 	// Instantiate balloon FSM
-	node.balloon, err = balloon.NewBalloonWithLogger(store, hasherF, node.log.Named("balloon"))
+	cacheOpts := balloon.DefaultCacheOptions()
+	if opts.HyperCache != nil {
+		cacheOpts = opts.HyperCache
+	}
+	if opts.HyperCacheCheckpointInterval > 0 {
+		node.cacheCheckpointInterval = opts.HyperCacheCheckpointInterval
+		node.cacheCheckpointPath = opts.HyperCacheCheckpointPath
+		if node.cacheCheckpointPath == "" {
+			node.cacheCheckpointPath = opts.RaftLogPath + "/hypercache.checkpoint"
+		}
+		withCheckpoint := *cacheOpts
+		withCheckpoint.Checkpoint = node.cacheCheckpointPath
+		cacheOpts = &withCheckpoint
+	}
+	node.balloon, err = balloon.NewBalloonWithOptions(store, hasherF, cacheOpts, node.log.Named("balloon"))
 	if err != nil {
 		return nil, err
 	}
+	node.audit = newAuditLog(hasherF, store, node.log.Named("audit"))
 	err = node.loadState()
 	if err != nil {
 		node.log.Error("There was an error recovering the FSM state!!")
 		return nil, err
 	}
 
+	// the cache checkpoint must correspond to the last applied command
+	if checkpoint := node.balloon.CacheCheckpoint(); checkpoint != nil {
+		if checkpoint.Index != node.state.Index {
+			node.log.Infof("Hyper cache checkpoint at index %d but FSM state is at index %d", checkpoint.Index, node.state.Index)
+			node.balloon.RebuildCache()
+		} else {
+			node.log.Infof("Hyper cache loaded from checkpoint at index %d", checkpoint.Index)
+		}
+	}
+	node.hyperHistory = opts.HyperHistory
+	node.raftExtendedCommands = opts.RaftExtendedCommands
+	if node.hyperHistory {
+		if err := node.balloon.KeepHyperHistory(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.HistoryArchive != nil {
+		node.balloon.SetHistoryArchive(opts.HistoryArchive, opts.HistoryArchiveSegmentHeight)
+		node.archiveKeepVersions = opts.HistoryArchiveKeepVersions
+		node.archiveInterval = opts.HistoryArchiveInterval
+	}
+	node.balloon.PublishView()
+
 	// setup Raft configuration
 	conf := raft.DefaultConfig()
 	if opts.RaftHeartbeatTimeout != 0 {
@@ -278,6 +424,25 @@ func NewRaftNodeWithLogger(opts *ClusteringOptions, store storage.ManagedStore,
 		}
 	}
 
+	if opts.HistoryArchive != nil && node.archiveInterval > 0 {
+		node.wg.Add(1)
+		go node.archiveHistory()
+	}
+	if opts.ConsistencyCheckInterval > 0 {
+		node.checkInterval = opts.ConsistencyCheckInterval
+		node.checkSnapshots = opts.ConsistencyCheckSnapshots
+		node.wg.Add(1)
+		go node.checkConsistency()
+	}
+	if opts.BackupInterval > 0 {
+		node.backupInterval = opts.BackupInterval
+		node.backupRetention = opts.BackupRetention
+		node.backupVerify = opts.BackupVerify
+		node.backupUpload = opts.BackupUpload
+		node.wg.Add(1)
+		go node.scheduleBackups()
+	}
+
 	return node, nil
 }
 
@@ -296,6 +461,10 @@ func (n *RaftNode) Close(wait bool) error {
 	n.closed = true
 	n.Unlock()
 
+	// stop background jobs
+	close(n.done)
+	n.wg.Wait()
+
 	// shutdown Raft
 	if n.raft != nil {
 		f := n.raft.Shutdown()
@@ -326,6 +495,7 @@ func (n *RaftNode) Close(wait bool) error {
 
 	// close fsm
 	if n.balloon != nil {
+		n.saveCacheCheckpoint(true)
 		n.balloon.Close()
 		n.balloon = nil
 		n.log.Trace("RaftNode closed balloon")
@@ -464,6 +634,7 @@ func (n *RaftNode) RegisterMetrics(registry metrics.Registry) {
 	}
 	registry.MustRegister(n.metrics.collectors()...)
 	registry.MustRegister(n.raftMetrics.collectors()...)
+	registry.MustRegister(hyper.CacheCollectors()...)
 }
 
 func (n *RaftNode) bootstrapCluster() error {
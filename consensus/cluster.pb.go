@@ -384,6 +384,327 @@ func (m *InfoRequest) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_InfoRequest proto.InternalMessageInfo
 
+type CreateCheckpointRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CreateCheckpointRequest) Reset()         { *m = CreateCheckpointRequest{} }
+func (m *CreateCheckpointRequest) String() string { return proto.CompactTextString(m) }
+func (*CreateCheckpointRequest) ProtoMessage()    {}
+func (*CreateCheckpointRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{8}
+}
+
+func (m *CreateCheckpointRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CreateCheckpointRequest.Unmarshal(m, b)
+}
+func (m *CreateCheckpointRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CreateCheckpointRequest.Marshal(b, m, deterministic)
+}
+func (m *CreateCheckpointRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CreateCheckpointRequest.Merge(m, src)
+}
+func (m *CreateCheckpointRequest) XXX_Size() int {
+	return xxx_messageInfo_CreateCheckpointRequest.Size(m)
+}
+func (m *CreateCheckpointRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CreateCheckpointRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CreateCheckpointRequest proto.InternalMessageInfo
+
+type CheckpointFile struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Size                 uint64   `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	Checksum             []byte   `protobuf:"bytes,3,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CheckpointFile) Reset()         { *m = CheckpointFile{} }
+func (m *CheckpointFile) String() string { return proto.CompactTextString(m) }
+func (*CheckpointFile) ProtoMessage()    {}
+func (*CheckpointFile) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{9}
+}
+
+func (m *CheckpointFile) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CheckpointFile.Unmarshal(m, b)
+}
+func (m *CheckpointFile) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CheckpointFile.Marshal(b, m, deterministic)
+}
+func (m *CheckpointFile) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CheckpointFile.Merge(m, src)
+}
+func (m *CheckpointFile) XXX_Size() int {
+	return xxx_messageInfo_CheckpointFile.Size(m)
+}
+func (m *CheckpointFile) XXX_DiscardUnknown() {
+	xxx_messageInfo_CheckpointFile.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CheckpointFile proto.InternalMessageInfo
+
+func (m *CheckpointFile) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *CheckpointFile) GetSize() uint64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *CheckpointFile) GetChecksum() []byte {
+	if m != nil {
+		return m.Checksum
+	}
+	return nil
+}
+
+type CheckpointManifest struct {
+	CheckpointId         string            `protobuf:"bytes,1,opt,name=checkpointId,proto3" json:"checkpointId,omitempty"`
+	LastSeqNum           uint64            `protobuf:"varint,2,opt,name=lastSeqNum,proto3" json:"lastSeqNum,omitempty"`
+	Files                []*CheckpointFile `protobuf:"bytes,3,rep,name=files,proto3" json:"files,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *CheckpointManifest) Reset()         { *m = CheckpointManifest{} }
+func (m *CheckpointManifest) String() string { return proto.CompactTextString(m) }
+func (*CheckpointManifest) ProtoMessage()    {}
+func (*CheckpointManifest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{10}
+}
+
+func (m *CheckpointManifest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CheckpointManifest.Unmarshal(m, b)
+}
+func (m *CheckpointManifest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CheckpointManifest.Marshal(b, m, deterministic)
+}
+func (m *CheckpointManifest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CheckpointManifest.Merge(m, src)
+}
+func (m *CheckpointManifest) XXX_Size() int {
+	return xxx_messageInfo_CheckpointManifest.Size(m)
+}
+func (m *CheckpointManifest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CheckpointManifest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CheckpointManifest proto.InternalMessageInfo
+
+func (m *CheckpointManifest) GetCheckpointId() string {
+	if m != nil {
+		return m.CheckpointId
+	}
+	return ""
+}
+
+func (m *CheckpointManifest) GetLastSeqNum() uint64 {
+	if m != nil {
+		return m.LastSeqNum
+	}
+	return 0
+}
+
+func (m *CheckpointManifest) GetFiles() []*CheckpointFile {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+type FetchCheckpointFileRequest struct {
+	CheckpointId         string   `protobuf:"bytes,1,opt,name=checkpointId,proto3" json:"checkpointId,omitempty"`
+	Name                 string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Offset               uint64   `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FetchCheckpointFileRequest) Reset()         { *m = FetchCheckpointFileRequest{} }
+func (m *FetchCheckpointFileRequest) String() string { return proto.CompactTextString(m) }
+func (*FetchCheckpointFileRequest) ProtoMessage()    {}
+func (*FetchCheckpointFileRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{11}
+}
+
+func (m *FetchCheckpointFileRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchCheckpointFileRequest.Unmarshal(m, b)
+}
+func (m *FetchCheckpointFileRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchCheckpointFileRequest.Marshal(b, m, deterministic)
+}
+func (m *FetchCheckpointFileRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchCheckpointFileRequest.Merge(m, src)
+}
+func (m *FetchCheckpointFileRequest) XXX_Size() int {
+	return xxx_messageInfo_FetchCheckpointFileRequest.Size(m)
+}
+func (m *FetchCheckpointFileRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchCheckpointFileRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FetchCheckpointFileRequest proto.InternalMessageInfo
+
+func (m *FetchCheckpointFileRequest) GetCheckpointId() string {
+	if m != nil {
+		return m.CheckpointId
+	}
+	return ""
+}
+
+func (m *FetchCheckpointFileRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *FetchCheckpointFileRequest) GetOffset() uint64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+type CheckpointChunk struct {
+	Offset               uint64   `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Content              []byte   `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	Checksum             uint32   `protobuf:"varint,3,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CheckpointChunk) Reset()         { *m = CheckpointChunk{} }
+func (m *CheckpointChunk) String() string { return proto.CompactTextString(m) }
+func (*CheckpointChunk) ProtoMessage()    {}
+func (*CheckpointChunk) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{12}
+}
+
+func (m *CheckpointChunk) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CheckpointChunk.Unmarshal(m, b)
+}
+func (m *CheckpointChunk) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CheckpointChunk.Marshal(b, m, deterministic)
+}
+func (m *CheckpointChunk) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CheckpointChunk.Merge(m, src)
+}
+func (m *CheckpointChunk) XXX_Size() int {
+	return xxx_messageInfo_CheckpointChunk.Size(m)
+}
+func (m *CheckpointChunk) XXX_DiscardUnknown() {
+	xxx_messageInfo_CheckpointChunk.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CheckpointChunk proto.InternalMessageInfo
+
+func (m *CheckpointChunk) GetOffset() uint64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *CheckpointChunk) GetContent() []byte {
+	if m != nil {
+		return m.Content
+	}
+	return nil
+}
+
+func (m *CheckpointChunk) GetChecksum() uint32 {
+	if m != nil {
+		return m.Checksum
+	}
+	return 0
+}
+
+type ReleaseCheckpointRequest struct {
+	CheckpointId         string   `protobuf:"bytes,1,opt,name=checkpointId,proto3" json:"checkpointId,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReleaseCheckpointRequest) Reset()         { *m = ReleaseCheckpointRequest{} }
+func (m *ReleaseCheckpointRequest) String() string { return proto.CompactTextString(m) }
+func (*ReleaseCheckpointRequest) ProtoMessage()    {}
+func (*ReleaseCheckpointRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{13}
+}
+
+func (m *ReleaseCheckpointRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReleaseCheckpointRequest.Unmarshal(m, b)
+}
+func (m *ReleaseCheckpointRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReleaseCheckpointRequest.Marshal(b, m, deterministic)
+}
+func (m *ReleaseCheckpointRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReleaseCheckpointRequest.Merge(m, src)
+}
+func (m *ReleaseCheckpointRequest) XXX_Size() int {
+	return xxx_messageInfo_ReleaseCheckpointRequest.Size(m)
+}
+func (m *ReleaseCheckpointRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReleaseCheckpointRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReleaseCheckpointRequest proto.InternalMessageInfo
+
+func (m *ReleaseCheckpointRequest) GetCheckpointId() string {
+	if m != nil {
+		return m.CheckpointId
+	}
+	return ""
+}
+
+type ReleaseCheckpointResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReleaseCheckpointResponse) Reset()         { *m = ReleaseCheckpointResponse{} }
+func (m *ReleaseCheckpointResponse) String() string { return proto.CompactTextString(m) }
+func (*ReleaseCheckpointResponse) ProtoMessage()    {}
+func (*ReleaseCheckpointResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_3cfb3b8ec240c376, []int{14}
+}
+
+func (m *ReleaseCheckpointResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReleaseCheckpointResponse.Unmarshal(m, b)
+}
+func (m *ReleaseCheckpointResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReleaseCheckpointResponse.Marshal(b, m, deterministic)
+}
+func (m *ReleaseCheckpointResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReleaseCheckpointResponse.Merge(m, src)
+}
+func (m *ReleaseCheckpointResponse) XXX_Size() int {
+	return xxx_messageInfo_ReleaseCheckpointResponse.Size(m)
+}
+func (m *ReleaseCheckpointResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReleaseCheckpointResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReleaseCheckpointResponse proto.InternalMessageInfo
+
 func init() {
 	proto.RegisterType((*NodeInfo)(nil), "consensus.NodeInfo")
 	proto.RegisterType((*ClusterInfo)(nil), "consensus.ClusterInfo")
@@ -394,43 +715,64 @@ func init() {
 	proto.RegisterType((*Chunk)(nil), "consensus.Chunk")
 	proto.RegisterType((*InfoResponse)(nil), "consensus.InfoResponse")
 	proto.RegisterType((*InfoRequest)(nil), "consensus.InfoRequest")
+	proto.RegisterType((*CreateCheckpointRequest)(nil), "consensus.CreateCheckpointRequest")
+	proto.RegisterType((*CheckpointFile)(nil), "consensus.CheckpointFile")
+	proto.RegisterType((*CheckpointManifest)(nil), "consensus.CheckpointManifest")
+	proto.RegisterType((*FetchCheckpointFileRequest)(nil), "consensus.FetchCheckpointFileRequest")
+	proto.RegisterType((*CheckpointChunk)(nil), "consensus.CheckpointChunk")
+	proto.RegisterType((*ReleaseCheckpointRequest)(nil), "consensus.ReleaseCheckpointRequest")
+	proto.RegisterType((*ReleaseCheckpointResponse)(nil), "consensus.ReleaseCheckpointResponse")
 }
 
 func init() { proto.RegisterFile("cluster.proto", fileDescriptor_3cfb3b8ec240c376) }
 
 var fileDescriptor_3cfb3b8ec240c376 = []byte{
-	// 481 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x93, 0xcf, 0x6e, 0xd3, 0x40,
-	0x10, 0xc6, 0xe5, 0xfc, 0x69, 0xe3, 0x71, 0x02, 0xd1, 0x82, 0x68, 0xe4, 0x20, 0x91, 0xf8, 0x54,
-	0x2e, 0x56, 0x15, 0x0e, 0x20, 0x4e, 0x2d, 0x81, 0xa2, 0x20, 0xd1, 0x83, 0x23, 0x71, 0xe0, 0x52,
-	0x19, 0xef, 0x84, 0x58, 0x75, 0x76, 0xdd, 0xdd, 0x75, 0xa5, 0xbe, 0x00, 0x6f, 0xc1, 0x4b, 0xf0,
-	0x44, 0x3c, 0x0a, 0xda, 0x3f, 0x8e, 0x0d, 0x84, 0x0b, 0x37, 0xef, 0xf7, 0x1b, 0xcd, 0x7c, 0xf3,
-	0xad, 0x17, 0x46, 0x59, 0x51, 0x49, 0x85, 0x22, 0x2e, 0x05, 0x57, 0x9c, 0xf8, 0x19, 0x67, 0x12,
-	0x99, 0xac, 0x64, 0xf4, 0xdd, 0x83, 0xc1, 0x15, 0xa7, 0xb8, 0x62, 0x1b, 0x4e, 0x4e, 0xe0, 0x98,
-	0x71, 0x8a, 0xd7, 0x39, 0x9d, 0x78, 0x33, 0xef, 0xd4, 0x4f, 0x8e, 0xf4, 0x71, 0x45, 0xc9, 0x14,
-	0x7c, 0x91, 0x6e, 0xd4, 0x75, 0x4a, 0xa9, 0x98, 0x74, 0x0c, 0x1a, 0x68, 0xe1, 0x82, 0x52, 0xa1,
-	0xe1, 0xee, 0xeb, 0xce, 0xc1, 0xae, 0x85, 0x5a, 0xa8, 0xe1, 0x56, 0xa9, 0xd2, 0xc2, 0x9e, 0x85,
-	0x5a, 0x30, 0x70, 0x0e, 0xc3, 0x1d, 0x2a, 0x91, 0x67, 0xd2, 0xf2, 0xbe, 0xe1, 0x81, 0xd3, 0x74,
-	0x49, 0xf4, 0xc3, 0x83, 0x60, 0x69, 0xcd, 0x1b, 0x8b, 0x53, 0xf0, 0x0b, 0x4c, 0x29, 0x8a, 0xc6,
-	0xe4, 0xc0, 0x0a, 0x2b, 0x4a, 0x5e, 0x42, 0x5f, 0x1b, 0x96, 0x93, 0xce, 0xac, 0x7b, 0x1a, 0x2c,
-	0xe6, 0xf1, 0x7e, 0xcf, 0xb8, 0xd5, 0x23, 0xd6, 0xfb, 0xca, 0x77, 0x4c, 0x89, 0xfb, 0xc4, 0xd6,
-	0x87, 0x1f, 0x01, 0x1a, 0x91, 0x8c, 0xa1, 0x7b, 0x83, 0xf7, 0xae, 0xbb, 0xfe, 0x24, 0xcf, 0xa1,
-	0x7f, 0x97, 0x16, 0x15, 0x9a, 0xdd, 0x83, 0xc5, 0xa3, 0x56, 0xe3, 0x3a, 0xbc, 0xc4, 0x56, 0xbc,
-	0xee, 0xbc, 0xf2, 0xa2, 0xf7, 0xf0, 0x30, 0x49, 0x37, 0xea, 0x03, 0xcf, 0x59, 0x82, 0xb7, 0x15,
-	0x4a, 0xf5, 0x7f, 0xd1, 0x46, 0x04, 0xc6, 0x4d, 0x23, 0x59, 0xea, 0xa1, 0xd1, 0x37, 0x0f, 0x1e,
-	0x5f, 0xa2, 0xca, 0xb6, 0x6b, 0x96, 0x96, 0x72, 0xcb, 0x55, 0x3d, 0x22, 0x06, 0x52, 0xa4, 0x52,
-	0x5d, 0x94, 0x65, 0x91, 0x23, 0xfd, 0x84, 0x42, 0xe6, 0x9c, 0x99, 0x69, 0xbd, 0xe4, 0x00, 0x21,
-	0x33, 0x08, 0xa4, 0x4a, 0x85, 0x5a, 0xe3, 0xed, 0x55, 0xb5, 0x33, 0xb3, 0x7b, 0x49, 0x5b, 0x22,
-	0x4f, 0xc1, 0x47, 0x46, 0x1d, 0xef, 0x1a, 0xde, 0x08, 0xd1, 0x1c, 0xfa, 0xcb, 0x6d, 0xc5, 0x6e,
-	0xc8, 0x04, 0x8e, 0x97, 0x9c, 0x29, 0x64, 0xca, 0x4c, 0x1b, 0x26, 0xf5, 0x31, 0x3a, 0x87, 0xa1,
-	0xc9, 0xc6, 0x79, 0x27, 0x67, 0xe0, 0xdb, 0x14, 0xd8, 0x86, 0x9b, 0xda, 0x7f, 0x64, 0x39, 0x60,
-	0xee, 0x2b, 0x1a, 0x41, 0x60, 0x3b, 0x98, 0x1d, 0x17, 0x3f, 0x3d, 0x78, 0xe0, 0xae, 0x72, 0x8d,
-	0xe2, 0x2e, 0xcf, 0x90, 0x5c, 0x42, 0xa0, 0xf3, 0x71, 0x2a, 0x09, 0x5b, 0xfd, 0xfe, 0xb8, 0x84,
-	0x70, 0x7a, 0x90, 0x39, 0x6f, 0x6f, 0x61, 0xf4, 0x5b, 0xac, 0xe4, 0x59, 0xab, 0xfa, 0x50, 0xe0,
-	0xe1, 0xb8, 0xfd, 0x7f, 0xe9, 0x24, 0xce, 0x3c, 0x72, 0xee, 0xba, 0xec, 0xdf, 0xd4, 0x93, 0x56,
-	0x51, 0x6b, 0x93, 0xf0, 0xe4, 0x2f, 0xdd, 0xfa, 0x78, 0x13, 0x7c, 0x6e, 0x9e, 0xe7, 0x97, 0x23,
-	0xf3, 0x60, 0x5f, 0xfc, 0x0a, 0x00, 0x00, 0xff, 0xff, 0x96, 0xe2, 0xd1, 0xdc, 0xc1, 0x03, 0x00,
-	0x00,
+	// 717 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x55, 0xdd, 0x6e, 0xd3, 0x4a,
+	0x10, 0x96, 0xf3, 0xd3, 0x26, 0xe3, 0xa4, 0xcd, 0xd9, 0x1e, 0xb5, 0xa9, 0x73, 0x7e, 0xda, 0x3d,
+	0x07, 0xa9, 0xdc, 0x84, 0xaa, 0x5c, 0x80, 0xb8, 0x40, 0x2d, 0x81, 0xa2, 0x20, 0xb5, 0x17, 0x2e,
+	0x70, 0xd1, 0x0b, 0x2a, 0x63, 0x8f, 0x89, 0x15, 0x67, 0x9d, 0x7a, 0x37, 0x95, 0xca, 0x03, 0x20,
+	0xf1, 0x10, 0xbc, 0x04, 0xaf, 0xc6, 0x0b, 0xa0, 0xfd, 0x71, 0xec, 0x24, 0x2e, 0xaa, 0xb8, 0xdb,
+	0xfd, 0xbe, 0xc9, 0xec, 0xcc, 0x37, 0xdf, 0xc4, 0xd0, 0xf6, 0xe3, 0x19, 0x17, 0x98, 0xf6, 0xa7,
+	0x69, 0x22, 0x12, 0xd2, 0xf4, 0x13, 0xc6, 0x91, 0xf1, 0x19, 0xa7, 0xdf, 0x2c, 0x68, 0x9c, 0x27,
+	0x01, 0x0e, 0x59, 0x98, 0x90, 0x1d, 0x58, 0x67, 0x49, 0x80, 0x57, 0x51, 0xd0, 0xb5, 0xf6, 0xac,
+	0x83, 0xa6, 0xbb, 0x26, 0xaf, 0xc3, 0x80, 0xf4, 0xa0, 0x99, 0x7a, 0xa1, 0xb8, 0xf2, 0x82, 0x20,
+	0xed, 0x56, 0x14, 0xd5, 0x90, 0xc0, 0x49, 0x10, 0xa4, 0x92, 0x9c, 0x7c, 0x9a, 0x18, 0xb2, 0xaa,
+	0x49, 0x09, 0x64, 0xe4, 0x48, 0x88, 0xa9, 0x26, 0x6b, 0x9a, 0x94, 0x80, 0x22, 0xf7, 0xa1, 0x35,
+	0x41, 0x91, 0x46, 0x3e, 0xd7, 0x7c, 0x5d, 0xf1, 0xb6, 0xc1, 0x64, 0x08, 0xfd, 0x6e, 0x81, 0x3d,
+	0xd0, 0xc5, 0xab, 0x12, 0x7b, 0xd0, 0x8c, 0xd1, 0x0b, 0x30, 0xcd, 0x8b, 0x6c, 0x68, 0x60, 0x18,
+	0x90, 0x27, 0x50, 0x97, 0x05, 0xf3, 0x6e, 0x65, 0xaf, 0x7a, 0x60, 0x1f, 0xed, 0xf7, 0xe7, 0x7d,
+	0xf6, 0x0b, 0x39, 0xfa, 0xb2, 0x5f, 0xfe, 0x8a, 0x89, 0xf4, 0xd6, 0xd5, 0xf1, 0xce, 0x19, 0x40,
+	0x0e, 0x92, 0x0e, 0x54, 0xc7, 0x78, 0x6b, 0xb2, 0xcb, 0x23, 0x79, 0x08, 0xf5, 0x1b, 0x2f, 0x9e,
+	0xa1, 0xea, 0xdd, 0x3e, 0xda, 0x2a, 0x24, 0xce, 0xc4, 0x73, 0x75, 0xc4, 0xb3, 0xca, 0x53, 0x8b,
+	0xbe, 0x86, 0x4d, 0xd7, 0x0b, 0xc5, 0x9b, 0x24, 0x62, 0x2e, 0x5e, 0xcf, 0x90, 0x8b, 0xdf, 0x93,
+	0x96, 0x12, 0xe8, 0xe4, 0x89, 0xf8, 0x54, 0x3e, 0x4a, 0xbf, 0x58, 0xf0, 0xe7, 0x29, 0x0a, 0x7f,
+	0x74, 0xc1, 0xbc, 0x29, 0x1f, 0x25, 0x22, 0x7b, 0xa2, 0x0f, 0x24, 0xf6, 0xb8, 0x38, 0x99, 0x4e,
+	0xe3, 0x08, 0x83, 0xf7, 0x98, 0xf2, 0x28, 0x61, 0xea, 0xb5, 0x9a, 0x5b, 0xc2, 0x90, 0x3d, 0xb0,
+	0xb9, 0xf0, 0x52, 0x71, 0x81, 0xd7, 0xe7, 0xb3, 0x89, 0x7a, 0xbb, 0xe6, 0x16, 0x21, 0xf2, 0x17,
+	0x34, 0x91, 0x05, 0x86, 0xaf, 0x2a, 0x3e, 0x07, 0xe8, 0x3e, 0xd4, 0x07, 0xa3, 0x19, 0x1b, 0x93,
+	0x2e, 0xac, 0x0f, 0x12, 0x26, 0x90, 0x09, 0xf5, 0x5a, 0xcb, 0xcd, 0xae, 0xf4, 0x18, 0x5a, 0x4a,
+	0x1b, 0x53, 0x3b, 0x39, 0x84, 0xa6, 0x56, 0x81, 0x85, 0x49, 0xd7, 0xba, 0x5b, 0xcb, 0x06, 0x33,
+	0x27, 0xda, 0x06, 0x5b, 0x67, 0x50, 0x3d, 0xd2, 0x5d, 0xd8, 0x19, 0xa4, 0xe8, 0x09, 0x1c, 0x8c,
+	0xd0, 0x1f, 0x4f, 0x93, 0x88, 0x65, 0xed, 0xd3, 0xb7, 0xb0, 0x91, 0x83, 0xa7, 0x51, 0x8c, 0x84,
+	0x40, 0x8d, 0x79, 0x13, 0x34, 0x82, 0xab, 0xb3, 0xc4, 0x78, 0xf4, 0x19, 0x4d, 0xb7, 0xea, 0x4c,
+	0x1c, 0x68, 0xf8, 0xf2, 0x97, 0xdc, 0x74, 0xd9, 0x72, 0xe7, 0x77, 0xfa, 0xd5, 0x02, 0x92, 0xa7,
+	0x3d, 0xf3, 0x58, 0x14, 0x4a, 0xad, 0x29, 0xb4, 0xfc, 0x39, 0x3a, 0xcc, 0x66, 0xba, 0x80, 0x91,
+	0x7f, 0x00, 0xa4, 0xea, 0x0b, 0xf2, 0x16, 0x10, 0xf2, 0x08, 0xea, 0x61, 0x14, 0x23, 0xef, 0x56,
+	0x95, 0x5b, 0x77, 0x8b, 0x6e, 0x5d, 0x68, 0xc4, 0xd5, 0x71, 0x34, 0x06, 0x47, 0x0d, 0x7e, 0x89,
+	0x35, 0xe3, 0xbf, 0x4f, 0x49, 0x99, 0x22, 0x95, 0x82, 0x22, 0xdb, 0xb0, 0x96, 0x84, 0x21, 0x47,
+	0x61, 0x26, 0x6c, 0x6e, 0xf4, 0x0a, 0x36, 0xf3, 0x87, 0xf4, 0xa0, 0xf3, 0x50, 0xab, 0x18, 0x2a,
+	0x0d, 0xe0, 0x1b, 0x03, 0x54, 0xb4, 0x01, 0xcc, 0x75, 0x45, 0xda, 0x76, 0x41, 0xda, 0xe7, 0xd0,
+	0x75, 0x31, 0x46, 0x8f, 0xaf, 0x0e, 0xf3, 0x3e, 0xcd, 0xd0, 0x1e, 0xec, 0x96, 0xfc, 0x5e, 0x3b,
+	0xed, 0xe8, 0x47, 0x15, 0x36, 0xcc, 0xce, 0x5f, 0x60, 0x7a, 0x13, 0xf9, 0x48, 0x4e, 0xc1, 0x96,
+	0x8b, 0x64, 0x50, 0xe2, 0x14, 0xf4, 0x5e, 0xda, 0x56, 0xa7, 0x57, 0xca, 0x19, 0x13, 0xbf, 0x84,
+	0xf6, 0xc2, 0xfe, 0x91, 0x7f, 0x0b, 0xd1, 0x65, 0x9b, 0xe9, 0x74, 0x16, 0x46, 0x3b, 0x63, 0xe3,
+	0x43, 0x8b, 0x1c, 0x9b, 0x2c, 0xf3, 0x3f, 0xdf, 0xed, 0x42, 0x50, 0xc1, 0xf2, 0xce, 0xce, 0x0a,
+	0x6e, 0xea, 0x78, 0x07, 0x9d, 0xe5, 0x5d, 0x20, 0xb4, 0xf8, 0x52, 0xf9, 0xa2, 0x38, 0x7f, 0x97,
+	0x1a, 0x6d, 0x6e, 0xed, 0x4b, 0xd8, 0x2a, 0x71, 0x19, 0x79, 0xb0, 0xdc, 0x64, 0xa9, 0x0b, 0x1d,
+	0xa7, 0x34, 0x79, 0xd6, 0xf4, 0x07, 0xf8, 0x63, 0x65, 0x64, 0xe4, 0xbf, 0xa2, 0xd8, 0x77, 0x18,
+	0xc2, 0xf9, 0xff, 0xd7, 0x41, 0x5a, 0x92, 0x17, 0xf6, 0x65, 0xfe, 0x69, 0xfb, 0xb8, 0xa6, 0x3e,
+	0x76, 0x8f, 0x7f, 0x0e, 0x00, 0x0e, 0x66, 0x06, 0x73, 0xfd, 0x06, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -448,6 +790,9 @@ type ClusterServiceClient interface {
 	JoinCluster(ctx context.Context, in *RaftJoinRequest, opts ...grpc.CallOption) (*RaftJoinResponse, error)
 	FetchSnapshot(ctx context.Context, in *FetchSnapshotRequest, opts ...grpc.CallOption) (ClusterService_FetchSnapshotClient, error)
 	FetchNodeInfo(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*InfoResponse, error)
+	CreateCheckpoint(ctx context.Context, in *CreateCheckpointRequest, opts ...grpc.CallOption) (*CheckpointManifest, error)
+	FetchCheckpointFile(ctx context.Context, in *FetchCheckpointFileRequest, opts ...grpc.CallOption) (ClusterService_FetchCheckpointFileClient, error)
+	ReleaseCheckpoint(ctx context.Context, in *ReleaseCheckpointRequest, opts ...grpc.CallOption) (*ReleaseCheckpointResponse, error)
 }
 
 type clusterServiceClient struct {
@@ -508,11 +853,64 @@ func (c *clusterServiceClient) FetchNodeInfo(ctx context.Context, in *InfoReques
 	return out, nil
 }
 
+func (c *clusterServiceClient) CreateCheckpoint(ctx context.Context, in *CreateCheckpointRequest, opts ...grpc.CallOption) (*CheckpointManifest, error) {
+	out := new(CheckpointManifest)
+	err := c.cc.Invoke(ctx, "/consensus.ClusterService/CreateCheckpoint", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clusterServiceClient) FetchCheckpointFile(ctx context.Context, in *FetchCheckpointFileRequest, opts ...grpc.CallOption) (ClusterService_FetchCheckpointFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ClusterService_serviceDesc.Streams[1], "/consensus.ClusterService/FetchCheckpointFile", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &clusterServiceFetchCheckpointFileClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ClusterService_FetchCheckpointFileClient interface {
+	Recv() (*CheckpointChunk, error)
+	grpc.ClientStream
+}
+
+type clusterServiceFetchCheckpointFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *clusterServiceFetchCheckpointFileClient) Recv() (*CheckpointChunk, error) {
+	m := new(CheckpointChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *clusterServiceClient) ReleaseCheckpoint(ctx context.Context, in *ReleaseCheckpointRequest, opts ...grpc.CallOption) (*ReleaseCheckpointResponse, error) {
+	out := new(ReleaseCheckpointResponse)
+	err := c.cc.Invoke(ctx, "/consensus.ClusterService/ReleaseCheckpoint", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ClusterServiceServer is the server API for ClusterService service.
 type ClusterServiceServer interface {
 	JoinCluster(context.Context, *RaftJoinRequest) (*RaftJoinResponse, error)
 	FetchSnapshot(*FetchSnapshotRequest, ClusterService_FetchSnapshotServer) error
 	FetchNodeInfo(context.Context, *InfoRequest) (*InfoResponse, error)
+	CreateCheckpoint(context.Context, *CreateCheckpointRequest) (*CheckpointManifest, error)
+	FetchCheckpointFile(*FetchCheckpointFileRequest, ClusterService_FetchCheckpointFileServer) error
+	ReleaseCheckpoint(context.Context, *ReleaseCheckpointRequest) (*ReleaseCheckpointResponse, error)
 }
 
 // UnimplementedClusterServiceServer can be embedded to have forward compatible implementations.
@@ -528,6 +926,15 @@ func (*UnimplementedClusterServiceServer) FetchSnapshot(req *FetchSnapshotReques
 func (*UnimplementedClusterServiceServer) FetchNodeInfo(ctx context.Context, req *InfoRequest) (*InfoResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method FetchNodeInfo not implemented")
 }
+func (*UnimplementedClusterServiceServer) CreateCheckpoint(ctx context.Context, req *CreateCheckpointRequest) (*CheckpointManifest, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateCheckpoint not implemented")
+}
+func (*UnimplementedClusterServiceServer) FetchCheckpointFile(req *FetchCheckpointFileRequest, srv ClusterService_FetchCheckpointFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method FetchCheckpointFile not implemented")
+}
+func (*UnimplementedClusterServiceServer) ReleaseCheckpoint(ctx context.Context, req *ReleaseCheckpointRequest) (*ReleaseCheckpointResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseCheckpoint not implemented")
+}
 
 func RegisterClusterServiceServer(s *grpc.Server, srv ClusterServiceServer) {
 	s.RegisterService(&_ClusterService_serviceDesc, srv)
@@ -590,6 +997,63 @@ func _ClusterService_FetchNodeInfo_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ClusterService_CreateCheckpoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateCheckpointRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClusterServiceServer).CreateCheckpoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/consensus.ClusterService/CreateCheckpoint",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClusterServiceServer).CreateCheckpoint(ctx, req.(*CreateCheckpointRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClusterService_FetchCheckpointFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FetchCheckpointFileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ClusterServiceServer).FetchCheckpointFile(m, &clusterServiceFetchCheckpointFileServer{stream})
+}
+
+type ClusterService_FetchCheckpointFileServer interface {
+	Send(*CheckpointChunk) error
+	grpc.ServerStream
+}
+
+type clusterServiceFetchCheckpointFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *clusterServiceFetchCheckpointFileServer) Send(m *CheckpointChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ClusterService_ReleaseCheckpoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseCheckpointRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClusterServiceServer).ReleaseCheckpoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/consensus.ClusterService/ReleaseCheckpoint",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClusterServiceServer).ReleaseCheckpoint(ctx, req.(*ReleaseCheckpointRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _ClusterService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "consensus.ClusterService",
 	HandlerType: (*ClusterServiceServer)(nil),
@@ -602,6 +1066,14 @@ var _ClusterService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "FetchNodeInfo",
 			Handler:    _ClusterService_FetchNodeInfo_Handler,
 		},
+		{
+			MethodName: "CreateCheckpoint",
+			Handler:    _ClusterService_CreateCheckpoint_Handler,
+		},
+		{
+			MethodName: "ReleaseCheckpoint",
+			Handler:    _ClusterService_ReleaseCheckpoint_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -609,6 +1081,11 @@ var _ClusterService_serviceDesc = grpc.ServiceDesc{
 			Handler:       _ClusterService_FetchSnapshot_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "FetchCheckpointFile",
+			Handler:       _ClusterService_FetchCheckpointFile_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "cluster.proto",
 }
@@ -23,7 +23,6 @@ import (
 	"time"
 
 	"github.com/bbva/qed/log"
-	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/storage/rocks"
 	"github.com/bbva/qed/testutils/spec"
 )
@@ -308,7 +307,7 @@ func newFollower(name string, id int, seeds ...string) (*RaftNode, closeF, error
 
 func newNode(opts *ClusteringOptions, rocksOpts *rocks.Options) (*RaftNode, closeF, error) {
 
-	snapshotsCh := make(chan *protocol.Snapshot, 25000)
+	snapshotsCh := make(chan *TracedSnapshot, 25000)
 	snapshotsDrainer(snapshotsCh)
 
 	// var metricsCloseF = func() {}
@@ -350,7 +349,7 @@ func newNode(opts *ClusteringOptions, rocksOpts *rocks.Options) (*RaftNode, clos
 
 }
 
-func snapshotsDrainer(snapshotsCh chan *protocol.Snapshot) {
+func snapshotsDrainer(snapshotsCh chan *TracedSnapshot) {
 	go func() {
 		for {
 			_, ok := <-snapshotsCh
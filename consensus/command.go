@@ -19,6 +19,8 @@ package consensus
 import (
 	"bytes"
 	"fmt"
+
+	"github.com/bbva/qed/crypto/hashing"
 )
 
 // commandType are commands that affect the state of the cluster,
@@ -26,9 +28,31 @@ import (
 type commandType uint8
 
 const (
-	addEventCommandType commandType = iota // Commands which modify the database.
+	addEventCommandType            commandType = iota // Commands which modify the database.
+	addEventWithContextCommandType                    // Add commands carrying the context of the request.
+	addAuditEventCommandType                          // Commands recording an administrative operation in the audit log.
 )
 
+// addEventsWithContext is the payload of the add commands carrying the
+// trace context and the identifier of the request, so every node logs and
+// traces the apply as part of it. They are only proposed if the cluster
+// enables RaftExtendedCommands and there is any context to carry: the
+// requests sampled by the tracer or with an identifier.
+type addEventsWithContext struct {
+	TraceParent string
+	RequestID   string
+	Digests     []hashing.Digest
+}
+
+// addAuditEvent is the payload of the audit commands. Unlike the add
+// commands, it carries the whole event, which every node adds to its
+// audit log instead of the balloon. They are only proposed if the
+// cluster enables RaftExtendedCommands.
+type addAuditEvent struct {
+	RequestID string
+	Event     []byte
+}
+
 type command struct {
 	id   commandType
 	data []byte
@@ -0,0 +1,83 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"time"
+
+	"github.com/bbva/qed/balloon"
+)
+
+// checkConsistency periodically checks the stored trees for corruption
+// until the node is closed.
+func (n *RaftNode) checkConsistency() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			_, _ = n.CheckConsistency()
+		}
+	}
+}
+
+// CheckConsistency checks the history nodes added since the previous
+// check, the whole hyper tree, and the roots against the configured
+// snapshots. The corruptions found are logged, and the nodes are checked
+// again in the next run.
+func (n *RaftNode) CheckConsistency() (*balloon.CheckReport, error) {
+	n.checkMu.Lock()
+	defer n.checkMu.Unlock()
+
+	version := n.balloon.PublishedVersion()
+	if version == 0 {
+		return &balloon.CheckReport{}, nil
+	}
+	start := n.lastChecked
+	if start >= version {
+		// the last root is compared anyway
+		start = version - 1
+	}
+
+	begin := time.Now()
+	report, err := n.balloon.Check(&balloon.CheckOptions{
+		Start:     start,
+		End:       version - 1,
+		Hyper:     true,
+		Snapshots: n.checkSnapshots,
+	})
+	if err != nil {
+		n.log.Infof("Unable to check the consistency of the stored trees: %v", err)
+		return nil, err
+	}
+
+	n.metrics.ConsistencyChecks.Inc()
+	n.metrics.Corruptions.Set(float64(len(report.Corruptions)))
+	for _, c := range report.Corruptions {
+		n.log.Errorf("Corruption found in %v", c)
+	}
+	if report.Ok() {
+		n.lastChecked = report.End + 1
+	}
+	n.log.Debugf("Consistency of versions %d to %d checked in %v: %d corruptions found", report.Start, report.End, time.Since(begin), len(report.Corruptions))
+	return report, nil
+}
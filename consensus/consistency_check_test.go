@@ -0,0 +1,106 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+	"github.com/bbva/qed/util"
+)
+
+func TestBoltCheckConsistency(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	snapshots := make(map[uint64]*balloon.Snapshot)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.ConsistencyCheckInterval = time.Hour
+	opts.ConsistencyCheckSnapshots = func(version uint64) (*balloon.Snapshot, error) {
+		return snapshots[version], nil
+	}
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	snapshotsDrainer(snapshotsCh)
+	defer close(snapshotsCh)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			snapshot, err := node.Add([]byte(fmt.Sprintf("event %d", i)))
+			require.NoError(t, err)
+			snapshots[snapshot.Version] = snapshot
+		}
+	}
+
+	add(0, 10)
+	report, err := node.CheckConsistency()
+	require.NoError(t, err)
+	require.True(t, report.Ok())
+	require.Equal(t, uint64(0), report.Start)
+	require.Equal(t, uint64(9), report.End)
+	require.Equal(t, uint64(10), report.Snapshots)
+
+	// only the new versions are checked
+	add(10, 20)
+	report, err = node.CheckConsistency()
+	require.NoError(t, err)
+	require.True(t, report.Ok())
+	require.Equal(t, uint64(10), report.Start)
+
+	// corrupt a leaf of the history tree already checked, which
+	// does not match the event in the hyper tree anymore
+	key := append(util.Uint64AsBytes(15), 0, 0)
+	require.NoError(t, db.Mutate([]*storage.Mutation{
+		storage.NewMutation(storage.HistoryTable, key, make([]byte, 32)),
+	}, nil))
+	report, err = node.CheckConsistency()
+	require.NoError(t, err)
+	require.False(t, report.Ok())
+	require.Len(t, report.Corruptions, 1)
+	require.Equal(t, "hyper", report.Corruptions[0].Tree)
+	require.Equal(t, "Leaf does not match the history leaf of version 15", report.Corruptions[0].Reason)
+
+	// corruptions are reported until fixed
+	report, err = node.CheckConsistency()
+	require.NoError(t, err)
+	require.False(t, report.Ok())
+}
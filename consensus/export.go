@@ -0,0 +1,351 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/export"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+)
+
+// exportHasher is the name of the hasher of the balloon in export files.
+const exportHasher = "sha256"
+
+// importBulkSize bounds the number of events added at once while
+// importing, between checkpoints.
+const importBulkSize = 1000
+
+// ExportOptions configure the export of the log of a database.
+type ExportOptions struct {
+	// Versions between consecutive checkpoints. The last version always
+	// has a checkpoint.
+	CheckpointInterval uint64
+
+	// Signs the checkpoints.
+	Signer sign.Signer
+
+	// Directory of the temporary file used to sort the events by
+	// version. Defaults to the temporary directory of the system.
+	TempDir string
+
+	// Node the log is exported from, recorded in the header.
+	NodeID string
+}
+
+// ExportReport summarizes the events and checkpoints of an export file
+// once written or imported.
+type ExportReport struct {
+	Events      uint64
+	Payloads    uint64
+	Checkpoints uint64
+	HistoryRoot hashing.Digest
+	HyperRoot   hashing.Digest
+}
+
+// ExportLog writes the digests of every event of the database to w in
+// version order, along with a signed checkpoint every
+// opts.CheckpointInterval versions. The payloads of the events are not
+// stored, and the audit log of the cluster is not part of the export.
+//
+// Only the last version of each event is kept in the hyper tree, so the
+// earlier versions of the events added more than once are found in the
+// leaves of the history tree.
+func ExportLog(db storage.Store, w io.Writer, opts *ExportOptions) (*ExportReport, error) {
+	hasherF := hashing.NewSha256Hasher
+	size := int64(hasherF().Len() / 8)
+	bln, err := balloon.NewBalloonWithLogger(db, hasherF, log.L().Named("balloon"))
+	if err != nil {
+		return nil, err
+	}
+	defer bln.Close()
+
+	count := bln.Version()
+	if count == 0 {
+		return nil, fmt.Errorf("There are no events to export")
+	}
+
+	tmp, err := ioutil.TempFile(opts.TempDir, "qed-export")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// digests are sorted in the temporary file at the offset of their version
+	filled := make([]uint64, (count+63)/64)
+	isFilled := func(v uint64) bool { return filled[v/64]&(1<<(v%64)) != 0 }
+	fill := func(v uint64, digest hashing.Digest) error {
+		if _, err := tmp.WriteAt(digest, int64(v)*size); err != nil {
+			return err
+		}
+		filled[v/64] |= 1 << (v % 64)
+		return nil
+	}
+
+	var events uint64
+	var walkErr error
+	hyperRoot, err := bln.WalkEvents(func(digest hashing.Digest, version uint64) {
+		if walkErr != nil {
+			return
+		}
+		if version >= count || int64(len(digest)) != size {
+			walkErr = fmt.Errorf("Invalid event at version %d in the hyper tree", version)
+			return
+		}
+		events++
+		walkErr = fill(version, digest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	state, err := readState(db)
+	if err != nil {
+		return nil, err
+	}
+	if state.Snapshot != nil && !bytes.Equal(state.Snapshot.HyperDigest, hyperRoot) {
+		return nil, fmt.Errorf("The root of the hyper tree does not match the stored state")
+	}
+
+	// the missing versions belong to events added again later, so the
+	// candidates of a missing version are the events of the hyper tree
+	// whose last version is after it
+	if events < count {
+		digests := make([]hashing.Digest, 0, events)
+		versions := make([]uint64, 0, events)
+		filledDigests := bufio.NewReader(io.NewSectionReader(tmp, 0, int64(count)*size))
+		for v := uint64(0); v < count; v++ {
+			digest := make([]byte, size)
+			if _, err := io.ReadFull(filledDigests, digest); err != nil {
+				return nil, err
+			}
+			if isFilled(v) {
+				digests = append(digests, digest)
+				versions = append(versions, v)
+			}
+		}
+		first := 0
+		for missing := uint64(0); missing < count; missing++ {
+			for first < len(versions) && versions[first] <= missing {
+				first++
+			}
+			if isFilled(missing) {
+				continue
+			}
+			digest, found := bln.FindEvent(missing, digests[first:])
+			if !found {
+				return nil, fmt.Errorf("Unable to find the event of version %d", missing)
+			}
+			if err := fill(missing, digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	writer, err := export.NewWriter(w, &export.Header{
+		Hasher:             exportHasher,
+		Events:             count,
+		CheckpointInterval: opts.CheckpointInterval,
+		Timestamp:          time.Now().Unix(),
+		NodeID:             opts.NodeID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ExportReport{Events: count, HyperRoot: hyperRoot}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	digests := bufio.NewReader(tmp)
+	for v := uint64(0); v < count; v++ {
+		digest := make([]byte, size)
+		if _, err := io.ReadFull(digests, digest); err != nil {
+			return nil, err
+		}
+		if err := writer.WriteEvent(digest, nil); err != nil {
+			return nil, err
+		}
+
+		last := v == count-1
+		if !last && (opts.CheckpointInterval == 0 || (v+1)%opts.CheckpointInterval != 0) {
+			continue
+		}
+		historyRoot, err := bln.HistoryRoot(v)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := &protocol.Snapshot{EventDigest: digest, HistoryDigest: historyRoot, Version: v}
+		if last {
+			snapshot.HyperDigest = hyperRoot
+			report.HistoryRoot = historyRoot
+		}
+		signature, err := opts.Signer.Sign(snapshot.SigningMessage())
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.WriteCheckpoint(&protocol.SignedSnapshot{Snapshot: snapshot, Signature: signature}); err != nil {
+			return nil, err
+		}
+		report.Checkpoints++
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ImportLog adds the events of an export file to an empty database,
+// storing them like the FSM does. The roots of the trees are recomputed
+// and verified against every checkpoint of the file, whose signature is
+// verified too. The file must end with a checkpoint of its last version.
+//
+// The imported database does not correspond to any Raft log, so it
+// must be started with an empty Raft directory, as a new cluster.
+func ImportLog(db storage.Store, r *export.Reader, verifier sign.Verifier) (*ExportReport, error) {
+	header := r.Header()
+	if header.Hasher != exportHasher {
+		return nil, fmt.Errorf("Unsupported hasher %q", header.Hasher)
+	}
+
+	state, err := readState(db)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.GetLast(storage.HistoryTable); err != storage.ErrKeyNotFound || state.Snapshot != nil {
+		return nil, fmt.Errorf("The database is not empty")
+	}
+
+	hasherF := hashing.NewSha256Hasher
+	bln, err := balloon.NewBalloonWithLogger(db, hasherF, log.L().Named("balloon"))
+	if err != nil {
+		return nil, err
+	}
+	defer bln.Close()
+
+	report := new(ExportReport)
+	var pending []hashing.Digest
+	pendingSet := make(map[string]bool)
+	var last *balloon.Snapshot
+	var checkpointed uint64
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		snapshots, mutations, err := bln.AddBulk(pending)
+		if err != nil {
+			return err
+		}
+		last = snapshots[len(snapshots)-1]
+		newState := &fsmState{BalloonVersion: last.Version, Snapshot: last}
+		stateBuff, err := newState.encode()
+		if err != nil {
+			return err
+		}
+		mutations = append(mutations, storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff))
+		meta := &VersionMetadata{PreviousVersion: state.BalloonVersion, NewVersion: newState.BalloonVersion}
+		metaBytes, err := meta.encode()
+		if err != nil {
+			return err
+		}
+		if err := db.Mutate(mutations, metaBytes); err != nil {
+			return err
+		}
+		state = newState
+		pending = nil
+		pendingSet = make(map[string]bool)
+		return nil
+	}
+
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch record.Type {
+		case export.EventRecord:
+			// the hyper tree keeps the last version of each event only if
+			// they are added in different bulks
+			if pendingSet[string(record.Digest)] {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			// payloads are verified, but the database only keeps digests
+			if record.Payload != nil {
+				if !bytes.Equal(hasherF().Do(record.Payload), record.Digest) {
+					return nil, fmt.Errorf("The payload of version %d does not match its digest", record.Version)
+				}
+				report.Payloads++
+			}
+			pending = append(pending, record.Digest)
+			pendingSet[string(record.Digest)] = true
+			report.Events++
+			if len(pending) >= importBulkSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+
+		case export.CheckpointRecord:
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			ok, err := record.Checkpoint.VerifySignature(verifier)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("Invalid signature of the checkpoint of version %d", record.Version)
+			}
+			checkpoint := record.Checkpoint.Snapshot
+			if !bytes.Equal(checkpoint.EventDigest, last.EventDigest) ||
+				!bytes.Equal(checkpoint.HistoryDigest, last.HistoryDigest) ||
+				checkpoint.HyperDigest != nil && !bytes.Equal(checkpoint.HyperDigest, last.HyperDigest) {
+				return nil, fmt.Errorf("The roots of version %d do not match its checkpoint", record.Version)
+			}
+			report.Checkpoints++
+			checkpointed = record.Version + 1
+			report.HistoryRoot = last.HistoryDigest
+			report.HyperRoot = last.HyperDigest
+		}
+	}
+
+	if report.Events == 0 || checkpointed != report.Events {
+		return nil, fmt.Errorf("The file does not end with a checkpoint of its last version")
+	}
+	return report, nil
+}
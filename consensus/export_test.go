@@ -0,0 +1,184 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/export"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+)
+
+func TestBoltExportImportLog(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.RaftExtendedCommands = true
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	snapshotsDrainer(snapshotsCh)
+	defer close(snapshotsCh)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	// events 1 and 3 are added more than once, and the audit entry is not
+	// part of the balloon
+	for _, bulk := range [][]string{{"event 0", "event 1", "event 2"}, {"event 3", "event 1"}, {"event 3", "event 5", "event 1"}} {
+		var events [][]byte
+		for _, e := range bulk {
+			events = append(events, []byte(e))
+		}
+		_, err := node.AddBulk(events)
+		require.NoError(t, err)
+		if len(bulk) == 2 {
+			_, err = node.AddAuditEntry(context.Background(), &protocol.AuditEntry{Node: t.Name(), Operation: "POST /backup", Status: 200})
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, node.Close(true))
+
+	db, err = bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	defer db.Close()
+	stored, err := readState(db)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), stored.BalloonVersion)
+
+	signer := sign.NewEd25519Signer()
+	var file bytes.Buffer
+	report, err := ExportLog(db, &file, &ExportOptions{CheckpointInterval: 4, Signer: signer, NodeID: t.Name()})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), report.Events)
+	require.Equal(t, uint64(0), report.Payloads)
+	require.Equal(t, uint64(2), report.Checkpoints, "Checkpoints at versions 3 and 7")
+	require.Equal(t, stored.Snapshot.HistoryDigest, report.HistoryRoot)
+	require.Equal(t, stored.Snapshot.HyperDigest, report.HyperRoot)
+
+	testCases := []struct {
+		verifier sign.Verifier
+		valid    bool
+	}{
+		{signer, true},
+		{sign.NewEd25519Signer(), false},
+	}
+
+	for i, c := range testCases {
+		reader, err := export.NewReader(bytes.NewReader(file.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, t.Name(), reader.Header().NodeID, "Wrong header in test case %d", i)
+
+		imported, err := bolt.NewBoltStore(fmt.Sprintf("%s/import%d", path, i), 0)
+		require.NoError(t, err)
+		importReport, err := ImportLog(imported, reader, c.verifier)
+		if !c.valid {
+			require.Error(t, err, "The checkpoints must not be verified in test case %d", i)
+			require.NoError(t, imported.Close())
+			continue
+		}
+		require.NoError(t, err, "Unable to import in test case %d", i)
+		require.Equal(t, report, importReport, "Wrong import report in test case %d", i)
+
+		state, err := readState(imported)
+		require.NoError(t, err)
+		require.Zero(t, state.Index, "The imported state must not refer to the Raft log in test case %d", i)
+		require.Equal(t, stored.Snapshot, state.Snapshot, "Wrong state in test case %d", i)
+		_, err = imported.GetLast(storage.AuditTable)
+		require.Equal(t, storage.ErrKeyNotFound, err, "The audit log must not be imported in test case %d", i)
+
+		// the database is no longer empty
+		reader, err = export.NewReader(bytes.NewReader(file.Bytes()))
+		require.NoError(t, err)
+		_, err = ImportLog(imported, reader, c.verifier)
+		require.Error(t, err, "Imported into a non empty database in test case %d", i)
+		require.NoError(t, imported.Close())
+	}
+}
+
+func TestImportLogRepeatedEvents(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+	require.NoError(t, os.MkdirAll(path, 0755))
+
+	// the roots to match are the ones of the events added one by one
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	defer db.Close()
+	bln, err := balloon.NewBalloon(db, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	defer bln.Close()
+
+	var digests []hashing.Digest
+	var last *balloon.Snapshot
+	for _, event := range []string{"event 0", "event 1", "event 2", "event 1"} {
+		digest := hashing.NewSha256Hasher().Do([]byte(event))
+		snapshot, mutations, err := bln.Add(digest)
+		require.NoError(t, err)
+		require.NoError(t, db.Mutate(mutations, nil))
+		digests = append(digests, digest)
+		last = snapshot
+	}
+
+	signer := sign.NewEd25519Signer()
+	var file bytes.Buffer
+	writer, err := export.NewWriter(&file, &export.Header{Hasher: exportHasher, Events: uint64(len(digests))})
+	require.NoError(t, err)
+	for _, digest := range digests {
+		require.NoError(t, writer.WriteEvent(digest, nil))
+	}
+	snapshot := protocol.ToSnapshot(last)
+	signature, err := signer.Sign(snapshot.SigningMessage())
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteCheckpoint(&protocol.SignedSnapshot{Snapshot: snapshot, Signature: signature}))
+	require.NoError(t, writer.Close())
+
+	reader, err := export.NewReader(bytes.NewReader(file.Bytes()))
+	require.NoError(t, err)
+	imported, err := bolt.NewBoltStore(path+"/import", 0)
+	require.NoError(t, err)
+	defer imported.Close()
+
+	// the repeated event is not added in the same bulk
+	report, err := ImportLog(imported, reader, signer)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), report.Events)
+	require.Equal(t, last.HyperDigest, report.HyperRoot)
+}
@@ -17,16 +17,21 @@ package consensus
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/pkg/errors"
 
 	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
 	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/tracing"
 )
 
 type fsmResponse struct {
@@ -37,6 +42,10 @@ type fsmResponse struct {
 type VersionMetadata struct {
 	PreviousVersion uint64
 	NewVersion      uint64
+
+	// Audit batches add an entry to the audit log without changing
+	// the version of the balloon. They can be applied more than once.
+	Audit bool
 }
 
 func (m *VersionMetadata) encode() ([]byte, error) {
@@ -49,6 +58,11 @@ func (m *VersionMetadata) decode(value []byte) error {
 
 type fsmState struct {
 	Index, BalloonVersion uint64
+
+	// Snapshot of the last event applied, so backups and checkpoints
+	// know the roots they contain. States written by older versions
+	// do not have it.
+	Snapshot *balloon.Snapshot
 }
 
 func (s *fsmState) encode() ([]byte, error) {
@@ -59,9 +73,15 @@ func (s *fsmState) decode(value []byte) error {
 	return decodeMsgPack(value, s)
 }
 
+// applied reports whether the Raft log entry of the given index is
+// already applied to the state.
+func (s *fsmState) applied(index uint64) bool {
+	return s.Index >= index && s.Index != 0
+}
+
 func (s *fsmState) shouldApply(f *fsmState) bool {
 
-	if s.Index >= f.Index && s.Index != 0 {
+	if s.applied(f.Index) {
 		return false
 	}
 
@@ -91,6 +111,24 @@ func (n *RaftNode) loadState() error {
 	return nil
 }
 
+// StoredSnapshot returns the snapshot of the last event applied to the
+// given database, like a restored backup, or nil if the database has no
+// events or its last event was applied by an older version of QED.
+func StoredSnapshot(db storage.Store) (*balloon.Snapshot, error) {
+	kvstate, err := db.Get(storage.FSMStateTable, storage.FSMStateTableKey)
+	if err == storage.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state fsmState
+	if err := state.decode(kvstate.Value); err != nil {
+		return nil, fmt.Errorf("Unable to decode state: %v", err)
+	}
+	return state.Snapshot, nil
+}
+
 /*
 	RaftBalloon API implements the Ballon API in the RAFT system
 */
@@ -99,7 +137,13 @@ func (n *RaftNode) loadState() error {
 // As a result, it returns a shapshot, but previously it sends the snapshot
 // to the agents channel, in order to be published/queried.
 func (n *RaftNode) Add(event []byte) (*balloon.Snapshot, error) {
-	snapshots, err := n.AddBulk(append([][]byte{}, event))
+	return n.AddWithContext(context.Background(), event)
+}
+
+// AddWithContext works like Add, tracing the operation as a child of the
+// span carried by the context.
+func (n *RaftNode) AddWithContext(ctx context.Context, event []byte) (*balloon.Snapshot, error) {
+	snapshots, err := n.AddBulkWithContext(ctx, append([][]byte{}, event))
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +154,19 @@ func (n *RaftNode) Add(event []byte) (*balloon.Snapshot, error) {
 // As a result, it returns a bulk of shapshots, but previously it sends each snapshot
 // of the bulk to the agents channel, in order to be published/queried.
 func (n *RaftNode) AddBulk(bulk [][]byte) ([]*balloon.Snapshot, error) {
+	return n.AddBulkWithContext(context.Background(), bulk)
+}
+
+// AddBulkWithContext works like AddBulk, tracing the operation as a child of
+// the span carried by the context. If the cluster enables extended commands,
+// the trace context travels inside the Raft command, so every node traces
+// the application of the bulk.
+func (n *RaftNode) AddBulkWithContext(ctx context.Context, bulk [][]byte) ([]*balloon.Snapshot, error) {
+	ctx, span := tracing.StartSpan(ctx, "raft.propose")
+	defer span.End()
+	span.SetAttribute("raft.node", n.info.NodeId)
+	span.SetAttribute("balloon.events", len(bulk))
+
 	// Hash events
 	var eventHashBulk []hashing.Digest
 	for _, event := range bulk {
@@ -117,10 +174,25 @@ func (n *RaftNode) AddBulk(bulk [][]byte) ([]*balloon.Snapshot, error) {
 	}
 
 	// Create and apply command.
-	cmd := newCommand(addEventCommandType)
-	cmd.encode(eventHashBulk)
+	// older nodes cannot apply the commands carrying the context, so
+	// they are only proposed once the whole cluster understands them
+	traceParent := tracing.TraceParent(ctx)
+	requestID := log.RequestID(ctx)
+	if !span.Context().Sampled {
+		traceParent = ""
+	}
+	var cmd *command
+	if n.raftExtendedCommands && (traceParent != "" || requestID != "") {
+		cmd = newCommand(addEventWithContextCommandType)
+		cmd.encode(&addEventsWithContext{TraceParent: traceParent, RequestID: requestID, Digests: eventHashBulk})
+	} else {
+		cmd = newCommand(addEventCommandType)
+		cmd.encode(eventHashBulk)
+	}
 	resp, err := n.propose(cmd)
 	if err != nil {
+		span.SetError(err)
+		log.FromContext(ctx, n.log).Debugf("Node [%s] - Unable to add %d events: %v", n.info.NodeId, len(bulk), err)
 		return nil, err
 	}
 
@@ -129,8 +201,7 @@ func (n *RaftNode) AddBulk(bulk [][]byte) ([]*balloon.Snapshot, error) {
 	//Send snapshot to the snapshot channel
 	// TODO move this to an upper layer (shard manager?)
 	for _, s := range snapshotBulk {
-		p := protocol.Snapshot(*s)
-		n.snapshotsCh <- &p
+		n.snapshotsCh <- &TracedSnapshot{Snapshot: protocol.ToSnapshot(s), TraceParent: traceParent}
 	}
 
 	return snapshotBulk, nil
@@ -150,6 +221,20 @@ func (n *RaftNode) QueryMembershipConsistency(event []byte, version uint64) (*ba
 	return n.balloon.QueryMembershipConsistency(event, version)
 }
 
+// QueryDigestMembershipAt acts as a passthrough when an event digest is given to request a
+// membership proof against a certain balloon version and the hyper tree at that version.
+func (n *RaftNode) QueryDigestMembershipAt(keyDigest hashing.Digest, version uint64) (*balloon.MembershipProof, error) {
+	n.metrics.DigestMembershipQueries.Inc()
+	return n.balloon.QueryDigestMembershipAt(keyDigest, version)
+}
+
+// QueryMembershipAt acts as a passthrough when an event is given to request a membership
+// proof against a certain balloon version and the hyper tree at that version.
+func (n *RaftNode) QueryMembershipAt(event []byte, version uint64) (*balloon.MembershipProof, error) {
+	n.metrics.MembershipQueries.Inc()
+	return n.balloon.QueryMembershipAt(event, version)
+}
+
 // QueryDigestMembership acts as a passthrough when an event digest is given to request a
 // membership proof against the last balloon version.
 func (n *RaftNode) QueryDigestMembership(keyDigest hashing.Digest) (*balloon.MembershipProof, error) {
@@ -186,12 +271,36 @@ func (n *RaftNode) Apply(l *raft.Log) interface{} {
 		if err := cmd.decode(&eventDigests); err != nil {
 			panic(fmt.Sprintf("Unable to decode command: %v", err))
 		}
-		newState := &fsmState{l.Index, n.balloon.Version() + uint64(len(eventDigests)) - 1}
+		newState := &fsmState{Index: l.Index, BalloonVersion: n.balloon.Version() + uint64(len(eventDigests)) - 1}
+		if n.state.shouldApply(newState) {
+			return n.applyAdd(context.Background(), eventDigests, newState)
+		}
+		return &fsmResponse{fmt.Errorf("state already applied!: %+v -> %+v", n.state, newState), nil}
+
+	case addEventWithContextCommandType:
+		var events addEventsWithContext
+		if err := cmd.decode(&events); err != nil {
+			panic(fmt.Sprintf("Unable to decode command: %v", err))
+		}
+		newState := &fsmState{Index: l.Index, BalloonVersion: n.balloon.Version() + uint64(len(events.Digests)) - 1}
 		if n.state.shouldApply(newState) {
-			return n.applyAdd(eventDigests, newState)
+			ctx := tracing.ContextWithTraceParent(context.Background(), events.TraceParent)
+			ctx = log.ContextWithRequestID(ctx, events.RequestID)
+			return n.applyAdd(ctx, events.Digests, newState)
 		}
 		return &fsmResponse{fmt.Errorf("state already applied!: %+v -> %+v", n.state, newState), nil}
 
+	case addAuditEventCommandType:
+		var audit addAuditEvent
+		if err := cmd.decode(&audit); err != nil {
+			panic(fmt.Sprintf("Unable to decode command: %v", err))
+		}
+		if !n.state.applied(l.Index) {
+			ctx := log.ContextWithRequestID(context.Background(), audit.RequestID)
+			return n.applyAuditEntry(ctx, audit.Event, l.Index)
+		}
+		return &fsmResponse{fmt.Errorf("state already applied!: %+v -> index %d", n.state, l.Index), nil}
+
 	default:
 		// ignore
 		n.log.Warnf("Unknown command: %v", cmd.id)
@@ -213,6 +322,7 @@ func (n *RaftNode) StoreConfiguration(index uint64, config raft.Configuration) {
 func (n *RaftNode) Snapshot() (raft.FSMSnapshot, error) {
 	lastSeqNum := n.db.LastWALSequenceNumber()
 	n.log.Debugf("Generating snapshot until seqNum: %d (balloon version %d)", lastSeqNum, n.balloon.Version())
+	n.saveCacheCheckpoint(false)
 	return &fsmSnapshot{lastSeqNum, n.balloon.Version()}, nil
 }
 
@@ -234,34 +344,78 @@ func (n *RaftNode) Restore(rc io.ReadCloser) error {
 
 		// we make a remote call to fetch the snapshot
 		reader, err := n.attemptToFetchSnapshot(snap.LastSeqNum, n.state.BalloonVersion)
-		if err != nil {
+		if err == nil {
+			err = n.db.LoadSnapshot(reader)
+		}
+		if err == nil {
+			err = n.balloon.RefreshVersion()
+		}
+		if err != nil && !isWALUnavailable(err) {
 			return err
 		}
 
-		if err := n.db.LoadSnapshot(reader); err != nil {
-			return err
+		// if the WAL of the leader does not contain every transaction
+		// we need, we fall back to fetch the whole state
+		if err != nil || n.balloon.Version() < snap.BalloonVersion {
+			n.log.Infof("Unable to catch up from the leader WAL, fetching a full checkpoint...")
+			if err := n.restoreFromCheckpoint(); err != nil {
+				return err
+			}
 		}
 	}
 
 	n.loadState()
-	n.balloon.RefreshVersion()
+	if err := n.balloon.RefreshVersion(); err != nil {
+		return err
+	}
+	// a checkpoint may carry the history of the leader
+	if n.hyperHistory {
+		if err := n.balloon.KeepHyperHistory(); err != nil {
+			return err
+		}
+	}
+	n.balloon.PublishView()
 
 	n.log.Infof("Recovering finished, new version: %d", n.state.BalloonVersion)
 
 	return nil
 }
 
-func (n *RaftNode) applyAdd(hashes []hashing.Digest, state *fsmState) *fsmResponse {
+// restoreFromCheckpoint fetches a checkpoint from the leader and loads
+// it into the database, replacing the whole state of the node.
+func (n *RaftNode) restoreFromCheckpoint() error {
+	dir, seqNum, err := n.attemptToFetchCheckpoint()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := n.db.LoadCheckpoint(dir, seqNum); err != nil {
+		return err
+	}
+	n.balloon.RebuildCache()
+	return nil
+}
+
+func (n *RaftNode) applyAdd(ctx context.Context, hashes []hashing.Digest, state *fsmState) *fsmResponse {
+	ctx, span := tracing.StartSpan(ctx, "raft.apply")
+	defer span.End()
+	span.SetAttribute("raft.node", n.info.NodeId)
+	span.SetAttribute("raft.index", state.Index)
+
+	logger := log.FromContext(ctx, n.log).With("raft_index", state.Index)
+	logger.Debugf("Node [%s] - Applying %d events up to version %d", n.info.NodeId, len(hashes), state.BalloonVersion)
 
 	resp := new(fsmResponse)
-	snapshotBulk, mutations, err := n.balloon.AddBulk(hashes)
+	snapshotBulk, mutations, err := n.balloon.AddBulkWithContext(ctx, hashes)
 	if err != nil {
-		n.log.Panicf("Unable to add bulk: %v", err)
+		logger.Panicf("Unable to add bulk: %v", err)
 	}
 
+	state.Snapshot = snapshotBulk[len(snapshotBulk)-1]
 	stateBuff, err := state.encode()
 	if err != nil {
-		n.log.Panicf("Unable to encode state: %v", err)
+		logger.Panicf("Unable to encode state: %v", err)
 	}
 	mutations = append(mutations, storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff))
 
@@ -271,14 +425,23 @@ func (n *RaftNode) applyAdd(hashes []hashing.Digest, state *fsmState) *fsmRespon
 	}
 	metaBytes, err := meta.encode()
 	if err != nil {
-		n.log.Panicf("Unable to encode version metadata: %v", err)
+		logger.Panicf("Unable to encode version metadata: %v", err)
 	}
 
+	_, mutateSpan := tracing.StartSpan(ctx, "storage.mutate")
+	mutateSpan.SetAttribute("db.engine", n.dbEngine)
+	mutateSpan.SetAttribute("db.mutations", len(mutations))
+	start := time.Now()
 	err = n.db.Mutate(mutations, metaBytes)
+	mutateSpan.SetError(err)
+	mutateSpan.End()
+	storageLogger := logger.With("db_engine", n.dbEngine)
 	if err != nil {
-		n.log.Panicf("Unable to mutate database: %v", err)
+		storageLogger.Panicf("Unable to mutate database: %v", err)
 	}
+	storageLogger.Debugf("Stored %d mutations in %v", len(mutations), time.Since(start))
 	n.state = state
+	n.balloon.PublishView()
 	resp.val = snapshotBulk
 	n.metrics.Adds.Add(float64(len(hashes)))
 
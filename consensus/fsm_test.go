@@ -17,12 +17,18 @@
 package consensus
 
 import (
+	"fmt"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
 	"github.com/bbva/qed/testutils/rand"
 	utilrand "github.com/bbva/qed/testutils/rand"
+	"github.com/bbva/qed/testutils/spec"
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
 )
@@ -69,6 +75,47 @@ func TestApplyAdd(t *testing.T) {
 	}
 }
 
+func TestBoltStoredSnapshot(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	snapshotsDrainer(snapshotsCh)
+	defer close(snapshotsCh)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	snapshot, err := StoredSnapshot(db)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+
+	for i := 0; i < 3; i++ {
+		_, err = node.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+	}
+	snapshots, err := node.AddBulk([][]byte{[]byte("event 3"), []byte("event 4")})
+	require.NoError(t, err)
+
+	snapshot, err = StoredSnapshot(db)
+	require.NoError(t, err)
+	require.Equal(t, snapshots[1], snapshot)
+}
+
 func BenchmarkApplyAdd(b *testing.B) {
 
 	// start only one seed
@@ -0,0 +1,50 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"time"
+)
+
+// archiveHistory periodically moves the frozen history nodes of the
+// old versions to the archive until the node is closed.
+func (n *RaftNode) archiveHistory() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			version := n.balloon.PublishedVersion()
+			if version <= n.archiveKeepVersions {
+				continue
+			}
+			archived, err := n.balloon.ArchiveHistory(version - n.archiveKeepVersions)
+			if err != nil {
+				n.log.Infof("Unable to archive history nodes: %v", err)
+				continue
+			}
+			if archived > 0 {
+				n.log.Infof("Archived %d history segments before version %d", archived, version-n.archiveKeepVersions)
+			}
+		}
+	}
+}
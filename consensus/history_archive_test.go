@@ -0,0 +1,86 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+)
+
+func TestBoltHistoryArchive(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	backend, err := archive.NewLocalBackend(path + "/archive")
+	require.NoError(t, err)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.HistoryArchive = backend
+	opts.HistoryArchiveKeepVersions = 4
+	opts.HistoryArchiveInterval = 100 * time.Millisecond
+	opts.HistoryArchiveSegmentHeight = 2
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	snapshotsDrainer(snapshotsCh)
+	defer close(snapshotsCh)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	var last *balloon.Snapshot
+	for i := 0; i < 16; i++ {
+		last, err = node.Add([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+	}
+
+	// the events older than the last 4 versions are archived
+	spec.RetryOnFalse(t, 50, 100*time.Millisecond, func() bool {
+		_, err := backend.Get("history-02-0000000000000002.seg")
+		return err == nil
+	}, "The history should be archived")
+	_, err = backend.Get("history-02-0000000000000003.seg")
+	require.Equal(t, archive.ErrNotFound, err, "The last versions should not be archived")
+
+	for i := 0; i < 16; i++ {
+		proof, err := node.QueryMembership([]byte(fmt.Sprintf("event %d", i)))
+		require.NoError(t, err)
+		require.True(t, proof.Verify([]byte(fmt.Sprintf("event %d", i)), last))
+	}
+}
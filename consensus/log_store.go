@@ -0,0 +1,56 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bbva/qed/metrics"
+	"github.com/bbva/qed/storage"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	// ErrKeyNotFound is an error indicating a given key does not exist
+	ErrKeyNotFound = errors.New("not found")
+)
+
+// raftLogNamespace is the leading part of all published metrics for the Raft log.
+const raftLogNamespace = "qed_wal"
+
+// logStore is a persistent Raft log that also stores
+// the Raft configuration.
+type logStore interface {
+	raft.LogStore
+	raft.StableStore
+	metrics.Registerer
+	Close() error
+}
+
+// openLogStore opens the Raft log in the given path using
+// the selected storage engine.
+func openLogStore(engine, path string, noSync bool) (logStore, error) {
+	switch engine {
+	case "", storage.RocksDBEngine:
+		return openRocksDBLogStore(path, noSync)
+	case storage.BoltEngine:
+		return newBoltRaftLog(path, noSync)
+	default:
+		return nil, fmt.Errorf("Unknown storage engine %s", engine)
+	}
+}
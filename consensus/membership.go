@@ -0,0 +1,287 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/bbva/qed/protocol"
+)
+
+const (
+	// probeTimeout is the time to wait for a member to answer
+	// before considering it unreachable.
+	probeTimeout = 2 * time.Second
+)
+
+var (
+	// ErrUnknownMember is raised when the requested node is not part
+	// of the cluster configuration.
+	ErrUnknownMember = errors.New("Unknown cluster member")
+
+	// ErrMemberExists is raised when adding a node that is already part
+	// of the cluster configuration with a different role or address.
+	ErrMemberExists = errors.New("Cluster member already exists")
+
+	// ErrLeaderMember is raised when trying to remove or demote the leader.
+	// The leadership must be transferred first.
+	ErrLeaderMember = errors.New("Operation not allowed on the cluster leader, transfer the leadership first")
+
+	// ErrQuorumLoss is raised when a membership change would leave the
+	// cluster without enough reachable voters to reach a quorum.
+	ErrQuorumLoss = errors.New("Membership change would make the cluster lose its quorum")
+)
+
+// ListMembers returns the members of the Raft configuration along with
+// their role and whether they are reachable from this node.
+func (n *RaftNode) ListMembers() ([]*protocol.MemberInfo, error) {
+	servers, err := n.servers()
+	if err != nil {
+		return nil, err
+	}
+
+	leaderAddr := n.raft.Leader()
+	reachable := n.probe(servers)
+
+	members := make([]*protocol.MemberInfo, 0, len(servers))
+	for _, srv := range servers {
+		members = append(members, &protocol.MemberInfo{
+			NodeId:    string(srv.ID),
+			RaftAddr:  string(srv.Address),
+			Suffrage:  srv.Suffrage.String(),
+			Leader:    srv.Address == leaderAddr,
+			Reachable: reachable[srv.ID],
+		})
+	}
+	return members, nil
+}
+
+// RemoveMember removes a node from the cluster. Unless forced, a voter is
+// only removed if the remaining reachable voters can reach a quorum.
+func (n *RaftNode) RemoveMember(id string, force bool) error {
+	srv, servers, err := n.leaderLookup(id)
+	if err != nil {
+		return err
+	}
+	if srv.Address == n.transport.LocalAddr() {
+		return ErrLeaderMember
+	}
+
+	if srv.Suffrage == raft.Voter && !force {
+		err := n.checkQuorum(voters(servers, srv.ID, false))
+		if err != nil {
+			return err
+		}
+	}
+
+	n.log.Infof("Removing member %s at %s from the cluster", srv.ID, srv.Address)
+	return n.raft.RemoveServer(srv.ID, 0, 0).Error()
+}
+
+// AddNonvoterMember adds a node to the cluster that receives the log
+// entries but does not take part in elections or commitment.
+func (n *RaftNode) AddNonvoterMember(id, addr string) error {
+	_, servers, err := n.leaderLookup("")
+	if err != nil {
+		return err
+	}
+
+	for _, srv := range servers {
+		if srv.ID == raft.ServerID(id) || srv.Address == raft.ServerAddress(addr) {
+			if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(addr) && srv.Suffrage == raft.Nonvoter {
+				return nil
+			}
+			return ErrMemberExists
+		}
+	}
+
+	n.log.Infof("Adding nonvoter member %s at %s to the cluster", id, addr)
+	return n.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0).Error()
+}
+
+// PromoteMember turns a nonvoter into a voter. Unless forced, the node
+// is only promoted if the resulting voters can still reach a quorum.
+func (n *RaftNode) PromoteMember(id string, force bool) error {
+	srv, servers, err := n.leaderLookup(id)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage == raft.Voter {
+		return nil
+	}
+
+	if !force {
+		err := n.checkQuorum(voters(servers, srv.ID, true))
+		if err != nil {
+			return err
+		}
+	}
+
+	n.log.Infof("Promoting member %s at %s to voter", srv.ID, srv.Address)
+	return n.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error()
+}
+
+// DemoteMember turns a voter into a nonvoter. Unless forced, the node
+// is only demoted if the remaining reachable voters can reach a quorum.
+func (n *RaftNode) DemoteMember(id string, force bool) error {
+	srv, servers, err := n.leaderLookup(id)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage != raft.Voter {
+		return nil
+	}
+	if srv.Address == n.transport.LocalAddr() {
+		return ErrLeaderMember
+	}
+
+	if !force {
+		err := n.checkQuorum(voters(servers, srv.ID, false))
+		if err != nil {
+			return err
+		}
+	}
+
+	n.log.Infof("Demoting member %s at %s to nonvoter", srv.ID, srv.Address)
+	return n.raft.DemoteVoter(srv.ID, 0, 0).Error()
+}
+
+// TransferLeadership transfers the leadership of the cluster to the given
+// voter, or to the most up to date one if no node is given.
+func (n *RaftNode) TransferLeadership(id string) error {
+	if id == "" {
+		if !n.IsLeader() {
+			return ErrNotLeader
+		}
+		n.log.Infof("Transferring leadership")
+		return n.leaveLeadership()
+	}
+
+	srv, _, err := n.leaderLookup(id)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage != raft.Voter {
+		return ErrUnknownMember
+	}
+
+	n.log.Infof("Transferring leadership to %s at %s", srv.ID, srv.Address)
+	return n.raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+}
+
+// leaderLookup checks that this node is the leader and returns the
+// server with the given id, if any, along with the cluster configuration.
+func (n *RaftNode) leaderLookup(id string) (*raft.Server, []raft.Server, error) {
+	if !n.IsLeader() {
+		return nil, nil, ErrNotLeader
+	}
+	servers, err := n.servers()
+	if err != nil {
+		return nil, nil, err
+	}
+	if id == "" {
+		return nil, servers, nil
+	}
+	for i := range servers {
+		if servers[i].ID == raft.ServerID(id) {
+			return &servers[i], servers, nil
+		}
+	}
+	return nil, nil, ErrUnknownMember
+}
+
+func (n *RaftNode) servers() ([]raft.Server, error) {
+	configFuture := n.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+	return configFuture.Configuration().Servers, nil
+}
+
+// checkQuorum checks that a majority of the given voters is reachable.
+func (n *RaftNode) checkQuorum(voters []raft.Server) error {
+	return quorum(voters, n.probe(voters))
+}
+
+// probe concurrently asks every server for its info and returns
+// which of them answered.
+func (n *RaftNode) probe(servers []raft.Server) map[raft.ServerID]bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	reachable := make(map[raft.ServerID]bool, len(servers))
+	for _, srv := range servers {
+		if srv.Address == n.transport.LocalAddr() {
+			reachable[srv.ID] = true
+			continue
+		}
+		wg.Add(1)
+		go func(srv raft.Server) {
+			defer wg.Done()
+			_, err := n.grpcFetchInfo(ctx, string(srv.Address))
+			if err != nil {
+				n.log.Infof("Member %s at %s is unreachable: %v", srv.ID, srv.Address, err)
+			}
+			mu.Lock()
+			reachable[srv.ID] = err == nil
+			mu.Unlock()
+		}(srv)
+	}
+	wg.Wait()
+
+	return reachable
+}
+
+// voters returns the voters of the configuration after including
+// or excluding the given server.
+func voters(servers []raft.Server, id raft.ServerID, include bool) []raft.Server {
+	list := make([]raft.Server, 0, len(servers))
+	for _, srv := range servers {
+		if srv.ID == id {
+			if include {
+				list = append(list, srv)
+			}
+			continue
+		}
+		if srv.Suffrage == raft.Voter {
+			list = append(list, srv)
+		}
+	}
+	return list
+}
+
+// quorum returns ErrQuorumLoss unless a majority of the
+// voters is reachable.
+func quorum(voters []raft.Server, reachable map[raft.ServerID]bool) error {
+	var count int
+	for _, srv := range voters {
+		if reachable[srv.ID] {
+			count++
+		}
+	}
+	if len(voters) == 0 || count < len(voters)/2+1 {
+		return ErrQuorumLoss
+	}
+	return nil
+}
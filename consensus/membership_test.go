@@ -0,0 +1,61 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembershipQuorum(t *testing.T) {
+	servers := []raft.Server{
+		{ID: "0", Suffrage: raft.Voter},
+		{ID: "1", Suffrage: raft.Voter},
+		{ID: "2", Suffrage: raft.Voter},
+		{ID: "3", Suffrage: raft.Nonvoter},
+	}
+
+	testCases := []struct {
+		id        raft.ServerID
+		include   bool
+		reachable map[raft.ServerID]bool
+		expected  error
+	}{
+		// removing a voter from a healthy cluster
+		{"2", false, map[raft.ServerID]bool{"0": true, "1": true, "2": true}, nil},
+		// removing a voter when another one is down
+		{"2", false, map[raft.ServerID]bool{"0": true, "2": true}, ErrQuorumLoss},
+		// removing a nonvoter with a voter down
+		{"3", false, map[raft.ServerID]bool{"0": true, "1": true}, nil},
+		// promoting a reachable nonvoter
+		{"3", true, map[raft.ServerID]bool{"0": true, "1": true, "3": true}, nil},
+		// promoting an unreachable nonvoter with a voter down
+		{"3", true, map[raft.ServerID]bool{"0": true, "1": true}, ErrQuorumLoss},
+		// no voters left
+		{"0", false, map[raft.ServerID]bool{}, ErrQuorumLoss},
+	}
+
+	for i, c := range testCases {
+		list := voters(servers, c.id, c.include)
+		require.Equalf(t, c.expected, quorum(list, c.reachable), "Unexpected quorum check in test case %d", i)
+	}
+
+	require.Len(t, voters(servers, "3", true), 4)
+	require.Len(t, voters(servers, "1", false), 2)
+}
@@ -27,9 +27,16 @@ const subSystem = "raft_balloon"
 type raftNodeMetrics struct {
 	Version                 prometheus.GaugeFunc
 	Adds                    prometheus.Counter
+	AuditEntries            prometheus.Counter
 	MembershipQueries       prometheus.Counter
 	DigestMembershipQueries prometheus.Counter
 	IncrementalQueries      prometheus.Counter
+	ConsistencyChecks       prometheus.Counter
+	Corruptions             prometheus.Gauge
+	BackupsCreated          prometheus.Counter
+	BackupsDeleted          prometheus.Counter
+	BackupErrors            prometheus.Counter
+	LastBackup              prometheus.Gauge
 }
 
 func newRaftNodeMetrics(n *RaftNode) *raftNodeMetrics {
@@ -53,6 +60,14 @@ func newRaftNodeMetrics(n *RaftNode) *raftNodeMetrics {
 				Help:      "Number of add operations",
 			},
 		),
+		AuditEntries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "audit_entries",
+				Help:      "Number of audit entries added.",
+			},
+		),
 		MembershipQueries: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -77,6 +92,54 @@ func newRaftNodeMetrics(n *RaftNode) *raftNodeMetrics {
 				Help:      "Number of incremental queries.",
 			},
 		),
+		ConsistencyChecks: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "consistency_checks",
+				Help:      "Number of consistency checks of the stored trees.",
+			},
+		),
+		Corruptions: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "corruptions",
+				Help:      "Number of corruptions found by the last consistency check.",
+			},
+		),
+		BackupsCreated: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "scheduled_backups",
+				Help:      "Number of scheduled backups created.",
+			},
+		),
+		BackupsDeleted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "expired_backups",
+				Help:      "Number of backups deleted by the retention of the scheduled backups.",
+			},
+		),
+		BackupErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "scheduled_backup_errors",
+				Help:      "Number of scheduled backups that failed to be created, verified or pruned.",
+			},
+		),
+		LastBackup: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subSystem,
+				Name:      "last_scheduled_backup_timestamp_seconds",
+				Help:      "Unix time of the last successful scheduled backup.",
+			},
+		),
 	}
 }
 
@@ -85,8 +148,15 @@ func (m *raftNodeMetrics) collectors() []prometheus.Collector {
 	return []prometheus.Collector{
 		m.Version,
 		m.Adds,
+		m.AuditEntries,
 		m.MembershipQueries,
 		m.DigestMembershipQueries,
 		m.IncrementalQueries,
+		m.ConsistencyChecks,
+		m.Corruptions,
+		m.BackupsCreated,
+		m.BackupsDeleted,
+		m.BackupErrors,
+		m.LastBackup,
 	}
 }
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
    Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
 
@@ -17,8 +20,6 @@
 package consensus
 
 import (
-	"errors"
-
 	"github.com/bbva/qed/metrics"
 	"github.com/bbva/qed/rocksdb"
 	"github.com/bbva/qed/util"
@@ -26,11 +27,6 @@ import (
 	"github.com/hashicorp/raft"
 )
 
-var (
-	// ErrKeyNotFound is an error indicating a given key does not exist
-	ErrKeyNotFound = errors.New("not found")
-)
-
 // table groups related key-value pairs under a
 // consistent space.
 type table uint32
@@ -378,3 +374,12 @@ func (s *raftLog) encodeRaftLog(in *raft.Log) ([]byte, error) {
 	err := enc.Encode(in)
 	return buf, err
 }
+
+// openRocksDBLogStore opens a RocksDB-backed Raft log in the given path.
+func openRocksDBLogStore(path string, noSync bool) (logStore, error) {
+	return newRaftLogOpts(raftLogOptions{
+		Path:             path,
+		NoSync:           noSync,
+		EnableStatistics: true,
+	})
+}
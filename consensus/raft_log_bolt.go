@@ -0,0 +1,236 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bbva/qed/metrics"
+	"github.com/bbva/qed/util"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLogsBucket   = []byte("logs")
+	boltStableBucket = []byte("stable")
+)
+
+// boltRaftLog implements both the raft LogStore and Stable interfaces
+// on top of bbolt, so it can be used in binaries built without cgo.
+type boltRaftLog struct {
+	db    *bbolt.DB
+	codec *codec.MsgpackHandle
+
+	// The path to the bbolt database directory.
+	path string
+
+	metrics []prometheus.Collector
+}
+
+// newBoltRaftLog opens or creates a bbolt-backed Raft log in the given directory.
+func newBoltRaftLog(path string, noSync bool) (*boltRaftLog, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(filepath.Join(path, "raft.db"), 0644, &bbolt.Options{
+		Timeout: time.Second,
+		NoSync:  noSync,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltLogsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltStableBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &boltRaftLog{
+		db:    db,
+		codec: &codec.MsgpackHandle{},
+		path:  path,
+	}
+	store.metrics = []prometheus.Collector{
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: raftLogNamespace,
+				Subsystem: "bolt",
+				Name:      "tx_writes",
+				Help:      "Total number of writes performed.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().TxStats.Write)
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: raftLogNamespace,
+				Subsystem: "bolt",
+				Name:      "tx_write_seconds",
+				Help:      "Total time spent writing to disk.",
+			},
+			func() float64 {
+				return store.db.Stats().TxStats.WriteTime.Seconds()
+			},
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: raftLogNamespace,
+				Subsystem: "bolt",
+				Name:      "free_pages",
+				Help:      "Number of free pages on the freelist.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().FreePageN)
+			},
+		),
+	}
+	return store, nil
+}
+
+// Close is used to gracefully close the DB connection.
+func (s *boltRaftLog) Close() error {
+	return s.db.Close()
+}
+
+// FirstIndex returns the first known index from the Raft log.
+func (s *boltRaftLog) FirstIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(boltLogsBucket).Cursor().First(); k != nil {
+			index = util.BytesAsUint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// LastIndex returns the last known index from the Raft log.
+func (s *boltRaftLog) LastIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if k, _ := tx.Bucket(boltLogsBucket).Cursor().Last(); k != nil {
+			index = util.BytesAsUint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// GetLog gets a log entry at a given index.
+func (s *boltRaftLog) GetLog(index uint64, log *raft.Log) error {
+	var val []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(boltLogsBucket).Get(util.Uint64AsBytes(index))
+		if v == nil {
+			return raft.ErrLogNotFound
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return codec.NewDecoderBytes(val, s.codec).Decode(log)
+}
+
+// StoreLog stores a single raft log.
+func (s *boltRaftLog) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stores a set of raft logs.
+func (s *boltRaftLog) StoreLogs(logs []*raft.Log) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltLogsBucket)
+		for _, log := range logs {
+			var val []byte
+			if err := codec.NewEncoderBytes(&val, s.codec).Encode(log); err != nil {
+				return err
+			}
+			if err := b.Put(util.Uint64AsBytes(log.Index), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange deletes logs within a given range inclusively.
+func (s *boltRaftLog) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltLogsBucket).Cursor()
+		for k, _ := c.Seek(util.Uint64AsBytes(min)); k != nil && util.BytesAsUint64(k) <= max; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Set is used to set a key/value set outside of the raft log.
+func (s *boltRaftLog) Set(key []byte, val []byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltStableBucket).Put(key, val)
+	})
+}
+
+// Get is used to retrieve a value from the k/v store by key
+func (s *boltRaftLog) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(boltStableBucket).Get(key)
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	return val, err
+}
+
+// SetUint64 is like Set, but handles uint64 values
+func (s *boltRaftLog) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, util.Uint64AsBytes(val))
+}
+
+// GetUint64 is like Get, but handles uint64 values
+func (s *boltRaftLog) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return util.BytesAsUint64(val), nil
+}
+
+func (s *boltRaftLog) RegisterMetrics(registry metrics.Registry) {
+	if registry != nil {
+		registry.MustRegister(s.metrics...)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltRaftLog(t *testing.T) {
+	path := mustTempDir()
+	defer deleteFile(path)
+
+	store, err := newBoltRaftLog(path, true)
+	require.NoError(t, err)
+
+	var _ logStore = store
+
+	idx, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), idx)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(1, new(raft.Log)))
+
+	require.NoError(t, store.StoreLog(fakeRaftLog(1, "log1")))
+	require.NoError(t, store.StoreLogs([]*raft.Log{
+		fakeRaftLog(2, "log2"),
+		fakeRaftLog(3, "log3"),
+		fakeRaftLog(4, "log4"),
+	}))
+
+	idx, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), idx)
+	idx, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), idx)
+
+	log := new(raft.Log)
+	require.NoError(t, store.GetLog(2, log))
+	require.Equal(t, fakeRaftLog(2, "log2"), log)
+
+	// delete a range inclusively
+	require.NoError(t, store.DeleteRange(1, 2))
+	idx, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(2, log))
+
+	_, err = store.Get([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, store.Set([]byte("key"), []byte("value")))
+	require.NoError(t, store.SetUint64([]byte("term"), 42))
+
+	// the contents survive a restart
+	require.NoError(t, store.Close())
+	store, err = newBoltRaftLog(path, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	val, err := store.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+	term, err := store.GetUint64([]byte("term"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), term)
+	idx, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), idx)
+}
+
+func TestBoltRaftNode(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+
+	open := func() (*RaftNode, func()) {
+		db, err := bolt.NewBoltStore(path+"/db", 0)
+		require.NoError(t, err)
+		snapshotsCh := make(chan *TracedSnapshot, 100)
+		snapshotsDrainer(snapshotsCh)
+		node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+		require.NoError(t, err)
+		return node, func() {
+			require.NoError(t, node.Close(true))
+			close(snapshotsCh)
+		}
+	}
+
+	node, closeF := open()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+	snapshot, err := node.Add([]byte("event"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), snapshot.Version)
+	closeF()
+
+	// the node recovers its state from both bolt databases
+	node, closeF = open()
+	defer closeF()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+	proof, err := node.QueryMembership([]byte("event"))
+	require.NoError(t, err)
+	require.True(t, proof.Exists)
+}
@@ -0,0 +1,402 @@
+/*
+Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/util"
+)
+
+// errTargetVersionReached stops reading the WAL once the next batch
+// goes beyond the target version.
+var errTargetVersionReached = errors.New("Target version reached")
+
+// ReplayOptions configure the replay of the events added after a
+// backup, to take a restored database to a given version.
+type ReplayOptions struct {
+	// Last version of the balloon once replayed.
+	Version uint64
+
+	// Database whose WAL contains the batches written after the backup,
+	// usually the one the backup was taken from. Optional.
+	WAL storage.ManagedStore
+
+	// Path and storage engine of the Raft log of a node of the cluster,
+	// whose commands are replayed once the WAL is exhausted. Optional.
+	RaftLogPath   string
+	RaftLogEngine string
+
+	// Keep every version of the hyper tree, as the node did.
+	HyperHistory bool
+
+	// Returns the signed snapshot of a version, or nil if it is not
+	// available. The history root of the target version is validated
+	// against it.
+	Snapshots func(version uint64) (*balloon.Snapshot, error)
+}
+
+// ReplayReport describes the replay of a restored database.
+type ReplayReport struct {
+	FromVersion uint64 // Last version of the restored database before the replay.
+	Version     uint64 // Last version of the replayed database.
+	WALBatches  int    // Number of batches replayed from the WAL.
+	RaftEntries int    // Number of Raft log entries replayed.
+	Validated   bool   // The history root matches the signed snapshot.
+	HistoryRoot hashing.Digest
+
+	// The last bulk was cut at the target version, so the hyper root
+	// differs from the one signed for the version, taken after the bulk.
+	Partial bool
+}
+
+// ReplayToVersion takes a database restored from a backup containing
+// events up to a version at or before the target one, to exactly the
+// target version. It replays the batches of the WAL, tagged with their
+// VersionMetadata, that fit entirely before the target version, and the
+// remaining events from the commands of the Raft log, cutting the last
+// bulk at the target version. Finally, it validates the history root of
+// the target version against its signed snapshot. The hasher must be
+// the one the database was built with.
+//
+// The replayed database no longer corresponds to any Raft log, so it
+// must be started with an empty Raft directory, as a new cluster.
+func ReplayToVersion(db storage.ManagedStore, hasherF func() hashing.Hasher, opts *ReplayOptions) (*ReplayReport, error) {
+	report := new(ReplayReport)
+
+	state, err := readState(db)
+	if err != nil {
+		return nil, err
+	}
+	// the number of events stored, like the version of the balloon
+	count := uint64(0)
+	kv, err := db.GetLast(storage.HistoryTable)
+	if err == nil {
+		count = util.BytesAsUint64(kv.Key[:8]) + 1
+	} else if err != storage.ErrKeyNotFound {
+		return nil, err
+	}
+	if count > opts.Version+1 {
+		return nil, fmt.Errorf("The restored database is already at version %d, after version %d", state.BalloonVersion, opts.Version)
+	}
+	report.FromVersion = state.BalloonVersion
+
+	if opts.WAL != nil && count < opts.Version+1 {
+		n, err := replayWAL(db, opts.WAL, count, opts.Version)
+		if err != nil {
+			return nil, err
+		}
+		report.WALBatches = n
+		state, err = readState(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bln, err := balloon.NewBalloonWithLogger(db, hasherF, log.L().Named("balloon"))
+	if err != nil {
+		return nil, err
+	}
+	defer bln.Close()
+	if opts.HyperHistory {
+		if err := bln.KeepHyperHistory(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RaftLogPath != "" && bln.Version() < opts.Version+1 {
+		r := &replayer{db: db, balloon: bln, audit: newAuditLog(hasherF, db, log.L().Named("audit")), hasherF: hasherF, state: state, target: opts.Version}
+		n, err := r.replayRaftLog(opts.RaftLogEngine, opts.RaftLogPath)
+		if err != nil {
+			return nil, err
+		}
+		report.RaftEntries = n
+		report.Partial = r.partial
+		state = r.state
+	}
+
+	if bln.Version() != opts.Version+1 {
+		return nil, fmt.Errorf("Unable to reach version %d: the WAL and the Raft log end at version %d", opts.Version, state.BalloonVersion)
+	}
+	report.Version = opts.Version
+
+	// the new cluster starts its Raft log from the beginning
+	state.Index = 0
+	stateBuff, err := state.encode()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Mutate([]*storage.Mutation{storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff)}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Snapshots == nil {
+		return report, nil
+	}
+	snapshot, err := opts.Snapshots(opts.Version)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("No signed snapshot found for version %d", opts.Version)
+	}
+	check, err := bln.Check(&balloon.CheckOptions{
+		Start: opts.Version,
+		End:   opts.Version,
+		Snapshots: func(version uint64) (*balloon.Snapshot, error) {
+			return snapshot, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.HistoryRoot = check.HistoryDigest
+	if !check.Ok() {
+		return report, fmt.Errorf("Validation of version %d failed: %v", opts.Version, check.Corruptions[0])
+	}
+	report.Validated = true
+
+	return report, nil
+}
+
+func readState(db storage.Store) (*fsmState, error) {
+	state := new(fsmState)
+	kvstate, err := db.Get(storage.FSMStateTable, storage.FSMStateTableKey)
+	if err == storage.ErrKeyNotFound {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := state.decode(kvstate.Value); err != nil {
+		return nil, fmt.Errorf("Unable to decode state: %v", err)
+	}
+	return state, nil
+}
+
+// replayWAL loads the batches of the WAL that follow the given number of
+// events and end at or before the target version. It stops at the first
+// gap, leaving the rest to the Raft log.
+func replayWAL(db, wal storage.ManagedStore, count, target uint64) (int, error) {
+	var batches int
+	validate := func(meta []byte) (bool, error) {
+		metadata := new(VersionMetadata)
+		if err := decodeMsgPack(meta, metadata); err != nil {
+			return false, nil
+		}
+		if metadata.Audit {
+			// the audit entries added at the last restored version may be
+			// missing, and adding them again stores the same nodes
+			return count == 0 || metadata.NewVersion+1 == count, nil
+		}
+		if metadata.NewVersion+1 <= count {
+			return false, nil
+		}
+		if count > 0 && metadata.PreviousVersion != count-1 || count == 0 && metadata.PreviousVersion != 0 {
+			return false, errVersionGap
+		}
+		if metadata.NewVersion > target {
+			return false, errTargetVersionReached
+		}
+		count = metadata.NewVersion + 1
+		batches++
+		return true, nil
+	}
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := wal.FetchSnapshot(w, db.LastWALSequenceNumber(), wal.LastWALSequenceNumber(), validate)
+		// the writer is left open when nothing is written
+		w.Close()
+		done <- err
+	}()
+	if err := db.LoadSnapshot(r); err != nil {
+		return 0, err
+	}
+	err := <-done
+	switch err {
+	case nil, errTargetVersionReached:
+	case storage.ErrWALUnavailable, errVersionGap:
+		log.L().Infof("Replayed %d batches before the WAL was exhausted: %v", batches, err)
+	default:
+		return 0, err
+	}
+	return batches, nil
+}
+
+type replayer struct {
+	db      storage.Store
+	balloon *balloon.Balloon
+	audit   *auditLog
+	hasherF func() hashing.Hasher
+	state   *fsmState
+	target  uint64
+	partial bool
+}
+
+// replayRaftLog applies the commands of the Raft log following the
+// last one applied to the database until reaching the target version.
+func (r *replayer) replayRaftLog(engine, path string) (int, error) {
+	path = path + "/wal"
+	if _, err := os.Stat(path); err != nil {
+		return 0, fmt.Errorf("Unable to open the Raft log: %v", err)
+	}
+	logs, err := openLogStore(engine, path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer logs.Close()
+
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	next := r.state.Index + 1
+	if first > next {
+		return 0, fmt.Errorf("The Raft log starts at index %d, entries from index %d are missing", first, next)
+	}
+
+	var entries int
+	for index := next; index <= last && r.balloon.Version() <= r.target; index++ {
+		var l raft.Log
+		if err := logs.GetLog(index, &l); err != nil {
+			return entries, fmt.Errorf("Unable to read Raft log entry %d: %v", index, err)
+		}
+		applied, err := r.apply(&l)
+		if err != nil {
+			return entries, err
+		}
+		if applied {
+			entries++
+		}
+	}
+	return entries, nil
+}
+
+// apply adds the events of an add command up to the target version,
+// and stores them like the FSM does.
+func (r *replayer) apply(l *raft.Log) (bool, error) {
+	if l.Type != raft.LogCommand || len(l.Data) == 0 {
+		return false, nil
+	}
+
+	var digests []hashing.Digest
+	version := r.balloon.Version()
+	cmd := newCommandFromRaft(l.Data)
+	switch cmd.id {
+	case addEventCommandType:
+		if err := cmd.decode(&digests); err != nil {
+			return false, fmt.Errorf("Unable to decode command %d: %v", l.Index, err)
+		}
+	case addEventWithContextCommandType:
+		var events addEventsWithContext
+		if err := cmd.decode(&events); err != nil {
+			return false, fmt.Errorf("Unable to decode command %d: %v", l.Index, err)
+		}
+		digests = events.Digests
+	case addAuditEventCommandType:
+		var audit addAuditEvent
+		if err := cmd.decode(&audit); err != nil {
+			return false, fmt.Errorf("Unable to decode command %d: %v", l.Index, err)
+		}
+		return true, r.applyAudit(l.Index, audit.Event)
+	default:
+		return false, nil
+	}
+	if len(digests) == 0 {
+		return false, nil
+	}
+
+	// the last bulk is cut at the target version
+	if version+uint64(len(digests)) > r.target+1 {
+		digests = digests[:r.target+1-version]
+		r.partial = true
+	}
+
+	snapshots, mutations, err := r.balloon.AddBulk(digests)
+	if err != nil {
+		return false, err
+	}
+	state := &fsmState{
+		Index:          l.Index,
+		BalloonVersion: version + uint64(len(digests)) - 1,
+		Snapshot:       snapshots[len(snapshots)-1],
+	}
+	stateBuff, err := state.encode()
+	if err != nil {
+		return false, err
+	}
+	mutations = append(mutations, storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff))
+
+	meta := &VersionMetadata{
+		PreviousVersion: r.state.BalloonVersion,
+		NewVersion:      state.BalloonVersion,
+	}
+	metaBytes, err := meta.encode()
+	if err != nil {
+		return false, err
+	}
+	if err := r.db.Mutate(mutations, metaBytes); err != nil {
+		return false, err
+	}
+	r.state = state
+	return true, nil
+}
+
+// applyAudit adds the event of an audit command to the audit log, and
+// stores it like the FSM does.
+func (r *replayer) applyAudit(index uint64, event []byte) error {
+	_, mutations, err := r.audit.add(event)
+	if err != nil {
+		return err
+	}
+	state := &fsmState{Index: index, BalloonVersion: r.state.BalloonVersion, Snapshot: r.state.Snapshot}
+	stateBuff, err := state.encode()
+	if err != nil {
+		return err
+	}
+	mutations = append(mutations, storage.NewMutation(storage.FSMStateTable, storage.FSMStateTableKey, stateBuff))
+
+	meta := &VersionMetadata{
+		PreviousVersion: r.state.BalloonVersion,
+		NewVersion:      r.state.BalloonVersion,
+		Audit:           true,
+	}
+	metaBytes, err := meta.encode()
+	if err != nil {
+		return err
+	}
+	if err := r.db.Mutate(mutations, metaBytes); err != nil {
+		return err
+	}
+	r.state = state
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package consensus
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+)
+
+func TestBoltReplayToVersion(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	snapshotsDrainer(snapshotsCh)
+	defer close(snapshotsCh)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	// versions 0-2 in the backup, then bulks 3-6, 7 and 8-10
+	var snapshots []*balloon.Snapshot
+	addBulk := func(n int) {
+		var bulk [][]byte
+		for i := 0; i < n; i++ {
+			bulk = append(bulk, []byte(fmt.Sprintf("event %d", len(snapshots)+i)))
+		}
+		s, err := node.AddBulk(bulk)
+		require.NoError(t, err)
+		snapshots = append(snapshots, s...)
+	}
+	addBulk(3)
+	require.NoError(t, node.CreateBackup())
+	addBulk(4)
+	addBulk(1)
+	addBulk(3)
+	require.NoError(t, node.Close(true))
+
+	// the database of the stopped node provides the WAL
+	db, err = bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	signed := func(version uint64) (*balloon.Snapshot, error) {
+		return snapshots[version], nil
+	}
+
+	testCases := []struct {
+		version     uint64
+		wal         bool
+		raftLog     bool
+		walBatches  int
+		raftEntries int
+		partial     bool
+	}{
+		{2, true, true, 0, 0, false},
+		{7, true, false, 2, 0, false},
+		{9, true, true, 2, 1, true},
+		{9, false, true, 0, 3, true},
+		{10, true, false, 3, 0, false},
+		{10, false, true, 0, 3, false},
+	}
+
+	for i, c := range testCases {
+		restorePath := fmt.Sprintf("%s/restore%d", path, i)
+		require.NoError(t, bolt.RestoreFromBackup(path+"/db/backups", 1, restorePath))
+		restored, err := bolt.NewBoltStore(restorePath, 0)
+		require.NoError(t, err)
+
+		replayOpts := &ReplayOptions{Version: c.version, Snapshots: signed}
+		if c.wal {
+			replayOpts.WAL = db
+		}
+		if c.raftLog {
+			replayOpts.RaftLogPath = opts.RaftLogPath
+			replayOpts.RaftLogEngine = storage.BoltEngine
+		}
+		report, err := ReplayToVersion(restored, hashing.NewSha256Hasher, replayOpts)
+		require.NoError(t, err, "Unable to replay in test case %d", i)
+		require.Equal(t, uint64(2), report.FromVersion, "Wrong backup version in test case %d", i)
+		require.Equal(t, c.version, report.Version, "Wrong version in test case %d", i)
+		require.Equal(t, c.walBatches, report.WALBatches, "Wrong WAL batches in test case %d", i)
+		require.Equal(t, c.raftEntries, report.RaftEntries, "Wrong Raft log entries in test case %d", i)
+		require.Equal(t, c.partial, report.Partial, "Wrong partial bulk in test case %d", i)
+		require.True(t, report.Validated, "Version not validated in test case %d", i)
+		require.Equal(t, snapshots[c.version].HistoryDigest, report.HistoryRoot, "Wrong history root in test case %d", i)
+
+		state, err := readState(restored)
+		require.NoError(t, err)
+		require.Zero(t, state.Index, "The restored state must not refer to the Raft log in test case %d", i)
+		require.Equal(t, c.version, state.BalloonVersion, "Wrong state in test case %d", i)
+		require.NoError(t, restored.Close())
+	}
+
+	// the version cannot be reached without the Raft log
+	restorePath := path + "/restore-wal"
+	require.NoError(t, bolt.RestoreFromBackup(path+"/db/backups", 1, restorePath))
+	restored, err := bolt.NewBoltStore(restorePath, 0)
+	require.NoError(t, err)
+	_, err = ReplayToVersion(restored, hashing.NewSha256Hasher, &ReplayOptions{Version: 9, WAL: db})
+	require.Error(t, err)
+	require.NoError(t, restored.Close())
+
+	// the history root does not match a wrong snapshot
+	restorePath = path + "/restore-invalid"
+	require.NoError(t, bolt.RestoreFromBackup(path+"/db/backups", 1, restorePath))
+	restored, err = bolt.NewBoltStore(restorePath, 0)
+	require.NoError(t, err)
+	_, err = ReplayToVersion(restored, hashing.NewSha256Hasher, &ReplayOptions{
+		Version: 7,
+		WAL:     db,
+		Snapshots: func(version uint64) (*balloon.Snapshot, error) {
+			return snapshots[version-1], nil
+		},
+	})
+	require.Error(t, err)
+	require.NoError(t, restored.Close())
+}
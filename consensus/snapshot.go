@@ -25,9 +25,15 @@ import (
 	"github.com/bbva/qed/storage"
 	"github.com/hashicorp/raft"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
+// errVersionGap is raised when the WAL transactions requested by
+// a follower do not follow its last applied version.
+var errVersionGap = errors.New("Gap found between versions")
+
 type fsmSnapshot struct {
 	LastSeqNum     uint64
 	BalloonVersion uint64
@@ -135,7 +141,12 @@ func (n *RaftNode) FetchSnapshot(req *FetchSnapshotRequest, srv ClusterService_F
 				return false, nil
 			}
 			if metadata.PreviousVersion > lastSnapshotAppliedVersion {
-				return false, errors.New("Gap found between versions")
+				return false, errVersionGap
+			}
+			if metadata.Audit {
+				// audit entries added at the last applied version may be
+				// missing, and adding them again stores the same nodes
+				return metadata.NewVersion == lastSnapshotAppliedVersion, nil
 			}
 			if metadata.NewVersion < lastSnapshotAppliedVersion {
 				// apply only those who are ahead the version specified with the parameter.
@@ -149,21 +160,15 @@ func (n *RaftNode) FetchSnapshot(req *FetchSnapshotRequest, srv ClusterService_F
 		}
 	}
 
-	return n.db.FetchSnapshot(chunker, req.StartSeqNum, req.EndSeqNum, validateF(req.LastAppliedVersion))
+	err := n.db.FetchSnapshot(chunker, req.StartSeqNum, req.EndSeqNum, validateF(req.LastAppliedVersion))
+	if err == storage.ErrWALUnavailable || err == errVersionGap {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return err
 }
 
 func (n *RaftNode) attemptToFetchSnapshot(lastSeqNum, lastAppliedVersion uint64) (io.ReadCloser, error) {
-	leaderAddr := string(n.raft.Leader())
-	conf, err := n.tlsConfigurator.OutgoingTLSConfig()
-	if err != nil {
-		return nil, err
-	}
-	var conn *grpc.ClientConn
-	if conf != nil {
-		conn, err = grpc.Dial(leaderAddr, grpc.WithTransportCredentials(credentials.NewTLS(conf)))
-	} else {
-		conn, err = grpc.Dial(leaderAddr, grpc.WithInsecure())
-	}
+	conn, err := n.dialLeader()
 	if err != nil {
 		return nil, err
 	}
@@ -173,8 +178,42 @@ func (n *RaftNode) attemptToFetchSnapshot(lastSeqNum, lastAppliedVersion uint64)
 		StartSeqNum:        n.db.LastWALSequenceNumber(),
 		EndSeqNum:          lastSeqNum})
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return newChunkReader(conn, stream), nil
+	// the leader reports an unavailable WAL before sending
+	// any chunk, so we wait for the first one to detect it
+	reader := newChunkReader(conn, stream)
+	chunk, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		reader.Close()
+		if isWALUnavailable(err) {
+			return nil, storage.ErrWALUnavailable
+		}
+		return nil, err
+	}
+	if chunk != nil {
+		reader.buf.Write(chunk.Content)
+	}
+
+	return reader, nil
+}
+
+// isWALUnavailable returns true if the error received from the leader
+// means that it cannot build a snapshot from its WAL.
+func isWALUnavailable(err error) bool {
+	return err == storage.ErrWALUnavailable || status.Code(err) == codes.FailedPrecondition
+}
+
+func (n *RaftNode) dialLeader() (*grpc.ClientConn, error) {
+	leaderAddr := string(n.raft.Leader())
+	conf, err := n.tlsConfigurator.OutgoingTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		return grpc.Dial(leaderAddr, grpc.WithTransportCredentials(credentials.NewTLS(conf)))
+	}
+	return grpc.Dial(leaderAddr, grpc.WithInsecure())
 }
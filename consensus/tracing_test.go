@@ -0,0 +1,239 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+	"github.com/bbva/qed/testutils/spec"
+	"github.com/bbva/qed/tracing"
+)
+
+func TestBoltAddTracing(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+	require.NoError(t, os.MkdirAll(path, 0755))
+
+	exporter, err := tracing.NewFileExporter(path + "/spans.json")
+	require.NoError(t, err)
+	tracer := tracing.NewTracer(exporter, nil)
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.RaftExtendedCommands = true
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	ctx, root := tracing.StartSpan(context.Background(), "test")
+	_, err = node.AddBulkWithContext(ctx, [][]byte{[]byte("event 0"), []byte("event 1")})
+	require.NoError(t, err)
+	root.End()
+
+	var traceParents []string
+	for i := 0; i < 2; i++ {
+		snapshot := <-snapshotsCh
+		traceParents = append(traceParents, snapshot.TraceParent)
+	}
+
+	// requests do not carry any trace context while tracing is disabled
+	tracing.SetTracer(nil)
+	_, err = node.Add([]byte("event 2"))
+	require.NoError(t, err)
+	snapshot := <-snapshotsCh
+	require.Empty(t, snapshot.TraceParent)
+
+	require.NoError(t, tracer.Close())
+	spans, err := tracing.ReadSpans(path + "/spans.json")
+	require.NoError(t, err)
+
+	traceID := root.Context().TraceID.String()
+	byName := make(map[string]*tracing.SpanData)
+	for _, span := range spans {
+		if span.TraceID == traceID {
+			byName[span.Name] = span
+		}
+	}
+	parents := map[string]string{
+		"raft.propose":     "test",
+		"raft.apply":       "raft.propose",
+		"balloon.add_bulk": "raft.apply",
+		"history.add_bulk": "balloon.add_bulk",
+		"hyper.add_bulk":   "balloon.add_bulk",
+		"storage.mutate":   "raft.apply",
+	}
+	for name, parent := range parents {
+		require.Contains(t, byName, name)
+		require.Equal(t, byName[parent].SpanID, byName[name].ParentSpanID, "Parent of %s should be %s", name, parent)
+	}
+	// snapshots carry the trace to the gossip sender
+	for _, traceParent := range traceParents {
+		sc, err := tracing.Parse(traceParent)
+		require.NoError(t, err)
+		require.Equal(t, byName["raft.propose"].SpanID, sc.SpanID.String())
+	}
+	require.Equal(t, storage.BoltEngine, byName["storage.mutate"].Attributes["db.engine"])
+	require.Equal(t, float64(2), byName["balloon.add_bulk"].Attributes["balloon.events"])
+}
+
+func TestBoltAddRequestID(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+	require.NoError(t, os.MkdirAll(path, 0755))
+
+	output, err := os.Create(path + "/node.log")
+	require.NoError(t, err)
+	defer output.Close()
+	logger := log.New(&log.LoggerOptions{
+		Name:   t.Name(),
+		Output: output,
+		Level:  log.Debug,
+		Format: log.JSONFormat,
+	})
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+	opts.RaftExtendedCommands = true
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, logger)
+	require.NoError(t, err)
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	ctx := log.ContextWithRequestID(context.Background(), "request-0")
+	_, err = node.AddBulkWithContext(ctx, [][]byte{[]byte("event 0")})
+	require.NoError(t, err)
+	<-snapshotsCh
+	require.NoError(t, node.Close(true))
+
+	content, err := ioutil.ReadFile(path + "/node.log")
+	require.NoError(t, err)
+
+	messages := make(map[string]map[string]interface{})
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &entry))
+		if entry[log.RequestIDKey] == "request-0" {
+			messages[entry["@message"].(string)] = entry
+		}
+	}
+	applied, ok := messages[fmt.Sprintf("Node [%s] - Applying 1 events up to version 0", t.Name())]
+	require.True(t, ok, "The apply should be logged with the request id")
+	require.NotNil(t, applied["raft_index"])
+	stored := false
+	for msg, entry := range messages {
+		if strings.HasPrefix(msg, "Stored") {
+			stored = true
+			require.Equal(t, storage.BoltEngine, entry["db_engine"])
+			require.Equal(t, applied["raft_index"], entry["raft_index"])
+		}
+	}
+	require.True(t, stored, "The storage mutation should be logged with the request id")
+}
+
+func TestBoltAddExtendedCommandsDisabled(t *testing.T) {
+	path := fmt.Sprintf("/var/tmp/cluster-test/node_%s", t.Name())
+	defer os.RemoveAll(path)
+	require.NoError(t, os.MkdirAll(path, 0755))
+
+	exporter, err := tracing.NewFileExporter(path + "/spans.json")
+	require.NoError(t, err)
+	tracer := tracing.NewTracer(exporter, nil)
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+	defer tracer.Close()
+
+	opts := DefaultClusteringOptions()
+	opts.NodeID = t.Name()
+	opts.Addr = raftAddr(1)
+	opts.MgmtAddr = mgmtAddr(1)
+	opts.HttpAddr = httpAddr(1)
+	opts.Bootstrap = true
+	opts.RaftLogPath = path + "/raft"
+	opts.RaftLogEngine = storage.BoltEngine
+
+	db, err := bolt.NewBoltStore(path+"/db", 0)
+	require.NoError(t, err)
+	snapshotsCh := make(chan *TracedSnapshot, 100)
+	node, err := NewRaftNodeWithLogger(opts, db, snapshotsCh, nil, log.L().Named(opts.NodeID))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, node.Close(true))
+	}()
+	spec.RetryOnFalse(t, 50, 200*time.Millisecond, node.IsLeader, "A single node is not leader!")
+
+	// nodes that predate the extended commands must keep applying the
+	// log, whatever the context of the request
+	requestCtx := log.ContextWithRequestID(context.Background(), "request-0")
+	tracedCtx, root := tracing.StartSpan(context.Background(), "test")
+	defer root.End()
+
+	for i, ctx := range []context.Context{requestCtx, tracedCtx} {
+		_, err = node.AddBulkWithContext(ctx, [][]byte{[]byte(fmt.Sprintf("event %d", i))})
+		require.NoError(t, err, "in test case %d", i)
+		snapshot := <-snapshotsCh
+
+		index, err := node.raftLog.LastIndex()
+		require.NoError(t, err, "in test case %d", i)
+		var entry raft.Log
+		require.NoError(t, node.raftLog.GetLog(index, &entry), "in test case %d", i)
+		require.Equal(t, raft.LogCommand, entry.Type, "in test case %d", i)
+		require.Equal(t, addEventCommandType, commandType(entry.Data[0]), "in test case %d", i)
+
+		// the gossip still continues the trace of the request
+		if ctx == tracedCtx {
+			require.NotEmpty(t, snapshot.TraceParent, "in test case %d", i)
+		}
+	}
+}
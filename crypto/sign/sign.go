@@ -20,6 +20,8 @@ package sign
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -34,6 +36,12 @@ type Signer interface {
 	Verify(message, sig []byte) (bool, error)
 }
 
+// Verifier is the interface implemented by any value that is able to
+// verify signed messages without having access to the private key.
+type Verifier interface {
+	Verify(message, sig []byte) (bool, error)
+}
+
 type Ed25519Signer struct {
 	privateKey ed25519.PrivateKey
 	publicKey  ed25519.PublicKey
@@ -91,3 +99,39 @@ func (s *Ed25519Signer) Sign(message []byte) ([]byte, error) {
 func (s *Ed25519Signer) Verify(message, sig []byte) (bool, error) {
 	return ed25519.Verify(s.publicKey, message, sig), nil
 }
+
+type Ed25519Verifier struct {
+	publicKey ed25519.PublicKey
+}
+
+// NewEd25519VerifierFromFile creates an ed25519 verifier using an existing
+// public key.
+func NewEd25519VerifierFromFile(publicKeyPath string) (Verifier, error) {
+
+	publicKeyBytes, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEd25519Verifier(publicKeyBytes)
+
+}
+
+// NewEd25519Verifier creates an ed25519 verifier from a public key.
+func NewEd25519Verifier(publicKey []byte) (Verifier, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("key is unusable")
+	}
+	return &Ed25519Verifier{publicKey}, nil
+}
+
+// KeyID returns the fingerprint of a public key, the hex encoding of
+// the first 8 bytes of its SHA-256 hash.
+func KeyID(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (v *Ed25519Verifier) Verify(message, sig []byte) (bool, error) {
+	return ed25519.Verify(v.publicKey, message, sig), nil
+}
@@ -18,6 +18,9 @@ package sign
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -36,6 +39,27 @@ func testSign(t *testing.T, signer Signer) {
 
 func TestEdSign(t *testing.T) { testSign(t, NewEd25519Signer()) }
 
+func TestEdVerifierFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-sign")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	signer := NewEd25519Signer()
+	path := filepath.Join(dir, "id_ed25519.pub")
+	require.NoError(t, ioutil.WriteFile(path, signer.(*Ed25519Signer).publicKey, 0644))
+
+	verifier, err := NewEd25519VerifierFromFile(path)
+	require.NoError(t, err)
+
+	message := []byte("send reinforcements, we're going to advance")
+	sig, _ := signer.Sign(message)
+	result, _ := verifier.Verify(message, sig)
+	require.True(t, result, "Must be verified")
+
+	result, _ = verifier.Verify([]byte("send three and fourpence, we're going to a dance"), sig)
+	require.False(t, result, "Must not be verified")
+}
+
 func syncBenchmark(b *testing.B, signer Signer, iterations int) {
 
 	b.N = iterations
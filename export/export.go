@@ -0,0 +1,293 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+// Package export implements the portable file format used to move a QED
+// log between clusters and storage engines.
+//
+// An export file is a gzip stream. It starts with the magic string
+// "QEDLOG", the version of the format as a big-endian uint16, and the
+// header encoded as JSON and prefixed by its length as a uvarint. A
+// sequence of records follows, each one made of its type as a byte, the
+// length of its body as a uvarint, and the body:
+//
+//   - Event records carry the digest of the event of the next version,
+//     starting at version 0, prefixed by its length as a uvarint. The rest
+//     of the body is the payload of the event, empty if it is not stored.
+//   - Checkpoint records carry a JSON signed snapshot of the version of the
+//     last event record. Its hyper digest is only set if it is the root of
+//     the hyper tree after that version.
+//   - The end record carries the number of event records as a uvarint. It
+//     is always the last one, so truncated files are detected.
+//
+// Readers must reject files with a newer version of the format.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/protocol"
+)
+
+// FormatVersion is the version of the format written by this package.
+const FormatVersion uint16 = 1
+
+// maxRecordSize bounds the size of the records, so corrupted lengths
+// are detected before allocating them.
+const maxRecordSize = 64 * 1024 * 1024
+
+var magic = []byte("QEDLOG")
+
+// ErrInvalidFormat is returned when reading a file that is not an export
+// file or is corrupted.
+var ErrInvalidFormat = errors.New("Invalid export file")
+
+// RecordType identifies the kind of a record.
+type RecordType byte
+
+const (
+	EventRecord      RecordType = 'E'
+	CheckpointRecord RecordType = 'C'
+	EndRecord        RecordType = 'Z'
+)
+
+// Header describes the contents of an export file.
+type Header struct {
+	FormatVersion      uint16
+	Hasher             string // Hasher of the balloon of the exported log.
+	Events             uint64 // Number of events exported.
+	CheckpointInterval uint64 // Versions between consecutive checkpoints.
+	Timestamp          int64  // Unix time of the export.
+	NodeID             string `json:",omitempty"` // Node the log was exported from.
+}
+
+// Record is an entry of an export file. Depending on its type, it
+// carries an event along with its version, or a signed checkpoint.
+type Record struct {
+	Type       RecordType
+	Version    uint64
+	Digest     hashing.Digest
+	Payload    []byte
+	Checkpoint *protocol.SignedSnapshot
+}
+
+// Writer writes an export file.
+type Writer struct {
+	gz     *gzip.Writer
+	buf    *bufio.Writer
+	events uint64
+}
+
+// NewWriter writes the header of an export file to w, and returns a
+// writer to add its records.
+func NewWriter(w io.Writer, header *Header) (*Writer, error) {
+	header.FormatVersion = FormatVersion
+	content, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	writer := &Writer{gz: gz, buf: bufio.NewWriter(gz)}
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, FormatVersion)
+	if _, err := writer.buf.Write(append(magic, version...)); err != nil {
+		return nil, err
+	}
+	if err := writer.writeBytes(content); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (w *Writer) writeBytes(b []byte) error {
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(b)))
+	if _, err := w.buf.Write(size[:n]); err != nil {
+		return err
+	}
+	_, err := w.buf.Write(b)
+	return err
+}
+
+func (w *Writer) writeRecord(t RecordType, body []byte) error {
+	if err := w.buf.WriteByte(byte(t)); err != nil {
+		return err
+	}
+	return w.writeBytes(body)
+}
+
+// WriteEvent adds the event of the next version, with its payload
+// if it is stored.
+func (w *Writer) WriteEvent(digest hashing.Digest, payload []byte) error {
+	var body bytes.Buffer
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(digest)))
+	body.Write(size[:n])
+	body.Write(digest)
+	body.Write(payload)
+	if err := w.writeRecord(EventRecord, body.Bytes()); err != nil {
+		return err
+	}
+	w.events++
+	return nil
+}
+
+// WriteCheckpoint adds the signed snapshot of the version of the last event.
+func (w *Writer) WriteCheckpoint(s *protocol.SignedSnapshot) error {
+	if w.events == 0 || s.Snapshot == nil || s.Snapshot.Version != w.events-1 {
+		return fmt.Errorf("Checkpoint does not match the version of the last event")
+	}
+	body, err := s.Encode()
+	if err != nil {
+		return err
+	}
+	return w.writeRecord(CheckpointRecord, body)
+}
+
+// Close writes the end record and flushes the file. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, w.events)
+	if err := w.writeRecord(EndRecord, size[:n]); err != nil {
+		return err
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// Reader reads an export file.
+type Reader struct {
+	gz     *gzip.Reader
+	buf    *bufio.Reader
+	header *Header
+	events uint64
+	done   bool
+}
+
+// NewReader reads the header of the export file in r, and returns
+// a reader of its records.
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	reader := &Reader{gz: gz, buf: bufio.NewReader(gz)}
+
+	prefix := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(reader.buf, prefix); err != nil || !bytes.Equal(prefix[:len(magic)], magic) {
+		return nil, ErrInvalidFormat
+	}
+	if version := binary.BigEndian.Uint16(prefix[len(magic):]); version > FormatVersion {
+		return nil, fmt.Errorf("Unsupported export format version %d, the latest supported is %d", version, FormatVersion)
+	}
+	content, err := reader.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	reader.header = new(Header)
+	if err := json.Unmarshal(content, reader.header); err != nil {
+		return nil, ErrInvalidFormat
+	}
+	return reader, nil
+}
+
+// Header returns the header of the file.
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+func (r *Reader) readBytes() ([]byte, error) {
+	size, err := binary.ReadUvarint(r.buf)
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	if size > maxRecordSize {
+		return nil, ErrInvalidFormat
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.buf, b); err != nil {
+		return nil, ErrInvalidFormat
+	}
+	return b, nil
+}
+
+// Next returns the next event or checkpoint record of the file. It
+// returns io.EOF after the end record, and ErrInvalidFormat if the file
+// ends without it or the number of events does not match.
+func (r *Reader) Next() (*Record, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	t, err := r.buf.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	body, err := r.readBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	switch RecordType(t) {
+	case EventRecord:
+		body := bytes.NewReader(body)
+		size, err := binary.ReadUvarint(body)
+		if err != nil || size > uint64(body.Len()) {
+			return nil, ErrInvalidFormat
+		}
+		digest := make([]byte, size)
+		_, _ = body.Read(digest)
+		var payload []byte
+		if body.Len() > 0 {
+			payload = make([]byte, body.Len())
+			_, _ = body.Read(payload)
+		}
+		r.events++
+		return &Record{Type: EventRecord, Version: r.events - 1, Digest: digest, Payload: payload}, nil
+
+	case CheckpointRecord:
+		var s protocol.SignedSnapshot
+		if err := s.Decode(body); err != nil || s.Snapshot == nil || r.events == 0 || s.Snapshot.Version != r.events-1 {
+			return nil, ErrInvalidFormat
+		}
+		return &Record{Type: CheckpointRecord, Version: s.Snapshot.Version, Checkpoint: &s}, nil
+
+	case EndRecord:
+		events, n := binary.Uvarint(body)
+		if n <= 0 || events != r.events || events != r.header.Events {
+			return nil, ErrInvalidFormat
+		}
+		r.done = true
+		return nil, io.EOF
+
+	default:
+		return nil, ErrInvalidFormat
+	}
+}
+
+// Close releases the reader. It does not close the underlying reader.
+func (r *Reader) Close() error {
+	return r.gz.Close()
+}
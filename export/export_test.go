@@ -0,0 +1,123 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/bbva/qed/protocol"
+)
+
+func TestWriteAndRead(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &Header{Hasher: "sha256", Events: 3, CheckpointInterval: 2})
+	require.NoError(t, err)
+
+	checkpoint := func(version uint64) *protocol.SignedSnapshot {
+		return &protocol.SignedSnapshot{
+			Snapshot:  &protocol.Snapshot{EventDigest: []byte{byte(version)}, HistoryDigest: []byte{0xff}, Version: version},
+			Signature: []byte{0x1},
+		}
+	}
+
+	require.NoError(t, w.WriteEvent([]byte{0x0}, nil))
+	require.Error(t, w.WriteCheckpoint(checkpoint(1)), "The checkpoint must match the last event")
+	require.NoError(t, w.WriteEvent([]byte{0x1}, []byte("payload")))
+	require.NoError(t, w.WriteCheckpoint(checkpoint(1)))
+	require.NoError(t, w.WriteEvent([]byte{0x2}, nil))
+	require.NoError(t, w.WriteCheckpoint(checkpoint(2)))
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, FormatVersion, r.Header().FormatVersion)
+	require.Equal(t, "sha256", r.Header().Hasher)
+	require.Equal(t, uint64(3), r.Header().Events)
+
+	expected := []*Record{
+		{Type: EventRecord, Version: 0, Digest: []byte{0x0}},
+		{Type: EventRecord, Version: 1, Digest: []byte{0x1}, Payload: []byte("payload")},
+		{Type: CheckpointRecord, Version: 1, Checkpoint: checkpoint(1)},
+		{Type: EventRecord, Version: 2, Digest: []byte{0x2}},
+		{Type: CheckpointRecord, Version: 2, Checkpoint: checkpoint(2)},
+	}
+	for i, e := range expected {
+		record, err := r.Next()
+		require.NoError(t, err, "Unable to read record %d", i)
+		require.Equal(t, e, record, "Wrong record %d", i)
+	}
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestReadInvalidFiles(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &Header{Hasher: "sha256", Events: 2})
+	require.NoError(t, err)
+	require.NoError(t, w.WriteEvent([]byte{0x0}, nil))
+	require.NoError(t, w.WriteEvent([]byte{0x1}, nil))
+	require.NoError(t, w.Close())
+
+	readAll := func(content []byte) error {
+		r, err := NewReader(bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for {
+			_, err := r.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	require.NoError(t, readAll(buf.Bytes()))
+
+	// truncated files miss the end record
+	var plain bytes.Buffer
+	gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	_, err = io.Copy(&plain, gz)
+	require.NoError(t, err)
+	compress := func(content []byte) []byte {
+		var out bytes.Buffer
+		gz := gzip.NewWriter(&out)
+		_, _ = gz.Write(content)
+		_ = gz.Close()
+		return out.Bytes()
+	}
+	truncated := plain.Bytes()[:plain.Len()-3]
+	require.Equal(t, ErrInvalidFormat, readAll(compress(truncated)))
+
+	// newer versions of the format are rejected
+	newer := append([]byte{}, plain.Bytes()...)
+	newer[len(magic)+1] = byte(FormatVersion + 1)
+	require.Error(t, readAll(compress(newer)))
+
+	// not an export file
+	require.Equal(t, ErrInvalidFormat, readAll([]byte("QEDLOG")))
+	require.Equal(t, ErrInvalidFormat, readAll(compress([]byte("NOTQED\x00\x01"))))
+}
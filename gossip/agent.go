@@ -283,6 +283,14 @@ func (a *Agent) RegisterMetrics(cs []prometheus.Collector) {
 	a.metrics.MustRegister(cs...)
 }
 
+// Register an http handler in the agent metrics server
+// to expose additional information of its components.
+func (a *Agent) RegisterHandler(pattern string, h http.Handler) {
+	if a.metrics != nil {
+		a.metrics.Handle(pattern, h)
+	}
+}
+
 // Registers the agent in all output channels to send
 // all the messages in the bus to other peers.
 //
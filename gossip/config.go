@@ -28,6 +28,7 @@ const DefaultBindPort int = 7946
 // DefaultConfig contains the defaults for configurations.
 func DefaultConfig() *Config {
 	return &Config{
+		LogFormat:           "text",
 		BindAddr:            "",
 		AdvertiseAddr:       "",
 		LeaveOnTerm:         true,
@@ -38,6 +39,7 @@ func DefaultConfig() *Config {
 		ProcessInterval:     1 * time.Second,
 		CacheSize:           1 << 20,
 		MaxSenders:          10,
+		TracingSampleRatio:  1.0,
 	}
 }
 
@@ -45,6 +47,8 @@ func DefaultConfig() *Config {
 type Config struct {
 	Log string `desc:"Set log level to info, error or debug"`
 
+	LogFormat string `desc:"Set log output format to text or json"`
+
 	// The name of this node. This must be unique in the cluster. If this
 	// is not set, Auditor will set it to the hostname of the running machine.
 	NodeName string `desc:"Set gossip name for this agent"`
@@ -118,6 +122,17 @@ type Config struct {
 	// Cache size in bytes to store agent temporal objects.
 	// This cache will evict old objects by default
 	CacheSize int `desc:"Cache size in bytes to store agent temporal objects"`
+
+	// Exporter of the traces of the processed batches: otlp or file.
+	// Empty disables tracing.
+	TracingExporter string `desc:"Exporter of the traces: otlp or file (empty disables tracing)"`
+
+	// Base URL of the OTLP/HTTP collector or path of the spans file.
+	TracingEndpoint string `desc:"OTLP collector URL or file path where traces are exported"`
+
+	// Ratio of the batches that are traced when the server did not
+	// decide whether to trace them.
+	TracingSampleRatio float64 `desc:"Ratio of untraced batches that start a new trace"`
 }
 
 // AddrParts returns the parts of the BindAddr that should be
@@ -0,0 +1,562 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	pendingTasksBucket = []byte("pending")
+	deadTasksBucket    = []byte("dead")
+)
+
+// PersistentTasksManager is a TasksManager able to build
+// tasks by itself from the batches received by the agent.
+// Instead of receiving closures, which cannot be stored,
+// it receives the name of the factory and the batch, so
+// the task can be rebuilt after a failure or an agent
+// restart.
+type PersistentTasksManager interface {
+	TasksManager
+	RegisterFactory(name string, f TaskFactory, ctx context.Context)
+	Enqueue(ctx context.Context, factory string, b *protocol.BatchSnapshots) error
+}
+
+// TaskRecord is the persistent representation of a
+// task enqueued in a DurableTasksManager.
+type TaskRecord struct {
+	ID          uint64
+	Factory     string
+	Batch       *protocol.BatchSnapshots // Snapshots selected for the task.
+	Attempts    int
+	TraceParent string `json:",omitempty"`
+	CreatedAt   time.Time
+	NextRun     time.Time
+	LastError   string
+}
+
+func (r *TaskRecord) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *TaskRecord) Decode(msg []byte) error {
+	return json.Unmarshal(msg, r)
+}
+
+//DurableTasksManager configuration object used to parse
+//cli options and to build the DurableTasksManager instance
+type DurableTasksManagerConfig struct {
+	Path       string        `desc:"Path to the local database used to persist pending tasks"`
+	Interval   time.Duration `desc:"Interval to execute enqueued tasks"`
+	MaxTasks   int           `desc:"Maximum number of tasks dispatched per interval"`
+	MaxRetries int           `desc:"Maximum number of attempts before moving a task to the dead-letter queue"`
+	MinBackoff time.Duration `desc:"Initial wait time before retrying a failed task"`
+	MaxBackoff time.Duration `desc:"Maximum wait time before retrying a failed task"`
+}
+
+// Returns the default configuration for the DurableTasksManager
+func DefaultDurableTasksManagerConfig() *DurableTasksManagerConfig {
+	return &DurableTasksManagerConfig{
+		Interval:   200 * time.Millisecond,
+		MaxTasks:   10,
+		MaxRetries: 10,
+		MinBackoff: 1 * time.Second,
+		MaxBackoff: 10 * time.Minute,
+	}
+}
+
+func NewDurableTasksManagerFromConfig(c *DurableTasksManagerConfig, logger log.Logger) (*DurableTasksManager, error) {
+	return NewDurableTasksManager(
+		c.Path,
+		c.Interval,
+		c.MaxTasks,
+		c.MaxRetries,
+		client.NewExponentialBackoff(c.MinBackoff, c.MaxBackoff),
+		logger,
+	)
+}
+
+type taskFactoryEntry struct {
+	factory TaskFactory
+	ctx     context.Context
+}
+
+// DurableTasksManager is a task manager which persists the
+// pending tasks in a local embedded store. Failed tasks
+// are retried following a backoff policy, and those that
+// keep failing after the maximum number of retries are moved
+// to a dead-letter queue, where they can be inspected and
+// requeued.
+//
+// Only tasks enqueued through the Enqueue method are
+// persisted. Tasks added using the Add method are executed
+// once, as the SimpleTasksManager does.
+type DurableTasksManager struct {
+	sync.Mutex
+
+	db         *bolt.DB
+	closed     bool
+	factories  map[string]taskFactoryEntry
+	inflight   map[uint64]bool
+	taskCh     chan Task
+	quitCh     chan bool
+	ticker     *time.Ticker
+	wg         sync.WaitGroup
+	maxTasks   int
+	maxRetries int
+	backoff    client.Backoff
+	metrics    *durableTasksMetrics
+	log        log.Logger
+}
+
+// NewDurableTasksManager opens (or creates) the task database in path and
+// returns a new DurableTasksManager. The execution loop will try to execute
+// up to max tasks each interval. Failed tasks will be retried up to retries
+// times waiting between attempts the time given by the backoff policy.
+func NewDurableTasksManager(path string, i time.Duration, max, retries int, backoff client.Backoff, l log.Logger) (*DurableTasksManager, error) {
+
+	logger := l
+	if logger == nil {
+		logger = log.L()
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open tasks database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(pendingTasksBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(deadTasksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	t := &DurableTasksManager{
+		db:         db,
+		factories:  make(map[string]taskFactoryEntry),
+		inflight:   make(map[uint64]bool),
+		taskCh:     make(chan Task, max),
+		quitCh:     make(chan bool),
+		ticker:     time.NewTicker(i),
+		maxTasks:   max,
+		maxRetries: retries,
+		backoff:    backoff,
+		log:        logger,
+	}
+	t.metrics = newDurableTasksMetrics(t)
+
+	return t, nil
+}
+
+// RegisterFactory associates a name to a task factory and the
+// context used to build its tasks. Persisted tasks only keep the
+// name of its factory, so factories must be registered with the
+// same names after an agent restart.
+func (t *DurableTasksManager) RegisterFactory(name string, f TaskFactory, ctx context.Context) {
+	t.Lock()
+	defer t.Unlock()
+	t.factories[name] = taskFactoryEntry{factory: f, ctx: ctx}
+}
+
+// Start activates the task dispatcher
+// to execute enqueued tasks. Tasks persisted
+// by a previous execution will be dispatched too.
+func (t *DurableTasksManager) Start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			select {
+			case <-t.ticker.C:
+				t.dispatchTasks()
+			case <-t.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop disables the task dispatcher, waits for the
+// tasks in flight to finish and closes the task database.
+// Pending tasks remain in the database to be executed
+// on the next start.
+func (t *DurableTasksManager) Stop() {
+	close(t.quitCh)
+	t.ticker.Stop()
+	t.wg.Wait()
+
+	// the metrics may still read the database
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	t.db.Close()
+}
+
+// Add a non-persistent task to the task manager queue.
+// It will block until the task is read if the channel is full.
+func (t *DurableTasksManager) Add(task Task) error {
+	t.taskCh <- task
+	return nil
+}
+
+// Enqueue persists a new task to be built by the named factory
+// with the given batch. The task continues the trace carried
+// by the context.
+func (t *DurableTasksManager) Enqueue(ctx context.Context, factory string, b *protocol.BatchSnapshots) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(pendingTasksBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		r := &TaskRecord{
+			ID:          id,
+			Factory:     factory,
+			Batch:       b,
+			TraceParent: tracing.TraceParent(ctx),
+			CreatedAt:   now,
+			NextRun:     now,
+		}
+		return putRecord(bucket, r)
+	})
+}
+
+// Len returns the number of pending tasks, both
+// persisted and non-persistent ones.
+func (t *DurableTasksManager) Len() int {
+	return t.count(pendingTasksBucket) + len(t.taskCh)
+}
+
+// DeadTasks returns the tasks in the dead-letter queue.
+func (t *DurableTasksManager) DeadTasks() ([]*TaskRecord, error) {
+	records := make([]*TaskRecord, 0)
+	err := t.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadTasksBucket).ForEach(func(k, v []byte) error {
+			r := new(TaskRecord)
+			if err := r.Decode(v); err != nil {
+				return err
+			}
+			records = append(records, r)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Requeue moves a task from the dead-letter queue to the
+// pending queue, resetting its number of attempts.
+func (t *DurableTasksManager) Requeue(id uint64) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadTasksBucket)
+		v := dead.Get(taskKey(id))
+		if v == nil {
+			return fmt.Errorf("Task %d not found in the dead-letter queue", id)
+		}
+		r := new(TaskRecord)
+		if err := r.Decode(v); err != nil {
+			return err
+		}
+		r.Attempts = 0
+		r.NextRun = time.Now()
+		if err := dead.Delete(taskKey(id)); err != nil {
+			return err
+		}
+		return putRecord(tx.Bucket(pendingTasksBucket), r)
+	})
+}
+
+// DeadLetterHandler returns an http handler to list the
+// tasks in the dead-letter queue (GET) and to move them back
+// to the pending queue (POST with the task id as parameter).
+func (t *DurableTasksManager) DeadLetterHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			records, err := t.DeadTasks()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			out, err := json.Marshal(records)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(out)
+		case "POST":
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid task id", http.StatusBadRequest)
+				return
+			}
+			if err := t.Requeue(id); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Metrics returns the collectors of the task manager metrics.
+func (t *DurableTasksManager) Metrics() []prometheus.Collector {
+	return t.metrics.collectors()
+}
+
+// dispatchTasks executes up to maxTasks tasks,
+// non-persistent ones first, and then those persisted
+// tasks whose next execution time has come.
+func (t *DurableTasksManager) dispatchTasks() {
+	count := 0
+
+loop:
+	for count < t.maxTasks {
+		select {
+		case task := <-t.taskCh:
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				if err := task(); err != nil {
+					t.log.Infof("Task manager got an error from a task: %v", err)
+				}
+			}()
+			count++
+		default:
+			break loop
+		}
+	}
+
+	if count >= t.maxTasks {
+		return
+	}
+
+	records, err := t.due(time.Now(), t.maxTasks-count)
+	if err != nil {
+		t.log.Infof("Task manager is unable to read pending tasks: %v", err)
+		return
+	}
+
+	for _, r := range records {
+		t.wg.Add(1)
+		go func(r *TaskRecord) {
+			defer t.wg.Done()
+			t.run(r)
+		}(r)
+	}
+}
+
+// due returns up to limit pending tasks ready to be executed,
+// marking them as in flight.
+func (t *DurableTasksManager) due(now time.Time, limit int) ([]*TaskRecord, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	records := make([]*TaskRecord, 0)
+	err := t.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(pendingTasksBucket).Cursor()
+		for k, v := c.First(); k != nil && len(records) < limit; k, v = c.Next() {
+			r := new(TaskRecord)
+			if err := r.Decode(v); err != nil {
+				return err
+			}
+			if t.inflight[r.ID] || r.NextRun.After(now) {
+				continue
+			}
+			if _, ok := t.factories[r.Factory]; !ok {
+				continue
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range records {
+		t.inflight[r.ID] = true
+	}
+	return records, nil
+}
+
+// run builds the task of a record and executes it,
+// updating its state in the database.
+func (t *DurableTasksManager) run(r *TaskRecord) {
+	t.Lock()
+	entry := t.factories[r.Factory]
+	t.Unlock()
+
+	ctx := tracing.ContextWithTraceParent(entry.ctx, r.TraceParent)
+	ctx = context.WithValue(ctx, "batch", r.Batch)
+	ctx = context.WithValue(ctx, "attempts", r.Attempts)
+	task := entry.factory.New(ctx)
+	err := task()
+
+	t.Lock()
+	defer t.Unlock()
+	delete(t.inflight, r.ID)
+
+	if err == nil {
+		if err := t.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(pendingTasksBucket).Delete(taskKey(r.ID))
+		}); err != nil {
+			t.log.Infof("Task manager is unable to remove finished task %d: %v", r.ID, err)
+		}
+		return
+	}
+
+	t.log.Infof("Task manager got an error from task %d: %v", r.ID, err)
+
+	r.LastError = err.Error()
+	wait, retry := t.backoff.Next(r.Attempts)
+	r.Attempts++
+
+	if !retry || r.Attempts >= t.maxRetries {
+		t.log.Infof("Task %d failed %d times, moving it to the dead-letter queue", r.ID, r.Attempts)
+		t.metrics.DeadTotal.Inc()
+		if err := t.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(pendingTasksBucket).Delete(taskKey(r.ID)); err != nil {
+				return err
+			}
+			return putRecord(tx.Bucket(deadTasksBucket), r)
+		}); err != nil {
+			t.log.Infof("Task manager is unable to move task %d to the dead-letter queue: %v", r.ID, err)
+		}
+		return
+	}
+
+	t.metrics.RetriesTotal.Inc()
+	r.NextRun = time.Now().Add(wait)
+	if err := t.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx.Bucket(pendingTasksBucket), r)
+	}); err != nil {
+		t.log.Infof("Task manager is unable to reschedule task %d: %v", r.ID, err)
+	}
+}
+
+func (t *DurableTasksManager) count(bucket []byte) int {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return 0
+	}
+
+	var n int
+	_ = t.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func putRecord(b *bolt.Bucket, r *TaskRecord) error {
+	value, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	return b.Put(taskKey(r.ID), value)
+}
+
+// taskKey encodes task ids in big endian to
+// iterate them in insertion order.
+func taskKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// taskFactoryName returns the name used to register
+// a task factory in a PersistentTasksManager.
+func taskFactoryName(f TaskFactory) string {
+	return fmt.Sprintf("%T", f)
+}
+
+type durableTasksMetrics struct {
+	Pending      prometheus.GaugeFunc
+	Dead         prometheus.GaugeFunc
+	RetriesTotal prometheus.Counter
+	DeadTotal    prometheus.Counter
+}
+
+func newDurableTasksMetrics(t *DurableTasksManager) *durableTasksMetrics {
+	return &durableTasksMetrics{
+		Pending: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "qed_agent_tasks_pending",
+				Help: "Number of tasks pending of execution.",
+			},
+			func() float64 {
+				return float64(t.Len())
+			},
+		),
+		Dead: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "qed_agent_tasks_dead_letter",
+				Help: "Number of tasks in the dead-letter queue.",
+			},
+			func() float64 {
+				return float64(t.count(deadTasksBucket))
+			},
+		),
+		RetriesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_tasks_retries_total",
+				Help: "Number of task retries.",
+			},
+		),
+		DeadTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "qed_agent_tasks_dead_letter_total",
+				Help: "Number of tasks moved to the dead-letter queue.",
+			},
+		),
+	}
+}
+
+func (m *durableTasksMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.Pending,
+		m.Dead,
+		m.RetriesTotal,
+		m.DeadTotal,
+	}
+}
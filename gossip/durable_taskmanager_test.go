@@ -0,0 +1,219 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package gossip
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bbva/qed/client"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+type failingFactory struct {
+	executions *int32
+	failures   int32
+}
+
+func (f failingFactory) Metrics() []prometheus.Collector {
+	return nil
+}
+
+func (f failingFactory) New(ctx context.Context) Task {
+	b := ctx.Value("batch").(*protocol.BatchSnapshots)
+	return func() error {
+		if b == nil {
+			return errors.New("missing batch")
+		}
+		n := atomic.AddInt32(f.executions, 1)
+		if n <= f.failures {
+			return errors.New("failed task")
+		}
+		return nil
+	}
+}
+
+func newTestDurableTasksManager(t *testing.T, path string, retries int) *DurableTasksManager {
+	tm, err := NewDurableTasksManager(path, 10*time.Millisecond, 10, retries, client.NewConstantBackoff(10*time.Millisecond), nil)
+	require.NoError(t, err)
+	return tm
+}
+
+func TestDurableTasksManagerRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-tasks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var executions int32
+	tm := newTestDurableTasksManager(t, filepath.Join(dir, "tasks.db"), 5)
+	tm.RegisterFactory("f", failingFactory{&executions, 2}, context.Background())
+	tm.Start()
+
+	require.NoError(t, tm.Enqueue(context.Background(), "f", &protocol.BatchSnapshots{}))
+	require.Eventually(t, func() bool { return tm.Len() == 0 }, 2*time.Second, 10*time.Millisecond, "Pending tasks must be 0")
+	tm.Stop()
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&executions), "Executions must be 3")
+}
+
+func TestDurableTasksManagerDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-tasks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var executions int32
+	tm := newTestDurableTasksManager(t, filepath.Join(dir, "tasks.db"), 3)
+	tm.RegisterFactory("f", failingFactory{&executions, 10}, context.Background())
+	tm.Start()
+	defer tm.Stop()
+
+	require.NoError(t, tm.Enqueue(context.Background(), "f", &protocol.BatchSnapshots{}))
+	require.Eventually(t, func() bool { return tm.Len() == 0 }, 2*time.Second, 10*time.Millisecond, "Pending tasks must be 0")
+
+	dead, err := tm.DeadTasks()
+	require.NoError(t, err)
+	require.Len(t, dead, 1, "The dead-letter queue must contain the failed task")
+	require.Equal(t, 3, dead[0].Attempts, "The task must have been executed 3 times")
+	require.Equal(t, "failed task", dead[0].LastError)
+
+	srv := httptest.NewServer(tm.DeadLetterHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Post(srv.URL+"?id=1", "application/json", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	dead, err = tm.DeadTasks()
+	require.NoError(t, err)
+	require.Len(t, dead, 0, "The requeued task must leave the dead-letter queue")
+}
+
+func TestDurableTasksManagerRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-tasks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tasks.db")
+
+	tm := newTestDurableTasksManager(t, path, 5)
+	require.NoError(t, tm.Enqueue(context.Background(), "f", &protocol.BatchSnapshots{}))
+	require.NoError(t, tm.Enqueue(context.Background(), "f", &protocol.BatchSnapshots{}))
+	tm.Start()
+	tm.Stop()
+
+	var executions int32
+	tm = newTestDurableTasksManager(t, path, 5)
+	require.Equal(t, 2, tm.Len(), "Pending tasks must survive a restart")
+	tm.RegisterFactory("f", failingFactory{&executions, 0}, context.Background())
+	tm.Start()
+	require.Eventually(t, func() bool { return tm.Len() == 0 }, 2*time.Second, 10*time.Millisecond, "Pending tasks must be 0")
+	tm.Stop()
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&executions), "Executions must be 2")
+}
+
+type retriedFactory struct {
+	failingFactory
+	retried *int32
+}
+
+func (f retriedFactory) New(ctx context.Context) Task {
+	if Retried(ctx) {
+		atomic.AddInt32(f.retried, 1)
+	}
+	return f.failingFactory.New(ctx)
+}
+
+func TestDurableTasksManagerRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-tasks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var executions, retried int32
+	tm := newTestDurableTasksManager(t, filepath.Join(dir, "tasks.db"), 5)
+	tm.RegisterFactory("f", retriedFactory{failingFactory{&executions, 2}, &retried}, context.Background())
+	tm.Start()
+
+	require.NoError(t, tm.Enqueue(context.Background(), "f", &protocol.BatchSnapshots{}))
+	require.Eventually(t, func() bool { return tm.Len() == 0 }, 2*time.Second, 10*time.Millisecond, "Pending tasks must be 0")
+	tm.Stop()
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&executions), "Executions must be 3")
+	require.Equal(t, int32(2), atomic.LoadInt32(&retried), "Only the retries must be built as retried")
+}
+
+func TestDurableTasksManagerMetricsAfterStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-tasks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tm := newTestDurableTasksManager(t, filepath.Join(dir, "tasks.db"), 5)
+	tm.Start()
+	require.NoError(t, tm.Enqueue(context.Background(), "f", &protocol.BatchSnapshots{}))
+	tm.Stop()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(tm.Metrics()...)
+	_, err = registry.Gather()
+	require.NoError(t, err, "The metrics must be readable after stopping the task manager")
+	require.Equal(t, 0, tm.Len())
+}
+
+func TestDurableTasksManagerTraceParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-tasks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tasks.db")
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := tracing.ContextWithTraceParent(context.Background(), traceparent)
+
+	tm := newTestDurableTasksManager(t, path, 5)
+	require.NoError(t, tm.Enqueue(ctx, "f", &protocol.BatchSnapshots{}))
+	tm.Stop()
+
+	// the trace survives a restart of the agent
+	tf := contextTaskFactory{make(chan context.Context, 1)}
+	tm = newTestDurableTasksManager(t, path, 5)
+	tm.RegisterFactory("f", tf, context.Background())
+	tm.Start()
+	defer tm.Stop()
+
+	select {
+	case ctx = <-tf.ctxs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No task was created for the batch")
+	}
+	sc := tracing.SpanContextFromContext(ctx)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.NotNil(t, ctx.Value("batch"))
+}
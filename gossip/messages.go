@@ -32,7 +32,8 @@ const (
 type MessageType uint8
 
 const (
-	BatchMessageType MessageType = iota // Contains a protocol.BatchSnapshots
+	BatchMessageType     MessageType = iota // Contains a protocol.BatchSnapshots
+	AuditRootMessageType                    // Contains a protocol.SignedAuditRoot
 )
 
 // Gossip message code. Up to 255 different messages.
@@ -41,6 +42,9 @@ type Message struct {
 	From    *Peer
 	TTL     int
 	Payload []byte
+	// W3C traceparent of the operation that produced the message,
+	// so agents can continue its trace. Empty if it was not traced.
+	TraceParent string
 }
 
 /*
@@ -22,6 +22,7 @@ import (
 	"github.com/bbva/qed/crypto/hashing"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -74,6 +75,13 @@ func NewBatchProcessor(a *Agent, tf []TaskFactory, l log.Logger) *BatchProcessor
 		b.metrics = append(b.metrics, t.Metrics()...)
 	}
 
+	// persistent task managers build the tasks by themselves
+	if tm, ok := a.Tasks.(PersistentTasksManager); ok {
+		for _, t := range tf {
+			tm.RegisterFactory(taskFactoryName(t), t, b.ctx)
+		}
+	}
+
 	return b
 }
 
@@ -120,37 +128,147 @@ func (d *BatchProcessor) Subscribe(id int, ch <-chan *Message) {
 		for {
 			select {
 			case msg := <-ch:
-				// if the message is not a batch, ignore it
-				if msg.Kind != BatchMessageType {
-					d.log.Debug("BatchProcessor got an unknown message from agent")
-					continue
-				}
-
-				batch := new(protocol.BatchSnapshots)
-				err := batch.Decode(msg.Payload)
-				if err != nil {
-					d.log.Info("BatchProcessor unable to decode batch!. Dropping message.")
-					continue
-				}
-
-				if d.wasProcessed(batch) {
-					d.log.Debug("BatchProcessor got an already processed message from agent")
-					continue
-				}
-
-				ctx := context.WithValue(d.ctx, "batch", batch)
-				for _, t := range d.tf {
-					d.log.Debug("Batch processor creating a new task")
-					err := d.a.Tasks.Add(t.New(ctx))
-					if err != nil {
-						d.log.Infof("BatchProcessor was unable to enqueue new task becasue %v", err)
-					}
-				}
-
-				_ = d.a.Out.Publish(msg)
+				d.process(msg)
 			case <-d.quitCh:
 				return
 			}
 		}
 	}()
 }
+
+// process decodes a batch message and creates the tasks to handle it,
+// continuing the trace of the server that published the batch.
+func (d *BatchProcessor) process(msg *Message) {
+	// if the message is not a batch, ignore it
+	if msg.Kind != BatchMessageType {
+		d.log.Debug("BatchProcessor got an unknown message from agent")
+		return
+	}
+
+	ctx := tracing.ContextWithTraceParent(d.ctx, msg.TraceParent)
+	ctx, span := tracing.StartSpan(ctx, "gossip.process_batch")
+	defer span.End()
+	if d.a.Self != nil {
+		span.SetAttribute("gossip.agent", d.a.Self.Name)
+	}
+
+	batch := new(protocol.BatchSnapshots)
+	err := batch.Decode(msg.Payload)
+	if err != nil {
+		span.SetError(err)
+		d.log.Info("BatchProcessor unable to decode batch!. Dropping message.")
+		return
+	}
+	span.SetAttribute("gossip.snapshots", len(batch.Snapshots))
+
+	if d.wasProcessed(batch) {
+		span.SetAttribute("gossip.duplicated", true)
+		d.log.Debug("BatchProcessor got an already processed message from agent")
+		return
+	}
+
+	if tm, ok := d.a.Tasks.(PersistentTasksManager); ok {
+		for _, t := range d.tf {
+			d.log.Debug("Batch processor enqueuing a new persistent task")
+			err := tm.Enqueue(ctx, taskFactoryName(t), selectBatch(t, batch))
+			if err != nil {
+				d.log.Infof("BatchProcessor was unable to enqueue new task becasue %v", err)
+			}
+		}
+		_ = d.a.Out.Publish(msg)
+		return
+	}
+
+	for _, t := range d.tf {
+		d.log.Debug("Batch processor creating a new task")
+		err := d.a.Tasks.Add(t.New(context.WithValue(ctx, "batch", selectBatch(t, batch))))
+		if err != nil {
+			d.log.Infof("BatchProcessor was unable to enqueue new task becasue %v", err)
+		}
+	}
+
+	_ = d.a.Out.Publish(msg)
+}
+
+// selectBatch returns the part of the batch processed by the
+// task factory.
+func selectBatch(t TaskFactory, b *protocol.BatchSnapshots) *protocol.BatchSnapshots {
+	s, ok := t.(BatchSelector)
+	if !ok {
+		return b
+	}
+	return &protocol.BatchSnapshots{Snapshots: s.Select(b)}
+}
+
+// AuditRootProcessor reads the signed audit roots published by the QED
+// servers, stores them in the snapshot store of the agent, if any, and
+// forwards them to the rest of the gossip network.
+type AuditRootProcessor struct {
+	a      *Agent
+	quitCh chan bool
+	log    log.Logger
+}
+
+func NewAuditRootProcessor(a *Agent, l log.Logger) *AuditRootProcessor {
+	logger := l
+	if logger == nil {
+		logger = log.L()
+	}
+	return &AuditRootProcessor{
+		a:      a,
+		quitCh: make(chan bool),
+		log:    logger,
+	}
+}
+
+func (p *AuditRootProcessor) Stop() {
+	close(p.quitCh)
+}
+
+func (p *AuditRootProcessor) Metrics() []prometheus.Collector {
+	return nil
+}
+
+func (p *AuditRootProcessor) Subscribe(id int, ch <-chan *Message) {
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				p.process(msg)
+			case <-p.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// process stores the audit root of the message the first time it is
+// received, and forwards the message.
+func (p *AuditRootProcessor) process(msg *Message) {
+	if msg.Kind != AuditRootMessageType {
+		p.log.Debug("AuditRootProcessor got an unknown message from agent")
+		return
+	}
+
+	root := new(protocol.SignedAuditRoot)
+	if err := root.Decode(msg.Payload); err != nil || root.Root == nil {
+		p.log.Info("AuditRootProcessor unable to decode audit root!. Dropping message.")
+		return
+	}
+
+	if p.a.Cache != nil {
+		if _, err := p.a.Cache.Get(root.Signature); err == nil {
+			p.log.Debug("AuditRootProcessor got an already processed message from agent")
+			return
+		}
+		_ = p.a.Cache.Set(root.Signature, []byte{0x1}, 0)
+	}
+
+	if p.a.SnapshotStore != nil {
+		if err := p.a.SnapshotStore.PutAuditRoot(root); err != nil {
+			p.log.Infof("AuditRootProcessor unable to store the audit root of version %d: %v", root.Root.Version, err)
+		}
+	}
+
+	_ = p.a.Out.Publish(msg)
+}
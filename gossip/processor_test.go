@@ -18,15 +18,20 @@ package gossip
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 )
@@ -110,6 +115,53 @@ func TestBatchProcessorWasProcessed(t *testing.T) {
 	require.Equal(t, 1, len(ts.ch), "Output queue must be 1, duplicate event must be dropped by processor")
 }
 
+type fakeAuditRootStore struct {
+	SnapshotStore
+	roots chan *protocol.SignedAuditRoot
+}
+
+func (s fakeAuditRootStore) PutAuditRoot(root *protocol.SignedAuditRoot) error {
+	s.roots <- root
+	return nil
+}
+
+func TestAuditRootProcessor(t *testing.T) {
+	ts := &testSubscriber{}
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "publisher"
+	conf.BindAddr = "127.0.0.1:12345"
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	store := fakeAuditRootStore{roots: make(chan *protocol.SignedAuditRoot, 5)}
+	a.SnapshotStore = store
+
+	p := NewAuditRootProcessor(a, log.L())
+	a.In.Subscribe(AuditRootMessageType, p, 0)
+	defer p.Stop()
+
+	a.Out.Subscribe(AuditRootMessageType, ts, 5)
+	root := &protocol.SignedAuditRoot{Root: &protocol.AuditRoot{Version: 3}, Signature: []byte{0x1}}
+	buf, _ := root.Encode()
+	m1 := &Message{
+		Kind:    AuditRootMessageType,
+		TTL:     1,
+		Payload: buf,
+	}
+
+	_ = a.In.Publish(m1)
+	_ = a.In.Publish(m1)
+	// give time for the scheduler to route all the messages
+	time.Sleep(1 * time.Second)
+
+	// the duplicated root is neither stored nor forwarded again
+	require.Equal(t, 1, len(store.roots), "The audit root must be stored once")
+	require.Equal(t, root, <-store.roots)
+	require.Equal(t, 1, len(ts.ch), "The audit root must be forwarded once")
+}
+
 type fakeTaskFactory struct{}
 
 func (f fakeTaskFactory) Metrics() []prometheus.Collector {
@@ -154,3 +206,143 @@ func TestBatchProcessorRegisterMetrics(t *testing.T) {
 
 	require.True(t, found > 0, "Metric not found!")
 }
+
+type contextTaskFactory struct {
+	ctxs chan context.Context
+}
+
+func (f contextTaskFactory) Metrics() []prometheus.Collector {
+	return nil
+}
+
+func (f contextTaskFactory) New(c context.Context) Task {
+	f.ctxs <- c
+	return func() error {
+		return nil
+	}
+}
+
+func TestBatchProcessorTraceContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip-tracing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exporter, err := tracing.NewFileExporter(dir + "/spans.json")
+	require.NoError(t, err)
+	tracer := tracing.NewTracer(exporter, nil)
+	tracing.SetTracer(tracer)
+	defer tracing.SetTracer(nil)
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "auditor"
+	conf.BindAddr = "127.0.0.1:12345"
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	a.Tasks = NewSimpleTasksManager(100*time.Millisecond, 10)
+
+	tf := contextTaskFactory{make(chan context.Context, 1)}
+	p := NewBatchProcessor(a, []TaskFactory{tf}, log.L())
+	a.In.Subscribe(BatchMessageType, p, 1)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	batch := &protocol.BatchSnapshots{}
+	buf, _ := batch.Encode()
+	_ = a.In.Publish(&Message{
+		Kind:        BatchMessageType,
+		Payload:     buf,
+		TraceParent: traceparent,
+	})
+
+	var ctx context.Context
+	select {
+	case ctx = <-tf.ctxs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No task was created for the batch")
+	}
+	// tasks continue the trace of the server
+	sc := tracing.SpanContextFromContext(ctx)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.NotNil(t, ctx.Value("batch"))
+
+	p.Stop()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, tracer.Close())
+	spans, err := tracing.ReadSpans(dir + "/spans.json")
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	require.Equal(t, "gossip.process_batch", spans[0].Name)
+	require.Equal(t, "00f067aa0ba902b7", spans[0].ParentSpanID)
+	require.Equal(t, sc.SpanID.String(), spans[0].SpanID)
+}
+
+// samplingTaskFactory selects a different snapshot on every call
+// and fails the first attempt of its tasks.
+type samplingTaskFactory struct {
+	selections *int32
+	batches    chan *protocol.BatchSnapshots
+}
+
+func (f samplingTaskFactory) Metrics() []prometheus.Collector {
+	return nil
+}
+
+func (f samplingTaskFactory) Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot {
+	n := atomic.AddInt32(f.selections, 1)
+	return b.Snapshots[n-1 : n]
+}
+
+func (f samplingTaskFactory) New(ctx context.Context) Task {
+	b := ctx.Value("batch").(*protocol.BatchSnapshots)
+	f.batches <- b
+	return func() error {
+		if !Retried(ctx) {
+			return errors.New("failed task")
+		}
+		return nil
+	}
+}
+
+func TestBatchProcessorSelectOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip-select")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := DefaultConfig()
+	conf.NodeName = "testNode"
+	conf.Role = "auditor"
+	conf.BindAddr = "127.0.0.1:12345"
+
+	a, err := NewAgentFromConfig(conf)
+	require.NoError(t, err, "Error creating agent!")
+	tm := newTestDurableTasksManager(t, filepath.Join(dir, "tasks.db"), 5)
+	a.Tasks = tm
+
+	var selections int32
+	tf := samplingTaskFactory{&selections, make(chan *protocol.BatchSnapshots, 2)}
+	p := NewBatchProcessor(a, []TaskFactory{tf}, log.L())
+	a.In.Subscribe(BatchMessageType, p, 1)
+	tm.Start()
+	defer tm.Stop()
+
+	batch := &protocol.BatchSnapshots{Snapshots: []*protocol.SignedSnapshot{
+		{Snapshot: &protocol.Snapshot{Version: 0}},
+		{Snapshot: &protocol.Snapshot{Version: 1}},
+	}}
+	buf, _ := batch.Encode()
+	_ = a.In.Publish(&Message{Kind: BatchMessageType, Payload: buf})
+
+	// the retry works with the selection persisted with the task
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-tf.batches:
+			require.Len(t, b.Snapshots, 1, "Wrong selection in attempt %d", i)
+			require.Equal(t, uint64(0), b.Snapshots[0].Snapshot.Version, "Wrong selection in attempt %d", i)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No task was built in attempt %d", i)
+		}
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&selections), "The batch must be selected once")
+	p.Stop()
+}
@@ -24,6 +24,8 @@ type SnapshotStore interface {
 	GetSnapshot(version uint64) (*protocol.SignedSnapshot, error)
 	DeleteRange(start, end uint64) error
 	Count() (uint64, error)
+	PutAuditRoot(root *protocol.SignedAuditRoot) error
+	GetAuditRoot(version uint64) (*protocol.SignedAuditRoot, error)
 }
 
 // RestSnapshotStore implements access to a snapshot store
@@ -139,6 +141,61 @@ func (r *RestSnapshotStore) GetSnapshot(version uint64) (*protocol.SignedSnapsho
 	return &s, nil
 }
 
+// Stores a signed audit root in the store
+func (r *RestSnapshotStore) PutAuditRoot(root *protocol.SignedAuditRoot) error {
+	buf, err := root.Encode()
+	if err != nil {
+		return err
+	}
+	n := len(r.endpoint)
+	if n == 0 {
+		return fmt.Errorf("No endpoint configured for snapshot store!")
+	}
+	url := r.endpoint[0]
+	if n > 1 {
+		url = r.endpoint[rand.Intn(n)]
+	}
+	resp, err := r.client.Post(url+"/audit/root", "application/json", bytes.NewBuffer(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error storing the audit root in the store. Status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *RestSnapshotStore) GetAuditRoot(version uint64) (*protocol.SignedAuditRoot, error) {
+	n := len(r.endpoint)
+	url := r.endpoint[0]
+	if n > 1 {
+		url = r.endpoint[rand.Intn(n)]
+	}
+	resp, err := r.client.Get(fmt.Sprintf("%s/audit/root?v=%d", url, version))
+	if err != nil {
+		return nil, fmt.Errorf("Error getting audit root %d from store because %v", version, err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error getting audit root from the store. Status: %d", resp.StatusCode)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var root protocol.SignedAuditRoot
+	if err := root.Decode(buf); err != nil {
+		return nil, fmt.Errorf("Error decoding signed audit root %d: %v", version, err)
+	}
+	return &root, nil
+}
+
 func (r *RestSnapshotStore) DeleteRange(start uint64, end uint64) error {
 	panic("not implemented")
 }
@@ -56,6 +56,24 @@ type TaskFactory interface {
 	Metrics() []prometheus.Collector
 }
 
+// BatchSelector is implemented by task factories that only
+// process part of each batch. The processor selects the snapshots
+// once, before building or enqueuing the task, so persistent task
+// managers keep the selection and every retry of the task works
+// with the same snapshots.
+type BatchSelector interface {
+	Select(b *protocol.BatchSnapshots) []*protocol.SignedSnapshot
+}
+
+// Retried returns whether a task factory is building again the task of
+// a batch whose previous attempt failed. Persistent task managers build
+// the task again on every retry, so factories must not count the
+// batch as received more than once.
+func Retried(ctx context.Context) bool {
+	attempts, _ := ctx.Value("attempts").(int)
+	return attempts > 0
+}
+
 // TasksManager executes enqueued tasks, It is in charge
 // of applying limits to task execution such as timeouts.
 // It only has an API to stop and start the tasks execution
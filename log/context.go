@@ -0,0 +1,67 @@
+package log
+
+import "context"
+
+// RequestIDKey is the field name used to log the identifier of the
+// request being served.
+const RequestIDKey = "request_id"
+
+type contextKey int
+
+const fieldsKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying the given key/value pairs
+// along with those already stored in it, so any logger obtained with
+// FromContext adds them to its messages.
+func NewContext(ctx context.Context, args ...interface{}) context.Context {
+	if len(args) == 0 {
+		return ctx
+	}
+	if len(args)%2 != 0 {
+		args = append([]interface{}{missingKey}, args...)
+	}
+	parent := contextFields(ctx)
+	fields := make([]interface{}, 0, len(parent)+len(args))
+	fields = append(fields, parent...)
+	fields = append(fields, args...)
+	return context.WithValue(ctx, fieldsKey, fields)
+}
+
+// FromContext returns a logger adding the fields stored in ctx to all
+// the messages emitted by the given one.
+func FromContext(ctx context.Context, logger Logger) Logger {
+	fields := contextFields(ctx)
+	if len(fields) == 0 {
+		return logger
+	}
+	return logger.With(fields...)
+}
+
+// ContextWithRequestID returns a copy of ctx carrying the given
+// request identifier as a logging field.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return NewContext(ctx, RequestIDKey, id)
+}
+
+// RequestID returns the request identifier stored in ctx, if any.
+func RequestID(ctx context.Context) string {
+	fields := contextFields(ctx)
+	for i := len(fields) - 2; i >= 0; i -= 2 {
+		if key, ok := fields[i].(string); ok && key == RequestIDKey {
+			id, _ := fields[i+1].(string)
+			return id
+		}
+	}
+	return ""
+}
+
+func contextFields(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsKey).([]interface{})
+	return fields
+}
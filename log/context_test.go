@@ -0,0 +1,35 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextFields(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	logger := New(&LoggerOptions{
+		Output: &buf,
+		Level:  Info,
+	})
+
+	ctx := context.Background()
+	require.Equal(t, logger, FromContext(ctx, logger))
+	require.Equal(t, "", RequestID(ctx))
+
+	ctx = ContextWithRequestID(ctx, "abc")
+	ctx = NewContext(ctx, "key", "value")
+	require.Equal(t, "abc", RequestID(ctx))
+
+	FromContext(ctx, logger).Info("this is a test")
+
+	str := buf.String()
+	str = str[strings.IndexByte(str, ' ')+1:]
+	require.Equal(t, "[INFO]  this is a test request_id=abc key=value\n", str)
+
+}
@@ -1,8 +1,6 @@
 package log
 
 import (
-	"bytes"
-	"fmt"
 	"io"
 	"log"
 
@@ -23,83 +21,57 @@ func NewHclogAdapter(log Logger) *HclogAdapter {
 
 // Trace implementation
 func (l HclogAdapter) Trace(msg string, args ...interface{}) {
-	if len(args) > 0 {
-		l.log.Tracef("%s: %v", msg, argsToString(args...))
-	} else {
-		l.log.Trace(msg)
-	}
+	l.log.With(args...).Trace(msg)
 }
 
 // Debug implementation
 func (l HclogAdapter) Debug(msg string, args ...interface{}) {
-	if len(args) > 0 {
-		l.log.Debugf("%s: %v", msg, argsToString(args...))
-	} else {
-		l.log.Debug(msg)
-	}
+	l.log.With(args...).Debug(msg)
 }
 
 // Info implementation
 func (l HclogAdapter) Info(msg string, args ...interface{}) {
-	if len(args) > 0 {
-		l.log.Infof("%s: %v", msg, argsToString(args...))
-	} else {
-		l.log.Info(msg)
-	}
+	l.log.With(args...).Info(msg)
 }
 
 // Warn implementation
 func (l HclogAdapter) Warn(msg string, args ...interface{}) {
-	if len(args) > 0 {
-		l.log.Warnf("%s: %v", msg, argsToString(args...))
-	} else {
-		l.log.Warn(msg)
-	}
+	l.log.With(args...).Warn(msg)
 }
 
 // Error implementation
 func (l HclogAdapter) Error(msg string, args ...interface{}) {
-	if len(args) > 0 {
-		l.log.Errorf("%s: %v", msg, argsToString(args...))
-	} else {
-		l.log.Error(msg)
-	}
+	l.log.With(args...).Error(msg)
 }
 
 // IsTrace implementation.
 func (l HclogAdapter) IsTrace() bool {
-	_, ok := l.log.(*traceLogger)
-	return ok
+	return l.log.Level() >= Trace
 }
 
 // IsDebug implementation.
 func (l HclogAdapter) IsDebug() bool {
-	_, ok := l.log.(*debugLogger)
-	return ok
+	return l.log.Level() >= Debug
 }
 
 // IsInfo implementation.
 func (l HclogAdapter) IsInfo() bool {
-	_, ok := l.log.(*infoLogger)
-	return ok
+	return l.log.Level() >= Info
 }
 
 // IsWarn implementation.
 func (l HclogAdapter) IsWarn() bool {
-	_, ok := l.log.(*warnLogger)
-	return ok
+	return l.log.Level() >= Warn
 }
 
 // IsError implementation.
 func (l HclogAdapter) IsError() bool {
-	_, ok := l.log.(*errorLogger)
-	return ok
+	return l.log.Level() >= Error
 }
 
 // With implementation.
 func (l HclogAdapter) With(args ...interface{}) hclog.Logger {
-	// no need to implement that as Raft doesn't use this method.
-	return l
+	return HclogAdapter{log: l.log.With(args...)}
 }
 
 // Named implementation.
@@ -114,14 +86,14 @@ func (l HclogAdapter) ResetNamed(name string) hclog.Logger {
 
 // SetLevel implementation.
 func (l HclogAdapter) SetLevel(level hclog.Level) {
-	l.log = l.log.WithLevel(Level(level))
+	l.log.SetLevel(fromHclogLevel(level))
 }
 
 // StandardLogger implementation.
 func (l HclogAdapter) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Logger {
 	return l.log.StdLogger(&StdLoggerOptions{
 		InferLevels: opts.InferLevels,
-		ForceLevel:  Level(opts.ForceLevel),
+		ForceLevel:  fromHclogLevel(opts.ForceLevel),
 	})
 }
 
@@ -129,14 +101,23 @@ func (l HclogAdapter) StandardLogger(opts *hclog.StandardLoggerOptions) *log.Log
 func (l HclogAdapter) StandardWriter(opts *hclog.StandardLoggerOptions) io.Writer {
 	return l.log.StdWriter(&StdLoggerOptions{
 		InferLevels: opts.InferLevels,
-		ForceLevel:  Level(opts.ForceLevel),
+		ForceLevel:  fromHclogLevel(opts.ForceLevel),
 	})
 }
 
-func argsToString(args ...interface{}) string {
-	buf := bytes.Buffer{}
-	for i := 0; i < len(args); i += 2 {
-		buf.WriteString(fmt.Sprintf("%v=%v", args[i], args[i+1]))
+func fromHclogLevel(level hclog.Level) Level {
+	switch level {
+	case hclog.Trace:
+		return Trace
+	case hclog.Debug:
+		return Debug
+	case hclog.Info:
+		return Info
+	case hclog.Warn:
+		return Warn
+	case hclog.Error:
+		return Error
+	default:
+		return NotSet
 	}
-	return buf.String()
 }
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHclog2LoggerImplementsInterfaces(t *testing.T) {
@@ -12,3 +15,32 @@ func TestHclog2LoggerImplementsInterfaces(t *testing.T) {
 		t.Fatalf("logger does not implement hclog.Logger")
 	}
 }
+
+func TestHclogAdapter(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	adapter := NewHclogAdapter(New(&LoggerOptions{
+		Name:   "raft",
+		Output: &buf,
+		Level:  Info,
+	}))
+
+	adapter.Info("entering follower state", "node", "node0", "leader", "")
+	str := buf.String()
+	str = str[strings.IndexByte(str, ' ')+1:]
+	require.Equal(t, "[INFO]  raft: entering follower state node=node0 leader=\"\"\n", str)
+
+	require.True(t, adapter.IsInfo())
+	require.False(t, adapter.IsDebug())
+
+	adapter.SetLevel(hclog.Debug)
+	require.True(t, adapter.IsDebug())
+
+	buf.Reset()
+	adapter.With("peer", "node1").Debug("heartbeat")
+	str = buf.String()
+	str = str[strings.IndexByte(str, ' ')+1:]
+	require.Equal(t, "[DEBUG] raft: heartbeat peer=node1\n", str)
+
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,11 +25,23 @@ var (
 	}
 )
 
+// jsonTimeFormat is the time format of the JSON output, which does not
+// follow the configured one so log collectors can parse it.
+const jsonTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// missingKey names the value given to With without a key.
+const missingKey = "EXTRA_VALUE_AT_END"
+
 type internalLogger struct {
 	name       string
 	caller     bool
 	timeFormat string
-	level      Level
+	json       bool
+	fields     []interface{}
+
+	// This is a pointer so that it's shared by any derived loggers, which
+	// change their level along with this one.
+	level *int32
 
 	// This is a pointer so that it's shared by any derived loggers, since
 	// those derived loggers share the bufio.Writer as well.
@@ -35,40 +49,55 @@ type internalLogger struct {
 	writer *writer
 }
 
+// clone returns a logger sharing the level and the output of this one.
+func (l *internalLogger) clone() *internalLogger {
+	c := *l
+	return &c
+}
+
 func (l *internalLogger) Named(name string) Logger {
-	newName := l.name
-	if newName != "" {
-		newName = newName + "." + name
+	c := l.clone()
+	if c.name != "" {
+		c.name = c.name + "." + name
 	} else {
-		newName = name
+		c.name = name
 	}
-	return New(&LoggerOptions{
-		Name:            newName,
-		Level:           l.level,
-		Output:          l.writer.out,
-		TimeFormat:      l.timeFormat,
-		IncludeLocation: l.caller,
-	})
+	return c
 }
 
 func (l *internalLogger) ResetNamed(name string) Logger {
-	return New(&LoggerOptions{
-		Name:            name,
-		Level:           l.level,
-		Output:          l.writer.out,
-		TimeFormat:      l.timeFormat,
-		IncludeLocation: l.caller,
-	})
+	c := l.clone()
+	c.name = name
+	return c
+}
+
+func (l *internalLogger) With(args ...interface{}) Logger {
+	if len(args) == 0 {
+		return l
+	}
+	if len(args)%2 != 0 {
+		args = append([]interface{}{missingKey}, args...)
+	}
+	c := l.clone()
+	c.fields = make([]interface{}, 0, len(l.fields)+len(args))
+	c.fields = append(c.fields, l.fields...)
+	c.fields = append(c.fields, args...)
+	return c
 }
 
 func (l *internalLogger) WithLevel(level Level) Logger {
-	return New(&LoggerOptions{
-		Name:            l.name,
-		Level:           level,
-		Output:          l.writer.out,
-		TimeFormat:      l.timeFormat,
-		IncludeLocation: l.caller,
-	})
+	c := l.clone()
+	lvl := int32(normalizeLevel(level))
+	c.level = &lvl
+	return c
+}
+
+func (l *internalLogger) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+func (l *internalLogger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(normalizeLevel(level)))
 }
 
 func (l *internalLogger) StdLogger(opts *StdLoggerOptions) *log.Logger {
@@ -79,38 +108,55 @@ func (l *internalLogger) StdLogger(opts *StdLoggerOptions) *log.Logger {
 }
 
 func (l *internalLogger) StdWriter(opts *StdLoggerOptions) io.Writer {
-	logger := New(&LoggerOptions{
-		Name:            l.name,
-		Level:           l.level,
-		Output:          l.writer.out,
-		TimeFormat:      l.timeFormat,
-		IncludeLocation: l.caller,
-	})
 	return &stdLogAdapter{
-		log:         logger,
+		log:         l.clone(),
 		inferLevels: opts.InferLevels,
 		forceLevel:  opts.ForceLevel,
 	}
 }
 
-func (l *internalLogger) log(level Level, msg string) {
-	tm := time.Now()
-
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-
-	l.logPlain(tm, level, msg) // TODO we can extend it to logJSON
+// enabled reports whether messages of the given level are emitted.
+func (l *internalLogger) enabled(level Level) bool {
+	current := l.Level()
+	return current != Off && level <= current
+}
 
+func (l *internalLogger) log(level Level, msg string) {
+	if !l.enabled(level) {
+		return
+	}
+	l.write(time.Now(), level, msg)
 }
 
 func (l *internalLogger) logf(level Level, format string, args ...interface{}) {
-	tm := time.Now()
+	if !l.enabled(level) {
+		return
+	}
+	l.write(time.Now(), level, fmt.Sprintf(format, args...))
+}
 
+// write must be called from log or logf, so the location of the caller
+// is always at the same depth of the stack.
+func (l *internalLogger) write(tm time.Time, level Level, msg string) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	l.logPlain(tm, level, fmt.Sprintf(format, args...)) // TODO we can extend it to logJSON
+	if l.json {
+		l.logJSON(tm, level, msg)
+	} else {
+		l.logPlain(tm, level, msg)
+	}
+}
 
+func (l *internalLogger) location() (string, bool) {
+	if !l.caller {
+		return "", false
+	}
+	_, file, line, ok := runtime.Caller(5)
+	if !ok {
+		return "", false
+	}
+	return trimCallerPath(file) + ":" + strconv.Itoa(line), true
 }
 
 func (l *internalLogger) logPlain(tm time.Time, level Level, msg string) {
@@ -123,14 +169,10 @@ func (l *internalLogger) logPlain(tm time.Time, level Level, msg string) {
 	l.writer.WriteString(levelToBracket(level))
 
 	// caller
-	if l.caller {
-		if _, file, line, ok := runtime.Caller(4); ok {
-			l.writer.WriteByte(' ')
-			l.writer.WriteString(trimCallerPath(file))
-			l.writer.WriteByte(':')
-			l.writer.WriteString(strconv.Itoa(line))
-			l.writer.WriteByte(':')
-		}
+	if location, ok := l.location(); ok {
+		l.writer.WriteByte(' ')
+		l.writer.WriteString(location)
+		l.writer.WriteByte(':')
 	}
 
 	// name
@@ -143,10 +185,75 @@ func (l *internalLogger) logPlain(tm time.Time, level Level, msg string) {
 	// msg
 	l.writer.WriteString(msg)
 
+	// fields
+	for i := 0; i < len(l.fields); i += 2 {
+		l.writer.WriteByte(' ')
+		l.writer.WriteString(fmt.Sprint(l.fields[i]))
+		l.writer.WriteByte('=')
+		l.writer.WriteString(plainValue(l.fields[i+1]))
+	}
+
 	l.writer.WriteString("\n")
 	l.writer.Flush()
 }
 
+func (l *internalLogger) logJSON(tm time.Time, level Level, msg string) {
+	entry := make(map[string]interface{}, len(l.fields)/2+5)
+	for i := 0; i < len(l.fields); i += 2 {
+		entry[fmt.Sprint(l.fields[i])] = jsonValue(l.fields[i+1])
+	}
+	entry["@timestamp"] = tm.Format(jsonTimeFormat)
+	entry["@level"] = level.String()
+	entry["@message"] = msg
+	if l.name != "" {
+		entry["@module"] = l.name
+	}
+	if location, ok := l.location(); ok {
+		entry["@caller"] = location
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// some value cannot be encoded, fall back to its string representation
+		for k, v := range entry {
+			entry[k] = fmt.Sprint(v)
+		}
+		line, _ = json.Marshal(entry)
+	}
+	l.writer.Write(line)
+	l.writer.WriteString("\n")
+	l.writer.Flush()
+}
+
+func plainValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
 func trimCallerPath(path string) string {
 	// cleanups a path by returning only the last 2 segments of the path.
 
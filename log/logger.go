@@ -147,9 +147,22 @@ type Logger interface {
 	// messages. It overrides any previously set name.
 	ResetNamed(name string) Logger
 
+	// With creates a logger that will add the given key/value pairs
+	// to all messages. Keys are expected to be strings.
+	With(args ...interface{}) Logger
+
 	// WithLevel creates a logger with the given level changed.
+	// Unlike the loggers returned by Named, ResetNamed and With,
+	// it does not share the level with its parent.
 	WithLevel(level Level) Logger
 
+	// Level returns the current threshold of the logger.
+	Level() Level
+
+	// SetLevel changes the threshold of the logger and of all the
+	// loggers derived from it, which is safe to do while logging.
+	SetLevel(level Level)
+
 	// StdLogger returns a logger implementation that conforms to the
 	// stdlib log.Logger interface. This allows packages that expect
 	// to be using the standard library log to actually use this logger.
@@ -160,6 +173,14 @@ type Logger interface {
 	StdWriter(opts *StdLoggerOptions) io.Writer
 }
 
+const (
+	// TextFormat writes each message as a human readable line.
+	TextFormat = "text"
+
+	// JSONFormat writes each message as a JSON object per line.
+	JSONFormat = "json"
+)
+
 // LoggerOptions can be used to configure a new logger.
 type LoggerOptions struct {
 	// Name of the subsystem to prefix logs with.
@@ -176,6 +197,10 @@ type LoggerOptions struct {
 	// TimeFormat is the time format to use instead of the default one.
 	TimeFormat string
 
+	// Format is the output format, either TextFormat or JSONFormat.
+	// If empty, defaults to TextFormat.
+	Format string
+
 	// IncludeLocation includes file and line information in each log line.
 	IncludeLocation bool
 
@@ -210,10 +235,7 @@ func New(opts *LoggerOptions) Logger {
 		output = DefaultOutput
 	}
 
-	level := opts.Level
-	if level == NotSet {
-		level = DefaultLevel
-	}
+	level := normalizeLevel(opts.Level)
 
 	mutex := opts.Mutex
 	if mutex == nil {
@@ -225,34 +247,28 @@ func New(opts *LoggerOptions) Logger {
 		timeFormat = DefaultTimeFormat
 	}
 
-	intLogger := internalLogger{
+	lvl := int32(level)
+
+	return &internalLogger{
 		name:       opts.Name,
 		caller:     opts.IncludeLocation,
-		timeFormat: opts.TimeFormat,
-		level:      opts.Level,
+		timeFormat: timeFormat,
+		json:       strings.ToLower(opts.Format) == JSONFormat,
+		level:      &lvl,
 		mutex:      mutex,
 		writer:     newWriter(output),
 	}
+}
 
-	var l Logger
-	switch level {
-	case Off:
-		l = &silentLogger{intLogger}
-	case Fatal:
-		l = &fatalLogger{intLogger}
-	case Error:
-		l = &errorLogger{intLogger}
-	case Warn:
-		l = &warnLogger{intLogger}
-	case Info:
-		l = &infoLogger{intLogger}
-	case Debug:
-		l = &debugLogger{intLogger}
-	case Trace:
-		l = &traceLogger{intLogger}
+// normalizeLevel replaces an unset level with the default one
+// and any unknown level with Info.
+func normalizeLevel(level Level) Level {
+	switch {
+	case level == NotSet:
+		return DefaultLevel
+	case level > Trace:
+		return Info
 	default:
-		l = &infoLogger{intLogger}
+		return level
 	}
-
-	return l
 }
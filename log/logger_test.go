@@ -2,6 +2,8 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -101,7 +103,7 @@ func TestLogger(t *testing.T) {
 		str = str[strings.IndexByte(str, ' ')+1:]
 
 		// This test will break if you move this around, it's line dependent
-		require.Equal(t, "[INFO]  log/logger_test.go:98: test: this is a test\n", str)
+		require.Equal(t, "[INFO]  log/logger_test.go:100: test: this is a test\n", str)
 
 	})
 
@@ -148,4 +150,91 @@ func TestLogger(t *testing.T) {
 
 	})
 
+	t.Run("adds the fields given to With", func(t *testing.T) {
+
+		var buf bytes.Buffer
+
+		logger := New(&LoggerOptions{
+			Name:   "test",
+			Output: &buf,
+			Level:  Info,
+		})
+
+		logger.With("key", "value", "number", 1).With("quoted", "a value").Info("this is a test")
+
+		str := buf.String()
+		str = str[strings.IndexByte(str, ' ')+1:]
+
+		require.Equal(t, "[INFO]  test: this is a test key=value number=1 quoted=\"a value\"\n", str)
+
+		buf.Reset()
+		logger.With("lonely").Info("this is a test")
+
+		str = buf.String()
+		str = str[strings.IndexByte(str, ' ')+1:]
+
+		require.Equal(t, "[INFO]  test: this is a test EXTRA_VALUE_AT_END=lonely\n", str)
+
+	})
+
+	t.Run("writes json", func(t *testing.T) {
+
+		var buf bytes.Buffer
+
+		logger := New(&LoggerOptions{
+			Name:            "test",
+			Output:          &buf,
+			Level:           Info,
+			Format:          JSONFormat,
+			IncludeLocation: true,
+		})
+
+		logger.With("key", "value", "err", errors.New("failure")).Infof("this is a %s", "test")
+
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		require.Equal(t, "info", entry["@level"])
+		require.Equal(t, "test", entry["@module"])
+		require.Equal(t, "this is a test", entry["@message"])
+		require.Equal(t, "value", entry["key"])
+		require.Equal(t, "failure", entry["err"])
+		require.Contains(t, entry["@caller"], "log/logger_test.go:")
+		_, err := time.Parse(time.RFC3339, entry["@timestamp"].(string))
+		require.NoError(t, err)
+
+	})
+
+	t.Run("shares the level with derived loggers", func(t *testing.T) {
+
+		var buf bytes.Buffer
+
+		logger := New(&LoggerOptions{
+			Output: &buf,
+			Level:  Error,
+		})
+		derived := logger.Named("sublogger").With("key", "value")
+		independent := logger.WithLevel(Error)
+
+		derived.Info("this is a test")
+		require.Equal(t, "", buf.String())
+
+		logger.SetLevel(Debug)
+		require.Equal(t, Debug, derived.Level())
+		require.Equal(t, Error, independent.Level())
+
+		derived.Debug("this is a test")
+		str := buf.String()
+		str = str[strings.IndexByte(str, ' ')+1:]
+		require.Equal(t, "[DEBUG] sublogger: this is a test key=value\n", str)
+
+		buf.Reset()
+		independent.Info("this is a test")
+		require.Equal(t, "", buf.String())
+
+		logger.SetLevel(Off)
+		derived.Error("this is a test")
+		require.Equal(t, "", buf.String())
+
+	})
+
 }
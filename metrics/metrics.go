@@ -42,6 +42,7 @@ type Registerer interface {
 // which provides access to the registered metrics.
 type Server struct {
 	server   *http.Server
+	mux      *http.ServeMux
 	registry *prometheus.Registry
 
 	log log.Logger
@@ -51,11 +52,13 @@ type Server struct {
 // the server is started.
 func NewServer(addr string) *Server {
 	r := prometheus.NewRegistry()
+	mux := metricshttp.NewMetricsHTTP(r)
 	return &Server{
 		server: &http.Server{
 			Addr:    addr,
-			Handler: metricshttp.NewMetricsHTTP(r),
+			Handler: mux,
 		},
+		mux:      mux,
 		registry: r,
 	}
 }
@@ -73,6 +76,12 @@ func (m Server) Shutdown() {
 	m.server.Shutdown(ctx)
 }
 
+// Handle registers an additional http handler for the given pattern
+// in the metrics server.
+func (m Server) Handle(pattern string, handler http.Handler) {
+	m.mux.Handle(pattern, handler)
+}
+
 // Register registers a prometheus collector in the prometheus registry used
 // by the metrics server.
 func (m Server) Register(collector prometheus.Collector) error {
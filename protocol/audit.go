@@ -0,0 +1,234 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bbva/qed/balloon/history"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+)
+
+// AuditEventPrefix starts every event recording an administrative
+// operation, which sets them apart from the events added by clients.
+const AuditEventPrefix = "qed.audit:"
+
+// auditRootPrefix starts the signing message of the audit roots, so
+// their signatures can never be taken for the ones of the snapshots.
+const auditRootPrefix = "qed.audit.root:"
+
+// AuditEntry describes an administrative operation performed on a QED
+// server. Entries are added as events to the audit log of the cluster,
+// kept apart from the balloon, so operators can ask for membership
+// proofs of their own actions.
+type AuditEntry struct {
+	// Timestamp of the operation in nanoseconds since the Unix epoch.
+	Timestamp int64 `json:"timestamp"`
+	// Node serving the operation.
+	Node string `json:"node"`
+	// Actor identifies who asked for the operation. Requests with an API
+	// key are identified by a fingerprint of the key, never the key itself.
+	Actor string `json:"actor"`
+	// RemoteAddr of the client asking for the operation, if any.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// RequestID correlates the entry with the server logs.
+	RequestID string `json:"request_id,omitempty"`
+	// Operation performed, e.g. "DELETE /cluster/members".
+	Operation string `json:"operation"`
+	// Target of the operation, e.g. the query of the request.
+	Target string `json:"target,omitempty"`
+	// Status of the operation, an HTTP status code for API calls.
+	Status int `json:"status,omitempty"`
+	// ForwardedBy identifies who forwarded the entry to the leader, and
+	// ForwardedFrom the address it came from. They are set by the leader,
+	// so entries claiming to come from another node can be told apart.
+	ForwardedBy   string `json:"forwarded_by,omitempty"`
+	ForwardedFrom string `json:"forwarded_from,omitempty"`
+}
+
+// Event returns the bytes of the event recording this entry.
+func (e *AuditEntry) Event() ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(AuditEventPrefix), data...), nil
+}
+
+// IsAuditEvent reports whether the event records an audit entry.
+func IsAuditEvent(event []byte) bool {
+	return bytes.HasPrefix(event, []byte(AuditEventPrefix))
+}
+
+// ParseAuditEvent returns the entry recorded by the given event.
+func ParseAuditEvent(event []byte) (*AuditEntry, error) {
+	if !IsAuditEvent(event) {
+		return nil, fmt.Errorf("Not an audit event")
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal(event[len(AuditEventPrefix):], &entry); err != nil {
+		return nil, fmt.Errorf("Unable to decode audit event: %v", err)
+	}
+	return &entry, nil
+}
+
+// AuditRecord is the public struct that mgmthttp.ListAuditEntries returns
+// for every entry. The Version is the one to use to ask for a membership
+// proof of the entry in the audit log.
+type AuditRecord struct {
+	Version uint64      `json:"version"`
+	Event   []byte      `json:"event"`
+	Entry   *AuditEntry `json:"entry"`
+}
+
+// AuditProof is the public struct that mgmthttp.ProveAuditEntry returns.
+// It proves that the Event of the entry of the given Version is part of
+// the audit log at CurrentVersion, whose root is HistoryDigest.
+type AuditProof struct {
+	Version        uint64                    `json:"version"`
+	CurrentVersion uint64                    `json:"current_version"`
+	Event          []byte                    `json:"event"`
+	HistoryDigest  hashing.Digest            `json:"history_digest"`
+	AuditPath      map[string]hashing.Digest `json:"audit_path"`
+}
+
+// ToAuditProof translates the internal history.MembershipProof of an
+// audit event to the public struct protocol.AuditProof.
+func ToAuditProof(event []byte, root hashing.Digest, proof *history.MembershipProof) *AuditProof {
+	return &AuditProof{
+		Version:        proof.Index,
+		CurrentVersion: proof.Version,
+		Event:          event,
+		HistoryDigest:  root,
+		AuditPath:      proof.AuditPath.Serialize(),
+	}
+}
+
+// Verify checks that the event of the proof is part of the audit log
+// whose root at the current version of the proof is the given one.
+func (p *AuditProof) Verify(root hashing.Digest, hasherF func() hashing.Hasher) bool {
+	proof := history.NewMembershipProof(p.Version, p.CurrentVersion, history.ParseAuditPath(p.AuditPath), hasherF())
+	return proof.Verify(hasherF().Do(p.Event), root)
+}
+
+// VerifySigned checks that the event of the proof is part of the audit
+// log whose root at the current version of the proof is signed by the
+// given verifier.
+func (p *AuditProof) VerifySigned(root *SignedAuditRoot, verifier sign.Verifier, hasherF func() hashing.Hasher) (bool, error) {
+	if err := root.verify(p.CurrentVersion, verifier); err != nil {
+		return false, err
+	}
+	return p.Verify(root.Root.HistoryDigest, hasherF), nil
+}
+
+// AuditRoot is the root of the audit log at a version. QED servers sign
+// the root every time an entry is recorded and publish it through the
+// gossip network like the snapshots of the balloon.
+type AuditRoot struct {
+	Version       uint64         `json:"version"`
+	HistoryDigest hashing.Digest `json:"history_digest"`
+}
+
+// SigningMessage returns the message that QED servers sign when
+// publishing an audit root.
+func (r *AuditRoot) SigningMessage() []byte {
+	return []byte(fmt.Sprintf("%s%d:%x", auditRootPrefix, r.Version, r.HistoryDigest))
+}
+
+// SignedAuditRoot is the public struct that QED servers publish for
+// every version of the audit log.
+type SignedAuditRoot struct {
+	Root      *AuditRoot `json:"root"`
+	Signature []byte     `json:"signature"`
+}
+
+func (r *SignedAuditRoot) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *SignedAuditRoot) Decode(msg []byte) error {
+	return json.Unmarshal(msg, r)
+}
+
+// Verify checks the signature of the root using the given verifier.
+func (r *SignedAuditRoot) Verify(verifier sign.Verifier) (bool, error) {
+	if r.Root == nil || len(r.Signature) == 0 {
+		return false, nil
+	}
+	return verifier.Verify(r.Root.SigningMessage(), r.Signature)
+}
+
+// verify fails unless the root is of the given version and signed by the
+// given verifier.
+func (r *SignedAuditRoot) verify(version uint64, verifier sign.Verifier) error {
+	if r == nil || r.Root == nil {
+		return fmt.Errorf("No audit root of version %d", version)
+	}
+	if r.Root.Version != version {
+		return fmt.Errorf("The audit root is of version %d instead of %d", r.Root.Version, version)
+	}
+	ok, err := r.Verify(verifier)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Invalid signature of the audit root of version %d", version)
+	}
+	return nil
+}
+
+// AuditIncrementalProof is the public struct that
+// mgmthttp.ProveAuditConsistency returns. It proves that the audit log at
+// the End version is an extension of the one at the Start version, so no
+// entry was removed or changed between both.
+type AuditIncrementalProof struct {
+	Start     uint64                    `json:"start"`
+	End       uint64                    `json:"end"`
+	AuditPath map[string]hashing.Digest `json:"audit_path"`
+}
+
+// ToAuditIncrementalProof translates the internal history.IncrementalProof
+// of the audit log to the public struct protocol.AuditIncrementalProof.
+func ToAuditIncrementalProof(proof *history.IncrementalProof) *AuditIncrementalProof {
+	return &AuditIncrementalProof{
+		Start:     proof.StartVersion,
+		End:       proof.EndVersion,
+		AuditPath: proof.AuditPath.Serialize(),
+	}
+}
+
+// Verify checks that the audit log whose roots at the start and end
+// versions of the proof are the given ones is consistent between both.
+func (p *AuditIncrementalProof) Verify(start, end hashing.Digest, hasherF func() hashing.Hasher) bool {
+	proof := history.NewIncrementalProof(p.Start, p.End, history.ParseAuditPath(p.AuditPath), hasherF())
+	return proof.Verify(start, end)
+}
+
+// VerifySigned works like Verify, checking the proof against the roots of
+// its start and end versions signed by the given verifier.
+func (p *AuditIncrementalProof) VerifySigned(start, end *SignedAuditRoot, verifier sign.Verifier, hasherF func() hashing.Hasher) (bool, error) {
+	if err := start.verify(p.Start, verifier); err != nil {
+		return false, err
+	}
+	if err := end.verify(p.End, verifier); err != nil {
+		return false, err
+	}
+	return p.Verify(start.Root.HistoryDigest, end.Root.HistoryDigest, hasherF), nil
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/bbva/qed/balloon/history"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bplus"
+)
+
+func TestAuditEvent(t *testing.T) {
+	entry := &AuditEntry{
+		Timestamp: 1571234567000000000,
+		Node:      "server0",
+		Actor:     "anonymous",
+		Operation: "POST /backup",
+		Status:    200,
+	}
+
+	event, err := entry.Event()
+	require.NoError(t, err)
+	require.True(t, IsAuditEvent(event))
+	require.Equal(t, `qed.audit:{"timestamp":1571234567000000000,"node":"server0","actor":"anonymous","operation":"POST /backup","status":200}`, string(event))
+
+	parsed, err := ParseAuditEvent(event)
+	require.NoError(t, err)
+	require.Equal(t, entry, parsed)
+
+	require.False(t, IsAuditEvent([]byte("an event")))
+	_, err = ParseAuditEvent([]byte("an event"))
+	require.Error(t, err)
+	_, err = ParseAuditEvent([]byte(AuditEventPrefix + "{"))
+	require.Error(t, err)
+}
+
+func TestAuditProofsVerifySigned(t *testing.T) {
+	db := bplus.NewBPlusTreeStore()
+	defer db.Close()
+	tree := history.NewHistoryTreeOnTable(hashing.NewSha256Hasher, db, storage.AuditHistoryTable, 30, log.L())
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	verifier, err := sign.NewEd25519Verifier(publicKey)
+	require.NoError(t, err)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherVerifier, err := sign.NewEd25519Verifier(otherKey)
+	require.NoError(t, err)
+
+	var events [][]byte
+	roots := make(map[uint64]*SignedAuditRoot)
+	for i := uint64(0); i < 5; i++ {
+		entry := &AuditEntry{Node: "server0", Operation: "POST /backup", Target: fmt.Sprintf("id=%d", i), Status: 200}
+		event, err := entry.Event()
+		require.NoError(t, err)
+		events = append(events, event)
+		digest, mutations, err := tree.Add(hashing.NewSha256Hasher().Do(event), i)
+		require.NoError(t, err)
+		require.NoError(t, db.Mutate(mutations, nil))
+		root := &AuditRoot{Version: i, HistoryDigest: digest}
+		roots[i] = &SignedAuditRoot{Root: root, Signature: ed25519.Sign(privateKey, root.SigningMessage())}
+	}
+
+	// the signing message of a root never matches the one of a snapshot
+	snapshot := &Snapshot{HistoryDigest: roots[4].Root.HistoryDigest, Version: 4}
+	require.NotEqual(t, snapshot.SigningMessage(), roots[4].Root.SigningMessage())
+
+	membership, err := tree.ProveMembership(1, 4)
+	require.NoError(t, err)
+	proof := ToAuditProof(events[1], roots[4].Root.HistoryDigest, membership)
+
+	incremental, err := tree.ProveConsistency(1, 4)
+	require.NoError(t, err)
+	consistency := ToAuditIncrementalProof(incremental)
+
+	forged := &SignedAuditRoot{Root: &AuditRoot{Version: 4, HistoryDigest: roots[3].Root.HistoryDigest}, Signature: roots[4].Signature}
+
+	membershipCases := []struct {
+		root     *SignedAuditRoot
+		verifier sign.Verifier
+		valid    bool
+	}{
+		{roots[4], verifier, true},
+		{roots[4], otherVerifier, false},
+		{roots[3], verifier, false},
+		{nil, verifier, false},
+		{forged, verifier, false},
+	}
+
+	for i, c := range membershipCases {
+		valid, err := proof.VerifySigned(c.root, c.verifier, hashing.NewSha256Hasher)
+		if c.valid {
+			require.NoError(t, err, "in test case %d", i)
+		} else {
+			require.Error(t, err, "in test case %d", i)
+		}
+		require.Equal(t, c.valid, valid, "in test case %d", i)
+	}
+
+	consistencyCases := []struct {
+		start, end *SignedAuditRoot
+		verifier   sign.Verifier
+		valid      bool
+	}{
+		{roots[1], roots[4], verifier, true},
+		{roots[1], roots[4], otherVerifier, false},
+		{roots[2], roots[4], verifier, false},
+		{roots[1], roots[3], verifier, false},
+		{nil, roots[4], verifier, false},
+		{roots[1], forged, verifier, false},
+	}
+
+	for i, c := range consistencyCases {
+		valid, err := consistency.VerifySigned(c.start, c.end, c.verifier, hashing.NewSha256Hasher)
+		if c.valid {
+			require.NoError(t, err, "in test case %d", i)
+		} else {
+			require.Error(t, err, "in test case %d", i)
+		}
+		require.Equal(t, c.valid, valid, "in test case %d", i)
+	}
+
+	// a signed root that does not match the proof is not valid
+	tampered := &AuditRoot{Version: 4, HistoryDigest: roots[0].Root.HistoryDigest}
+	signedTampered := &SignedAuditRoot{Root: tampered, Signature: ed25519.Sign(privateKey, tampered.SigningMessage())}
+	valid, err := proof.VerifySigned(signedTampered, verifier, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.False(t, valid)
+	valid, err = consistency.VerifySigned(roots[1], signedTampered, verifier, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	require.False(t, valid)
+}
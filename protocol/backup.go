@@ -0,0 +1,77 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/bbva/qed/crypto/sign"
+)
+
+// ErrUnknownBackupTarget is returned when uploading a backup to a target
+// that is not configured in the server.
+var ErrUnknownBackupTarget = errors.New("Unknown backup target")
+
+// BackupManifest describes a backup uploaded to a backup target. The
+// snapshot is the one of the last event in the backup, signed by the
+// server that uploaded it, and it is missing if the backup has no events.
+// The whole manifest, digests of the files included, is signed by the
+// same server.
+type BackupManifest struct {
+	Name      string          `json:"name"`
+	NodeID    string          `json:"node_id"`
+	Engine    string          `json:"engine"`
+	BackupID  int64           `json:"backup_id"`
+	Timestamp int64           `json:"timestamp"`
+	Version   uint64          `json:"version"`
+	Hasher    string          `json:"hasher"`
+	Snapshot  *SignedSnapshot `json:"snapshot,omitempty"`
+	Files     []*BackupFile   `json:"files"`
+	Signature []byte          `json:"signature,omitempty"`
+}
+
+// SigningMessage returns the canonical bytes of the manifest that are
+// signed, which are its JSON encoding without the signature.
+func (m *BackupManifest) SigningMessage() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// VerifySignature checks the signature of the manifest using the given
+// verifier.
+func (m *BackupManifest) VerifySignature(v sign.Verifier) (bool, error) {
+	if len(m.Signature) == 0 {
+		return false, nil
+	}
+	msg, err := m.SigningMessage()
+	if err != nil {
+		return false, err
+	}
+	return v.Verify(msg, m.Signature)
+}
+
+// BackupFile describes a file of an uploaded backup, stored in parts
+// of at most PartSize bytes. SHA256 is the hex digest of the whole file.
+type BackupFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Parts    int    `json:"parts"`
+	PartSize int64  `json:"part_size"`
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/bbva/qed/crypto/sign"
+)
+
+func TestBackupManifestSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	verifier, err := sign.NewEd25519Verifier(publicKey)
+	require.NoError(t, err)
+
+	manifest := func(key ed25519.PrivateKey) *BackupManifest {
+		m := &BackupManifest{
+			Name:      "20200423T091414Z-server0-1",
+			NodeID:    "server0",
+			Engine:    "bolt",
+			BackupID:  1,
+			Timestamp: 1587632054,
+			Version:   9,
+			Hasher:    "sha256",
+			Snapshot:  &SignedSnapshot{Snapshot: &Snapshot{Version: 9}, Signature: []byte{0x1}},
+			Files:     []*BackupFile{{Path: "qed.db", Size: 4, SHA256: "0a0b", Parts: 1, PartSize: 32}},
+		}
+		msg, err := m.SigningMessage()
+		require.NoError(t, err)
+		m.Signature = ed25519.Sign(key, msg)
+		return m
+	}
+
+	testCases := []struct {
+		manifest *BackupManifest
+		change   func(m *BackupManifest)
+		valid    bool
+	}{
+		{manifest(privateKey), func(m *BackupManifest) {}, true},
+		{manifest(privateKey), func(m *BackupManifest) { m.Files[0].SHA256 = "0c0d" }, false},
+		{manifest(privateKey), func(m *BackupManifest) { m.Name = "20200423T091414Z-server0-2" }, false},
+		{manifest(privateKey), func(m *BackupManifest) { m.Engine = "rocksdb" }, false},
+		{manifest(privateKey), func(m *BackupManifest) { m.Version = 10 }, false},
+		{manifest(privateKey), func(m *BackupManifest) { m.Signature = nil }, false},
+		{manifest(otherPrivateKey), func(m *BackupManifest) {}, false},
+	}
+
+	for i, c := range testCases {
+		c.change(c.manifest)
+		// manifests are verified once downloaded
+		content, err := json.Marshal(c.manifest)
+		require.NoError(t, err)
+		var decoded BackupManifest
+		require.NoError(t, json.Unmarshal(content, &decoded))
+
+		ok, err := decoded.VerifySignature(verifier)
+		require.NoError(t, err, "Unexpected error in test case %d", i)
+		require.Equal(t, c.valid, ok, "Wrong verification in test case %d", i)
+	}
+}
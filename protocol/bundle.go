@@ -0,0 +1,156 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+)
+
+// ProofBundleFormatVersion is the version of the proof bundles built
+// by this package. Bundles of newer versions are rejected.
+const ProofBundleFormatVersion = 1
+
+// bundleHashers are the hashers proof bundles are verified with, by name.
+var bundleHashers = map[string]func() hashing.Hasher{
+	"sha256": hashing.NewSha256Hasher,
+}
+
+// ProofBundle is a self-contained membership proof of an event. It carries
+// the signed snapshots and the public key needed to verify it offline,
+// without contacting QED or the snapshot store.
+type ProofBundle struct {
+	FormatVersion int
+	Hasher        string         // Name of the hasher of the balloon.
+	Event         []byte         `json:",omitempty"` // Event, if known when building the bundle.
+	EventDigest   hashing.Digest // Digest of the event queried.
+
+	// Historical tells the hyper proof is against the hyper tree of
+	// the query version instead of the current one.
+	Historical bool
+	Proof      *MembershipResult
+
+	// Signed snapshots of the query version and, if different, of the
+	// version of the hyper tree the proof is against.
+	Snapshots []*SignedSnapshot
+
+	PublicKey []byte // ed25519 public key of the signed snapshots.
+	KeyID     string // Fingerprint of the public key.
+}
+
+// BundleSnapshotVersions returns the versions of the signed snapshots
+// a bundle with the given proof needs: the one of the query version, and
+// the one of the hyper tree the proof is against if different.
+func BundleSnapshotVersions(proof *MembershipResult, historical bool) []uint64 {
+	if historical || proof.CurrentVersion == proof.QueryVersion {
+		return []uint64{proof.QueryVersion}
+	}
+	return []uint64{proof.QueryVersion, proof.CurrentVersion}
+}
+
+func (b *ProofBundle) Encode() ([]byte, error) {
+	return json.MarshalIndent(b, "", "  ")
+}
+
+func (b *ProofBundle) Decode(msg []byte) error {
+	return json.Unmarshal(msg, b)
+}
+
+func (b *ProofBundle) snapshot(version uint64) (*SignedSnapshot, error) {
+	for _, s := range b.Snapshots {
+		if s != nil && s.Snapshot != nil && s.Snapshot.Version == version {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("Missing signed snapshot of version %d", version)
+}
+
+// Verify checks the membership proof of the bundle against its signed
+// snapshots, once their signatures are verified with the public key of
+// the bundle. The trusted public key is mandatory and the one of the
+// bundle must be the same, as anyone can sign a bundle with a key of
+// their own. Only the membership of events can be proved, so bundles of
+// events that do not exist are not valid.
+func (b *ProofBundle) Verify(trustedKey []byte) error {
+	if len(trustedKey) == 0 {
+		return errors.New("A trusted public key is required to verify the bundle")
+	}
+	if b.FormatVersion > ProofBundleFormatVersion {
+		return fmt.Errorf("Unsupported proof bundle format version %d, the latest supported is %d", b.FormatVersion, ProofBundleFormatVersion)
+	}
+	hasherF, ok := bundleHashers[b.Hasher]
+	if !ok {
+		return fmt.Errorf("Unsupported hasher %q", b.Hasher)
+	}
+	if b.Proof == nil {
+		return errors.New("Missing membership proof")
+	}
+	if !b.Proof.Exists {
+		return errors.New("The event does not exist")
+	}
+	if !bytes.Equal(b.Proof.KeyDigest, b.EventDigest) {
+		return errors.New("The proof is not of the event digest")
+	}
+	if b.Event != nil && !bytes.Equal(hasherF().Do(b.Event), b.EventDigest) {
+		return errors.New("The event does not match its digest")
+	}
+
+	if !bytes.Equal(trustedKey, b.PublicKey) {
+		return fmt.Errorf("The bundle is signed with key %s instead of the trusted key %s", sign.KeyID(b.PublicKey), sign.KeyID(trustedKey))
+	}
+	if b.KeyID != sign.KeyID(b.PublicKey) {
+		return errors.New("The key ID does not match the public key")
+	}
+	verifier, err := sign.NewEd25519Verifier(b.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	versions := BundleSnapshotVersions(b.Proof, b.Historical)
+	snapshots := make([]*Snapshot, len(versions))
+	for i, version := range versions {
+		signed, err := b.snapshot(version)
+		if err != nil {
+			return err
+		}
+		ok, err := signed.VerifySignature(verifier)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Invalid signature of snapshot %d", version)
+		}
+		snapshots[i] = signed.Snapshot
+	}
+
+	snapshot := &balloon.Snapshot{
+		EventDigest:   b.EventDigest,
+		HistoryDigest: snapshots[0].HistoryDigest,
+		HyperDigest:   snapshots[len(snapshots)-1].HyperDigest,
+		Version:       b.Proof.QueryVersion,
+	}
+	if !ToBalloonProof(b.Proof, hasherF).DigestVerify(b.EventDigest, snapshot) {
+		return errors.New("The membership proof does not match the signed snapshots")
+	}
+	return nil
+}
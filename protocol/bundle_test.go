@@ -0,0 +1,137 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package protocol
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/storage/bolt"
+)
+
+func TestProofBundleVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bolt.NewBoltStore(dir, 0)
+	require.NoError(t, err)
+	defer db.Close()
+	bln, err := balloon.NewBalloon(db, hashing.NewSha256Hasher)
+	require.NoError(t, err)
+	defer bln.Close()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signed := make(map[uint64]*SignedSnapshot)
+	for _, events := range [][][]byte{{[]byte("event 0"), []byte("event 1")}, {[]byte("event 2"), []byte("event 3")}} {
+		hasher := hashing.NewSha256Hasher()
+		var digests []hashing.Digest
+		for _, e := range events {
+			digests = append(digests, hasher.Do(e))
+		}
+		snapshots, mutations, err := bln.AddBulk(digests)
+		require.NoError(t, err)
+		require.NoError(t, db.Mutate(mutations, nil))
+		for _, s := range snapshots {
+			snapshot := ToSnapshot(s)
+			signed[s.Version] = &SignedSnapshot{Snapshot: snapshot, Signature: ed25519.Sign(privateKey, snapshot.SigningMessage())}
+		}
+	}
+
+	bundle := func(event string, version uint64) *ProofBundle {
+		digest := hashing.NewSha256Hasher().Do([]byte(event))
+		proof, err := bln.QueryDigestMembershipConsistency(digest, version)
+		require.NoError(t, err)
+		result := ToMembershipResult(digest, proof)
+		b := &ProofBundle{
+			FormatVersion: ProofBundleFormatVersion,
+			Hasher:        "sha256",
+			Event:         []byte(event),
+			EventDigest:   digest,
+			Proof:         result,
+			PublicKey:     publicKey,
+			KeyID:         sign.KeyID(publicKey),
+		}
+		for _, v := range BundleSnapshotVersions(result, false) {
+			b.Snapshots = append(b.Snapshots, signed[v])
+		}
+		return b
+	}
+
+	testCases := []struct {
+		bundle     *ProofBundle
+		trustedKey []byte
+		change     func(b *ProofBundle)
+		version    uint64
+		valid      bool
+	}{
+		{bundle("event 3", 3), publicKey, func(b *ProofBundle) {}, 3, true},
+		{bundle("event 1", 3), publicKey, func(b *ProofBundle) {}, 1, true},
+		{bundle("event 1", 2), publicKey, func(b *ProofBundle) {}, 1, true},
+		{bundle("event 1", 3), nil, func(b *ProofBundle) {}, 0, false},
+		{bundle("event 4", 3), publicKey, func(b *ProofBundle) {}, 0, false},
+		{bundle("event 1", 2), publicKey, func(b *ProofBundle) { b.Event = []byte("event 2") }, 0, false},
+		{bundle("event 1", 2), publicKey, func(b *ProofBundle) { b.Snapshots = b.Snapshots[:1] }, 0, false},
+		{bundle("event 1", 3), otherKey, func(b *ProofBundle) {}, 0, false},
+		{bundle("event 1", 3), publicKey, func(b *ProofBundle) { b.KeyID = sign.KeyID(otherKey) }, 0, false},
+		{bundle("event 1", 3), publicKey, func(b *ProofBundle) { b.Hasher = "xor" }, 0, false},
+		{bundle("event 1", 3), publicKey, func(b *ProofBundle) { b.FormatVersion = ProofBundleFormatVersion + 1 }, 0, false},
+		{bundle("event 1", 3), nil, func(b *ProofBundle) {
+			// signed with a key of its own, but no key is trusted
+			b.PublicKey, b.KeyID = otherKey, sign.KeyID(otherKey)
+		}, 0, false},
+		{bundle("event 1", 3), publicKey, func(b *ProofBundle) {
+			// signed with another key, but the one of the bundle is not trusted
+			b.PublicKey, b.KeyID = otherKey, sign.KeyID(otherKey)
+		}, 0, false},
+		{bundle("event 1", 3), otherKey, func(b *ProofBundle) {
+			// valid signatures of the wrong digests
+			s := *b.Snapshots[0].Snapshot
+			s.HistoryDigest = signed[2].Snapshot.HistoryDigest
+			b.Snapshots[0] = &SignedSnapshot{Snapshot: &s, Signature: ed25519.Sign(otherPrivateKey, s.SigningMessage())}
+			b.PublicKey, b.KeyID = otherKey, sign.KeyID(otherKey)
+		}, 0, false},
+	}
+
+	for i, c := range testCases {
+		c.change(c.bundle)
+		// bundles are verified once encoded
+		content, err := c.bundle.Encode()
+		require.NoError(t, err)
+		var decoded ProofBundle
+		require.NoError(t, decoded.Decode(content))
+
+		err = decoded.Verify(c.trustedKey)
+		if !c.valid {
+			require.Error(t, err, "The bundle must not be valid in test case %d", i)
+			continue
+		}
+		require.NoError(t, err, "The bundle must be valid in test case %d", i)
+		require.Equal(t, c.version, decoded.Proof.ActualVersion, "Wrong version in test case %d", i)
+	}
+}
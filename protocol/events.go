@@ -20,11 +20,13 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/balloon/history"
 	"github.com/bbva/qed/balloon/hyper"
 	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/crypto/sign"
 	"github.com/bbva/qed/util"
 )
 
@@ -45,6 +47,9 @@ type EventsBulk struct {
 type MembershipQuery struct {
 	Key     []byte
 	Version *uint64
+	// Historical asks for a hyper proof against the hyper tree
+	// at Version instead of the current one.
+	Historical bool
 }
 
 // MembershipDigest is the public struct that apihttp.DigestMembership
@@ -52,6 +57,9 @@ type MembershipQuery struct {
 type MembershipDigest struct {
 	KeyDigest hashing.Digest
 	Version   *uint64
+	// Historical asks for a hyper proof against the hyper tree
+	// at Version instead of the current one.
+	Historical bool
 }
 
 // Snapshot is the public struct that apihttp.Add Handler call returns.
@@ -66,11 +74,39 @@ func (b *Snapshot) Encode() ([]byte, error) {
 	return json.Marshal(b)
 }
 
+// ToSnapshot translates internal api balloon.Snapshot to the public
+// struct protocol.Snapshot.
+func ToSnapshot(s *balloon.Snapshot) *Snapshot {
+	return &Snapshot{
+		EventDigest:   s.EventDigest,
+		HistoryDigest: s.HistoryDigest,
+		HyperDigest:   s.HyperDigest,
+		Version:       s.Version,
+	}
+}
+
+// ToBalloonSnapshot translates public struct protocol.Snapshot to the
+// internal api balloon.Snapshot.
+func ToBalloonSnapshot(s *Snapshot) *balloon.Snapshot {
+	return &balloon.Snapshot{
+		EventDigest:   s.EventDigest,
+		HistoryDigest: s.HistoryDigest,
+		HyperDigest:   s.HyperDigest,
+		Version:       s.Version,
+	}
+}
+
 func (b *Snapshot) Decode(msg []byte) error {
 	err := json.Unmarshal(msg, b)
 	return err
 }
 
+// SigningMessage returns the message that QED servers sign when
+// publishing a snapshot.
+func (b *Snapshot) SigningMessage() []byte {
+	return []byte(fmt.Sprintf("%v", b))
+}
+
 // SignedSnapshot is the public struct that apihttp.Add Handler call returns.
 // It is comprised of a Snapshot and a signature.
 type SignedSnapshot struct {
@@ -87,6 +123,15 @@ func (b *SignedSnapshot) Decode(msg []byte) error {
 	return err
 }
 
+// VerifySignature checks the signature of the snapshot using
+// the given verifier.
+func (b *SignedSnapshot) VerifySignature(v sign.Verifier) (bool, error) {
+	if b.Snapshot == nil {
+		return false, nil
+	}
+	return v.Verify(b.Snapshot.SigningMessage(), b.Signature)
+}
+
 // BatchSnapshots is information structure that QED sends to Agents, and
 // Agents to alerts/snapshot store.
 // It is comprised of an array of Signed Snapshots.
@@ -45,3 +45,32 @@ type NodeInfo struct {
 	HttpAddr    string `json:"http_addr"`
 	MetricsAddr string `json:"metrics_addr"`
 }
+
+// MemberInfo is the public struct that describes a member of the
+// Raft cluster in the management API.
+type MemberInfo struct {
+	NodeId    string `json:"node_id"`
+	RaftAddr  string `json:"raft_addr"`
+	Suffrage  string `json:"suffrage"`
+	Leader    bool   `json:"leader"`
+	Reachable bool   `json:"reachable"`
+}
+
+// BackupStatus is the public struct that describes the state of the
+// scheduled backups of a node in the management API. Scheduled tells
+// whether the node was the one chosen to create the backups in the last
+// run, and LastUpload is the name of the last backup uploaded to the
+// backup target, if any. Times are Unix timestamps in seconds.
+type BackupStatus struct {
+	Enabled      bool   `json:"enabled"`
+	Interval     string `json:"interval,omitempty"`
+	Scheduled    bool   `json:"scheduled"`
+	LastRun      int64  `json:"last_run,omitempty"`
+	LastSuccess  int64  `json:"last_success,omitempty"`
+	LastBackupID int64  `json:"last_backup_id,omitempty"`
+	LastVerified bool   `json:"last_verified"`
+	LastUpload   string `json:"last_upload,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	LastDeleted  int    `json:"last_deleted"`
+	Backups      int    `json:"backups"`
+}
@@ -44,6 +44,14 @@ func (o *ReadOptions) SetIgnoreRangeDeletions(value bool) {
 	C.rocksdb_readoptions_set_ignore_range_deletions(o.c, boolToUchar(value))
 }
 
+// SetSnapshot sets the snapshot which should be used for the read.
+// The snapshot must belong to the DB that is being read and must
+// not have been released.
+// Default: nil
+func (o *ReadOptions) SetSnapshot(snapshot *Snapshot) {
+	C.rocksdb_readoptions_set_snapshot(o.c, snapshot.c)
+}
+
 // Destroy deallocates the ReadOptions object.
 func (o *ReadOptions) Destroy() {
 	C.rocksdb_readoptions_destroy(o.c)
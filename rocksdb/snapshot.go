@@ -0,0 +1,36 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rocksdb
+
+// #include <rocksdb/c.h>
+import "C"
+
+// Snapshot provides a consistent view of read operations in a DB.
+type Snapshot struct {
+	c *C.rocksdb_snapshot_t
+}
+
+// NewSnapshot creates a new snapshot of the database.
+func (db *DB) NewSnapshot() *Snapshot {
+	return &Snapshot{c: C.rocksdb_create_snapshot(db.c)}
+}
+
+// ReleaseSnapshot releases the snapshot and its resources.
+func (db *DB) ReleaseSnapshot(snapshot *Snapshot) {
+	C.rocksdb_release_snapshot(db.c, snapshot.c)
+	snapshot.c = nil
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rocksdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	db, path := newTestDB(t, "TestSnapshot", nil)
+	defer func() {
+		db.Close()
+		os.RemoveAll(path)
+	}()
+
+	wo := NewDefaultWriteOptions()
+	require.NoError(t, db.Put(wo, []byte("key1"), []byte("value1")))
+
+	snapshot := db.NewSnapshot()
+	ro := NewDefaultReadOptions()
+	ro.SetSnapshot(snapshot)
+	defer ro.Destroy()
+
+	// changes after the snapshot are not visible through it
+	require.NoError(t, db.Put(wo, []byte("key1"), []byte("value2")))
+	require.NoError(t, db.Put(wo, []byte("key2"), []byte("value2")))
+
+	value, err := db.GetBytes(ro, []byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+	value, err = db.GetBytes(ro, []byte("key2"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	value, err = db.GetBytes(NewDefaultReadOptions(), []byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), value)
+
+	db.ReleaseSnapshot(snapshot)
+}
@@ -0,0 +1,374 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bbva/qed/api/apihttp"
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+)
+
+const (
+	// auditPendingFile keeps, in the database directory, the audit entries
+	// waiting to be recorded while the server is not running.
+	auditPendingFile = "audit.pending"
+
+	// signerFingerprintFile keeps, in the database directory, the fingerprint
+	// of the signing key used the last time the server started.
+	signerFingerprintFile = "signer.fingerprint"
+
+	auditQueueSize     = 1024
+	auditRetryInterval = 2 * time.Second
+)
+
+var (
+	errNoLeader       = errors.New("No cluster leader to record the audit entry")
+	errAuditorStopped = errors.New("The audit log is stopped")
+)
+
+// auditor records the administrative operations served by this node in
+// the audit log of the cluster. Entries go through the Raft leader, so
+// followers forward them to the management API of the leader. Entries
+// that cannot be recorded yet are retried in the background, and saved
+// to be recorded on the next start if the server stops before that.
+// The saved entries stay in the pending file until all of them are
+// recorded, so they survive a server that fails to start. Every entry
+// takes a slot of the queue until it is recorded, so no entry is ever
+// dropped: requests wait for a free slot before being served instead.
+// Until the cluster enables the Raft extended commands, older nodes cannot
+// apply the audit entries, so they are saved in the pending file instead.
+type auditor struct {
+	node     string
+	dbPath   string
+	raftNode *consensus.RaftNode
+	enabled  bool
+	client   *http.Client
+
+	// number of entries of the pending file still to be recorded. They
+	// are queued before any other entry, so they are the first ones.
+	pending int
+
+	slots  chan struct{}
+	queue  chan *protocol.AuditEntry
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	log log.Logger
+}
+
+func newAuditor(node, dbPath string, raftNode *consensus.RaftNode, enabled bool, logger log.Logger) *auditor {
+	return &auditor{
+		node:     node,
+		dbPath:   dbPath,
+		raftNode: raftNode,
+		enabled:  enabled,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		slots:    make(chan struct{}, auditQueueSize),
+		queue:    make(chan *protocol.AuditEntry, auditQueueSize),
+		stopCh:   make(chan struct{}),
+		log:      logger,
+	}
+}
+
+// Reserve waits for a free slot of the queue to record an entry.
+func (a *auditor) Reserve(ctx context.Context) error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.stopCh:
+		return errAuditorStopped
+	}
+}
+
+// Record queues the entry in the slot reserved for it, so it neither
+// blocks the caller nor is dropped.
+func (a *auditor) Record(ctx context.Context, entry *protocol.AuditEntry) {
+	if entry.Node == "" {
+		entry.Node = a.node
+	}
+	if entry.RequestID == "" {
+		entry.RequestID = log.RequestID(ctx)
+	}
+	a.queue <- entry
+}
+
+// Start queues the entries left by a previous run or by an offline
+// operation and starts recording entries in the background. It must be
+// called before serving any request.
+func (a *auditor) Start() error {
+	if !a.enabled {
+		a.log.Info("Raft extended commands are disabled, audit entries are saved to be recorded once enabled")
+		a.wg.Add(1)
+		go a.run()
+		return nil
+	}
+
+	entries, err := readPendingAuditEntries(a.dbPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > auditQueueSize {
+		return fmt.Errorf("Too many pending audit entries: %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Node == "" {
+			entry.Node = a.node
+		}
+		a.slots <- struct{}{}
+		a.queue <- entry
+	}
+	a.pending = len(entries)
+	if a.pending > 0 {
+		a.log.Infof("Recording %d pending audit entries", a.pending)
+	}
+
+	a.wg.Add(1)
+	go a.run()
+	return nil
+}
+
+// Stop waits for the entry being recorded and saves the queued ones
+// to be recorded on the next start.
+func (a *auditor) Stop() {
+	close(a.stopCh)
+	a.wg.Wait()
+
+	var pending []*protocol.AuditEntry
+	for {
+		select {
+		case entry := <-a.queue:
+			pending = append(pending, entry)
+			continue
+		default:
+		}
+		break
+	}
+	if len(pending) == 0 {
+		return
+	}
+	a.log.Infof("Saving %d audit entries to be recorded on the next start", len(pending))
+	// the pending file is rewritten if it still contains some of them
+	mode := os.O_APPEND
+	if a.pending > 0 {
+		mode = os.O_TRUNC
+	}
+	if err := writePendingAuditEntries(a.dbPath, mode, pending...); err != nil {
+		a.log.Errorf("Unable to save the pending audit entries: %v", err)
+	}
+}
+
+func (a *auditor) run() {
+	defer a.wg.Done()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case entry := <-a.queue:
+			if !a.enabled {
+				if err := AppendPendingAuditEntries(a.dbPath, entry); err != nil {
+					a.log.Errorf("Unable to save audit entry %s %s: %v", entry.Operation, entry.Target, err)
+				}
+				<-a.slots
+				continue
+			}
+			for {
+				err := a.add(entry)
+				if err == nil {
+					a.recorded()
+					break
+				}
+				a.log.Infof("Unable to record audit entry %s %s, retrying: %v", entry.Operation, entry.Target, err)
+				select {
+				case <-a.stopCh:
+					// keep it to be saved on stop, its slot is still taken
+					a.queue <- entry
+					return
+				case <-time.After(auditRetryInterval):
+				}
+			}
+		}
+	}
+}
+
+// recorded frees the slot of the recorded entry, and removes the pending
+// file once all its entries are recorded.
+func (a *auditor) recorded() {
+	<-a.slots
+	if a.pending == 0 {
+		return
+	}
+	a.pending--
+	if a.pending > 0 {
+		return
+	}
+	if err := os.Remove(filepath.Join(a.dbPath, auditPendingFile)); err != nil && !os.IsNotExist(err) {
+		a.log.Errorf("Unable to remove the pending audit entries: %v", err)
+	}
+}
+
+// add records the entry through the leader of the cluster.
+func (a *auditor) add(entry *protocol.AuditEntry) error {
+	ctx := log.ContextWithRequestID(context.Background(), entry.RequestID)
+	if a.raftNode.IsLeader() {
+		_, err := a.raftNode.AddAuditEntry(ctx, entry)
+		return err
+	}
+
+	info := a.raftNode.ClusterInfo()
+	leader, ok := info.Nodes[info.LeaderId]
+	if !ok || leader.MgmtAddr == "" {
+		return errNoLeader
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/audit", leader.MgmtAddr), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if entry.RequestID != "" {
+		req.Header.Set(apihttp.RequestIDHeader, entry.RequestID)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Leader %s refused the audit entry: %s", info.LeaderId, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// AppendPendingAuditEntries saves audit entries in the database directory
+// to be recorded the next time a server starts on it. It is meant for
+// operations performed while the server is not running, like restores.
+func AppendPendingAuditEntries(dbPath string, entries ...*protocol.AuditEntry) error {
+	return writePendingAuditEntries(dbPath, os.O_APPEND, entries...)
+}
+
+func writePendingAuditEntries(dbPath string, mode int, entries ...*protocol.AuditEntry) error {
+	f, err := os.OpenFile(filepath.Join(dbPath, auditPendingFile), os.O_CREATE|os.O_WRONLY|mode, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func readPendingAuditEntries(dbPath string) ([]*protocol.AuditEntry, error) {
+	f, err := os.Open(filepath.Join(dbPath, auditPendingFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*protocol.AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry protocol.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("Unable to read pending audit entries: %v", err)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, scanner.Err()
+}
+
+// localActor identifies the user running an offline operation.
+func localActor() string {
+	u, err := user.Current()
+	if err != nil {
+		return "local"
+	}
+	return "local:" + u.Username
+}
+
+// newLocalAuditEntry describes an operation performed from the command
+// line instead of the management API.
+func newLocalAuditEntry(operation, target string) *protocol.AuditEntry {
+	return &protocol.AuditEntry{
+		Timestamp: time.Now().UnixNano(),
+		Actor:     localActor(),
+		Operation: operation,
+		Target:    target,
+	}
+}
+
+// checkSignerRotation compares the fingerprint of the public key of the
+// signer with the one used the last time the server started on the same
+// database. If it has changed, the rotation is saved to be recorded in
+// the audit log before the new fingerprint replaces the previous one.
+func checkSignerRotation(dbPath, privateKeyPath string) (*protocol.AuditEntry, error) {
+	publicKey, err := ioutil.ReadFile(privateKeyPath + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sign.KeyID(publicKey)
+
+	path := filepath.Join(dbPath, signerFingerprintFile)
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	previous = bytes.TrimSpace(previous)
+
+	var rotation *protocol.AuditEntry
+	if len(previous) > 0 && string(previous) != fingerprint {
+		rotation = newLocalAuditEntry("signer key rotation", fmt.Sprintf("from=%s to=%s", previous, fingerprint))
+		if err := AppendPendingAuditEntries(dbPath, rotation); err != nil {
+			return nil, err
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(fingerprint), 0644); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
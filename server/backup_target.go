@@ -0,0 +1,379 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/archive"
+)
+
+const (
+	// backupPartSize is the maximum size of the objects in which the
+	// files of a backup are uploaded.
+	backupPartSize = 32 << 20
+
+	// backupHasher is the hasher of the balloon of every QED server.
+	backupHasher = "sha256"
+
+	// latestBackupObject keeps, in every backup target, the name of the
+	// last backup uploaded to it.
+	latestBackupObject = "latest"
+
+	backupManifestObject = "manifest.json"
+)
+
+// backupUploader uploads the backups of the database to the backup
+// targets. Every backup is restored to a temporary directory first, so
+// the uploaded files form a database that can be opened as is, whatever
+// the storage engine.
+type backupUploader struct {
+	nodeID  string
+	engine  string
+	db      storage.ManagedStore
+	tmpDir  string
+	signer  sign.Signer
+	targets map[string]archive.Backend
+	log     log.Logger
+}
+
+// newBackupUploader builds the backup targets of the configuration,
+// given as name=location pairs.
+func newBackupUploader(conf *Config, db storage.ManagedStore, signer sign.Signer, logger log.Logger) (*backupUploader, error) {
+	opts := backupTargetOptions(conf)
+	targets := make(map[string]archive.Backend)
+	for _, t := range conf.BackupTargets {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid backup target %s, expected name=location", t)
+		}
+		if _, ok := targets[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicated backup target %s", parts[0])
+		}
+		backend, err := archive.NewBackendWithOptions(parts[1], opts)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backup target %s: %v", parts[0], err)
+		}
+		targets[parts[0]] = backend
+	}
+	if conf.BackupScheduledTarget != "" {
+		if _, ok := targets[conf.BackupScheduledTarget]; !ok {
+			return nil, fmt.Errorf("Unknown backup target %s for the scheduled backups", conf.BackupScheduledTarget)
+		}
+	}
+
+	return &backupUploader{
+		nodeID:  conf.NodeID,
+		engine:  conf.DBEngine,
+		db:      db,
+		tmpDir:  filepath.Join(conf.DBPath, "uploads"),
+		signer:  signer,
+		targets: targets,
+		log:     logger,
+	}, nil
+}
+
+func backupTargetOptions(conf *Config) *archive.Options {
+	return &archive.Options{
+		S3: &archive.S3Options{
+			Endpoint:        conf.BackupS3Endpoint,
+			Region:          conf.BackupS3Region,
+			AccessKeyID:     conf.BackupS3AccessKey,
+			SecretAccessKey: conf.BackupS3SecretKey,
+		},
+		SSH: &archive.SSHOptions{
+			KeyPath:        conf.BackupSSHKeyPath,
+			KnownHostsPath: conf.BackupSSHKnownHostsPath,
+		},
+	}
+}
+
+// Upload uploads the backup identified by backupID to the given target,
+// along with its manifest, and makes it the latest backup of the target.
+func (u *backupUploader) Upload(backupID uint32, target string) (*protocol.BackupManifest, error) {
+	backend, ok := u.targets[target]
+	if !ok {
+		return nil, protocol.ErrUnknownBackupTarget
+	}
+	var info *storage.BackupInfo
+	for _, b := range u.db.GetBackupsInfo() {
+		if b.ID == int64(backupID) {
+			info = b
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("Backup %d not found", backupID)
+	}
+
+	begin := time.Now()
+	if err := os.MkdirAll(u.tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(u.tmpDir, "backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := u.db.RestoreFromBackup(backupID, dir, dir); err != nil {
+		return nil, fmt.Errorf("Unable to restore backup %d: %v", backupID, err)
+	}
+	paths, err := listBackupFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &protocol.BackupManifest{
+		Name:      fmt.Sprintf("%s-%s-%d", time.Unix(info.Timestamp, 0).UTC().Format("20060102T150405Z"), u.nodeID, info.ID),
+		NodeID:    u.nodeID,
+		Engine:    u.engine,
+		BackupID:  info.ID,
+		Timestamp: info.Timestamp,
+		Hasher:    backupHasher,
+	}
+	if err := u.signSnapshot(dir, manifest); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		file, err := putBackupFile(backend, manifest.Name, dir, path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to upload %s: %v", path, err)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	msg, err := manifest.SigningMessage()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Signature, err = u.signer.Sign(msg); err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	// the manifest is written last, so incomplete backups are ignored
+	if err := backend.Put(manifest.Name+"/"+backupManifestObject, content); err != nil {
+		return nil, err
+	}
+	if err := backend.Put(latestBackupObject, []byte(manifest.Name)); err != nil {
+		return nil, err
+	}
+
+	u.log.Infof("Backup %d uploaded to %s as %s in %v", backupID, target, manifest.Name, time.Since(begin))
+	return manifest, nil
+}
+
+// signSnapshot adds the snapshot of the last event of the database
+// restored in the given directory to the manifest.
+func (u *backupUploader) signSnapshot(dir string, manifest *protocol.BackupManifest) error {
+	db, err := OpenStore(u.engine, dir, 0, true)
+	if err != nil {
+		return fmt.Errorf("Unable to open restored backup: %v", err)
+	}
+	defer db.Close()
+
+	snapshot, err := consensus.StoredSnapshot(db)
+	if err != nil || snapshot == nil {
+		return err
+	}
+	s := protocol.ToSnapshot(snapshot)
+	signature, err := u.signer.Sign(s.SigningMessage())
+	if err != nil {
+		return err
+	}
+	manifest.Version = s.Version
+	manifest.Snapshot = &protocol.SignedSnapshot{Snapshot: s, Signature: signature}
+	return nil
+}
+
+// listBackupFiles returns the path of every file in the directory,
+// relative to it.
+func listBackupFiles(dir string) ([]string, error) {
+	paths := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	return paths, err
+}
+
+func backupPartName(name, path string, part int) string {
+	return fmt.Sprintf("%s/files/%s.%04d", name, path, part)
+}
+
+// putBackupFile uploads the file in parts of backupPartSize bytes.
+func putBackupFile(backend archive.Backend, name, dir, path string) (*protocol.BackupFile, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(path)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file := &protocol.BackupFile{Path: path, PartSize: backupPartSize}
+	hash := sha256.New()
+	buf := make([]byte, backupPartSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if err := backend.Put(backupPartName(name, path, file.Parts), buf[:n]); err != nil {
+				return nil, err
+			}
+			hash.Write(buf[:n])
+			file.Size += int64(n)
+			file.Parts++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return file, nil
+}
+
+// FetchBackupManifest returns the manifest of the backup with the given
+// name, or of the latest one if it is empty, uploaded to the target.
+func FetchBackupManifest(target archive.Backend, name string) (*protocol.BackupManifest, error) {
+	if name == "" {
+		latest, err := target.Get(latestBackupObject)
+		if err == archive.ErrNotFound {
+			return nil, fmt.Errorf("No backups found in the backup target")
+		}
+		if err != nil {
+			return nil, err
+		}
+		name = string(latest)
+	}
+	content, err := target.Get(name + "/" + backupManifestObject)
+	if err == archive.ErrNotFound {
+		return nil, fmt.Errorf("Backup %s not found in the backup target", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest protocol.BackupManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest of backup %s: %v", name, err)
+	}
+	return &manifest, nil
+}
+
+// RestoreRemoteBackup downloads the backup with the given name, or the
+// latest one if it is empty, from the backup target at the source
+// location to the restore path, checking the digest of every file. The
+// signature of the manifest is verified before downloading anything, so
+// the digests can be trusted. Like RestoreBackup, the restore is
+// recorded in the audit log once a server starts on the restored
+// database.
+func RestoreRemoteBackup(source string, opts *archive.Options, name, restorePath string, verifier sign.Verifier) (*protocol.BackupManifest, error) {
+	backend, err := archive.NewBackendWithOptions(source, opts)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := FetchBackupManifest(backend, name)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := manifest.VerifySignature(verifier)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invalid signature of the manifest of backup %s", manifest.Name)
+	}
+
+	if err := os.MkdirAll(restorePath, 0755); err != nil {
+		return nil, err
+	}
+	for _, file := range manifest.Files {
+		if err := getBackupFile(backend, manifest.Name, restorePath, file); err != nil {
+			return nil, fmt.Errorf("Unable to download %s: %v", file.Path, err)
+		}
+	}
+
+	target := fmt.Sprintf("engine=%s backup=%s source=%s", manifest.Engine, manifest.Name, source)
+	err = AppendPendingAuditEntries(restorePath, newLocalAuditEntry("restore", target))
+	return manifest, err
+}
+
+// getBackupFile downloads the parts of the file to a temporary file,
+// which replaces the file once its digest is checked.
+func getBackupFile(backend archive.Backend, name, dir string, file *protocol.BackupFile) error {
+	rel := filepath.FromSlash(file.Path)
+	if filepath.IsAbs(rel) || rel != filepath.Clean(rel) || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("Invalid path in manifest")
+	}
+	path := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(f, hash)
+	var size int64
+	for part := 0; part < file.Parts; part++ {
+		data, err := backend.Get(backupPartName(name, file.Path, part))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		size += int64(len(data))
+	}
+	if size != file.Size || hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("Contents do not match the manifest")
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
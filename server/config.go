@@ -21,12 +21,17 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/bbva/qed/storage"
 )
 
 type Config struct {
 	//Log level
 	Log string
 
+	// Log output format: text or json.
+	LogFormat string
+
 	// Unique name for this node. It identifies itself both in raft and
 	// gossip clusters. If not set, fallback to hostname.
 	NodeID string
@@ -93,6 +98,123 @@ type Config struct {
 	// DB WAL TTL
 	DbWalTtl time.Duration
 
+	// Storage engine of the database and the Raft log: rocksdb or bolt.
+	// The bolt engine does not need cgo, so it can be used in static binaries.
+	DBEngine string
+
+	// Number of levels of the hyper tree kept in the cache, 0 for the default.
+	// It must be the same in every node and must not change once the
+	// database has events, since it determines the hyper digests.
+	HyperCacheLevels uint8
+
+	// Maximum memory in bytes used by the hyper cache, 0 for no limit.
+	// The server refuses to start if a hyper cache of the configured
+	// levels does not fit in it.
+	HyperCacheMaxMemory uint64
+
+	// Path to the file that backs the hyper cache to speed up restarts.
+	// If empty, the cache is kept in memory and rebuilt on every start.
+	HyperCachePath string
+
+	// Minimum time between two checkpoints of the hyper cache, written
+	// along with the Raft snapshots and on shutdown. 0 disables them.
+	HyperCacheCheckpointInterval time.Duration
+
+	// Path to the hyper cache checkpoint file, by default in the Raft path.
+	HyperCacheCheckpointPath string
+
+	// Keep every version of the hyper tree, so membership can be proven
+	// against the hyper digest of any snapshot from then on. It should be
+	// enabled in every node.
+	HyperHistory bool
+
+	// Directory or s3://bucket/prefix URL where frozen history nodes of
+	// old versions are archived. Empty disables the archive. The archive
+	// should be shared by every node of the cluster, since checkpoints
+	// received from other nodes do not include the archived nodes.
+	HistoryArchivePath string
+
+	// Number of latest versions whose history nodes are never archived.
+	HistoryArchiveKeepVersions uint64
+
+	// Time between two runs of the history archiving.
+	HistoryArchiveInterval time.Duration
+
+	// Endpoint of the S3-compatible object store, https://s3.amazonaws.com
+	// by default.
+	HistoryArchiveS3Endpoint string
+
+	// Region of the S3 bucket.
+	HistoryArchiveS3Region string
+
+	// Credentials of the S3 bucket. Requests are not signed if empty.
+	HistoryArchiveS3AccessKey string
+	HistoryArchiveS3SecretKey string
+
+	// Time between two consistency checks of the stored trees, which look
+	// for corrupted nodes and compare the roots with the snapshots of the
+	// snapshot store, if any. 0 disables them.
+	ConsistencyCheckInterval time.Duration
+
+	// REST snapshot store endpoints whose snapshots are compared with the
+	// roots of the trees in the consistency checks.
+	ConsistencyCheckSnapshotStore []string
+
+	// Time between two scheduled backups of the database. They are created
+	// by a single node, a reachable follower if any, to avoid loading the
+	// leader. 0 disables them.
+	BackupInterval time.Duration
+
+	// Number of latest backups kept after a scheduled backup.
+	BackupKeepLast int
+
+	// Number of days and weeks whose newest backup is kept after a
+	// scheduled backup. If every keep option is 0, all backups are kept.
+	BackupKeepDaily  int
+	BackupKeepWeekly int
+
+	// Verify every scheduled backup once created. Expired backups are not
+	// deleted if the verification fails.
+	BackupVerify bool
+
+	// Destinations where backups can be uploaded, as name=location pairs.
+	// A location is a directory, an s3://bucket/prefix URL or an
+	// ssh://user@host:port/path URL.
+	BackupTargets []string
+
+	// Name of the backup target where scheduled backups are uploaded once
+	// verified. Empty keeps them only in the local backup directory.
+	BackupScheduledTarget string
+
+	// Endpoint, region and credentials of the S3 backup targets.
+	BackupS3Endpoint  string
+	BackupS3Region    string
+	BackupS3AccessKey string
+	BackupS3SecretKey string
+
+	// Private key and known_hosts file used to connect to the SSH backup
+	// targets, ~/.ssh/known_hosts by default.
+	BackupSSHKeyPath        string `flag:"backup-ssh-key-path"`
+	BackupSSHKnownHostsPath string `flag:"backup-ssh-known-hosts-path"`
+
+	// Exporter of the traces of the requests: otlp or file. Empty
+	// disables tracing.
+	TracingExporter string
+
+	// Base URL of the OTLP/HTTP collector, e.g. http://localhost:4318,
+	// or path of the file the spans are appended to.
+	TracingEndpoint string
+
+	// Ratio of the requests that are traced, unless the caller already
+	// decided whether to trace them.
+	TracingSampleRatio float64
+
+	// Propose the Raft commands that carry the trace context and the
+	// request id of the adds, and the ones recording the audit log.
+	// Older nodes cannot apply those commands, so enable it only once
+	// every node of the cluster is upgraded.
+	RaftExtendedCommands bool
+
 	RaftHeartbeatTimeout time.Duration
 
 	RaftElectionTimeout time.Duration
@@ -105,6 +227,7 @@ func DefaultConfig() *Config {
 	currentDir := getCurrentDir()
 
 	return &Config{
+		LogFormat:               "text",
 		NodeID:                  hostname,
 		HTTPAddr:                "127.0.0.1:8800",
 		RaftAddr:                "127.0.0.1:8500",
@@ -126,9 +249,19 @@ func DefaultConfig() *Config {
 		TLSVerifyServerHostname: false,
 		PrivateKeyPath:          "",
 		DbWalTtl:                0,
+		DBEngine:                storage.RocksDBEngine,
 		RaftHeartbeatTimeout:    1000 * time.Millisecond,
 		RaftElectionTimeout:     1000 * time.Millisecond,
 		RaftLeaseTimeout:        1000 * time.Millisecond,
+
+		HistoryArchiveKeepVersions: 1 << 20,
+		HistoryArchiveInterval:     time.Hour,
+		HistoryArchiveS3Region:     "us-east-1",
+
+		BackupVerify:   true,
+		BackupS3Region: "us-east-1",
+
+		TracingSampleRatio: 1.0,
 	}
 }
 
@@ -0,0 +1,84 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/crypto/sign"
+	"github.com/bbva/qed/gossip"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/protocol"
+)
+
+// SnapshotsFromStore returns the snapshots of the given snapshot store
+// to compare the roots of the trees with in consistency checks. The
+// snapshots that cannot be fetched are skipped, since the store may
+// lag behind the server.
+func SnapshotsFromStore(store gossip.SnapshotStore, logger log.Logger) func(version uint64) (*balloon.Snapshot, error) {
+	return func(version uint64) (*balloon.Snapshot, error) {
+		signed, err := store.GetSnapshot(version)
+		if err != nil {
+			logger.Debugf("Snapshot %d not available: %v", version, err)
+			return nil, nil
+		}
+		if signed.Snapshot == nil || signed.Snapshot.Version != version {
+			return nil, nil
+		}
+		return &balloon.Snapshot{
+			EventDigest:   signed.Snapshot.EventDigest,
+			HistoryDigest: signed.Snapshot.HistoryDigest,
+			HyperDigest:   signed.Snapshot.HyperDigest,
+			Version:       signed.Snapshot.Version,
+		}, nil
+	}
+}
+
+// VerifiedSnapshotsFromStore returns the snapshots of the given snapshot
+// store whose signature is valid. Unlike SnapshotsFromStore, any snapshot
+// that cannot be fetched or verified is an error.
+func VerifiedSnapshotsFromStore(store gossip.SnapshotStore, verifier sign.Verifier) func(version uint64) (*balloon.Snapshot, error) {
+	return VerifiedSnapshots(store.GetSnapshot, verifier)
+}
+
+// VerifiedSnapshots returns the signed snapshots given by the get function,
+// like the one of a snapshot store, once their signature is verified.
+func VerifiedSnapshots(get func(version uint64) (*protocol.SignedSnapshot, error), verifier sign.Verifier) func(version uint64) (*balloon.Snapshot, error) {
+	return func(version uint64) (*balloon.Snapshot, error) {
+		signed, err := get(version)
+		if err != nil {
+			return nil, err
+		}
+		if signed == nil || signed.Snapshot == nil || signed.Snapshot.Version != version {
+			return nil, fmt.Errorf("No signed snapshot found for version %d", version)
+		}
+		ok, err := signed.VerifySignature(verifier)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Invalid signature of snapshot %d", version)
+		}
+		return &balloon.Snapshot{
+			EventDigest:   signed.Snapshot.EventDigest,
+			HistoryDigest: signed.Snapshot.HistoryDigest,
+			HyperDigest:   signed.Snapshot.HyperDigest,
+			Version:       signed.Snapshot.Version,
+		}, nil
+	}
+}
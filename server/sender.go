@@ -17,14 +17,16 @@
 package server
 
 import (
-	"fmt"
+	"context"
 	"time"
 
+	"github.com/bbva/qed/consensus"
 	"github.com/bbva/qed/crypto/sign"
 	"github.com/bbva/qed/gossip"
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/metrics"
 	"github.com/bbva/qed/protocol"
+	"github.com/bbva/qed/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -75,7 +77,7 @@ func NewSenderWithLogger(a *gossip.Agent, s sign.Signer, size, ttl, n int, logge
 
 // Start NumSenders concurrent senders and waits for them
 // to finish
-func (s Sender) Start(ch chan *protocol.Snapshot) {
+func (s Sender) Start(ch chan *consensus.TracedSnapshot) {
 	QedSenderInstancesCount.Inc()
 	for i := 0; i < s.NumSenders; i++ {
 		s.log.Debugf("Starting sender %d", i)
@@ -83,6 +85,21 @@ func (s Sender) Start(ch chan *protocol.Snapshot) {
 	}
 }
 
+// StartAuditRoots signs the audit roots read from the channel and sends
+// them to the gossip network, so they are published like the snapshots.
+func (s Sender) StartAuditRoots(ch <-chan *protocol.AuditRoot) {
+	go func() {
+		for {
+			select {
+			case root := <-ch:
+				s.publishAuditRoot(root)
+			case <-s.quitCh:
+				return
+			}
+		}
+	}()
+}
+
 func (s Sender) RegisterMetrics(srv *metrics.Server) {
 	metrics := []prometheus.Collector{
 		QedSenderInstancesCount,
@@ -101,49 +118,34 @@ func (s Sender) newBatch() *protocol.BatchSnapshots {
 // to other members of the gossip network.
 // If the out queue is full,  we drop the current batch and pray other sender will
 // send the batches to the gossip network.
-func (s Sender) batcher(id int, ch chan *protocol.Snapshot) {
+func (s Sender) batcher(id int, ch chan *consensus.TracedSnapshot) {
 	batch := s.newBatch()
+	var traceParent string
 
 	for {
 		select {
 		case snap := <-ch:
 			if len(batch.Snapshots) == s.BatchSize {
-				payload, err := batch.Encode()
-				if err != nil {
-					s.log.Warn("Error encoding batch, dropping it")
-					continue
-				}
-
-				s.agent.Out.Publish(&gossip.Message{
-					Kind:    gossip.BatchMessageType,
-					TTL:     s.TTL,
-					Payload: payload,
-				})
-				QedSenderBatchesSentTotal.Inc()
-
+				s.publish(batch, traceParent)
 				batch = s.newBatch()
+				traceParent = ""
 			}
-			ss, err := s.doSign(snap)
+			ss, err := s.doSign(snap.Snapshot)
 			if err != nil {
 				s.log.Warnf("Failed signing message: %v", err)
 			}
 			batch.Snapshots = append(batch.Snapshots, ss)
+			// a batch continues the trace of its first traced snapshot
+			if traceParent == "" {
+				traceParent = snap.TraceParent
+			}
 		case <-time.After(s.Interval):
 			// send whatever we have on each tick, do not wait
 			// to have complete batches
 			if len(batch.Snapshots) > 0 {
-				payload, err := batch.Encode()
-				if err != nil {
-					s.log.Warn("Error encoding batch, dropping it")
-					continue
-				}
-				s.agent.Out.Publish(&gossip.Message{
-					Kind:    gossip.BatchMessageType,
-					TTL:     s.TTL,
-					Payload: payload,
-				})
-				QedSenderBatchesSentTotal.Inc()
+				s.publish(batch, traceParent)
 				batch = s.newBatch()
+				traceParent = ""
 			}
 		case <-s.quitCh:
 			return
@@ -151,13 +153,56 @@ func (s Sender) batcher(id int, ch chan *protocol.Snapshot) {
 	}
 }
 
+// publish encodes the batch and sends it to the gossip network along
+// with the trace context of the request that originated it.
+func (s Sender) publish(batch *protocol.BatchSnapshots, traceParent string) {
+	ctx := tracing.ContextWithTraceParent(context.Background(), traceParent)
+	ctx, span := tracing.StartSpan(ctx, "gossip.send_batch")
+	defer span.End()
+	span.SetAttribute("gossip.snapshots", len(batch.Snapshots))
+
+	payload, err := batch.Encode()
+	if err != nil {
+		span.SetError(err)
+		s.log.Warn("Error encoding batch, dropping it")
+		return
+	}
+
+	s.agent.Out.Publish(&gossip.Message{
+		Kind:        gossip.BatchMessageType,
+		TTL:         s.TTL,
+		Payload:     payload,
+		TraceParent: tracing.TraceParent(ctx),
+	})
+	QedSenderBatchesSentTotal.Inc()
+}
+
+func (s Sender) publishAuditRoot(root *protocol.AuditRoot) {
+	signature, err := s.signer.Sign(root.SigningMessage())
+	if err != nil {
+		s.log.Warnf("Failed signing audit root %d: %v", root.Version, err)
+		return
+	}
+	signed := &protocol.SignedAuditRoot{Root: root, Signature: signature}
+	payload, err := signed.Encode()
+	if err != nil {
+		s.log.Warnf("Error encoding audit root %d, dropping it", root.Version)
+		return
+	}
+	s.agent.Out.Publish(&gossip.Message{
+		Kind:    gossip.AuditRootMessageType,
+		TTL:     s.TTL,
+		Payload: payload,
+	})
+}
+
 func (s Sender) Stop() {
 	QedSenderInstancesCount.Dec()
 	close(s.quitCh)
 }
 
 func (s *Sender) doSign(snapshot *protocol.Snapshot) (*protocol.SignedSnapshot, error) {
-	signature, err := s.signer.Sign([]byte(fmt.Sprintf("%v", snapshot)))
+	signature, err := s.signer.Sign(snapshot.SigningMessage())
 	if err != nil {
 		s.log.Error("Publisher: error signing snapshot")
 		return nil, err
@@ -27,6 +27,7 @@ import (
 
 	"github.com/bbva/qed/api/apihttp"
 	"github.com/bbva/qed/api/mgmthttp"
+	"github.com/bbva/qed/balloon"
 	"github.com/bbva/qed/consensus"
 	"github.com/bbva/qed/crypto/sign"
 	"github.com/bbva/qed/crypto/tlsutil"
@@ -34,7 +35,8 @@ import (
 	"github.com/bbva/qed/log"
 	"github.com/bbva/qed/metrics"
 	"github.com/bbva/qed/protocol"
-	"github.com/bbva/qed/storage/rocks"
+	"github.com/bbva/qed/storage/archive"
+	"github.com/bbva/qed/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -51,7 +53,10 @@ type Server struct {
 	signer             sign.Signer
 	sender             *Sender
 	agent              *gossip.Agent
-	snapshotsCh        chan *protocol.Snapshot
+	snapshotsCh        chan *consensus.TracedSnapshot
+	tracer             *tracing.Tracer
+	auditor            *auditor
+	backups            *backupUploader
 	log                log.Logger
 }
 
@@ -85,8 +90,11 @@ func NewServerWithLogger(conf *Config, logger log.Logger) (*Server, error) {
 		return nil, err
 	}
 
-	// Open RocksDB store
-	store, err := rocks.NewRocksDBStore(conf.DBPath, conf.DbWalTtl)
+	// Open the store, unless it is a restore that failed verification
+	if err := checkRestoreVerified(conf.DBPath); err != nil {
+		return nil, err
+	}
+	store, err := OpenStore(conf.DBEngine, conf.DBPath, conf.DbWalTtl, false)
 	if err != nil {
 		return nil, err
 	}
@@ -96,10 +104,32 @@ func NewServerWithLogger(conf *Config, logger log.Logger) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	rotation, err := checkSignerRotation(conf.DBPath, conf.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create backup targets
+	server.backups, err = newBackupUploader(conf, store, server.signer, logger.Named("backup"))
+	if err != nil {
+		return nil, err
+	}
 
 	// Create metrics server
 	server.metricsServer = metrics.NewServer(conf.MetricsAddr)
 
+	// Create tracer
+	if conf.TracingExporter != "" {
+		exporter, err := tracing.NewExporter(conf.TracingExporter, conf.TracingEndpoint, "qed-server")
+		if err != nil {
+			return nil, err
+		}
+		tracerConf := tracing.DefaultTracerConfig()
+		tracerConf.SampleRatio = conf.TracingSampleRatio
+		server.tracer = tracing.NewTracerWithLogger(exporter, tracerConf, logger.Named("tracing"))
+		tracing.SetTracer(server.tracer)
+	}
+
 	// Create profiling server
 	if server.conf.EnableProfiling {
 		go func() {
@@ -123,7 +153,7 @@ func NewServerWithLogger(conf *Config, logger log.Logger) (*Server, error) {
 	}
 
 	// TODO: add queue size to config
-	server.snapshotsCh = make(chan *protocol.Snapshot, 1<<16)
+	server.snapshotsCh = make(chan *consensus.TracedSnapshot, 1<<16)
 
 	// Create sender
 	server.sender = NewSenderWithLogger(server.agent, server.signer, 500, 2, 3, server.log.Named("sender"))
@@ -148,12 +178,65 @@ func NewServerWithLogger(conf *Config, logger log.Logger) (*Server, error) {
 	clusterOpts.Addr = conf.RaftAddr
 	clusterOpts.HttpAddr = conf.HTTPAddr
 	clusterOpts.RaftLogPath = conf.RaftPath
+	clusterOpts.RaftLogEngine = conf.DBEngine
+	clusterOpts.CheckpointPath = conf.DBPath + "/checkpoints"
 	clusterOpts.MgmtAddr = conf.MgmtAddr
 	clusterOpts.Bootstrap = bootstrap
 	clusterOpts.RaftLogging = true
 	clusterOpts.RaftHeartbeatTimeout = conf.RaftHeartbeatTimeout
 	clusterOpts.RaftElectionTimeout = conf.RaftElectionTimeout
 	clusterOpts.RaftLeaseTimeout = conf.RaftLeaseTimeout
+	clusterOpts.HyperCache = &balloon.CacheOptions{
+		Levels:    conf.HyperCacheLevels,
+		MaxMemory: conf.HyperCacheMaxMemory,
+		Path:      conf.HyperCachePath,
+	}
+	clusterOpts.HyperCacheCheckpointInterval = conf.HyperCacheCheckpointInterval
+	clusterOpts.HyperCacheCheckpointPath = conf.HyperCacheCheckpointPath
+	clusterOpts.HyperHistory = conf.HyperHistory
+	clusterOpts.RaftExtendedCommands = conf.RaftExtendedCommands
+	if conf.HistoryArchivePath != "" {
+		clusterOpts.HistoryArchive, err = archive.NewBackend(conf.HistoryArchivePath, &archive.S3Options{
+			Endpoint:        conf.HistoryArchiveS3Endpoint,
+			Region:          conf.HistoryArchiveS3Region,
+			AccessKeyID:     conf.HistoryArchiveS3AccessKey,
+			SecretAccessKey: conf.HistoryArchiveS3SecretKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		clusterOpts.HistoryArchiveKeepVersions = conf.HistoryArchiveKeepVersions
+		clusterOpts.HistoryArchiveInterval = conf.HistoryArchiveInterval
+		logger.Infof("History archive enabled in %s", conf.HistoryArchivePath)
+	}
+	if conf.ConsistencyCheckInterval > 0 {
+		clusterOpts.ConsistencyCheckInterval = conf.ConsistencyCheckInterval
+		if len(conf.ConsistencyCheckSnapshotStore) > 0 {
+			storeConf := gossip.DefaultRestSnapshotStoreConfig()
+			storeConf.Endpoint = conf.ConsistencyCheckSnapshotStore
+			snapshotStore := gossip.NewRestSnapshotStoreFromConfig(storeConf)
+			clusterOpts.ConsistencyCheckSnapshots = SnapshotsFromStore(snapshotStore, logger.Named("consistency"))
+		}
+	}
+	if conf.BackupInterval > 0 {
+		clusterOpts.BackupInterval = conf.BackupInterval
+		clusterOpts.BackupRetention = &consensus.BackupRetention{
+			KeepLast:   conf.BackupKeepLast,
+			KeepDaily:  conf.BackupKeepDaily,
+			KeepWeekly: conf.BackupKeepWeekly,
+		}
+		clusterOpts.BackupVerify = conf.BackupVerify
+		if conf.BackupScheduledTarget != "" {
+			clusterOpts.BackupUpload = func(backupID uint32) (string, error) {
+				manifest, err := server.backups.Upload(backupID, conf.BackupScheduledTarget)
+				if err != nil {
+					return "", err
+				}
+				return manifest.Name, nil
+			}
+		}
+		logger.Infof("Scheduled backups enabled every %v", conf.BackupInterval)
+	}
 	if !bootstrap {
 		clusterOpts.Seeds = conf.RaftJoinAddr
 	}
@@ -171,9 +254,15 @@ func NewServerWithLogger(conf *Config, logger log.Logger) (*Server, error) {
 		server.httpServer = newHTTPServer(conf.HTTPAddr, httpMux, logger.Named("api"))
 	}
 
+	// Record the administrative operations
+	server.auditor = newAuditor(conf.NodeID, conf.DBPath, server.raftNode, conf.RaftExtendedCommands, logger.Named("audit"))
+	if rotation != nil {
+		logger.Infof("Signer key changed since the last start: %s", rotation.Target)
+	}
+
 	// Create management endpoints
-	mgmtMux := mgmthttp.NewMgmtHttp(server.raftNode)
-	server.mgmtServer = newHTTPServer(conf.MgmtAddr, mgmtMux, logger.Named("mgmt"))
+	mgmtMux := mgmthttp.NewMgmtHttpWithLogger(&mgmtApi{server.raftNode, server.backups}, logger)
+	server.mgmtServer = newHTTPServer(conf.MgmtAddr, mgmthttp.AuditHandler(mgmtMux, server.auditor), logger.Named("mgmt"))
 
 	// register qed metrics
 	server.metrics = newServerMetrics()
@@ -186,11 +275,27 @@ func NewServerWithLogger(conf *Config, logger log.Logger) (*Server, error) {
 	return server, nil
 }
 
+// mgmtApi adds the management operations implemented by the server to
+// the ones of the Raft node.
+type mgmtApi struct {
+	*consensus.RaftNode
+	backups *backupUploader
+}
+
+func (a *mgmtApi) UploadBackup(backupID uint32, target string) (*protocol.BackupManifest, error) {
+	return a.backups.Upload(backupID, target)
+}
+
 // Start will start the server in a non-blockable fashion.
 func (s *Server) Start() error {
 	s.metrics.Instances.Inc()
 	s.log.Infof("Starting QED server. Node ID: %s", s.conf.NodeID)
 
+	s.log.Info("Starting audit log...")
+	if err := s.auditor.Start(); err != nil {
+		return err
+	}
+
 	metadata := map[string]string{}
 	metadata["HTTPAddr"] = s.conf.HTTPAddr
 
@@ -235,6 +340,7 @@ func (s *Server) Start() error {
 
 	s.log.Info("Starting snapshots sender...")
 	s.sender.Start(s.snapshotsCh)
+	s.sender.StartAuditRoots(s.raftNode.AuditRoots())
 
 	if err := s.raftNode.WaitForLeader(5 * time.Second); err != nil {
 		return err
@@ -265,6 +371,9 @@ func (s *Server) Stop() error {
 		return err
 	}
 
+	s.log.Info("Stopping audit log...")
+	s.auditor.Stop()
+
 	s.log.Info("Closing QED sender...")
 	s.sender.Stop()
 
@@ -283,6 +392,14 @@ func (s *Server) Stop() error {
 
 	close(s.snapshotsCh)
 
+	if s.tracer != nil {
+		s.log.Info("Flushing traces...")
+		tracing.SetTracer(nil)
+		if err := s.tracer.Close(); err != nil {
+			s.log.Errorf("Unable to close tracer: %v", err)
+		}
+	}
+
 	s.log.Info("Done. Exiting...")
 	return nil
 }
@@ -293,7 +410,7 @@ func (s *Server) RegisterMetrics(registry metrics.Registry) {
 	}
 }
 
-func newTLSServer(addr string, mux *http.ServeMux, logger log.Logger) *http.Server {
+func newTLSServer(addr string, mux http.Handler, logger log.Logger) *http.Server {
 
 	cfg := &tls.Config{
 		MinVersion: tls.VersionTLS12,
@@ -318,7 +435,7 @@ func newTLSServer(addr string, mux *http.ServeMux, logger log.Logger) *http.Serv
 
 	return &http.Server{
 		Addr:      addr,
-		Handler:   apihttp.LogHandler(mux, logger),
+		Handler:   apihttp.LogHandler(apihttp.TracingHandler(mux), logger),
 		TLSConfig: cfg,
 		ErrorLog: logger.StdLogger(&log.StdLoggerOptions{
 			ForceLevel: log.Error,
@@ -327,10 +444,10 @@ func newTLSServer(addr string, mux *http.ServeMux, logger log.Logger) *http.Serv
 
 }
 
-func newHTTPServer(addr string, mux *http.ServeMux, logger log.Logger) *http.Server {
+func newHTTPServer(addr string, mux http.Handler, logger log.Logger) *http.Server {
 	return &http.Server{
 		Addr:    addr,
-		Handler: apihttp.LogHandler(mux, logger),
+		Handler: apihttp.LogHandler(apihttp.TracingHandler(mux), logger),
 		ErrorLog: logger.StdLogger(&log.StdLoggerOptions{
 			ForceLevel: log.Error,
 		}),
@@ -0,0 +1,245 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bbva/qed/balloon"
+	"github.com/bbva/qed/consensus"
+	"github.com/bbva/qed/crypto/hashing"
+	"github.com/bbva/qed/log"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/bolt"
+)
+
+// restoreUnverifiedFile marks, in the database directory, a restored
+// database that has not passed verification, so servers refuse to use it.
+const restoreUnverifiedFile = "restore.unverified"
+
+// OpenStore opens the database in the given path using the selected
+// storage engine. Stores opened in read-only mode do not support
+// writes nor backups.
+func OpenStore(engine, path string, walTtl time.Duration, readOnly bool) (storage.ManagedStore, error) {
+	switch engine {
+	case "", storage.RocksDBEngine:
+		return openRocksDBStore(path, walTtl, readOnly)
+	case storage.BoltEngine:
+		opts := bolt.DefaultOptions()
+		opts.Path = path
+		opts.WALTtl = walTtl
+		opts.ReadOnly = readOnly
+		return bolt.NewBoltStoreWithOpts(opts)
+	default:
+		return nil, fmt.Errorf("Unknown storage engine %s", engine)
+	}
+}
+
+// RestoreBackup restores the backup identified by backupID, or the
+// latest one if it is 0, from the backups directory of a database
+// built with the selected storage engine to the restore path. The restore
+// is recorded in the audit log once a server starts on the restored database.
+func RestoreBackup(engine, backupDir string, backupID uint32, restorePath string) error {
+	engine, err := restoreBackup(engine, backupDir, backupID, restorePath)
+	if err != nil {
+		return err
+	}
+
+	// the server records the restore in the audit log when it starts
+	backup := "latest"
+	if backupID != 0 {
+		backup = fmt.Sprint(backupID)
+	}
+	target := fmt.Sprintf("engine=%s backup=%s dir=%s", engine, backup, backupDir)
+	return AppendPendingAuditEntries(restorePath, newLocalAuditEntry("restore", target))
+}
+
+func restoreBackup(engine, backupDir string, backupID uint32, restorePath string) (string, error) {
+	switch engine {
+	case "", storage.RocksDBEngine:
+		return storage.RocksDBEngine, restoreRocksDBBackup(backupDir, backupID, restorePath)
+	case storage.BoltEngine:
+		return engine, bolt.RestoreFromBackup(backupDir, backupID, restorePath)
+	default:
+		return engine, fmt.Errorf("Unknown storage engine %s", engine)
+	}
+}
+
+// PointInTimeRestore configures the restore of a database to a given
+// version of the balloon.
+type PointInTimeRestore struct {
+	Engine      string // Storage engine of the backups, the database and the Raft log.
+	BackupDir   string // Directory with the backups of the database.
+	RestorePath string // Path to restore the database.
+	Version     uint64 // Version to restore.
+
+	// Database whose WAL is replayed after the backup, and Raft directory
+	// of a node whose log is replayed after the WAL. Both are optional,
+	// and the servers using them must be stopped.
+	DBPath   string
+	RaftPath string
+
+	// Keep every version of the hyper tree, as the servers do.
+	HyperHistory bool
+
+	// Hasher the database was built with.
+	HasherF func() hashing.Hasher
+
+	// Returns the signed snapshot of a version to validate the restored
+	// database with.
+	Snapshots func(version uint64) (*balloon.Snapshot, error)
+}
+
+// BackupsInfo returns the information of the backups found in the
+// backups directory of a database built with the selected storage engine.
+func BackupsInfo(engine, backupDir string) ([]*storage.BackupInfo, error) {
+	switch engine {
+	case "", storage.RocksDBEngine:
+		return rocksDBBackupsInfo(backupDir)
+	case storage.BoltEngine:
+		return bolt.ReadBackupsInfo(backupDir), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage engine %s", engine)
+	}
+}
+
+// RestoreToVersion restores the backup containing the closest version at
+// or before the requested one, and replays the events added after it from
+// the WAL of the database and the Raft log up to exactly that version.
+// The history root of the version is validated against its signed snapshot.
+// It returns the backup restored and the report of the replay.
+func RestoreToVersion(r *PointInTimeRestore) (*storage.BackupInfo, *consensus.ReplayReport, error) {
+	backups, err := BackupsInfo(r.Engine, r.BackupDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	backup := storage.ClosestBackup(backups, r.Version)
+	if backup == nil {
+		return nil, nil, fmt.Errorf("No backup found at or before version %d in %s", r.Version, r.BackupDir)
+	}
+	engine, err := restoreBackup(r.Engine, r.BackupDir, uint32(backup.ID), r.RestorePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := OpenStore(engine, r.RestorePath, 0, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	opts := &consensus.ReplayOptions{
+		Version:       r.Version,
+		RaftLogPath:   r.RaftPath,
+		RaftLogEngine: engine,
+		HyperHistory:  r.HyperHistory,
+		Snapshots:     r.Snapshots,
+	}
+	if r.DBPath != "" {
+		wal, err := OpenStore(engine, r.DBPath, 0, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open the database %s: %v", r.DBPath, err)
+		}
+		defer wal.Close()
+		opts.WAL = wal
+	}
+
+	report, err := consensus.ReplayToVersion(db, r.HasherF, opts)
+	if err != nil {
+		return backup, report, err
+	}
+
+	target := fmt.Sprintf("engine=%s backup=%d dir=%s version=%d", engine, backup.ID, r.BackupDir, r.Version)
+	return backup, report, AppendPendingAuditEntries(r.RestorePath, newLocalAuditEntry("restore", target))
+}
+
+// VerifyRestore opens the database restored in the given path read-only,
+// recomputes the history root, and the hyper root if hyper is true, of its
+// last version, and compares them with the signed snapshot of the version.
+// The snapshots function must verify the signature of the snapshots it
+// returns. The database is marked as unusable until it passes verification.
+func VerifyRestore(engine, path string, snapshots func(version uint64) (*balloon.Snapshot, error), hyper bool) (*balloon.CheckReport, error) {
+	if err := markRestoreUnverified(path, "verification in progress"); err != nil {
+		return nil, err
+	}
+	report, err := verifyRestore(engine, path, snapshots, hyper)
+	if err == nil && !report.Ok() {
+		err = fmt.Errorf("Verification of version %d failed with %d errors, first: %v", report.Version, len(report.Corruptions), report.Corruptions[0])
+	}
+	if err != nil {
+		if err := markRestoreUnverified(path, err.Error()); err != nil {
+			log.L().Errorf("Unable to mark the restored database as unverified: %v", err)
+		}
+		return report, err
+	}
+	return report, os.Remove(filepath.Join(path, restoreUnverifiedFile))
+}
+
+func verifyRestore(engine, path string, snapshots func(version uint64) (*balloon.Snapshot, error), hyper bool) (*balloon.CheckReport, error) {
+	db, err := OpenStore(engine, path, 0, true)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the restored database: %v", err)
+	}
+	defer db.Close()
+
+	b, err := balloon.NewBalloonWithLogger(db, hashing.NewSha256Hasher, log.L().Named("balloon"))
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	if b.Version() == 0 {
+		return nil, fmt.Errorf("The restored database has no events to verify")
+	}
+	version := b.Version() - 1
+	report, err := b.Check(&balloon.CheckOptions{
+		Start:     version,
+		End:       version,
+		Hyper:     hyper,
+		Snapshots: snapshots,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report.Snapshots == 0 {
+		return report, fmt.Errorf("No signed snapshot found for version %d", version)
+	}
+	return report, nil
+}
+
+func markRestoreUnverified(path, reason string) error {
+	return ioutil.WriteFile(filepath.Join(path, restoreUnverifiedFile), []byte(reason+"\n"), 0644)
+}
+
+// checkRestoreVerified returns an error if the database in the given path
+// was restored and has not passed verification.
+func checkRestoreVerified(path string) error {
+	reason, err := ioutil.ReadFile(filepath.Join(path, restoreUnverifiedFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("The database in %s was restored but has not passed verification (%s): restore it again, or remove %s to use it anyway",
+		path, strings.TrimSpace(string(reason)), restoreUnverifiedFile)
+}
@@ -0,0 +1,38 @@
+//go:build !cgo
+// +build !cgo
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"time"
+
+	"github.com/bbva/qed/storage"
+)
+
+func openRocksDBStore(path string, walTtl time.Duration, readOnly bool) (storage.ManagedStore, error) {
+	return nil, storage.ErrRocksDBUnavailable
+}
+
+func restoreRocksDBBackup(backupDir string, backupID uint32, restorePath string) error {
+	return storage.ErrRocksDBUnavailable
+}
+
+func rocksDBBackupsInfo(backupDir string) ([]*storage.BackupInfo, error) {
+	return nil, storage.ErrRocksDBUnavailable
+}
@@ -0,0 +1,79 @@
+//go:build cgo
+// +build cgo
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package server
+
+import (
+	"time"
+
+	"github.com/bbva/qed/rocksdb"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/storage/rocks"
+)
+
+func openRocksDBStore(path string, walTtl time.Duration, readOnly bool) (storage.ManagedStore, error) {
+	opts := rocks.DefaultOptions()
+	opts.Path = path
+	opts.WALTtlSeconds = uint64(walTtl.Seconds())
+	opts.ReadOnly = readOnly
+	return rocks.NewRocksDBStoreWithOpts(opts)
+}
+
+func restoreRocksDBBackup(backupDir string, backupID uint32, restorePath string) error {
+	bo := rocksdb.NewDefaultOptions()
+	be, err := rocksdb.OpenBackupEngine(bo, backupDir)
+	if err != nil {
+		return err
+	}
+
+	ro := rocksdb.NewRestoreOptions()
+	defer ro.Destroy()
+
+	if backupID == 0 {
+		return be.RestoreDBFromLatestBackup(restorePath, restorePath, ro)
+	}
+	return be.RestoreDBFromBackup(backupID, restorePath, restorePath, ro)
+}
+
+func rocksDBBackupsInfo(backupDir string) ([]*storage.BackupInfo, error) {
+	bo := rocksdb.NewDefaultOptions()
+	be, err := rocksdb.OpenBackupEngine(bo, backupDir)
+	if err != nil {
+		return nil, err
+	}
+	defer be.Close()
+
+	bi := be.GetInfo()
+	if bi == nil {
+		return nil, nil
+	}
+	defer bi.Destroy()
+
+	backupsInfo := make([]*storage.BackupInfo, bi.GetCount())
+	for i := 0; i < bi.GetCount(); i++ {
+		backupsInfo[i] = &storage.BackupInfo{
+			ID:        bi.GetBackupID(i),
+			Timestamp: bi.GetTimestamp(i),
+			Size:      bi.GetSize(i),
+			NumFiles:  bi.GetNumFiles(i),
+			Metadata:  bi.GetAppMetadata(i),
+		}
+	}
+	return backupsInfo, nil
+}
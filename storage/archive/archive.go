@@ -0,0 +1,88 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package archive implements the backends used to keep immutable
+// files, like the segments of cold history tree nodes, out of the
+// database. Files can be stored in a local directory, in an
+// S3-compatible object store or in a remote host through SSH.
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned when the requested file is not in the archive.
+var ErrNotFound = errors.New("File not found in the archive")
+
+// Backend stores immutable files by name.
+type Backend interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+}
+
+// Options configure the access to the remote backends.
+type Options struct {
+	S3  *S3Options
+	SSH *SSHOptions
+}
+
+// NewBackend returns the backend for the given location, which is
+// either a local directory or an s3://bucket/prefix URL. The S3 options
+// are only used for S3 locations.
+func NewBackend(location string, s3Opts *S3Options) (Backend, error) {
+	return NewBackendWithOptions(location, &Options{S3: s3Opts})
+}
+
+// NewBackendWithOptions works like NewBackend, also accepting locations
+// of remote hosts, like ssh://user@host:port/path.
+func NewBackendWithOptions(location string, opts *Options) (Backend, error) {
+	if !strings.HasPrefix(location, "s3://") && !strings.HasPrefix(location, "ssh://") {
+		return NewLocalBackend(location)
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Missing host in archive location %s", location)
+	}
+
+	if u.Scheme == "ssh" {
+		sshOpts := SSHOptions{}
+		if opts.SSH != nil {
+			sshOpts = *opts.SSH
+		}
+		if u.User != nil {
+			sshOpts.User = u.User.Username()
+		}
+		return NewSSHBackend(u.Host, u.Path, &sshOpts)
+	}
+
+	s3Opts := S3Options{}
+	if opts.S3 != nil {
+		s3Opts = *opts.S3
+	}
+	s3Opts.Bucket = u.Host
+	s3Opts.Prefix = strings.TrimPrefix(u.Path, "/")
+	return NewS3Backend(&s3Opts)
+}
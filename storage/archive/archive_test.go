@@ -0,0 +1,277 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package archive
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestLocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend, err := NewBackend(dir, nil)
+	require.NoError(t, err)
+	testBackend(t, backend)
+}
+
+func TestS3Backend(t *testing.T) {
+	server := newS3StandIn(t, "bucket", "access", "secret")
+	defer server.Close()
+
+	backend, err := NewBackend("s3://bucket/qed/", &S3Options{
+		Endpoint:        server.URL,
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	require.NoError(t, err)
+	testBackend(t, backend)
+
+	// requests with wrong credentials are rejected
+	backend, err = NewBackend("s3://bucket/qed/", &S3Options{
+		Endpoint:        server.URL,
+		AccessKeyID:     "access",
+		SecretAccessKey: "wrong",
+	})
+	require.NoError(t, err)
+	require.Error(t, backend.Put("segment", []byte{0x1}))
+	_, err = backend.Get("segment")
+	require.Error(t, err)
+	require.NotEqual(t, ErrNotFound, err)
+}
+
+func TestSSHBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qed-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := newSSHStandIn(t, dir)
+	defer opts.Close()
+	backend, err := NewBackendWithOptions("ssh://qed@"+opts.addr+dir+"/remote", &Options{SSH: opts.SSHOptions})
+	require.NoError(t, err)
+	testBackend(t, backend)
+
+	// names are quoted for the remote shell
+	require.NoError(t, backend.Put("it's $HOME", []byte{0x4}))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "remote", "it's $HOME"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x4}, data)
+
+	// unknown hosts are rejected
+	unknown := *opts.SSHOptions
+	unknown.KnownHostsPath = filepath.Join(dir, "empty_known_hosts")
+	require.NoError(t, ioutil.WriteFile(unknown.KnownHostsPath, nil, 0644))
+	backend, err = NewBackendWithOptions("ssh://qed@"+opts.addr+dir+"/remote", &Options{SSH: &unknown})
+	require.NoError(t, err)
+	_, err = backend.Get("segment")
+	require.Error(t, err)
+	require.NotEqual(t, ErrNotFound, err)
+}
+
+func testBackend(t *testing.T, backend Backend) {
+	_, err := backend.Get("segment")
+	require.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, backend.Put("segment", []byte{0x1, 0x2}))
+	data, err := backend.Get("segment")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x1, 0x2}, data)
+
+	require.NoError(t, backend.Put("segment", []byte{0x3}))
+	data, err = backend.Get("segment")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x3}, data)
+
+	require.NoError(t, backend.Put("set/segment", []byte{0x5}))
+	data, err = backend.Get("set/segment")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x5}, data)
+}
+
+// newS3StandIn starts an in-memory object store that only accepts
+// requests signed with the given credentials.
+func newS3StandIn(t *testing.T, bucket, accessKey, secretKey string) *httptest.Server {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+
+	verifier := &S3Backend{opts: S3Options{
+		Region:          "us-east-1",
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+	}}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		expected, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+		require.NoError(t, err)
+		verifier.sign(expected, body, now)
+		if r.Header.Get("Authorization") != expected.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, "/"+bucket+"/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[key] = body
+		case http.MethodGet:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+type sshStandIn struct {
+	net.Listener
+	addr string
+	*SSHOptions
+}
+
+// newSSHStandIn starts an SSH server that only accepts the client key
+// written to the given directory, and runs the commands of the sessions
+// with the local shell.
+func newSSHStandIn(t *testing.T, dir string) *sshStandIn {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "qed" || string(key.Marshal()) != string(clientPub.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().String()
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{addr}, hostSigner.PublicKey())
+	require.NoError(t, ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0644))
+
+	return &sshStandIn{Listener: listener, addr: addr, SSHOptions: &SSHOptions{
+		KeyPath:        keyPath,
+		KnownHostsPath: knownHostsPath,
+	}}
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				// the payload is the length-prefixed command
+				cmd := exec.Command("sh", "-c", string(req.Payload[4:]))
+				cmd.Stdin = channel
+				cmd.Stdout = channel
+				cmd.Stderr = channel.Stderr()
+				status := make([]byte, 4)
+				if err := cmd.Run(); err != nil {
+					code := 1
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						code = exitErr.ExitCode()
+					}
+					binary.BigEndian.PutUint32(status, uint32(code))
+				}
+				_, _ = channel.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// exit status of the remote commands when the file does not exist
+const sshNotFoundStatus = 44
+
+// SSHOptions configure the access to a remote host through SSH.
+type SSHOptions struct {
+	User           string        // User name, unless given in the location.
+	KeyPath        string        // Path of the private key used to authenticate.
+	KnownHostsPath string        // Path of the known_hosts file used to verify the host, ~/.ssh/known_hosts by default.
+	Timeout        time.Duration // Timeout of every connection, 30 seconds by default.
+}
+
+// SSHBackend keeps the files in a directory of a remote host. Like scp
+// or sftp, files are copied over SSH sessions, which run the mkdir, cat
+// and mv commands of the remote shell.
+type SSHBackend struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+}
+
+// NewSSHBackend returns a backend for the given directory of the host,
+// whose address is host[:port].
+func NewSSHBackend(addr, dir string, opts *SSHOptions) (*SSHBackend, error) {
+	if opts == nil || opts.KeyPath == "" {
+		return nil, errors.New("Missing SSH private key")
+	}
+	if opts.User == "" {
+		return nil, errors.New("Missing SSH user")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	key, err := ioutil.ReadFile(opts.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse SSH private key: %v", err)
+	}
+
+	knownHostsPath := opts.KnownHostsPath
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load SSH known hosts: %v", err)
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &SSHBackend{
+		addr: addr,
+		dir:  dir,
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         timeout,
+		},
+	}, nil
+}
+
+// Put writes the file to a temporary file first, so readers never get
+// partial contents.
+func (b *SSHBackend) Put(name string, data []byte) error {
+	p := path.Join(b.dir, name)
+	cmd := fmt.Sprintf("mkdir -p %s && cat > %s && mv %s %s",
+		shellQuote(path.Dir(p)), shellQuote(p+".tmp"), shellQuote(p+".tmp"), shellQuote(p))
+	_, err := b.run(cmd, data)
+	return err
+}
+
+func (b *SSHBackend) Get(name string) ([]byte, error) {
+	p := shellQuote(path.Join(b.dir, name))
+	cmd := fmt.Sprintf("if [ -f %s ]; then cat %s; else exit %d; fi", p, p, sshNotFoundStatus)
+	data, err := b.run(cmd, nil)
+	if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.ExitStatus() == sshNotFoundStatus {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// run runs the command in a new connection to the host, with the given
+// standard input, and returns its standard output.
+func (b *SSHBackend) run(cmd string, stdin []byte) ([]byte, error) {
+	client, err := ssh.Dial("tcp", b.addr, b.config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = bytes.NewReader(stdin)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.ExitStatus() != sshNotFoundStatus {
+			return nil, fmt.Errorf("SSH command failed on %s: %v: %s", b.addr, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// shellQuote quotes the string to be used as a single word in a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,988 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bolt implements a pure-Go storage.ManagedStore on top of
+// bbolt, so QED can be built and run without cgo.
+//
+// Every write batch is applied in a single transaction which also
+// appends the batch, with its metadata, to a WAL bucket. The WAL is
+// used to stream incremental snapshots to other replicas and is pruned
+// by age and size as new batches are written.
+package bolt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbva/qed/metrics"
+	"github.com/bbva/qed/storage"
+	"github.com/bbva/qed/util"
+	bbolt "go.etcd.io/bbolt"
+)
+
+const (
+	dbFileName     = "qed.db"
+	backupsDirName = "backups"
+	backupMetaFile = "meta.json"
+
+	// maxPrunedPerBatch bounds the number of WAL records deleted
+	// in the same transaction as a new write batch.
+	maxPrunedPerBatch = 1000
+	// pageSize is the number of records read in every short-lived
+	// transaction when iterating over a table or the WAL.
+	pageSize = 1000
+)
+
+var (
+	walBucket  = []byte("wal")
+	metaBucket = []byte("meta")
+	seqKey     = []byte("seq")
+
+	tables = []storage.Table{
+		storage.DefaultTable,
+		storage.HyperTable,
+		storage.HyperCacheTable,
+		storage.HistoryTable,
+		storage.FSMStateTable,
+		storage.HyperHistoryTable,
+		storage.AuditTable,
+		storage.AuditHistoryTable,
+	}
+)
+
+type BoltStore struct {
+	path string
+	db   *bbolt.DB
+	opts *Options
+
+	// sequence number of the last write batch
+	seq uint64
+
+	metrics *boltMetrics
+}
+
+type Options struct {
+	Path          string
+	WALTtl        time.Duration // Max age of the WAL records. Zero means no limit.
+	WALMaxBatches uint64        // Max number of batches kept in the WAL. Zero means no limit.
+	NoSync        bool          // Skip fsync after every commit.
+	ReadOnly      bool          // Open an existing database without write or backup support.
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		WALTtl:        0,
+		WALMaxBatches: 1 << 14,
+	}
+}
+
+func NewBoltStore(path string, ttl time.Duration) (*BoltStore, error) {
+	opts := DefaultOptions()
+	opts.Path = path
+	opts.WALTtl = ttl
+	return NewBoltStoreWithOpts(opts)
+}
+
+func NewBoltStoreWithOpts(opts *Options) (*BoltStore, error) {
+
+	dbPath := filepath.Join(opts.Path, dbFileName)
+	if !opts.ReadOnly {
+		if err := os.MkdirAll(filepath.Join(opts.Path, backupsDirName), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := bbolt.Open(dbPath, 0644, &bbolt.Options{
+		Timeout:  time.Second,
+		NoSync:   opts.NoSync,
+		ReadOnly: opts.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store := &BoltStore{
+		path: opts.Path,
+		db:   db,
+		opts: opts,
+	}
+
+	if !opts.ReadOnly {
+		err = db.Update(func(tx *bbolt.Tx) error {
+			for _, name := range append(tableBuckets(), walBucket, metaBucket) {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		store.seq = readSeq(tx)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store.metrics = newBoltMetrics(store)
+	return store, nil
+}
+
+func tableBuckets() [][]byte {
+	names := make([][]byte, 0, len(tables))
+	for _, table := range tables {
+		names = append(names, []byte(table.String()))
+	}
+	return names
+}
+
+func readSeq(tx *bbolt.Tx) uint64 {
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return 0
+	}
+	v := b.Get(seqKey)
+	if v == nil {
+		return 0
+	}
+	return util.BytesAsUint64(v)
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// Mutate applies the mutations and appends them, tagged with the given
+// metadata, to the WAL in a single transaction.
+func (s *BoltStore) Mutate(mutations []*storage.Mutation, metadata []byte) error {
+	var seq uint64
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		seq = readSeq(tx) + 1
+		if err := applyMutations(tx, mutations); err != nil {
+			return err
+		}
+		record := append(util.Uint64AsBytes(uint64(time.Now().UnixNano())), encodeBatch(mutations, metadata)...)
+		if err := tx.Bucket(walBucket).Put(util.Uint64AsBytes(seq), record); err != nil {
+			return err
+		}
+		if err := tx.Bucket(metaBucket).Put(seqKey, util.Uint64AsBytes(seq)); err != nil {
+			return err
+		}
+		return s.pruneWAL(tx, seq)
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&s.seq, seq)
+	return nil
+}
+
+// Delete removes the given keys from the table. Deletions are not
+// appended to the WAL, so they are never sent to other replicas.
+func (s *BoltStore) Delete(table storage.Table, keys [][]byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.String()))
+		if b == nil {
+			return fmt.Errorf("Unknown table %s", table)
+		}
+		for _, key := range keys {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func applyMutations(tx *bbolt.Tx, mutations []*storage.Mutation) error {
+	for _, m := range mutations {
+		b := tx.Bucket([]byte(m.Table.String()))
+		if b == nil {
+			return fmt.Errorf("Unknown table %s", m.Table)
+		}
+		if err := b.Put(m.Key, m.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneWAL deletes the oldest WAL records exceeding the configured
+// age or number of batches.
+func (s *BoltStore) pruneWAL(tx *bbolt.Tx, last uint64) error {
+	if s.opts.WALTtl == 0 && s.opts.WALMaxBatches == 0 {
+		return nil
+	}
+	limit := time.Now().Add(-s.opts.WALTtl).UnixNano()
+	c := tx.Bucket(walBucket).Cursor()
+	k, v := c.First()
+	for i := 0; k != nil && i < maxPrunedPerBatch; i++ {
+		seq := util.BytesAsUint64(k)
+		tooMany := s.opts.WALMaxBatches > 0 && last-seq >= s.opts.WALMaxBatches
+		tooOld := s.opts.WALTtl > 0 && int64(util.BytesAsUint64(v[:8])) < limit
+		if seq == last || (!tooMany && !tooOld) {
+			break
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		k, v = c.First()
+	}
+	return nil
+}
+
+// encodeBatch serializes a write batch as the length-prefixed metadata
+// followed by every mutation as its table and length-prefixed key and value.
+func encodeBatch(mutations []*storage.Mutation, metadata []byte) []byte {
+	var buf bytes.Buffer
+	writeBytes(&buf, metadata)
+	for _, m := range mutations {
+		buf.WriteByte(byte(m.Table))
+		writeBytes(&buf, m.Key)
+		writeBytes(&buf, m.Value)
+	}
+	return buf.Bytes()
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(b)))
+	buf.Write(size[:n])
+	buf.Write(b)
+}
+
+func decodeBatch(data []byte) ([]*storage.Mutation, []byte, error) {
+	r := bytes.NewReader(data)
+	metadata, err := readBytes(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	mutations := make([]*storage.Mutation, 0)
+	for r.Len() > 0 {
+		table, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := readBytes(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		mutations = append(mutations, storage.NewMutation(storage.Table(table), key, value))
+	}
+	return mutations, metadata, nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("Corrupted batch: %v", err)
+	}
+	if size > uint64(r.Len()) {
+		return nil, fmt.Errorf("Corrupted batch")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("Corrupted batch: %v", err)
+	}
+	return b, nil
+}
+
+func (s *BoltStore) Get(table storage.Table, key []byte) (*storage.KVPair, error) {
+	result := new(storage.KVPair)
+	result.Key = key
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.String()))
+		if b == nil {
+			return storage.ErrKeyNotFound
+		}
+		v := b.Get(key)
+		if v == nil {
+			return storage.ErrKeyNotFound
+		}
+		result.Value = copyBytes(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *BoltStore) GetRange(table storage.Table, start, end []byte) (storage.KVRange, error) {
+	result := make(storage.KVRange, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.String()))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			result = append(result, storage.KVPair{Key: copyBytes(k), Value: copyBytes(v)})
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) GetLast(table storage.Table) (*storage.KVPair, error) {
+	var result *storage.KVPair
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.String()))
+		if b == nil {
+			return storage.ErrKeyNotFound
+		}
+		k, v := b.Cursor().Last()
+		if k == nil {
+			return storage.ErrKeyNotFound
+		}
+		result = &storage.KVPair{Key: copyBytes(k), Value: copyBytes(v)}
+		return nil
+	})
+	return result, err
+}
+
+// GetFloor returns the pair with the greatest key less than
+// or equal to the given one.
+func (s *BoltStore) GetFloor(table storage.Table, key []byte) (*storage.KVPair, error) {
+	var result *storage.KVPair
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.String()))
+		if b == nil {
+			return storage.ErrKeyNotFound
+		}
+		c := b.Cursor()
+		k, v := c.Seek(key)
+		switch {
+		case k == nil:
+			k, v = c.Last()
+		case !bytes.Equal(k, key):
+			k, v = c.Prev()
+		}
+		if k == nil {
+			return storage.ErrKeyNotFound
+		}
+		result = &storage.KVPair{Key: copyBytes(k), Value: copyBytes(v)}
+		return nil
+	})
+	return result, err
+}
+
+// GetAll returns a reader over every pair of the table. Every read
+// uses its own transaction, so readers never block the growth of the
+// database file, but they do not provide a consistent view either.
+func (s *BoltStore) GetAll(table storage.Table) storage.KVPairReader {
+	return &boltKVPairReader{db: s.db, bucket: []byte(table.String())}
+}
+
+type boltKVPairReader struct {
+	db     *bbolt.DB
+	bucket []byte
+	last   []byte
+	done   bool
+}
+
+func (r *boltKVPairReader) Read(buffer []*storage.KVPair) (n int, err error) {
+	if r.done {
+		return 0, nil
+	}
+	err = r.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(r.bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if r.last == nil {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(r.last)
+			if k != nil && bytes.Equal(k, r.last) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && n < len(buffer); k, v = c.Next() {
+			buffer[n] = &storage.KVPair{Key: copyBytes(k), Value: copyBytes(v)}
+			n++
+		}
+		return nil
+	})
+	if n > 0 {
+		r.last = buffer[n-1].Key
+	}
+	if n < len(buffer) {
+		r.done = true
+	}
+	return n, err
+}
+
+func (r *boltKVPairReader) Close() {
+	r.done = true
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// FetchSnapshot fetches all WAL transactions after the since sequence
+// number and up to the until one, and dumps them to the given writer.
+// It returns storage.ErrWALUnavailable without writing anything if
+// the WAL no longer contains the transactions following the since
+// sequence number.
+func (s *BoltStore) FetchSnapshot(w io.WriteCloser, since, until uint64, valid storage.ValidateF) error {
+
+	next := since + 1
+	first := true
+	for next <= until {
+		records, err := s.readWAL(next, until)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 || records[0].seq != next {
+			if first {
+				return storage.ErrWALUnavailable
+			}
+			w.Close()
+			return storage.ErrWALUnavailable
+		}
+		first = false
+
+		for _, record := range records {
+			_, metadata, err := decodeBatch(record.batch)
+			if err != nil {
+				w.Close()
+				return err
+			}
+			ok, err := valid(metadata)
+			if err != nil {
+				w.Close()
+				return err
+			}
+			if !ok {
+				continue
+			}
+			size := util.Uint64AsBytes(uint64(len(record.batch)))
+			if _, err := w.Write(append(size, record.batch...)); err != nil {
+				w.Close()
+				return err
+			}
+		}
+		next = records[len(records)-1].seq + 1
+	}
+
+	return w.Close()
+}
+
+type walRecord struct {
+	seq   uint64
+	batch []byte
+}
+
+// readWAL reads a page of contiguous WAL records starting at the
+// given sequence number.
+func (s *BoltStore) readWAL(from, until uint64) ([]walRecord, error) {
+	records := make([]walRecord, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(walBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		expected := from
+		for k, v := c.Seek(util.Uint64AsBytes(from)); k != nil && len(records) < pageSize; k, v = c.Next() {
+			seq := util.BytesAsUint64(k)
+			if seq > until || seq != expected {
+				break
+			}
+			records = append(records, walRecord{seq: seq, batch: copyBytes(v[8:])})
+			expected++
+		}
+		return nil
+	})
+	return records, err
+}
+
+// LoadSnapshot reads a list of serialized batches from a reader
+// and writes them to the database.
+// This method should be called on a database that is not running
+// any other concurrent transactions while it is running.
+func (s *BoltStore) LoadSnapshot(r io.ReadCloser) error {
+	defer r.Close()
+
+	sizeBuff := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, sizeBuff)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk := make([]byte, util.BytesAsUint64(sizeBuff))
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("Corrupted chunk: %v", err)
+		}
+		mutations, metadata, err := decodeBatch(chunk)
+		if err != nil {
+			return err
+		}
+		if err := s.Mutate(mutations, metadata); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checkpoint writes a copy of the database in the given directory,
+// which must not exist. It returns the sequence number of the last
+// transaction included in the checkpoint.
+func (s *BoltStore) Checkpoint(dir string) (uint64, error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		seq = readSeq(tx)
+		return tx.CopyFile(filepath.Join(dir, dbFileName), 0644)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// LoadCheckpoint replaces the contents of the database with the ones of
+// the checkpoint stored in the given directory. Tables are cleared and
+// copied in order, leaving the FSM state to the end, so the state is
+// never ahead of the trees. The WAL is discarded and the sequence number
+// is set to the one of the checkpoint, which must include every
+// transaction up to the given sequence number, so later snapshots can be
+// fetched from other replicas.
+// This method should be called on a database that is not running
+// any other concurrent transactions while it is running.
+func (s *BoltStore) LoadCheckpoint(dir string, seqNum uint64) error {
+
+	checkpoint, err := bbolt.Open(filepath.Join(dir, dbFileName), 0644, &bbolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer checkpoint.Close()
+
+	var seq uint64
+	err = checkpoint.View(func(tx *bbolt.Tx) error {
+		seq = readSeq(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if seq < seqNum {
+		return fmt.Errorf("Checkpoint only includes transactions up to seqNum %d, expected %d", seq, seqNum)
+	}
+
+	for _, table := range []storage.Table{
+		storage.HyperTable,
+		storage.HyperCacheTable,
+		storage.HistoryTable,
+		storage.HyperHistoryTable,
+		storage.AuditTable,
+		storage.AuditHistoryTable,
+		storage.FSMStateTable,
+	} {
+		if err := s.clearTable([]byte(table.String())); err != nil {
+			return fmt.Errorf("Unable to clear table %s: %v", table, err)
+		}
+		if err := s.copyTable(checkpoint, []byte(table.String())); err != nil {
+			return fmt.Errorf("Unable to load table %s from checkpoint: %v", table, err)
+		}
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(walBucket); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(walBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(seqKey, util.Uint64AsBytes(seq))
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&s.seq, seq)
+	return nil
+}
+
+// clearTable replaces a bucket with an empty one.
+func (s *BoltStore) clearTable(bucket []byte) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(bucket); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		_, err := tx.CreateBucket(bucket)
+		return err
+	})
+}
+
+func (s *BoltStore) copyTable(src *bbolt.DB, bucket []byte) error {
+	var last []byte
+	for {
+		pairs := make([]storage.KVPair, 0, pageSize)
+		err := src.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket(bucket)
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.First()
+			if last != nil {
+				k, v = c.Seek(last)
+				if k != nil && bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(pairs) < pageSize; k, v = c.Next() {
+				pairs = append(pairs, storage.KVPair{Key: copyBytes(k), Value: copyBytes(v)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(pairs) == 0 {
+			return nil
+		}
+		err = s.db.Update(func(tx *bbolt.Tx) error {
+			b := tx.Bucket(bucket)
+			for _, pair := range pairs {
+				if err := b.Put(pair.Key, pair.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		last = pairs[len(pairs)-1].Key
+	}
+}
+
+// LastWALSequenceNumber returns the sequence number of the
+// last transaction applied to the WAL. This sequence
+// number can be used as upper limit when fetching transactions
+// from the WAL.
+func (s *BoltStore) LastWALSequenceNumber() uint64 {
+	return atomic.LoadUint64(&s.seq)
+}
+
+type backupMeta struct {
+	ID        int64  `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Metadata  string `json:"metadata"`
+	// SHA256 is the hex encoded digest of the database file of the
+	// backup, taken right after copying it.
+	SHA256 string `json:"sha256"`
+}
+
+// fileSHA256 returns the hex encoded sha256 digest of the given file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *BoltStore) backupsDir() string {
+	return filepath.Join(s.path, backupsDirName)
+}
+
+// Backup writes a copy of the database with the given metadata in a new
+// directory under the backups directory of the store.
+func (s *BoltStore) Backup(metadata string) error {
+	var id int64 = 1
+	backups := ReadBackupsInfo(s.backupsDir())
+	if len(backups) > 0 {
+		id = backups[len(backups)-1].ID + 1
+	}
+
+	dir := filepath.Join(s.backupsDir(), strconv.FormatInt(id, 10))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(filepath.Join(dir, dbFileName), 0644)
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	digest, err := fileSHA256(filepath.Join(dir, dbFileName))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	meta, err := json.Marshal(&backupMeta{
+		ID:        id,
+		Timestamp: time.Now().Unix(),
+		Metadata:  metadata,
+		SHA256:    digest,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	// the metadata is written last, so incomplete backups are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, backupMetaFile), meta, 0644); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// GetBackupsInfo returns the information of every backup sorted by ID.
+func (s *BoltStore) GetBackupsInfo() []*storage.BackupInfo {
+	return ReadBackupsInfo(s.backupsDir())
+}
+
+// ReadBackupsInfo returns the information of every backup found in the
+// given backups directory sorted by ID.
+func ReadBackupsInfo(backupsDir string) []*storage.BackupInfo {
+	entries, err := ioutil.ReadDir(backupsDir)
+	if err != nil {
+		return nil
+	}
+	backupsInfo := make([]*storage.BackupInfo, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(backupsDir, entry.Name(), backupMetaFile))
+		if err != nil {
+			continue
+		}
+		var meta backupMeta
+		if err := json.Unmarshal(content, &meta); err != nil {
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(backupsDir, entry.Name(), dbFileName))
+		if err != nil {
+			continue
+		}
+		backupsInfo = append(backupsInfo, &storage.BackupInfo{
+			ID:        meta.ID,
+			Timestamp: meta.Timestamp,
+			Size:      stat.Size(),
+			NumFiles:  1,
+			Metadata:  meta.Metadata,
+		})
+	}
+	sort.Slice(backupsInfo, func(i, j int) bool {
+		return backupsInfo[i].ID < backupsInfo[j].ID
+	})
+	return backupsInfo
+}
+
+// DeleteBackup removes the backup identified by backupID.
+func (s *BoltStore) DeleteBackup(backupID uint32) error {
+	dir := filepath.Join(s.backupsDir(), strconv.FormatUint(uint64(backupID), 10))
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("Backup %d not found", backupID)
+	}
+	return os.RemoveAll(dir)
+}
+
+// VerifyBackup checks that the backup identified by backupID is complete,
+// that its database file has not changed since it was taken and that it
+// passes the bbolt consistency check.
+//
+// bbolt memory maps the files it opens and trusts their pages, so a
+// corrupted file can crash the process. The digest of the file is
+// compared before opening it, and only files matching the digest of the
+// backup are checked.
+func (s *BoltStore) VerifyBackup(backupID uint32) error {
+	dir := filepath.Join(s.backupsDir(), strconv.FormatUint(uint64(backupID), 10))
+	content, err := ioutil.ReadFile(filepath.Join(dir, backupMetaFile))
+	if err != nil {
+		return fmt.Errorf("Backup %d not found: %v", backupID, err)
+	}
+	var meta backupMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return fmt.Errorf("Invalid metadata in backup %d: %v", backupID, err)
+	}
+	if meta.ID != int64(backupID) {
+		return fmt.Errorf("Backup %d has metadata of backup %d", backupID, meta.ID)
+	}
+	if meta.SHA256 == "" {
+		return fmt.Errorf("Backup %d has no digest to verify", backupID)
+	}
+
+	dbPath := filepath.Join(dir, dbFileName)
+	digest, err := fileSHA256(dbPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read backup %d: %v", backupID, err)
+	}
+	if digest != meta.SHA256 {
+		return fmt.Errorf("Backup %d is corrupted: the digest of its database file does not match", backupID)
+	}
+
+	return checkBackup(backupID, dbPath)
+}
+
+// checkBackup opens the database file of a backup and runs the bbolt
+// consistency check on it. The check runs in a goroutine of bbolt whose
+// panics cannot be recovered, so every bucket is walked first in this
+// one, turning any panic or memory fault into an error.
+func checkBackup(backupID uint32, dbPath string) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Backup %d is corrupted: %v", backupID, r)
+		}
+	}()
+
+	db, err := bbolt.Open(dbPath, 0644, &bbolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to open backup %d: %v", backupID, err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(storage.FSMStateTable.String())) == nil {
+			return fmt.Errorf("Backup %d has no %s table", backupID, storage.FSMStateTable)
+		}
+		err := tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			return walkBucket(b)
+		})
+		if err != nil {
+			return err
+		}
+		// the check channel must be drained before closing the transaction
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = fmt.Errorf("Backup %d is corrupted: %v", backupID, err)
+			}
+		}
+		return checkErr
+	})
+}
+
+// walkBucket reads every key of the bucket and of its nested buckets.
+func walkBucket(b *bbolt.Bucket) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			if nested := b.Bucket(k); nested != nil {
+				return walkBucket(nested)
+			}
+		}
+		return nil
+	})
+}
+
+// RestoreFromBackup restores the backup identified by backupID to the
+// given database directory. The WAL is kept in the database file, so
+// the walDir is ignored.
+func (s *BoltStore) RestoreFromBackup(backupID uint32, dbDir, walDir string) error {
+	return RestoreFromBackup(s.backupsDir(), backupID, dbDir)
+}
+
+// RestoreFromBackup restores the backup identified by backupID, or the
+// latest one if it is 0, found in the given backups directory to the
+// database directory. Any database already present in that directory
+// is replaced.
+func RestoreFromBackup(backupsDir string, backupID uint32, dbDir string) error {
+	if backupID == 0 {
+		backups := ReadBackupsInfo(backupsDir)
+		if len(backups) == 0 {
+			return fmt.Errorf("No backups found in %s", backupsDir)
+		}
+		backupID = uint32(backups[len(backups)-1].ID)
+	}
+	src := filepath.Join(backupsDir, strconv.FormatUint(uint64(backupID), 10), dbFileName)
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Backup %d not found: %v", backupID, err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dbDir, dbFileName+".tmp")
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dbDir, dbFileName))
+}
+
+func (s *BoltStore) RegisterMetrics(registry metrics.Registry) {
+	if registry != nil {
+		registry.MustRegister(s.metrics.collectors()...)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bolt
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namespace is the leading part of all published metrics for the Storage service.
+const namespace = "qed_storage"
+
+const boltSubsystem = "bolt" // sub-system associated with metrics for the bbolt engine.
+
+type boltMetrics struct {
+	DBSize        prometheus.GaugeFunc
+	WALSeqNum     prometheus.GaugeFunc
+	OpenReadTxs   prometheus.GaugeFunc
+	FreePages     prometheus.GaugeFunc
+	TxWriteTime   prometheus.GaugeFunc
+	TxWrites      prometheus.GaugeFunc
+	TxPagesAlloc  prometheus.GaugeFunc
+	TxRebalances  prometheus.GaugeFunc
+	TxSplits      prometheus.GaugeFunc
+	TxSpillCounts prometheus.GaugeFunc
+}
+
+func newBoltMetrics(store *BoltStore) *boltMetrics {
+	return &boltMetrics{
+		DBSize: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "db_size_bytes",
+				Help:      "Size of the database file.",
+			},
+			func() float64 {
+				stat, err := os.Stat(filepath.Join(store.path, dbFileName))
+				if err != nil {
+					return 0
+				}
+				return float64(stat.Size())
+			},
+		),
+		WALSeqNum: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "wal_sequence_number",
+				Help:      "Sequence number of the last write batch.",
+			},
+			func() float64 {
+				return float64(store.LastWALSequenceNumber())
+			},
+		),
+		OpenReadTxs: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "open_read_txs",
+				Help:      "Number of currently open read transactions.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().OpenTxN)
+			},
+		),
+		FreePages: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "free_pages",
+				Help:      "Number of free pages on the freelist.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().FreePageN)
+			},
+		),
+		TxWriteTime: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "tx_write_seconds",
+				Help:      "Total time spent writing to disk.",
+			},
+			func() float64 {
+				return store.db.Stats().TxStats.WriteTime.Seconds()
+			},
+		),
+		TxWrites: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "tx_writes",
+				Help:      "Total number of writes performed.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().TxStats.Write)
+			},
+		),
+		TxPagesAlloc: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "tx_pages_allocated",
+				Help:      "Total number of page allocations.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().TxStats.PageCount)
+			},
+		),
+		TxRebalances: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "tx_rebalances",
+				Help:      "Total number of node rebalances.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().TxStats.Rebalance)
+			},
+		),
+		TxSplits: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "tx_splits",
+				Help:      "Total number of node splits.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().TxStats.Split)
+			},
+		),
+		TxSpillCounts: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: boltSubsystem,
+				Name:      "tx_spills",
+				Help:      "Total number of nodes spilled.",
+			},
+			func() float64 {
+				return float64(store.db.Stats().TxStats.Spill)
+			},
+		),
+	}
+}
+
+// collectors satisfies the prom.PrometheusCollector interface.
+func (m *boltMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.DBSize,
+		m.WALSeqNum,
+		m.OpenReadTxs,
+		m.FreePages,
+		m.TxWriteTime,
+		m.TxWrites,
+		m.TxPagesAlloc,
+		m.TxRebalances,
+		m.TxSplits,
+		m.TxSpillCounts,
+	}
+}
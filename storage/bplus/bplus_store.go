@@ -42,6 +42,30 @@ func (s *BPlusTreeStore) Mutate(mutations []*storage.Mutation, metadata []byte)
 	return nil
 }
 
+func (s *BPlusTreeStore) Delete(table storage.Table, keys [][]byte) error {
+	for _, key := range keys {
+		s.db.Delete(KVItem{append([]byte{table.Prefix()}, key...), nil})
+	}
+	return nil
+}
+
+// NewReadSnapshot returns a read-only copy of the current contents of the
+// tree. The copy is lazy, so taking it is cheap, but it must not happen
+// concurrently with a mutation.
+func (s *BPlusTreeStore) NewReadSnapshot() storage.ReadSnapshot {
+	return &bplusReadSnapshot{BPlusTreeStore{s.db.Clone()}}
+}
+
+type bplusReadSnapshot struct {
+	store BPlusTreeStore
+}
+
+func (r *bplusReadSnapshot) Get(table storage.Table, key []byte) (*storage.KVPair, error) {
+	return r.store.Get(table, key)
+}
+
+func (r *bplusReadSnapshot) Release() {}
+
 func (s BPlusTreeStore) GetRange(table storage.Table, start, end []byte) (storage.KVRange, error) {
 	result := make(storage.KVRange, 0)
 	startKey := append([]byte{table.Prefix()}, start...)
@@ -84,6 +108,23 @@ func (s BPlusTreeStore) GetLast(table storage.Table) (*storage.KVPair, error) {
 	return result, nil
 }
 
+// GetFloor returns the pair with the greatest key less than
+// or equal to the given one.
+func (s BPlusTreeStore) GetFloor(table storage.Table, key []byte) (*storage.KVPair, error) {
+	var result *storage.KVPair
+	s.db.DescendLessOrEqual(KVItem{append([]byte{table.Prefix()}, key...), nil}, func(i btree.Item) bool {
+		item := i.(KVItem)
+		if item.Key[0] == table.Prefix() {
+			result = &storage.KVPair{Key: item.Key[1:], Value: item.Value}
+		}
+		return false
+	})
+	if result == nil {
+		return nil, storage.ErrKeyNotFound
+	}
+	return result, nil
+}
+
 func (s BPlusTreeStore) GetAll(table storage.Table) storage.KVPairReader {
 	return NewBPlusKVPairReader(table, s.db)
 }
@@ -117,6 +158,10 @@ func (s *BPlusTreeStore) DeleteBackup(backupID uint32) error {
 	panic("Not implemented")
 }
 
+func (s *BPlusTreeStore) VerifyBackup(backupID uint32) error {
+	panic("Not implemented")
+}
+
 func (s BPlusTreeStore) RestoreFromBackup(backupID uint32, dbDir, walDir string) error {
 	panic("Not implemented")
 }
@@ -154,8 +199,12 @@ func (r *BPlusKVPairReader) Read(buffer []*storage.KVPair) (n int, err error) {
 			return false
 		}
 		key := i.(KVItem).Key
+		if key[0] != r.prefix {
+			// we have reached the next table
+			return false
+		}
 
-		if bytes.Compare(key[:1], r.lastKey[:1]) == 0 && bytes.Compare(key, r.lastKey) != 0 {
+		if bytes.Compare(key, r.lastKey) != 0 {
 			buffer[n] = &storage.KVPair{key[1:], i.(KVItem).Value}
 			n++
 		}
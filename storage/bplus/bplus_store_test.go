@@ -261,6 +261,91 @@ func BenchmarkGetRangeInLargeTree(b *testing.B) {
 
 }
 
+func TestDelete(t *testing.T) {
+	store, closeF := openBPlusTreeStore()
+	defer closeF()
+
+	for _, table := range []storage.Table{storage.HistoryTable, storage.HyperTable} {
+		for i := uint64(0); i < 10; i++ {
+			key := util.Uint64AsBytes(i)
+			require.NoError(t, store.Mutate([]*storage.Mutation{
+				{Table: table, Key: key, Value: key},
+			}, nil))
+		}
+	}
+
+	require.NoError(t, store.Delete(storage.HistoryTable, [][]byte{util.Uint64AsBytes(2), util.Uint64AsBytes(3)}))
+
+	for i := uint64(0); i < 10; i++ {
+		_, err := store.Get(storage.HistoryTable, util.Uint64AsBytes(i))
+		if i == 2 || i == 3 {
+			require.Equal(t, storage.ErrKeyNotFound, err)
+		} else {
+			require.NoError(t, err)
+		}
+		// other tables are not affected
+		_, err = store.Get(storage.HyperTable, util.Uint64AsBytes(i))
+		require.NoError(t, err)
+	}
+}
+
+func TestGetFloor(t *testing.T) {
+	store, closeF := openBPlusTreeStore()
+	defer closeF()
+
+	for _, table := range []storage.Table{storage.HyperTable, storage.HyperHistoryTable, storage.FSMStateTable} {
+		for i := uint64(10); i < 20; i += 2 {
+			key := util.Uint64AsBytes(i)
+			require.NoError(t, store.Mutate([]*storage.Mutation{
+				{table, key, []byte{byte(table)}},
+			}, nil))
+		}
+	}
+
+	kv, err := store.GetFloor(storage.HyperHistoryTable, util.Uint64AsBytes(15))
+	require.NoError(t, err)
+	require.Equal(t, util.Uint64AsBytes(14), kv.Key)
+	require.Equal(t, []byte{byte(storage.HyperHistoryTable)}, kv.Value)
+
+	kv, err = store.GetFloor(storage.HyperHistoryTable, util.Uint64AsBytes(16))
+	require.NoError(t, err)
+	require.Equal(t, util.Uint64AsBytes(16), kv.Key)
+
+	// keys from other tables are never returned
+	_, err = store.GetFloor(storage.HyperHistoryTable, util.Uint64AsBytes(9))
+	require.Equal(t, storage.ErrKeyNotFound, err)
+}
+
+func TestReadSnapshot(t *testing.T) {
+
+	store, closeF := openBPlusTreeStore()
+	defer closeF()
+
+	key := []byte("Key")
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		{Table: storage.HyperTable, Key: key, Value: []byte("Value1")},
+	}, nil))
+
+	snapshot := store.NewReadSnapshot()
+	defer snapshot.Release()
+
+	// later mutations are not visible through the snapshot
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		{Table: storage.HyperTable, Key: key, Value: []byte("Value2")},
+		{Table: storage.HyperTable, Key: []byte("Other"), Value: []byte("Value2")},
+	}, nil))
+
+	kv, err := snapshot.Get(storage.HyperTable, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Value1"), kv.Value)
+	_, err = snapshot.Get(storage.HyperTable, []byte("Other"))
+	require.Equal(t, storage.ErrKeyNotFound, err)
+
+	kv, err = store.Get(storage.HyperTable, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Value2"), kv.Value)
+}
+
 func openBPlusTreeStore() (*BPlusTreeStore, func()) {
 	store := NewBPlusTreeStore()
 	return store, func() {
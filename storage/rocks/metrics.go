@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
    Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
 
@@ -50,6 +53,9 @@ func newRocksDBMetrics(store *RocksDBStore) *rocksDBMetrics {
 	tables = append(tables, newPerTableMetrics(storage.HyperTable, store))
 	tables = append(tables, newPerTableMetrics(storage.HistoryTable, store))
 	tables = append(tables, newPerTableMetrics(storage.FSMStateTable, store))
+	tables = append(tables, newPerTableMetrics(storage.HyperHistoryTable, store))
+	tables = append(tables, newPerTableMetrics(storage.AuditTable, store))
+	tables = append(tables, newPerTableMetrics(storage.AuditHistoryTable, store))
 	return &rocksDBMetrics{
 		blockCacheMetrics:  newBlockCacheMetrics(store.stats, store.blockCache),
 		bloomFilterMetrics: newBloomFilterMetrics(store.stats),
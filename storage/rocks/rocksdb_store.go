@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
    Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
 
@@ -21,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/bbva/qed/metrics"
@@ -58,14 +62,26 @@ type RocksDBStore struct {
 
 	// metrics
 	metrics *rocksDBMetrics
+
+	// sequence numbers of the last loaded checkpoint
+	seqMu     sync.RWMutex
+	seqOrigin uint64
+	seqLocal  uint64
 }
 
+// checkpointSeqKey keeps in the default table the sequence number of
+// the last loaded checkpoint in the replica that built it, followed by
+// the local sequence number at which it was loaded. Sequence numbers
+// are translated with them to follow the ones of the origin replica.
+var checkpointSeqKey = []byte("checkpoint_seq")
+
 type Options struct {
 	Path             string
 	EnableStatistics bool
 	MaxTotalWalSize  uint64
 	WALSizeLimitMB   uint64
 	WALTtlSeconds    uint64
+	ReadOnly         bool // Open an existing database without write or backup support.
 }
 
 func DefaultOptions() *Options {
@@ -92,6 +108,9 @@ func NewRocksDBStoreWithOpts(opts *Options) (*RocksDBStore, error) {
 		storage.HyperCacheTable.String(),
 		storage.HistoryTable.String(),
 		storage.FSMStateTable.String(),
+		storage.HyperHistoryTable.String(),
+		storage.AuditTable.String(),
+		storage.AuditHistoryTable.String(),
 	}
 
 	// env
@@ -124,6 +143,31 @@ func NewRocksDBStoreWithOpts(opts *Options) (*RocksDBStore, error) {
 		getHyperTableOpts(blockCache), // hyperCacheOpts table options
 		getHistoryTableOpts(blockCache),
 		getFsmStateTableOpts(),
+		getHistoryTableOpts(blockCache), // hyperHistoryOpts table options
+		getHistoryTableOpts(blockCache), // auditOpts table options
+		getHistoryTableOpts(blockCache), // auditHistoryOpts table options
+	}
+
+	if opts.ReadOnly {
+		db, cfHandles, err := rocksdb.OpenDBForReadOnlyColumnFamilies(opts.Path, globalOpts, cfNames, cfOpts, false)
+		if err != nil {
+			return nil, err
+		}
+		store := &RocksDBStore{
+			path:       opts.Path,
+			db:         db,
+			stats:      stats,
+			cfHandles:  cfHandles,
+			blockCache: blockCache,
+			globalOpts: globalOpts,
+			cfOpts:     cfOpts,
+			ro:         rocksdb.NewDefaultReadOptions(),
+		}
+		if err := store.loadSeqBase(); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
 	}
 
 	db, cfHandles, err := rocksdb.OpenDBColumnFamilies(opts.Path, globalOpts, cfNames, cfOpts)
@@ -161,6 +205,11 @@ func NewRocksDBStoreWithOpts(opts *Options) (*RocksDBStore, error) {
 		ro:           rocksdb.NewDefaultReadOptions(),
 	}
 
+	if err := store.loadSeqBase(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
 	if stats != nil {
 		store.metrics = newRocksDBMetrics(store)
 	}
@@ -168,6 +217,49 @@ func NewRocksDBStoreWithOpts(opts *Options) (*RocksDBStore, error) {
 	return store, nil
 }
 
+// loadSeqBase reads the sequence numbers of the last loaded checkpoint.
+func (s *RocksDBStore) loadSeqBase() error {
+	origin, local, err := readSeqBase(s.db, s.ro, s.cfHandles[storage.DefaultTable])
+	if err != nil {
+		return err
+	}
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	s.seqOrigin, s.seqLocal = origin, local
+	return nil
+}
+
+func readSeqBase(db *rocksdb.DB, ro *rocksdb.ReadOptions, cf *rocksdb.ColumnFamilyHandle) (origin, local uint64, err error) {
+	value, err := db.GetBytesCF(ro, cf, checkpointSeqKey)
+	if err != nil || value == nil {
+		return 0, 0, err
+	}
+	if len(value) != 16 {
+		return 0, 0, fmt.Errorf("Corrupted checkpoint sequence number")
+	}
+	return util.BytesAsUint64(value[:8]), util.BytesAsUint64(value[8:]), nil
+}
+
+// toOriginSeq translates a local sequence number to the one it has in
+// the replica that built the last loaded checkpoint.
+func (s *RocksDBStore) toOriginSeq(local uint64) uint64 {
+	s.seqMu.RLock()
+	defer s.seqMu.RUnlock()
+	return local - s.seqLocal + s.seqOrigin
+}
+
+// toLocalSeq translates a sequence number of the replica that built
+// the last loaded checkpoint to the local one. It fails if the sequence
+// number is older than the checkpoint.
+func (s *RocksDBStore) toLocalSeq(origin uint64) (uint64, bool) {
+	s.seqMu.RLock()
+	defer s.seqMu.RUnlock()
+	if origin < s.seqOrigin {
+		return 0, false
+	}
+	return origin - s.seqOrigin + s.seqLocal, true
+}
+
 // The hyper table has the more varied behavior. It receives
 // a mixed workload of point lookups and write/updates.
 // The values are higher than the ones inserted in other tables (~1KB).
@@ -349,6 +441,17 @@ func (s *RocksDBStore) Mutate(mutations []*storage.Mutation, metadata []byte) er
 	return s.db.Write(s.wo, batch)
 }
 
+// Delete removes the given keys from the table in a single batch
+// without metadata.
+func (s *RocksDBStore) Delete(table storage.Table, keys [][]byte) error {
+	batch := rocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, key := range keys {
+		batch.DeleteCF(s.cfHandles[table], key)
+	}
+	return s.db.Write(s.wo, batch)
+}
+
 func (s *RocksDBStore) Get(table storage.Table, key []byte) (*storage.KVPair, error) {
 	result := new(storage.KVPair)
 	result.Key = key
@@ -363,6 +466,41 @@ func (s *RocksDBStore) Get(table storage.Table, key []byte) (*storage.KVPair, er
 	return result, nil
 }
 
+// NewReadSnapshot returns a consistent read-only view of the current
+// contents of the database. It must be released once it is no longer used.
+func (s *RocksDBStore) NewReadSnapshot() storage.ReadSnapshot {
+	snapshot := s.db.NewSnapshot()
+	ro := rocksdb.NewDefaultReadOptions()
+	ro.SetSnapshot(snapshot)
+	return &rocksDBReadSnapshot{
+		store:    s,
+		snapshot: snapshot,
+		ro:       ro,
+	}
+}
+
+type rocksDBReadSnapshot struct {
+	store    *RocksDBStore
+	snapshot *rocksdb.Snapshot
+	ro       *rocksdb.ReadOptions
+}
+
+func (r *rocksDBReadSnapshot) Get(table storage.Table, key []byte) (*storage.KVPair, error) {
+	v, err := r.store.db.GetBytesCF(r.ro, r.store.cfHandles[table], key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, storage.ErrKeyNotFound
+	}
+	return &storage.KVPair{Key: key, Value: v}, nil
+}
+
+func (r *rocksDBReadSnapshot) Release() {
+	r.ro.Destroy()
+	r.store.db.ReleaseSnapshot(r.snapshot)
+}
+
 func (s *RocksDBStore) GetRange(table storage.Table, start, end []byte) (storage.KVRange, error) {
 	result := make(storage.KVRange, 0)
 	it := s.db.NewIteratorCF(s.ro, s.cfHandles[table])
@@ -406,6 +544,27 @@ func (s *RocksDBStore) GetLast(table storage.Table) (*storage.KVPair, error) {
 	return nil, storage.ErrKeyNotFound
 }
 
+// GetFloor returns the pair with the greatest key less than
+// or equal to the given one.
+func (s *RocksDBStore) GetFloor(table storage.Table, key []byte) (*storage.KVPair, error) {
+	it := s.db.NewIteratorCF(s.ro, s.cfHandles[table])
+	defer it.Close()
+	it.SeekForPrev(key)
+	if it.Valid() {
+		result := new(storage.KVPair)
+		keySlice := it.Key()
+		result.Key = make([]byte, keySlice.Size())
+		copy(result.Key, keySlice.Data())
+		keySlice.Free()
+		valueSlice := it.Value()
+		result.Value = make([]byte, valueSlice.Size())
+		copy(result.Value, valueSlice.Data())
+		valueSlice.Free()
+		return result, nil
+	}
+	return nil, storage.ErrKeyNotFound
+}
+
 func (s *RocksDBStore) GetAll(table storage.Table) storage.KVPairReader {
 	return NewRocksDBKVPairReader(s.cfHandles[table], s.db)
 }
@@ -519,11 +678,31 @@ func (s *RocksDBStore) DeleteBackup(backupID uint32) error {
 	return nil
 }
 
+// VerifyBackup uses the backupEngine to check that every file of the backup
+// identified by backupID exists and has the expected size.
+func (s *RocksDBStore) VerifyBackup(backupID uint32) error {
+	err := s.backupEngine.VerifyBackup(backupID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // FetchSnapshot fetches all WAL transactions from the first available
 // seq_num to the last one specified in the lastSeqNum parameter, and dumps
 // them to the given writer.
+// It returns storage.ErrWALUnavailable without writing anything if
+// the WAL no longer contains the transactions following the since
+// seq_num.
 func (s *RocksDBStore) FetchSnapshot(w io.WriteCloser, since, until uint64, valid storage.ValidateF) error {
 
+	// the WAL before the last loaded checkpoint belongs to another history
+	since, okSince := s.toLocalSeq(since)
+	until, okUntil := s.toLocalSeq(until)
+	if !okSince || !okUntil {
+		return storage.ErrWALUnavailable
+	}
+
 	extractor := rocksdb.NewLogDataExtractor(s.path)
 	defer func() {
 		extractor.Destroy()
@@ -531,16 +710,29 @@ func (s *RocksDBStore) FetchSnapshot(w io.WriteCloser, since, until uint64, vali
 
 	it, err := s.db.GetUpdatesSince(since) // we start on the first available seq_num
 	if err != nil {
-		return err
+		// the requested seq_num has been purged or is not
+		// readable, so the caller has to use a checkpoint
+		return storage.ErrWALUnavailable
 	}
 	defer func() {
 		it.Close()
 		w.Close()
 	}()
 
+	// the first batch must contain the since seq_num or start just
+	// after it, otherwise the WAL files have been purged
+	if since < until && !it.Valid() {
+		return storage.ErrWALUnavailable
+	}
+
+	first := true
 	for ; it.Valid(); it.Next() {
 		batch, seqNum := it.GetBatch()
 		defer batch.Destroy()
+		if first && since < until && seqNum > since+1 {
+			return storage.ErrWALUnavailable
+		}
+		first = false
 		if seqNum <= since {
 			continue
 		}
@@ -620,12 +812,178 @@ func (s *RocksDBStore) LoadSnapshot(r io.ReadCloser) error {
 
 }
 
+// Checkpoint builds an openable snapshot of the database in the given
+// directory, which must not exist. SST files are hard-linked if the
+// directory is in the same filesystem. It returns the sequence number
+// of the last transaction included in the checkpoint.
+func (s *RocksDBStore) Checkpoint(dir string) (uint64, error) {
+	checkpoint, err := s.db.NewCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+	defer checkpoint.Destroy()
+
+	// memtables are always flushed so every transaction
+	// up to this seq_num is included in the checkpoint
+	seqNum := s.toOriginSeq(s.db.GetLatestSequenceNumber())
+	err = checkpoint.CreateCheckpoint(dir, 0)
+	if err != nil {
+		return 0, err
+	}
+	return seqNum, nil
+}
+
+// LoadCheckpoint replaces the contents of the database with the ones of
+// the checkpoint stored in the given directory. Tables are cleared and
+// copied in order, leaving the FSM state to the end, so the state is
+// never ahead of the trees. From then on, sequence numbers follow the
+// ones of the replica that built the checkpoint, which must include every
+// transaction up to the given sequence number, so later snapshots can be
+// fetched from it.
+// This method should be called on a database that is not running
+// any other concurrent transactions while it is running.
+func (s *RocksDBStore) LoadCheckpoint(dir string, seqNum uint64) error {
+
+	cfNames := make([]string, 0, len(s.cfHandles))
+	cfOpts := make([]*rocksdb.Options, 0, len(s.cfHandles))
+	for _, table := range []storage.Table{
+		storage.DefaultTable,
+		storage.HyperTable,
+		storage.HyperCacheTable,
+		storage.HistoryTable,
+		storage.FSMStateTable,
+		storage.HyperHistoryTable,
+		storage.AuditTable,
+		storage.AuditHistoryTable,
+	} {
+		opts := rocksdb.NewDefaultOptions()
+		defer opts.Destroy()
+		cfNames = append(cfNames, table.String())
+		cfOpts = append(cfOpts, opts)
+	}
+
+	opts := rocksdb.NewDefaultOptions()
+	defer opts.Destroy()
+	db, cfHandles, err := rocksdb.OpenDBForReadOnlyColumnFamilies(dir, opts, cfNames, cfOpts, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, cf := range cfHandles {
+			cf.Destroy()
+		}
+		db.Close()
+	}()
+
+	ro := rocksdb.NewDefaultReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Destroy()
+
+	// the checkpoint may come from a replica that loaded another one
+	origin, local, err := readSeqBase(db, ro, cfHandles[storage.DefaultTable])
+	if err != nil {
+		return err
+	}
+	checkpointSeq := db.GetLatestSequenceNumber() - local + origin
+	if checkpointSeq < seqNum {
+		return fmt.Errorf("Checkpoint only includes transactions up to seqNum %d, expected %d", checkpointSeq, seqNum)
+	}
+
+	for _, table := range []storage.Table{
+		storage.HyperTable,
+		storage.HyperCacheTable,
+		storage.HistoryTable,
+		storage.HyperHistoryTable,
+		storage.AuditTable,
+		storage.AuditHistoryTable,
+		storage.FSMStateTable,
+	} {
+		if err := s.clearTable(s.cfHandles[table]); err != nil {
+			return fmt.Errorf("Unable to clear table %s: %v", table, err)
+		}
+		err := s.copyTable(db.NewIteratorCF(ro, cfHandles[table]), s.cfHandles[table])
+		if err != nil {
+			return fmt.Errorf("Unable to load table %s from checkpoint: %v", table, err)
+		}
+	}
+
+	// the batch with the sequence numbers takes the next one
+	local = s.db.GetLatestSequenceNumber() + 1
+	batch := rocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.PutCF(s.cfHandles[storage.DefaultTable], checkpointSeqKey, append(util.Uint64AsBytes(checkpointSeq), util.Uint64AsBytes(local)...))
+	if err := s.db.Write(s.wo, batch); err != nil {
+		return err
+	}
+
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	s.seqOrigin, s.seqLocal = checkpointSeq, local
+	return nil
+}
+
+// clearTable removes every key of a column family with a range deletion.
+func (s *RocksDBStore) clearTable(cf *rocksdb.ColumnFamilyHandle) error {
+	it := s.db.NewIteratorCF(s.ro, cf)
+	defer it.Close()
+
+	it.SeekToFirst()
+	if !it.Valid() {
+		return it.Err()
+	}
+	first := it.Key()
+	begin := append([]byte{}, first.Data()...)
+	first.Free()
+
+	it.SeekToLast()
+	if !it.Valid() {
+		return it.Err()
+	}
+	last := it.Key()
+	// the end of the range is exclusive
+	end := append(append([]byte{}, last.Data()...), 0x00)
+	last.Free()
+
+	batch := rocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.DeleteRangeCF(cf, begin, end)
+	return s.db.Write(s.wo, batch)
+}
+
+func (s *RocksDBStore) copyTable(it *rocksdb.Iterator, cf *rocksdb.ColumnFamilyHandle) error {
+	defer it.Close()
+
+	batch := rocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		batch.PutCF(cf, key.Data(), value.Data())
+		key.Free()
+		value.Free()
+		if batch.Count() >= 1000 {
+			if err := s.db.Write(s.wo, batch); err != nil {
+				return err
+			}
+			batch.Clear()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Write(s.wo, batch)
+}
+
 // LastWALSequenceNumber returns the sequence number of the
 // last transaction applied to the WAL. This sequence
 // number can be used as upper limit when fetching transactions
 // from the WAL.
+//
+// Once a checkpoint is loaded, sequence numbers follow the ones of the
+// replica that built it, so snapshots can be fetched from it later on.
 func (s *RocksDBStore) LastWALSequenceNumber() uint64 {
-	return s.db.GetLatestSequenceNumber()
+	return s.toOriginSeq(s.db.GetLatestSequenceNumber())
 }
 
 func (s *RocksDBStore) RegisterMetrics(registry metrics.Registry) {
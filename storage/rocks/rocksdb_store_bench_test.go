@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
    Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
 
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*
    Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
 
@@ -191,6 +194,91 @@ func TestGetLast(t *testing.T) {
 	require.Equalf(t, util.Uint64AsBytes(numElems-1), kv.Value, "The value should match the last inserted element")
 }
 
+func TestDelete(t *testing.T) {
+	store, closeF := openRocksDBStore(t)
+	defer closeF()
+
+	for _, table := range []storage.Table{storage.HistoryTable, storage.HyperTable} {
+		for i := uint64(0); i < 10; i++ {
+			key := util.Uint64AsBytes(i)
+			require.NoError(t, store.Mutate([]*storage.Mutation{
+				{Table: table, Key: key, Value: key},
+			}, nil))
+		}
+	}
+
+	require.NoError(t, store.Delete(storage.HistoryTable, [][]byte{util.Uint64AsBytes(2), util.Uint64AsBytes(3)}))
+
+	for i := uint64(0); i < 10; i++ {
+		_, err := store.Get(storage.HistoryTable, util.Uint64AsBytes(i))
+		if i == 2 || i == 3 {
+			require.Equal(t, storage.ErrKeyNotFound, err)
+		} else {
+			require.NoError(t, err)
+		}
+		// other tables are not affected
+		_, err = store.Get(storage.HyperTable, util.Uint64AsBytes(i))
+		require.NoError(t, err)
+	}
+}
+
+func TestGetFloor(t *testing.T) {
+	store, closeF := openRocksDBStore(t)
+	defer closeF()
+
+	for _, table := range []storage.Table{storage.HyperTable, storage.HyperHistoryTable, storage.FSMStateTable} {
+		for i := uint64(10); i < 20; i += 2 {
+			key := util.Uint64AsBytes(i)
+			require.NoError(t, store.Mutate([]*storage.Mutation{
+				{table, key, []byte{byte(table)}},
+			}, nil))
+		}
+	}
+
+	kv, err := store.GetFloor(storage.HyperHistoryTable, util.Uint64AsBytes(15))
+	require.NoError(t, err)
+	require.Equal(t, util.Uint64AsBytes(14), kv.Key)
+	require.Equal(t, []byte{byte(storage.HyperHistoryTable)}, kv.Value)
+
+	kv, err = store.GetFloor(storage.HyperHistoryTable, util.Uint64AsBytes(16))
+	require.NoError(t, err)
+	require.Equal(t, util.Uint64AsBytes(16), kv.Key)
+
+	// keys from other tables are never returned
+	_, err = store.GetFloor(storage.HyperHistoryTable, util.Uint64AsBytes(9))
+	require.Equal(t, storage.ErrKeyNotFound, err)
+}
+
+func TestReadSnapshot(t *testing.T) {
+
+	store, closeF := openRocksDBStore(t)
+	defer closeF()
+
+	key := []byte("Key")
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		{Table: storage.HyperTable, Key: key, Value: []byte("Value1")},
+	}, nil))
+
+	snapshot := store.NewReadSnapshot()
+	defer snapshot.Release()
+
+	// later mutations are not visible through the snapshot
+	require.NoError(t, store.Mutate([]*storage.Mutation{
+		{Table: storage.HyperTable, Key: key, Value: []byte("Value2")},
+		{Table: storage.HyperTable, Key: []byte("Other"), Value: []byte("Value2")},
+	}, nil))
+
+	kv, err := snapshot.Get(storage.HyperTable, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Value1"), kv.Value)
+	_, err = snapshot.Get(storage.HyperTable, []byte("Other"))
+	require.Equal(t, storage.ErrKeyNotFound, err)
+
+	kv, err = store.Get(storage.HyperTable, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Value2"), kv.Value)
+}
+
 func TestFetchAndLoadSnapshot(t *testing.T) {
 	store, closeF := openRocksDBStore(t)
 	defer closeF()
@@ -382,4 +470,72 @@ type bufCloser struct {
 
 func (b bufCloser) Close() error {
 	return nil
-}
\ No newline at end of file
+}
+func TestFetchSnapshotWALUnavailable(t *testing.T) {
+	store, closeF := openRocksDBStore(t)
+	defer closeF()
+
+	// nothing has been written to the WAL
+	ioBuf := new(bufCloser)
+	err := store.FetchSnapshot(ioBuf, 0, 10, func(meta []byte) (bool, error) {
+		return true, nil
+	})
+	require.Equal(t, storage.ErrWALUnavailable, err, "The error should match")
+	require.Zero(t, ioBuf.Len(), "Nothing should be written")
+}
+
+func TestCheckpointAndLoad(t *testing.T) {
+	store, closeF := openRocksDBStore(t)
+	defer closeF()
+
+	numElems := uint64(2500)
+	tables := []storage.Table{storage.HistoryTable, storage.HyperTable, storage.FSMStateTable}
+	for _, table := range tables {
+		for i := uint64(0); i < numElems; i++ {
+			key := util.Uint64AsBytes(i)
+			err := store.Mutate([]*storage.Mutation{{Table: table, Key: key, Value: key}}, nil)
+			require.NoError(t, err)
+		}
+	}
+
+	// build a checkpoint
+	dir := filepath.Join(mustTempDir(), "checkpoint")
+	defer deleteFile(filepath.Dir(dir))
+	seqNum, err := store.Checkpoint(dir)
+	require.NoError(t, err)
+	require.Equal(t, store.LastWALSequenceNumber(), seqNum, "The seqNum should match")
+
+	// load checkpoint in another instance with stale contents
+	restore, recloseF := openRocksDBStore(t)
+	defer recloseF()
+	stale := util.Uint64AsBytes(numElems)
+	require.NoError(t, restore.Mutate([]*storage.Mutation{{Table: storage.HistoryTable, Key: stale, Value: stale}}, nil))
+	require.Error(t, restore.LoadCheckpoint(dir, seqNum+1), "The checkpoint must include the expected seqNum")
+	require.NoError(t, restore.LoadCheckpoint(dir, seqNum))
+	require.Equal(t, seqNum, restore.LastWALSequenceNumber(), "The seqNum should be the one of the checkpoint")
+	_, err = restore.Get(storage.HistoryTable, stale)
+	require.Equal(t, storage.ErrKeyNotFound, err, "Keys missing in the checkpoint must be removed")
+
+	// both replicas must agree on the seqNum of the following transactions
+	mutation := []*storage.Mutation{{Table: storage.HistoryTable, Key: stale, Value: stale}}
+	require.NoError(t, store.Mutate(mutation, nil))
+	require.NoError(t, restore.Mutate(mutation, nil))
+	require.Equal(t, store.LastWALSequenceNumber(), restore.LastWALSequenceNumber(), "The seqNums should match")
+
+	// and the WAL before the checkpoint is not available
+	ioBuf := new(bufCloser)
+	err = restore.FetchSnapshot(ioBuf, seqNum-1, restore.LastWALSequenceNumber(), func(meta []byte) (bool, error) {
+		return true, nil
+	})
+	require.Equal(t, storage.ErrWALUnavailable, err, "The error should match")
+
+	// check elements
+	for _, table := range tables {
+		for i := uint64(0); i < numElems; i++ {
+			key := util.Uint64AsBytes(i)
+			kv, err := restore.Get(table, key)
+			require.NoError(t, err)
+			require.Equal(t, key, kv.Value, "The values should match")
+		}
+	}
+}
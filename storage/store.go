@@ -19,6 +19,8 @@ package storage
 import (
 	"errors"
 	"io"
+	"math"
+	"strconv"
 
 	metrics "github.com/bbva/qed/metrics"
 )
@@ -41,11 +43,26 @@ const (
 	// FSMStateTable contains the current state of the FSM (index, term, version...).
 	// key -> state
 	FSMStateTable
+	// HyperHistoryTable contains every version of the hyper tree batches.
+	// Position + Version -> Batch
+	HyperHistoryTable
+	// AuditTable contains the entries of the audit log, kept apart
+	// from the balloon.
+	// Version -> Event
+	AuditTable
+	// AuditHistoryTable contains frozen hashes of the history tree of
+	// the audit log.
+	// Position -> Hash
+	AuditHistoryTable
 )
 
 // FSMStateTableKey single key to persist fsm state.
 var FSMStateTableKey = []byte{0xab}
 
+// HistoryArchiveKey key to persist the number of history segments moved
+// to the archive, kept in the FSMStateTable.
+var HistoryArchiveKey = []byte{0xac}
+
 // String returns a string representation of the table.
 func (t Table) String() string {
 	var s string
@@ -60,6 +77,12 @@ func (t Table) String() string {
 		s = "history"
 	case FSMStateTable:
 		s = "fsm"
+	case HyperHistoryTable:
+		s = "hyperhistory"
+	case AuditTable:
+		s = "audit"
+	case AuditHistoryTable:
+		s = "audithistory"
 	}
 	return s
 }
@@ -77,6 +100,12 @@ func (t Table) Prefix() byte {
 		prefix = byte(0x2)
 	case FSMStateTable:
 		prefix = byte(0x3)
+	case HyperHistoryTable:
+		prefix = byte(0x5)
+	case AuditTable:
+		prefix = byte(0x6)
+	case AuditHistoryTable:
+		prefix = byte(0x7)
 	default:
 		prefix = byte(0x4)
 	}
@@ -85,6 +114,20 @@ func (t Table) Prefix() byte {
 
 var (
 	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrWALUnavailable is returned when the transactions requested
+	// to build a snapshot are no longer available in the WAL.
+	ErrWALUnavailable = errors.New("requested sequence number is no longer available in the WAL")
+
+	// ErrRocksDBUnavailable is returned when the RocksDB engine
+	// is selected in a binary built without cgo.
+	ErrRocksDBUnavailable = errors.New("RocksDB is not available in binaries built without cgo")
+)
+
+// Names of the available storage engines.
+const (
+	RocksDBEngine = "rocksdb"
+	BoltEngine    = "bolt"
 )
 
 type Store interface {
@@ -101,13 +144,42 @@ type ManagedStore interface {
 	Backup(metadata string) error
 	GetBackupsInfo() []*BackupInfo
 	DeleteBackup(backupID uint32) error
+	VerifyBackup(backupID uint32) error
 	RestoreFromBackup(backupID uint32, dbDir, walDir string) error
 	FetchSnapshot(w io.WriteCloser, since, until uint64, validate ValidateF) error
 	LoadSnapshot(r io.ReadCloser) error
 	LastWALSequenceNumber() uint64
+	Checkpoint(dir string) (uint64, error)
+	LoadCheckpoint(dir string, seqNum uint64) error
 	metrics.Registerer
 }
 
+// ReadSnapshot is a consistent read-only view of the contents
+// of a store at the time it was taken.
+type ReadSnapshot interface {
+	Get(table Table, key []byte) (*KVPair, error)
+	Release()
+}
+
+// SnapshotStore is implemented by stores able to provide read
+// snapshots that are not affected by later mutations.
+type SnapshotStore interface {
+	NewReadSnapshot() ReadSnapshot
+}
+
+// FloorStore is implemented by stores able to find the greatest
+// key less than or equal to a given one.
+type FloorStore interface {
+	GetFloor(table Table, key []byte) (*KVPair, error)
+}
+
+// DeleteStore is implemented by stores able to remove keys. Deletions
+// are not tagged with metadata, so they are never included in the
+// snapshots sent to other replicas.
+type DeleteStore interface {
+	Delete(table Table, keys [][]byte) error
+}
+
 // ValidateF can be used to determine if a particular batch
 // can be applied to the database when loading a snapshot.
 // It receives the metadata of the write batch to make the decision.
@@ -152,3 +224,32 @@ type BackupInfo struct {
 	NumFiles  int32
 	Metadata  string
 }
+
+// Version returns the last balloon version contained in the backup, as
+// recorded in its metadata. It returns false if the backup contains no
+// events or its metadata is not a version.
+func (b *BackupInfo) Version() (uint64, bool) {
+	version, err := strconv.ParseUint(b.Metadata, 10, 64)
+	if err != nil || version == math.MaxUint64 {
+		return 0, false
+	}
+	return version, true
+}
+
+// ClosestBackup returns the backup containing the highest version at
+// or before the given one, the most recent among those containing the
+// same version, or nil if there is none.
+func ClosestBackup(backups []*BackupInfo, version uint64) *BackupInfo {
+	var closest *BackupInfo
+	var closestVersion uint64
+	for _, b := range backups {
+		v, ok := b.Version()
+		if !ok || v > version {
+			continue
+		}
+		if closest == nil || v > closestVersion || v == closestVersion && b.ID > closest.ID {
+			closest, closestVersion = b, v
+		}
+	}
+	return closest
+}
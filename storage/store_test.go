@@ -0,0 +1,75 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupVersion(t *testing.T) {
+	testCases := []struct {
+		metadata string
+		version  uint64
+		ok       bool
+	}{
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"18446744073709551615", 0, false}, // empty balloon
+		{"foo", 0, false},
+		{"", 0, false},
+	}
+
+	for i, c := range testCases {
+		version, ok := (&BackupInfo{Metadata: c.metadata}).Version()
+		require.Equal(t, c.ok, ok, "Wrong result in test case %d", i)
+		require.Equal(t, c.version, version, "Wrong version in test case %d", i)
+	}
+}
+
+func TestClosestBackup(t *testing.T) {
+	backups := []*BackupInfo{
+		{ID: 1, Metadata: "18446744073709551615"},
+		{ID: 2, Metadata: "9"},
+		{ID: 3, Metadata: "99"},
+		{ID: 4, Metadata: "99"},
+		{ID: 5, Metadata: "999"},
+	}
+
+	testCases := []struct {
+		version uint64
+		id      int64
+	}{
+		{0, 0},
+		{8, 0},
+		{9, 2},
+		{98, 2},
+		{99, 4},
+		{500, 4},
+		{10000, 5},
+	}
+
+	for i, c := range testCases {
+		backup := ClosestBackup(backups, c.version)
+		if c.id == 0 {
+			require.Nil(t, backup, "Unexpected backup in test case %d", i)
+			continue
+		}
+		require.NotNil(t, backup, "Backup not found in test case %d", i)
+		require.Equal(t, c.id, backup.ID, "Wrong backup in test case %d", i)
+	}
+}
@@ -184,6 +184,32 @@ func (s *snapStore) Get(version uint64) (*protocol.SignedSnapshot, error) {
 	return &snap, nil
 }
 
+// auditRootKey keeps the audit roots apart from the snapshots of the
+// same version.
+func auditRootKey(version uint64) []byte {
+	return append([]byte("audit:"), util.Uint64AsBytes(version)...)
+}
+
+func (s *snapStore) PutAuditRoot(root *protocol.SignedAuditRoot) error {
+	val, err := root.Encode()
+	if err != nil {
+		return err
+	}
+	return s.data.Set(auditRootKey(root.Root.Version), val, 0)
+}
+
+func (s *snapStore) GetAuditRoot(version uint64) (*protocol.SignedAuditRoot, error) {
+	val, err := s.data.Get(auditRootKey(version))
+	if err != nil {
+		return nil, err
+	}
+	var root protocol.SignedAuditRoot
+	if err := root.Decode(val); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
 func (s *snapStore) Count() uint64 {
 	return *s.count
 }
@@ -242,6 +268,7 @@ func (s *Service) Start(foreground bool) {
 	router.HandleFunc("/batch", s.postBatchHandler())
 	router.HandleFunc("/count", s.getSnapshotCountHandler())
 	router.HandleFunc("/snapshot", s.getSnapshotHandler())
+	router.HandleFunc("/audit/root", s.auditRootHandler())
 	router.HandleFunc("/alert", s.alertHandler())
 
 	s.httpServer = newHttpServer(":8888", router, s.log)
@@ -352,6 +379,48 @@ func (s *Service) getSnapshotHandler() func(http.ResponseWriter, *http.Request)
 	}
 }
 
+func (s *Service) auditRootHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var root protocol.SignedAuditRoot
+			buf, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := root.Decode(buf); err != nil || root.Root == nil {
+				s.log.Infof("test_service(POST /audit/root): invalid audit root: %v", err)
+				http.Error(w, "Invalid audit root", http.StatusBadRequest)
+				return
+			}
+			if err := s.snaps.PutAuditRoot(&root); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "GET":
+			version, err := strconv.ParseUint(r.URL.Query().Get("v"), 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			root, err := s.snaps.GetAuditRoot(version)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Version not found: %v", version), http.StatusNotFound)
+				return
+			}
+			buf, err := root.Encode()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write(buf)
+		default:
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
 func (s *Service) getSnapshotCountHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
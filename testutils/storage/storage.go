@@ -20,8 +20,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/bbva/qed/storage/bolt"
 	"github.com/bbva/qed/storage/bplus"
-	"github.com/bbva/qed/storage/rocks"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,10 +32,10 @@ func OpenBPlusTreeStore() (*bplus.BPlusTreeStore, func()) {
 	}
 }
 
-func OpenRocksDBStore(t require.TestingT, path string) (*rocks.RocksDBStore, func()) {
-	store, err := rocks.NewRocksDBStore(path, 0)
+func OpenBoltStore(t require.TestingT, path string) (*bolt.BoltStore, func()) {
+	store, err := bolt.NewBoltStore(path, 0)
 	if err != nil {
-		t.Errorf("Error opening rocksdb store: %v", err)
+		t.Errorf("Error opening bolt store: %v", err)
 		t.FailNow()
 	}
 	return store, func() {
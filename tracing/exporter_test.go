@@ -0,0 +1,81 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var received otlpRequest
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer collector.Close()
+
+	start := time.Unix(0, 1000)
+	exporter := NewOTLPExporter(collector.URL, "qed")
+	err := exporter.Export([]*SpanData{
+		{
+			TraceID:      "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanID:       "00f067aa0ba902b7",
+			ParentSpanID: "00f067aa0ba902b8",
+			Name:         "raft.apply",
+			Start:        start,
+			End:          start.Add(time.Microsecond),
+			Attributes:   map[string]interface{}{"events": 3, "node": "server0"},
+			Error:        "failed",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/v1/traces", path)
+
+	require.Len(t, received.ResourceSpans, 1)
+	resource := received.ResourceSpans[0]
+	require.Equal(t, "service.name", resource.Resource.Attributes[0].Key)
+	require.Equal(t, "qed", resource.Resource.Attributes[0].Value["stringValue"])
+
+	span := resource.ScopeSpans[0].Spans[0]
+	require.Equal(t, "raft.apply", span.Name)
+	require.Equal(t, "00f067aa0ba902b8", span.ParentSpanID)
+	require.Equal(t, "1000", span.StartTimeUnixNano)
+	require.Equal(t, "2000", span.EndTimeUnixNano)
+	require.Equal(t, []otlpKeyValue{
+		{Key: "events", Value: map[string]interface{}{"intValue": "3"}},
+		{Key: "node", Value: map[string]interface{}{"stringValue": "server0"}},
+	}, span.Attributes)
+	require.Equal(t, &otlpStatus{Code: otlpStatusError, Message: "failed"}, span.Status)
+}
+
+func TestOTLPExporterError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL+"/v1/traces", "qed")
+	require.Error(t, exporter.Export([]*SpanData{{Name: "span"}}))
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceParentHeader is the W3C trace context header that carries the
+// span context between processes.
+const TraceParentHeader = "traceparent"
+
+const sampledFlag = 0x01
+
+// Format encodes the span context following the W3C traceparent format:
+// version-traceid-spanid-flags. It returns an empty string if the span
+// context is not valid.
+func Format(sc SpanContext) string {
+	if !sc.IsValid() {
+		return ""
+	}
+	var flags byte
+	if sc.Sampled {
+		flags |= sampledFlag
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// Parse decodes a span context in the W3C traceparent format.
+func Parse(traceparent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("Invalid traceparent %q", traceparent)
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return sc, fmt.Errorf("Invalid traceparent version %q", parts[0])
+	}
+	// only version 00 has a fixed number of fields
+	if version[0] == 0 && len(parts) != 4 {
+		return sc, fmt.Errorf("Invalid traceparent %q", traceparent)
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, fmt.Errorf("Invalid trace id %q", parts[1])
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, fmt.Errorf("Invalid span id %q", parts[2])
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, fmt.Errorf("Invalid trace flags %q", parts[3])
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&sampledFlag != 0
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("Invalid traceparent %q", traceparent)
+	}
+	return sc, nil
+}
+
+// Inject writes the span context carried by the context into the
+// headers of an outgoing request.
+func Inject(ctx context.Context, header http.Header) {
+	if tp := Format(SpanContextFromContext(ctx)); tp != "" {
+		header.Set(TraceParentHeader, tp)
+	}
+}
+
+// Extract returns a context carrying the span context found in the
+// headers of an incoming request, if any.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return ContextWithTraceParent(ctx, header.Get(TraceParentHeader))
+}
+
+// ContextWithTraceParent returns a context whose spans will be children
+// of the span encoded in the traceparent. Empty or malformed
+// traceparents are ignored.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	sc, err := Parse(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// TraceParent returns the traceparent of the span carried by the context,
+// or an empty string if there is none.
+func TraceParent(ctx context.Context) string {
+	return Format(SpanContextFromContext(ctx))
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatParse(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := Parse(traceparent)
+	require.NoError(t, err)
+	require.True(t, sc.Sampled)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	require.Equal(t, traceparent, Format(sc))
+
+	sc.Sampled = false
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", Format(sc))
+	require.Empty(t, Format(SpanContext{}))
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	}
+	for _, tp := range invalid {
+		_, err := Parse(tp)
+		require.Error(t, err, "traceparent %q should be invalid", tp)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter, nil)
+	defer tracer.Close()
+
+	ctx, span := tracer.Start(context.Background(), "client")
+	header := http.Header{}
+	Inject(ctx, header)
+	require.Equal(t, Format(span.Context()), header.Get(TraceParentHeader))
+
+	remote := Extract(context.Background(), header)
+	require.Equal(t, span.Context(), SpanContextFromContext(remote))
+
+	_, server := tracer.Start(remote, "server")
+	require.Equal(t, span.Context().TraceID, server.Context().TraceID)
+
+	// malformed headers are ignored
+	header.Set(TraceParentHeader, "garbage")
+	require.False(t, SpanContextFromContext(Extract(context.Background(), header)).IsValid())
+}
@@ -0,0 +1,428 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package tracing implements lightweight, OpenTelemetry-style distributed
+// tracing: spans grouped in traces, propagated between processes with W3C
+// trace context headers and exported in batches to an OTLP collector or
+// to a local file.
+//
+// Tracing is disabled until a tracer is installed with SetTracer. While it
+// is disabled, StartSpan returns nil spans, whose methods are no-ops, so
+// instrumented code pays almost nothing for it.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbva/qed/log"
+)
+
+// TraceID identifies a trace, that is, the tree of spans of an operation.
+type TraceID [16]byte
+
+// IsValid reports whether the trace identifier is not all zeros.
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span inside a trace.
+type SpanID [8]byte
+
+// IsValid reports whether the span identifier is not all zeros.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that is propagated to its children,
+// even to those started in other processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both identifiers of the span context are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanData is the exported representation of a finished span.
+type SpanData struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Span is a timed operation of a trace. A nil span is valid and
+// ignores every call, which is what StartSpan returns while tracing
+// is disabled.
+type Span struct {
+	tracer *Tracer
+	ctx    SpanContext
+	parent SpanID
+	name   string
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+	ended bool
+}
+
+// Context returns the span context to propagate to the children of the span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttribute annotates the span with a key/value pair.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed. Nil errors are ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and hands it to the exporter of its tracer if
+// it was sampled. Ending a span more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+
+	if !s.ctx.Sampled {
+		return
+	}
+	data := &SpanData{
+		TraceID:    s.ctx.TraceID.String(),
+		SpanID:     s.ctx.SpanID.String(),
+		Name:       s.name,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attrs,
+		Error:      s.err,
+	}
+	if s.parent.IsValid() {
+		data.ParentSpanID = s.parent.String()
+	}
+	s.tracer.enqueue(data)
+}
+
+// TracerConfig holds the parameters of a tracer.
+type TracerConfig struct {
+	// Ratio of new traces that are sampled. Traces started by remote
+	// callers follow the sampling decision of the caller.
+	SampleRatio float64
+	// Maximum number of finished spans waiting to be exported.
+	// Spans are dropped when the queue is full.
+	QueueSize int
+	// Maximum number of spans exported at once.
+	BatchSize int
+	// Time between two exports of a partial batch.
+	FlushInterval time.Duration
+}
+
+// DefaultTracerConfig samples every trace and exports spans in batches
+// of 512 at least once per second.
+func DefaultTracerConfig() *TracerConfig {
+	return &TracerConfig{
+		SampleRatio:   1.0,
+		QueueSize:     1 << 14,
+		BatchSize:     512,
+		FlushInterval: 1 * time.Second,
+	}
+}
+
+// Tracer creates spans and exports the finished ones in batches
+// from a background goroutine.
+type Tracer struct {
+	exporter  Exporter
+	threshold uint64
+	batchSize int
+	interval  time.Duration
+
+	queue   chan *SpanData
+	done    chan struct{}
+	stopped chan struct{}
+	closed  uint32
+	dropped uint64
+
+	log log.Logger
+}
+
+// NewTracer returns a tracer that exports its spans with the given exporter.
+func NewTracer(exporter Exporter, conf *TracerConfig) *Tracer {
+	return NewTracerWithLogger(exporter, conf, log.L())
+}
+
+// NewTracerWithLogger returns a tracer that exports its spans with the given
+// exporter and logs export errors with the given logger.
+func NewTracerWithLogger(exporter Exporter, conf *TracerConfig, logger log.Logger) *Tracer {
+	if conf == nil {
+		conf = DefaultTracerConfig()
+	}
+	ratio := conf.SampleRatio
+	if ratio < 0 {
+		ratio = 0
+	}
+	var threshold uint64
+	if ratio >= 1 {
+		threshold = ^uint64(0)
+	} else {
+		threshold = uint64(ratio * float64(^uint64(0)))
+	}
+	t := &Tracer{
+		exporter:  exporter,
+		threshold: threshold,
+		batchSize: conf.BatchSize,
+		interval:  conf.FlushInterval,
+		queue:     make(chan *SpanData, conf.QueueSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		log:       logger,
+	}
+	if t.batchSize <= 0 {
+		t.batchSize = 1
+	}
+	if t.interval <= 0 {
+		t.interval = DefaultTracerConfig().FlushInterval
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a new span named after the operation it measures. The
+// span is a child of the span found in the context, if any, which can
+// be a remote span extracted from a request. The returned context
+// carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+	}
+	if parent := SpanContextFromContext(ctx); parent.IsValid() {
+		span.ctx.TraceID = parent.TraceID
+		span.ctx.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		span.ctx.TraceID = newTraceID()
+		span.ctx.Sampled = t.sample(span.ctx.TraceID)
+	}
+	span.ctx.SpanID = newSpanID()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Dropped returns the number of spans dropped because the export
+// queue was full.
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Close exports the pending spans and closes the exporter.
+func (t *Tracer) Close() error {
+	if !atomic.CompareAndSwapUint32(&t.closed, 0, 1) {
+		return nil
+	}
+	close(t.done)
+	<-t.stopped
+	return t.exporter.Close()
+}
+
+// sample decides whether a new trace is sampled. The decision only
+// depends on the trace identifier, which is random.
+func (t *Tracer) sample(id TraceID) bool {
+	return binary.BigEndian.Uint64(id[8:]) < t.threshold || t.threshold == ^uint64(0)
+}
+
+func (t *Tracer) enqueue(data *SpanData) {
+	if atomic.LoadUint32(&t.closed) == 1 {
+		return
+	}
+	select {
+	case t.queue <- data:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, t.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			t.log.Infof("Unable to export %d spans: %v", len(batch), err)
+		}
+		batch = make([]*SpanData, 0, t.batchSize)
+	}
+
+	for {
+		select {
+		case data := <-t.queue:
+			batch = append(batch, data)
+			if len(batch) >= t.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.done:
+			for {
+				select {
+				case data := <-t.queue:
+					batch = append(batch, data)
+					if len(batch) >= t.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+var global atomic.Value // *Tracer
+
+// SetTracer installs the tracer used by StartSpan. A nil tracer
+// disables tracing.
+func SetTracer(t *Tracer) {
+	global.Store(&t)
+}
+
+// T returns the tracer installed with SetTracer, or nil if tracing
+// is disabled.
+func T() *Tracer {
+	t, _ := global.Load().(**Tracer)
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// StartSpan starts a span with the installed tracer. See Tracer.Start.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return T().Start(ctx, name)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// SpanFromContext returns the span carried by the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the context of the span carried by the
+// context or, if there is none, the remote span context set with
+// ContextWithRemoteSpanContext.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	if span := SpanFromContext(ctx); span != nil {
+		return span.ctx
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// ContextWithRemoteSpanContext returns a context whose spans will be
+// children of a span started in another process.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func newTraceID() (id TraceID) {
+	randomFill(id[:])
+	return
+}
+
+func newSpanID() (id SpanID) {
+	randomFill(id[:])
+	return
+}
+
+func randomFill(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("Unable to generate a random identifier: %v", err))
+	}
+}
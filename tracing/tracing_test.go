@@ -0,0 +1,131 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memoryExporter struct {
+	spans  []*SpanData
+	closed bool
+}
+
+func (e *memoryExporter) Export(spans []*SpanData) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestDisabledTracing(t *testing.T) {
+	SetTracer(nil)
+
+	ctx, span := StartSpan(context.Background(), "noop")
+	require.Nil(t, span)
+	require.Equal(t, context.Background(), ctx)
+
+	// nil spans ignore every call
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+	require.False(t, span.Context().IsValid())
+	require.Empty(t, TraceParent(ctx))
+}
+
+func TestSpanHierarchy(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter, nil)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	root.SetAttribute("events", 2)
+	_, child := tracer.Start(ctx, "child")
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+	root.End()
+
+	require.NoError(t, tracer.Close())
+	require.True(t, exporter.closed)
+	require.Len(t, exporter.spans, 2)
+
+	childData, rootData := exporter.spans[0], exporter.spans[1]
+	require.Equal(t, "root", rootData.Name)
+	require.Empty(t, rootData.ParentSpanID)
+	require.Equal(t, 2, rootData.Attributes["events"])
+	require.Equal(t, "child", childData.Name)
+	require.Equal(t, rootData.TraceID, childData.TraceID)
+	require.Equal(t, rootData.SpanID, childData.ParentSpanID)
+	require.Equal(t, "failed", childData.Error)
+	require.False(t, childData.End.Before(childData.Start))
+}
+
+func TestSampling(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer(exporter, &TracerConfig{SampleRatio: 0, QueueSize: 16, BatchSize: 4})
+
+	_, span := tracer.Start(context.Background(), "unsampled")
+	require.False(t, span.Context().Sampled)
+	span.End()
+
+	// remote parents decide whether the trace is sampled
+	remote := SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	_, sampled := tracer.Start(ContextWithRemoteSpanContext(context.Background(), remote), "sampled")
+	require.True(t, sampled.Context().Sampled)
+	require.Equal(t, remote.TraceID, sampled.Context().TraceID)
+	sampled.End()
+
+	require.NoError(t, tracer.Close())
+	require.Len(t, exporter.spans, 1)
+	require.Equal(t, "sampled", exporter.spans[0].Name)
+	require.Equal(t, remote.SpanID.String(), exporter.spans[0].ParentSpanID)
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+
+	exporter, err := NewExporter(FileExporterName, path, "qed")
+	require.NoError(t, err)
+	tracer := NewTracer(exporter, nil)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttribute("engine", "bolt")
+	child.End()
+	root.End()
+	require.NoError(t, tracer.Close())
+
+	spans, err := ReadSpans(path)
+	require.NoError(t, err)
+	require.Len(t, spans, 2)
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, "bolt", spans[0].Attributes["engine"])
+	require.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+}